@@ -90,6 +90,9 @@ type Options struct {
 	//  detected by ICMP response time or TCP connection time
 	FastestAddress bool `long:"fastest-addr" description:"Respond to A or AAAA requests only with the fastest IP address" optional:"yes" optional-value:"true"`
 
+	// Timeout of establishing the connections to the upstreams
+	UpstreamDialTimeout time.Duration `long:"upstream-dial-timeout" description:"Timeout of establishing the connections to the upstreams, for example 1s. Zero means no separate limit." default:"0"`
+
 	// Cache settings
 	// --
 
@@ -242,11 +245,13 @@ func initUpstreams(config *proxy.Config, options Options) {
 			InsecureSkipVerify: options.Insecure,
 			Bootstrap:          options.BootstrapDNS,
 			Timeout:            defaultTimeout,
+			DialTimeout:        options.UpstreamDialTimeout,
 		})
 	if err != nil {
 		log.Fatalf("error while parsing upstreams configuration: %s", err)
 	}
 	config.UpstreamConfig = &upstreamConfig
+	config.UpstreamDialTimeout = options.UpstreamDialTimeout
 
 	if options.AllServers {
 		config.UpstreamMode = proxy.UModeParallel
@@ -259,7 +264,10 @@ func initUpstreams(config *proxy.Config, options Options) {
 	if options.Fallbacks != nil {
 		fallbacks := []upstream.Upstream{}
 		for i, f := range options.Fallbacks {
-			fallback, err := upstream.AddressToUpstream(f, upstream.Options{Timeout: defaultTimeout})
+			fallback, err := upstream.AddressToUpstream(f, upstream.Options{
+				Timeout:     defaultTimeout,
+				DialTimeout: options.UpstreamDialTimeout,
+			})
 			if err != nil {
 				log.Fatalf("cannot parse the fallback %s (%s): %s", f, options.BootstrapDNS, err)
 			}
@@ -0,0 +1,67 @@
+package proxy
+
+import "sync"
+
+// asyncWriter queues the data for a single goroutine which writes it, so that
+// writing never blocks the request handlers.
+type asyncWriter struct {
+	queue chan []byte
+	done  chan struct{}
+
+	// lock protects closed and queue from being closed while the data is
+	// being queued.
+	lock   sync.RWMutex
+	closed bool
+}
+
+// newAsyncWriter creates a new asyncWriter with the queue of size and starts
+// loop, which must process the queue until it's closed.
+func newAsyncWriter(size int, loop func(queue <-chan []byte)) (w *asyncWriter) {
+	w = &asyncWriter{
+		queue: make(chan []byte, size),
+		done:  make(chan struct{}),
+	}
+
+	go func() {
+		defer close(w.done)
+
+		loop(w.queue)
+	}()
+
+	return w
+}
+
+// write queues b.  It never blocks and returns false if b is dropped since the
+// queue is full or the writer is closed.
+func (w *asyncWriter) write(b []byte) (ok bool) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	if w.closed {
+		return false
+	}
+
+	select {
+	case w.queue <- b:
+		return true
+	default:
+		return false
+	}
+}
+
+// close closes the queue and waits for the loop to process the queued data.
+// The data written after that is dropped.
+func (w *asyncWriter) close() {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+
+		return
+	}
+
+	w.closed = true
+	close(w.queue)
+	w.lock.Unlock()
+
+	<-w.done
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"sync"
+)
+
+// defaultBackgroundConcurrency is the number of the background workers used
+// when Config.BackgroundConcurrency is zero.
+const defaultBackgroundConcurrency = 4
+
+// backgroundQueueSize is the number of the background jobs that may wait for a
+// worker.  Jobs are dropped when the queue is full so that the background work
+// never piles up.
+const backgroundQueueSize = 256
+
+// backgroundPool is a fixed number of workers running the background jobs,
+// such as refreshing the expiring cache entries and the secondary zones, so
+// that they're bounded and don't compete with the client requests.
+type backgroundPool struct {
+	jobs chan func()
+	wg   sync.WaitGroup
+
+	// lock protects closed and jobs from being closed while a job is being
+	// submitted.
+	lock   sync.RWMutex
+	closed bool
+}
+
+// newBackgroundPool returns a new backgroundPool and starts its workers.
+// workers must be greater than zero.
+func newBackgroundPool(workers int) (bp *backgroundPool) {
+	bp = &backgroundPool{
+		jobs: make(chan func(), backgroundQueueSize),
+	}
+
+	bp.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go bp.work()
+	}
+
+	return bp
+}
+
+// work runs the jobs until the pool is closed and its queue is drained.
+func (bp *backgroundPool) work() {
+	defer bp.wg.Done()
+
+	for job := range bp.jobs {
+		job()
+	}
+}
+
+// submit schedules job to be run by a worker.  It never blocks and returns
+// false if the job has been dropped since the queue is full or the pool is
+// closed.
+func (bp *backgroundPool) submit(job func()) (ok bool) {
+	if bp == nil {
+		return false
+	}
+
+	bp.lock.RLock()
+	defer bp.lock.RUnlock()
+
+	if bp.closed {
+		return false
+	}
+
+	select {
+	case bp.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops accepting the jobs and waits for the queued ones to finish.
+func (bp *backgroundPool) close() {
+	bp.lock.Lock()
+	if bp.closed {
+		bp.lock.Unlock()
+
+		return
+	}
+	bp.closed = true
+	close(bp.jobs)
+	bp.lock.Unlock()
+
+	bp.wg.Wait()
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackgroundPool(t *testing.T) {
+	const workers, jobs = 3, 30
+
+	bp := newBackgroundPool(workers)
+
+	var running, maxRunning, done int32
+	for i := 0; i < jobs; i++ {
+		ok := bp.submit(func() {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+
+			time.Sleep(5 * time.Millisecond)
+
+			atomic.AddInt32(&running, -1)
+			atomic.AddInt32(&done, 1)
+		})
+		assert.True(t, ok)
+	}
+
+	// The queued jobs are finished on close.
+	bp.close()
+	assert.Equal(t, int32(jobs), atomic.LoadInt32(&done))
+	assert.Equal(t, int32(workers), atomic.LoadInt32(&maxRunning))
+
+	// The jobs aren't accepted after close.
+	assert.False(t, bp.submit(func() {}))
+}
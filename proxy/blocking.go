@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Weekdays is a bitmask of the days of week.  The bit number n corresponds to
+// the time.Weekday(n).
+type Weekdays uint8
+
+// EveryDay is the Weekdays mask containing all days of week.
+const EveryDay Weekdays = 1<<7 - 1
+
+// WeekdaysOf returns the Weekdays mask containing the specified days.
+func WeekdaysOf(days ...time.Weekday) (w Weekdays) {
+	for _, d := range days {
+		w |= 1 << d
+	}
+
+	return w
+}
+
+// Has returns true if w contains d.
+func (w Weekdays) Has(d time.Weekday) bool {
+	return w&(1<<d) != 0
+}
+
+// TimeWindow is a daily period of time.
+type TimeWindow struct {
+	// Weekdays are the days on which the window starts.
+	Weekdays Weekdays
+	// Start is the beginning of the window as an offset from midnight.
+	Start time.Duration
+	// End is the end of the window as an offset from midnight.  If End is
+	// not after Start, the window ends on the next day.
+	End time.Duration
+}
+
+// isActive returns true if t is inside the window.
+func (w TimeWindow) isActive(t time.Time) bool {
+	y, m, d := t.Date()
+	offset := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+	day := t.Weekday()
+
+	if w.Start < w.End {
+		return w.Weekdays.Has(day) && offset >= w.Start && offset < w.End
+	}
+
+	// The window ends on the next day, so it may have started today or
+	// yesterday.
+	if w.Weekdays.Has(day) && offset >= w.Start {
+		return true
+	}
+
+	yesterday := (day + 6) % 7
+
+	return w.Weekdays.Has(yesterday) && offset < w.End
+}
+
+// Schedule is a set of domains blocked during the specified time windows.
+type Schedule struct {
+	// Domains are the blocked domains.  A domain starting with "*." also
+	// matches all its subdomains.
+	Domains []string
+	// Windows are the periods of time during which the domains are
+	// blocked.
+	Windows []TimeWindow
+	// Location is the time zone of the windows.  If nil, UTC is used.
+	Location *time.Location
+}
+
+// isActive returns true if the schedule is active at t.
+func (s *Schedule) isActive(t time.Time) bool {
+	loc := s.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	t = t.In(loc)
+
+	for _, w := range s.Windows {
+		if w.isActive(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matches returns true if host matches any of the schedule's domains.
+func (s *Schedule) matches(host string) bool {
+	for _, d := range s.Domains {
+		if matchDomain(d, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchDomain returns true if host matches pattern.  pattern is either a
+// domain name or a domain name prefixed with "*." which matches all the
+// subdomains of that domain.  Both are case-insensitive and the trailing dots
+// are ignored.
+func matchDomain(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+
+	return host == pattern
+}
+
+// isAllowlisted returns true if the requested host matches the allowlist.
+func (p *Proxy) isAllowlisted(req *dns.Msg) bool {
+	if len(p.Allowlist) == 0 || len(req.Question) != 1 {
+		return false
+	}
+
+	host := req.Question[0].Name
+	for _, d := range p.Allowlist {
+		if matchDomain(d, host) {
+			log.Tracef("%s is allowlisted", host)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// isBlockedBySchedule returns true if the requested host is blocked by one of
+// the currently active schedules.
+func (p *Proxy) isBlockedBySchedule(req *dns.Msg) bool {
+	if len(p.BlockSchedules) == 0 || len(req.Question) != 1 {
+		return false
+	}
+
+	host := req.Question[0].Name
+	now := p.now()
+	for i := range p.BlockSchedules {
+		s := &p.BlockSchedules[i]
+		if s.matches(host) && s.isActive(now) {
+			log.Tracef("%s is blocked by schedule", host)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// initBlocklistRegex compiles the BlocklistRegex.
+func (p *Proxy) initBlocklistRegex() error {
+	p.blocklistRegex = nil
+	for _, expr := range p.BlocklistRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("invalid blocklist regex %q: %w", expr, err)
+		}
+
+		p.blocklistRegex = append(p.blocklistRegex, re)
+	}
+
+	return nil
+}
+
+// isBlockedByRegex returns true if the requested host matches one of the
+// BlocklistRegex.
+func (p *Proxy) isBlockedByRegex(req *dns.Msg) bool {
+	if len(p.blocklistRegex) == 0 || len(req.Question) != 1 {
+		return false
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
+	for _, re := range p.blocklistRegex {
+		if re.MatchString(host) {
+			log.Tracef("%s is blocked by regex %s", host, re)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// genBlocked returns the response for a blocked request according to the
+// BlockingMode.
+func (p *Proxy) genBlocked(req *dns.Msg) *dns.Msg {
+	if p.BlockingMode != BlockingModeRedirect {
+		return p.genBlockedNegative(req, dns.RcodeNameError)
+	}
+
+	var rr dns.RR
+	q := req.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: p.rewriteTTL()}
+	if p.BlockTTL != nil {
+		hdr.Ttl = *p.BlockTTL
+	}
+
+	switch {
+	case q.Qtype == dns.TypeA && p.BlockRedirectIPv4 != nil:
+		rr = &dns.A{Hdr: hdr, A: p.BlockRedirectIPv4.To4()}
+	case q.Qtype == dns.TypeAAAA && p.BlockRedirectIPv6 != nil:
+		rr = &dns.AAAA{Hdr: hdr, AAAA: p.BlockRedirectIPv6}
+	default:
+		return p.genBlockedNegative(req, dns.RcodeSuccess)
+	}
+
+	resp := p.genResponse(req, dns.RcodeSuccess)
+	resp.Answer = []dns.RR{rr}
+
+	return resp
+}
+
+// genBlockedNegative returns the negative response with rcode for a blocked
+// request.
+func (p *Proxy) genBlockedNegative(req *dns.Msg, rcode int) *dns.Msg {
+	resp := GenEmptyMessage(req, rcode, retryNoError)
+	resp.Ns = p.genNegativeSOA(req, retryNoError)
+	if p.BlockTTL != nil {
+		soa := resp.Ns[0].(*dns.SOA)
+		soa.Hdr.Ttl = *p.BlockTTL
+		soa.Minttl = *p.BlockTTL
+	}
+
+	return resp
+}
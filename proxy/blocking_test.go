@@ -0,0 +1,450 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchDomain(t *testing.T) {
+	assert.True(t, matchDomain("example.org", "example.org."))
+	assert.True(t, matchDomain("example.org", "EXAMPLE.org"))
+	assert.False(t, matchDomain("example.org", "www.example.org."))
+	assert.True(t, matchDomain("*.example.org", "www.example.org."))
+	assert.True(t, matchDomain("*.example.org", "a.b.example.org."))
+	assert.False(t, matchDomain("*.example.org", "example.org."))
+	assert.False(t, matchDomain("*.example.org", "badexample.org."))
+}
+
+func TestTimeWindow(t *testing.T) {
+	// 2021-03-01 is a Monday.
+	monday := func(h, m int) time.Time {
+		return time.Date(2021, 3, 1, h, m, 0, 0, time.UTC)
+	}
+
+	w := TimeWindow{
+		Weekdays: WeekdaysOf(time.Monday),
+		Start:    9 * time.Hour,
+		End:      17 * time.Hour,
+	}
+	assert.False(t, w.isActive(monday(8, 59)))
+	assert.True(t, w.isActive(monday(9, 0)))
+	assert.True(t, w.isActive(monday(16, 59)))
+	assert.False(t, w.isActive(monday(17, 0)))
+	assert.False(t, w.isActive(monday(12, 0).AddDate(0, 0, 1)))
+
+	// The window ending on the next day.
+	w = TimeWindow{
+		Weekdays: WeekdaysOf(time.Monday),
+		Start:    22 * time.Hour,
+		End:      6 * time.Hour,
+	}
+	assert.False(t, w.isActive(monday(5, 0)))
+	assert.True(t, w.isActive(monday(23, 0)))
+	assert.True(t, w.isActive(monday(5, 0).AddDate(0, 0, 1)))
+	assert.False(t, w.isActive(monday(7, 0).AddDate(0, 0, 1)))
+}
+
+func TestBlockSchedules(t *testing.T) {
+	loc := time.FixedZone("UTC+3", 3*60*60)
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&hostsUpstream{
+		hosts: map[string]net.IP{
+			"games.example.org": {1, 2, 3, 4},
+		},
+	}}
+	dnsProxy.BlockSchedules = []Schedule{{
+		Domains: []string{"*.example.org"},
+		Windows: []TimeWindow{{
+			Weekdays: EveryDay,
+			Start:    20 * time.Hour,
+			End:      8 * time.Hour,
+		}},
+		Location: loc,
+	}}
+
+	clock := newFakeClock()
+	dnsProxy.TimeSource = clock.Now
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	client := dns.Client{Net: "udp", Timeout: defaultTimeout}
+	addr := dnsProxy.Addr(ProtoUDP).String()
+
+	// Inside the window.
+	clock.Set(time.Date(2021, 3, 1, 21, 0, 0, 0, loc))
+	reply, _, err := client.Exchange(createHostTestMessage("games.example.org"), addr)
+	if err != nil {
+		t.Fatalf("cannot exchange the message: %s", err)
+	}
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+	assert.Empty(t, reply.Answer)
+
+	// Outside the window.
+	clock.Set(time.Date(2021, 3, 1, 12, 0, 0, 0, loc))
+	reply, _, err = client.Exchange(createHostTestMessage("games.example.org"), addr)
+	if err != nil {
+		t.Fatalf("cannot exchange the message: %s", err)
+	}
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Len(t, reply.Answer, 1)
+}
+
+func TestAllowlist(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&hostsUpstream{
+		hosts: map[string]net.IP{
+			"ads.example.com":            {1, 2, 3, 4},
+			"tracker.example.com":        {1, 2, 3, 5},
+			"www.google.com":             {1, 2, 3, 6},
+			"forcesafesearch.google.com": {1, 2, 3, 7},
+		},
+	}}
+	dnsProxy.BlockSchedules = []Schedule{{
+		Domains: []string{"*.example.com"},
+		Windows: []TimeWindow{{
+			Weekdays: EveryDay,
+			Start:    0,
+			End:      24 * time.Hour,
+		}},
+	}}
+	dnsProxy.SafeSearchEnabled = true
+	dnsProxy.Allowlist = []string{"ads.example.com", "www.google.com"}
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	client := dns.Client{Net: "udp", Timeout: defaultTimeout}
+	addr := dnsProxy.Addr(ProtoUDP).String()
+
+	testCases := []struct {
+		host  string
+		rcode int
+		want  net.IP
+	}{{
+		host:  "ads.example.com",
+		rcode: dns.RcodeSuccess,
+		want:  net.IP{1, 2, 3, 4},
+	}, {
+		host:  "tracker.example.com",
+		rcode: dns.RcodeNameError,
+	}, {
+		host:  "www.google.com",
+		rcode: dns.RcodeSuccess,
+		want:  net.IP{1, 2, 3, 6},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			reply, _, err := client.Exchange(createHostTestMessage(tc.host), addr)
+			if err != nil {
+				t.Fatalf("cannot exchange the message: %s", err)
+			}
+
+			assert.Equal(t, tc.rcode, reply.Rcode)
+			if tc.want == nil {
+				assert.Empty(t, reply.Answer)
+			} else if assert.Len(t, reply.Answer, 1) {
+				assert.True(t, tc.want.Equal(reply.Answer[0].(*dns.A).A))
+			}
+		})
+	}
+}
+
+func TestBlocklistRegex(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&hostsUpstream{
+		hosts: map[string]net.IP{
+			"ad123.example.com": {1, 2, 3, 4},
+			"example.com":       {1, 2, 3, 5},
+			"bad1.example.com":  {1, 2, 3, 6},
+		},
+	}}
+	dnsProxy.BlocklistRegex = []string{`^ad[0-9]+\.`}
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	client := dns.Client{Net: "udp", Timeout: defaultTimeout}
+	addr := dnsProxy.Addr(ProtoUDP).String()
+
+	testCases := []struct {
+		host  string
+		rcode int
+	}{{
+		host:  "ad123.example.com",
+		rcode: dns.RcodeNameError,
+	}, {
+		host:  "AD123.Example.com",
+		rcode: dns.RcodeNameError,
+	}, {
+		host:  "example.com",
+		rcode: dns.RcodeSuccess,
+	}, {
+		host:  "bad1.example.com",
+		rcode: dns.RcodeSuccess,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			reply, _, err := client.Exchange(createHostTestMessage(tc.host), addr)
+			if err != nil {
+				t.Fatalf("cannot exchange the message: %s", err)
+			}
+
+			assert.Equal(t, tc.rcode, reply.Rcode)
+		})
+	}
+}
+
+func TestBlocklistRegexInvalid(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.BlocklistRegex = []string{`^ad[0-9+\.`}
+
+	err := dnsProxy.Start()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "invalid blocklist regex")
+	}
+}
+
+func TestBlockingModeRedirect(t *testing.T) {
+	blockTTL := uint32(300)
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&hostsUpstream{
+		hosts: map[string]net.IP{
+			"blocked.example.com": {1, 2, 3, 4},
+		},
+	}}
+	dnsProxy.BlocklistRegex = []string{`^blocked\.`}
+	dnsProxy.BlockingMode = BlockingModeRedirect
+	dnsProxy.BlockRedirectIPv4 = net.IP{192, 0, 2, 10}
+	dnsProxy.BlockTTL = &blockTTL
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	client := dns.Client{Net: "udp", Timeout: defaultTimeout}
+	addr := dnsProxy.Addr(ProtoUDP).String()
+
+	reply, _, err := client.Exchange(createHostTestMessage("blocked.example.com"), addr)
+	if err != nil {
+		t.Fatalf("cannot exchange the message: %s", err)
+	}
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	if assert.Len(t, reply.Answer, 1) {
+		a := reply.Answer[0].(*dns.A)
+		assert.True(t, a.A.Equal(dnsProxy.BlockRedirectIPv4))
+		assert.Equal(t, blockTTL, a.Hdr.Ttl)
+	}
+
+	// The other types, including AAAA without BlockRedirectIPv6, get empty
+	// NOERROR responses.
+	for _, qtype := range []uint16{dns.TypeAAAA, dns.TypeTXT} {
+		req := (&dns.Msg{}).SetQuestion("blocked.example.com.", qtype)
+		reply, _, err = client.Exchange(req, addr)
+		if err != nil {
+			t.Fatalf("cannot exchange the message: %s", err)
+		}
+		assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+		assert.Empty(t, reply.Answer)
+		if assert.Len(t, reply.Ns, 1) {
+			assert.Equal(t, blockTTL, reply.Ns[0].Header().Ttl)
+		}
+	}
+}
+
+func TestBlockingModeValidation(t *testing.T) {
+	testCases := []struct {
+		name string
+		mode BlockingModeType
+		ipv4 net.IP
+		ipv6 net.IP
+		ok   bool
+	}{{
+		name: "default",
+		ok:   true,
+	}, {
+		name: "nxdomain",
+		mode: BlockingModeNXDomain,
+		ok:   true,
+	}, {
+		name: "unknown",
+		mode: "unknown",
+	}, {
+		name: "redirect_no_addresses",
+		mode: BlockingModeRedirect,
+	}, {
+		name: "redirect_ipv6_only",
+		mode: BlockingModeRedirect,
+		ipv6: net.ParseIP("2001:db8::1"),
+		ok:   true,
+	}, {
+		name: "redirect_wrong_family",
+		mode: BlockingModeRedirect,
+		ipv4: net.ParseIP("2001:db8::1"),
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dnsProxy := createTestProxy(t, nil)
+			dnsProxy.BlockingMode = tc.mode
+			dnsProxy.BlockRedirectIPv4 = tc.ipv4
+			dnsProxy.BlockRedirectIPv6 = tc.ipv6
+
+			err := dnsProxy.validateConfig()
+			if tc.ok {
+				assert.Nil(t, err)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestNegativeSOA(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.BlockSchedules = []Schedule{{
+		Domains: []string{"blocked.example.org"},
+		Windows: []TimeWindow{{Weekdays: EveryDay, Start: 0, End: 0}},
+	}}
+	dnsProxy.NegativeSOA = &NegativeSOA{
+		Mname:  "ns.example.net",
+		Rname:  "hostmaster.example.net",
+		Serial: 2021030101,
+		TTL:    300,
+	}
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	client := dns.Client{Net: "udp", Timeout: defaultTimeout}
+	reply, _, err := client.Exchange(createHostTestMessage("blocked.example.org"), dnsProxy.Addr(ProtoUDP).String())
+	if err != nil {
+		t.Fatalf("cannot exchange the message: %s", err)
+	}
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+	if !assert.Len(t, reply.Ns, 1) {
+		return
+	}
+
+	soa, ok := reply.Ns[0].(*dns.SOA)
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Equal(t, "blocked.example.org.", soa.Hdr.Name)
+	assert.Equal(t, "ns.example.net.", soa.Ns)
+	assert.Equal(t, "hostmaster.example.net.", soa.Mbox)
+	assert.Equal(t, uint32(2021030101), soa.Serial)
+	assert.Equal(t, uint32(300), soa.Hdr.Ttl)
+	assert.Equal(t, uint32(300), soa.Minttl)
+}
+
+func TestSynthesizedTTL(t *testing.T) {
+	zero := uint32(0)
+
+	testCases := []struct {
+		name       string
+		rewriteTTL *uint32
+		blockTTL   *uint32
+		want       uint32
+	}{{
+		name:       "default",
+		rewriteTTL: nil,
+		blockTTL:   nil,
+		want:       10,
+	}, {
+		name:       "zero",
+		rewriteTTL: &zero,
+		blockTTL:   &zero,
+		want:       0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dnsProxy := createTestProxy(t, nil)
+			dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&hostsUpstream{
+				hosts: map[string]net.IP{
+					"forcesafesearch.google.com": {216, 239, 38, 120},
+				},
+			}}
+			dnsProxy.SafeSearchEnabled = true
+			dnsProxy.BlockSchedules = []Schedule{{
+				Domains: []string{"blocked.example.org"},
+				Windows: []TimeWindow{{Weekdays: EveryDay, Start: 0, End: 0}},
+			}}
+			dnsProxy.SelfPTR = "proxy.local"
+			dnsProxy.RewriteTTL = tc.rewriteTTL
+			dnsProxy.BlockTTL = tc.blockTTL
+
+			err := dnsProxy.Start()
+			if err != nil {
+				t.Fatalf("cannot start the DNS proxy: %s", err)
+			}
+			defer func() {
+				assert.Nil(t, dnsProxy.Stop())
+			}()
+
+			client := dns.Client{Net: "udp", Timeout: defaultTimeout}
+			exchange := func(req *dns.Msg) *dns.Msg {
+				reply, _, err := client.Exchange(req, dnsProxy.Addr(ProtoUDP).String())
+				if err != nil {
+					t.Fatalf("cannot exchange the message: %s", err)
+				}
+
+				return reply
+			}
+
+			// The safe search rewrite.
+			reply := exchange(createHostTestMessage("www.google.com"))
+			if assert.Len(t, reply.Answer, 1) {
+				assert.Equal(t, tc.want, reply.Answer[0].Header().Ttl)
+			}
+
+			// The answer about the proxy's own address.
+			req := &dns.Msg{}
+			req.SetQuestion("1.0.0.127.in-addr.arpa.", dns.TypePTR)
+			reply = exchange(req)
+			if assert.Len(t, reply.Answer, 1) {
+				assert.Equal(t, tc.want, reply.Answer[0].Header().Ttl)
+			}
+
+			// The blocked response.
+			reply = exchange(createHostTestMessage("blocked.example.org"))
+			assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+			if assert.Len(t, reply.Ns, 1) {
+				assert.Equal(t, tc.want, reply.Ns[0].Header().Ttl)
+			}
+		})
+	}
+}
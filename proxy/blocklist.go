@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// bloomBitsPerName and bloomHashes make the bloom filter have about 1% of the
+// false positives.
+const (
+	bloomBitsPerName = 10
+	bloomHashes      = 7
+)
+
+// domainSet is a set of the domain names.
+type domainSet interface {
+	// has returns true if name is in the set.
+	has(name string) bool
+}
+
+// mapDomainSet is a domainSet backed by a map.  It's fast, but takes much
+// memory for the large lists.
+type mapDomainSet map[string]struct{}
+
+// has implements the domainSet interface for mapDomainSet.
+func (s mapDomainSet) has(name string) bool {
+	_, ok := s[name]
+
+	return ok
+}
+
+// bloomDomainSet is a domainSet backed by the sorted names packed into a single
+// string with a bloom filter in front of it.  The filter rules out most of the
+// names which aren't in the set without searching them, and the search rules
+// out the false positives of the filter.
+type bloomDomainSet struct {
+	bits []uint64
+	// data are the sorted names concatenated.
+	data string
+	// offsets are the offsets of the names within data followed by the
+	// length of data.
+	offsets []uint32
+}
+
+// newBloomDomainSet returns a new bloomDomainSet containing names.  names is
+// sorted.
+func newBloomDomainSet(names []string) (s *bloomDomainSet) {
+	sort.Strings(names)
+
+	size := 0
+	for _, name := range names {
+		size += len(name)
+	}
+
+	b := &strings.Builder{}
+	b.Grow(size)
+	s = &bloomDomainSet{
+		bits:    make([]uint64, len(names)*bloomBitsPerName/64+1),
+		offsets: make([]uint32, 0, len(names)+1),
+	}
+
+	for _, name := range names {
+		s.offsets = append(s.offsets, uint32(b.Len()))
+		_, _ = b.WriteString(name)
+
+		s.forEachBit(name, func(i uint64) bool {
+			s.bits[i/64] |= 1 << (i % 64)
+
+			return true
+		})
+	}
+	s.offsets = append(s.offsets, uint32(b.Len()))
+	s.data = b.String()
+
+	return s
+}
+
+// forEachBit calls f with the indexes of the filter's bits of name until f
+// returns false.
+func (s *bloomDomainSet) forEachBit(name string, f func(i uint64) bool) {
+	// FNV-1a, computed inline to avoid the allocations.
+	sum := uint64(14695981039346656037)
+	for i := 0; i < len(name); i++ {
+		sum ^= uint64(name[i])
+		sum *= 1099511628211
+	}
+
+	// Derive the hashes from the two halves of a single one, see "Less
+	// Hashing, Same Performance" by Kirsch and Mitzenmacher.
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	size := uint64(len(s.bits)) * 64
+	for i := uint64(0); i < bloomHashes; i++ {
+		if !f((h1 + i*h2) % size) {
+			return
+		}
+	}
+}
+
+// name returns the i-th name of the set.
+func (s *bloomDomainSet) name(i int) string {
+	return s.data[s.offsets[i]:s.offsets[i+1]]
+}
+
+// has implements the domainSet interface for *bloomDomainSet.
+func (s *bloomDomainSet) has(name string) bool {
+	maybe := true
+	s.forEachBit(name, func(i uint64) bool {
+		maybe = s.bits[i/64]&(1<<(i%64)) != 0
+
+		return maybe
+	})
+	if !maybe {
+		return false
+	}
+
+	n := len(s.offsets) - 1
+	i := sort.Search(n, func(i int) bool { return s.name(i) >= name })
+
+	return i < n && s.name(i) == name
+}
+
+// blocklist matches the domain names against Blocklist.
+type blocklist struct {
+	// names are the blocked names.
+	names domainSet
+	// parents are the names which subdomains are blocked.
+	parents domainSet
+}
+
+// newBlocklist returns the blocklist of domains, which are either the domain
+// names or the domain names prefixed with "*." which match all the subdomains
+// of that domain.  The sets are bloom-filtered if bloom is true.
+func newBlocklist(domains []string, bloom bool) (bl *blocklist) {
+	var names, parents []string
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		if strings.HasPrefix(d, "*.") {
+			parents = append(parents, d[2:])
+		} else {
+			names = append(names, d)
+		}
+	}
+
+	newSet := func(names []string) domainSet {
+		if bloom {
+			return newBloomDomainSet(names)
+		}
+
+		s := make(mapDomainSet, len(names))
+		for _, name := range names {
+			s[name] = struct{}{}
+		}
+
+		return s
+	}
+
+	return &blocklist{
+		names:   newSet(names),
+		parents: newSet(parents),
+	}
+}
+
+// matches returns true if host is blocked.  host must be lowercased and have
+// no trailing dot.
+func (bl *blocklist) matches(host string) bool {
+	if bl.names.has(host) {
+		return true
+	}
+
+	for i := strings.IndexByte(host, '.'); i >= 0; i = strings.IndexByte(host, '.') {
+		host = host[i+1:]
+		if bl.parents.has(host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// initBlocklist builds the blocklist from Blocklist.
+func (p *Proxy) initBlocklist() {
+	p.blocklist = nil
+	if len(p.Blocklist) == 0 {
+		return
+	}
+
+	p.blocklist = newBlocklist(p.Blocklist, p.BlocklistBloom)
+	log.Info("Blocklist contains %d domains", len(p.Blocklist))
+}
+
+// isBlocklisted returns true if the requested host matches the Blocklist.
+func (p *Proxy) isBlocklisted(req *dns.Msg) bool {
+	if p.blocklist == nil || len(req.Question) != 1 {
+		return false
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
+	if p.blocklist.matches(host) {
+		log.Tracef("%s is blocklisted", host)
+
+		return true
+	}
+
+	return false
+}
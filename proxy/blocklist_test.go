@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// heapGrowth returns the growth of the heap after calling f and the value
+// returned by it.
+func heapGrowth(f func() interface{}) (growth int64, v interface{}) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	v = f()
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	return int64(after.HeapAlloc) - int64(before.HeapAlloc), v
+}
+
+func TestBlocklistBloom(t *testing.T) {
+	const n = 200_000
+
+	// The list is built within f, so that the set owns the names as if
+	// they've been read from a file.
+	newList := func(bloom bool) func() interface{} {
+		return func() interface{} {
+			domains := make([]string, 0, n+1)
+			for i := 0; i < n; i++ {
+				domains = append(domains, fmt.Sprintf("host%d.example", i))
+			}
+			domains = append(domains, "*.tracker.example")
+
+			return newBlocklist(domains, bloom)
+		}
+	}
+
+	mapSize, mapList := heapGrowth(newList(false))
+	bloomSize, bloomList := heapGrowth(newList(true))
+	assert.Less(t, bloomSize, mapSize/2)
+
+	for _, v := range []interface{}{mapList, bloomList} {
+		bl := v.(*blocklist)
+
+		// There are no false negatives.
+		for i := 0; i < n; i++ {
+			if d := fmt.Sprintf("host%d.example", i); !bl.matches(d) {
+				t.Fatalf("%s isn't matched", d)
+			}
+		}
+
+		// The false positives of the filter are ruled out.
+		for i := 0; i < n; i++ {
+			if d := fmt.Sprintf("other%d.example", i); bl.matches(d) {
+				t.Fatalf("%s is matched", d)
+			}
+		}
+
+		assert.True(t, bl.matches("a.b.tracker.example"))
+		assert.False(t, bl.matches("tracker.example"))
+		assert.False(t, bl.matches("example"))
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	for _, bloom := range []bool{false, true} {
+		t.Run(fmt.Sprintf("bloom_%t", bloom), func(t *testing.T) {
+			dnsProxy := createTestProxy(t, nil)
+			dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&hostsUpstream{
+				hosts: map[string]net.IP{
+					"ads.example.com":     {1, 2, 3, 4},
+					"www.ads.example.com": {1, 2, 3, 5},
+					"example.com":         {1, 2, 3, 6},
+				},
+			}}
+			dnsProxy.Blocklist = []string{"Ads.Example.com.", "*.ads.example.com"}
+			dnsProxy.BlocklistBloom = bloom
+			err := dnsProxy.Init()
+			assert.Nil(t, err)
+
+			testCases := []struct {
+				host  string
+				rcode int
+			}{{
+				host:  "ads.example.com",
+				rcode: dns.RcodeNameError,
+			}, {
+				host:  "www.ads.example.com",
+				rcode: dns.RcodeNameError,
+			}, {
+				host:  "example.com",
+				rcode: dns.RcodeSuccess,
+			}}
+
+			for _, tc := range testCases {
+				d := &DNSContext{Req: createHostTestMessage(tc.host), Addr: &net.TCPAddr{}}
+				err = dnsProxy.handleDNSRequest(d)
+				assert.Nil(t, err)
+				assert.Equal(t, tc.rcode, d.Res.Rcode, tc.host)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"math"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	glcache "github.com/AdguardTeam/golibs/cache"
@@ -16,35 +17,156 @@ const (
 	defaultCacheSize = 64 * 1024 // in bytes
 )
 
+// The reasons of the cache entries removal passed to CacheEvictionCallback.
+const (
+	cacheEvictionCapacity = "capacity"
+	cacheEvictionExpired  = "expired"
+)
+
 type cache struct {
-	items        glcache.Cache // cache
-	cacheSize    int           // cache size (in bytes)
-	sync.RWMutex               // lock
+	items        glcache.Cache         // cache
+	keys         map[string]struct{}   // keys of the items, since glcache can't iterate over them
+	cacheSize    int                   // cache size (in bytes)
+	clock        func() time.Time      // returns the current time, time.Now is used if nil
+	onEvict      CacheEvictionCallback // called when an item is removed, may be nil
+	rcodes       []int                 // cacheable response codes, NOERROR and NXDOMAIN are used if empty
+	sync.RWMutex                       // lock
+
+	capacityEvictions uint64 // number of the items evicted to free space, accessed atomically
+	expiryEvictions   uint64 // number of the expired items removed, accessed atomically
+}
+
+// now returns the current time using the cache's clock.
+func (c *cache) now() time.Time {
+	if c.clock != nil {
+		return c.clock()
+	}
+
+	return time.Now()
+}
+
+// initLocked lazily initializes the cache.  c must be locked.
+func (c *cache) initLocked() {
+	if c.items != nil {
+		return
+	}
+
+	conf := glcache.Config{
+		MaxSize:   uint(c.maxSize()),
+		EnableLRU: true,
+		OnDelete:  c.onDelete,
+	}
+	c.items = glcache.New(conf)
+	c.keys = map[string]struct{}{}
+}
+
+// maxSize returns the size of the cache in bytes.
+func (c *cache) maxSize() int {
+	if c.cacheSize > 0 {
+		return c.cacheSize
+	}
+
+	return defaultCacheSize
+}
+
+// onDelete is called by glcache when an item is evicted.
+func (c *cache) onDelete(key, data []byte) {
+	c.Lock()
+	delete(c.keys, string(key))
+	c.Unlock()
+
+	c.evicted(data, cacheEvictionCapacity)
+}
+
+// evicted counts the removal of the item with data and reports it to onEvict.
+func (c *cache) evicted(data []byte, reason string) {
+	if reason == cacheEvictionCapacity {
+		atomic.AddUint64(&c.capacityEvictions, 1)
+	} else {
+		atomic.AddUint64(&c.expiryEvictions, 1)
+	}
+
+	if c.onEvict == nil {
+		return
+	}
+
+	// The keys are binary, so use the cached question instead.
+	m := &dns.Msg{}
+	if len(data) < 4 || m.Unpack(data[4:]) != nil || len(m.Question) == 0 {
+		return
+	}
+
+	q := m.Question[0]
+	c.onEvict(q.Name+" "+dns.TypeToString[q.Qtype], reason)
+}
+
+// evictions returns the numbers of the items evicted to free space and of the
+// expired items removed.  It's safe to call on nil c.
+func (c *cache) evictions() (capacity, expiry uint64) {
+	if c == nil {
+		return 0, 0
+	}
+
+	return atomic.LoadUint64(&c.capacityEvictions), atomic.LoadUint64(&c.expiryEvictions)
+}
+
+// setData stores the packed response data under key.
+func (c *cache) setData(key, data []byte) {
+	// glcache silently rejects the items larger than the whole cache, so
+	// don't keep their keys.
+	if len(key)+len(data) > c.maxSize() {
+		return
+	}
+
+	c.Lock()
+	c.initLocked()
+	c.keys[string(key)] = struct{}{}
+	c.Unlock()
+
+	_ = c.items.Set(key, data)
+}
+
+// del removes the item with key from the cache.
+func (c *cache) del(key []byte) {
+	c.items.Del(key)
+
+	c.Lock()
+	delete(c.keys, string(key))
+	c.Unlock()
 }
 
 func (c *cache) Get(request *dns.Msg) (*dns.Msg, bool) {
+	res, _, ok := c.get(request)
+
+	return res, ok
+}
+
+// get returns the cached response for request.  expiring is true if the
+// response is about to expire.
+func (c *cache) get(request *dns.Msg) (res *dns.Msg, expiring, ok bool) {
 	if request == nil || len(request.Question) != 1 {
-		return nil, false
+		return nil, false, false
 	}
 	// create key for request
 	key := key(request)
 	c.Lock()
 	if c.items == nil {
 		c.Unlock()
-		return nil, false
+		return nil, false, false
 	}
 	c.Unlock()
 	data := c.items.Get(key)
 	if data == nil {
-		return nil, false
+		return nil, false, false
 	}
 
-	res := unpackResponse(data, request)
+	res, expiring = unpackResponse(data, request, c.now())
 	if res == nil {
-		c.items.Del(key)
-		return nil, false
+		c.del(key)
+		c.evicted(data, cacheEvictionExpired)
+		return nil, false, false
 	}
-	return res, true
+	return res, expiring, true
 }
 
 func (c *cache) Set(m *dns.Msg) {
@@ -52,32 +174,15 @@ func (c *cache) Set(m *dns.Msg) {
 		return // no-op
 	}
 
-	if !isCacheable(m) {
+	if !isCacheable(m, c.rcodes) {
 		return
 	}
 
-	key := key(m)
-
-	c.Lock()
-	// lazy initialization for cache
-	if c.items == nil {
-		conf := glcache.Config{
-			MaxSize:   defaultCacheSize,
-			EnableLRU: true,
-		}
-		if c.cacheSize > 0 {
-			conf.MaxSize = uint(c.cacheSize)
-		}
-		c.items = glcache.New(conf)
-	}
-	c.Unlock()
-
-	data := packResponse(m)
-	_ = c.items.Set(key, data)
+	c.setData(key(m), packResponse(m, c.now()))
 }
 
-// check if message is cacheable
-func isCacheable(m *dns.Msg) bool {
+// check if message is cacheable, rcodes are the cacheable response codes
+func isCacheable(m *dns.Msg, rcodes []int) bool {
 	// truncated messages aren't valid
 	if m.Truncated {
 		log.Tracef("Refusing to cache truncated message")
@@ -98,7 +203,7 @@ func isCacheable(m *dns.Msg) bool {
 		return false
 	}
 
-	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+	if !isCacheableRcode(m.Rcode, rcodes) {
 		log.Tracef("%s: refusing to cache message with response type %s", qName, dns.RcodeToString[m.Rcode])
 		return false
 	}
@@ -127,6 +232,22 @@ func isCacheable(m *dns.Msg) bool {
 	return true
 }
 
+// isCacheableRcode returns true if the responses with rcode may be cached.
+// Only NOERROR and NXDOMAIN responses are cached if rcodes is empty.
+func isCacheableRcode(rcode int, rcodes []int) bool {
+	if len(rcodes) == 0 {
+		return rcode == dns.RcodeSuccess || rcode == dns.RcodeNameError
+	}
+
+	for _, r := range rcodes {
+		if r == rcode {
+			return true
+		}
+	}
+
+	return false
+}
+
 func findLowestTTL(m *dns.Msg) uint32 {
 	var ttl uint32 = math.MaxUint32
 
@@ -148,6 +269,12 @@ func findLowestTTL(m *dns.Msg) uint32 {
 		}
 	}
 
+	// The authoritative servers may limit the time the zone data is valid
+	// for with the EXPIRE option, see RFC 7314.
+	if expire, ok := findExpire(m); ok && expire < ttl {
+		ttl = expire
+	}
+
 	if ttl == math.MaxUint32 {
 		return 0
 	}
@@ -155,6 +282,23 @@ func findLowestTTL(m *dns.Msg) uint32 {
 	return ttl
 }
 
+// findExpire returns the value of the EDNS0 EXPIRE option of m if there is
+// one.
+func findExpire(m *dns.Msg) (expire uint32, ok bool) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return 0, false
+	}
+
+	for _, o := range opt.Option {
+		if e, isExpire := o.(*dns.EDNS0_EXPIRE); isExpire {
+			return e.Expire, true
+		}
+	}
+
+	return 0, false
+}
+
 func getTTLIfLower(h *dns.RR_Header, ttl uint32) uint32 {
 	if h.Rrtype == dns.TypeOPT {
 		return ttl
@@ -232,11 +376,11 @@ func filterRRSlice(rrs []dns.RR, do bool, ttl uint32) (filtered []dns.RR) {
 }
 
 // packResponse turns m into a byte slice where first 4 bytes contain the expire
-// value.
-func packResponse(m *dns.Msg) []byte {
+// value calculated from now.
+func packResponse(m *dns.Msg, now time.Time) []byte {
 	pm, _ := m.Pack()
 	actualTTL := findLowestTTL(m)
-	expire := uint32(time.Now().Unix()) + actualTTL
+	expire := uint32(now.Unix()) + actualTTL
 	d := make([]byte, 4+len(pm))
 	binary.BigEndian.PutUint32(d, expire)
 	copy(d[4:], pm)
@@ -258,28 +402,43 @@ func filterMsg(dst, m *dns.Msg, ad, do bool, ttl uint32) {
 	dst.Extra = filterRRSlice(m.Extra, do, ttl)
 }
 
-// unpackResponse returns the unpacked response if it exists and didn't expire,
-// nil otherwise.
-func unpackResponse(data []byte, request *dns.Msg) *dns.Msg {
+// Responses are considered expiring when less than 1/expiringTTLDivisor of
+// their original TTL or less than expiringMinTTL seconds are left.
+const (
+	expiringTTLDivisor = 10
+	expiringMinTTL     = 1
+)
+
+// unpackResponse returns the unpacked response if it exists and didn't expire
+// by now, nil otherwise.  expiring is true if the response is about to expire.
+func unpackResponse(data []byte, request *dns.Msg, now time.Time) (res *dns.Msg, expiring bool) {
 	expire := binary.BigEndian.Uint32(data[:4])
-	now := time.Now().Unix()
-	if int64(expire) <= now {
-		return nil
+	if int64(expire) <= now.Unix() {
+		return nil, false
 	}
-	ttl := expire - uint32(now)
+	ttl := expire - uint32(now.Unix())
 
 	m := &dns.Msg{}
 	if m.Unpack(data[4:]) != nil {
-		return nil
+		return nil, false
+	}
+
+	// The truncated responses are incomplete, and the TC bit isn't copied
+	// into res, so they mustn't be served from cache.  They could be put
+	// there only with LoadCache.
+	if m.Truncated {
+		return nil, false
 	}
 
+	expiring = ttl <= expiringMinTTL || ttl <= findLowestTTL(m)/expiringTTLDivisor
+
 	adBit := request.AuthenticatedData
 	var doBit bool
 	if o := request.IsEdns0(); o != nil {
 		doBit = o.Do()
 	}
 
-	res := &dns.Msg{}
+	res = &dns.Msg{}
 	res.SetReply(request)
 	res.AuthenticatedData = m.AuthenticatedData
 	res.RecursionAvailable = m.RecursionAvailable
@@ -289,5 +448,5 @@ func unpackResponse(data []byte, request *dns.Msg) *dns.Msg {
 	// (https://tools.ietf.org/html/rfc6891).
 	filterMsg(res, m, adBit, doBit, ttl)
 
-	return res
+	return res, expiring
 }
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+)
+
+// cacheDumpEntry is a single cache item in the dump.
+type cacheDumpEntry struct {
+	// Key is the cache key of the item.
+	Key []byte
+	// Data is the packed response with its expiration time, see
+	// packResponse.
+	Data []byte
+	// Subnet is true if the item belongs to the subnet cache.
+	Subnet bool
+}
+
+// cacheDump is the gob-encoded contents of the cache files.
+type cacheDump struct {
+	Entries []cacheDumpEntry
+}
+
+// isExpired returns true if the packed response data has expired by now.
+func isExpired(data []byte, now time.Time) bool {
+	return len(data) < 4 || int64(binary.BigEndian.Uint32(data)) <= now.Unix()
+}
+
+// dump returns the non-expired items of the cache.
+func (c *cache) dump(subnet bool) (entries []cacheDumpEntry) {
+	c.Lock()
+	if c.items == nil {
+		c.Unlock()
+
+		return nil
+	}
+
+	keys := make([]string, 0, len(c.keys))
+	for k := range c.keys {
+		keys = append(keys, k)
+	}
+	c.Unlock()
+
+	for _, k := range keys {
+		data := c.items.Get([]byte(k))
+		if data == nil || isExpired(data, c.now()) {
+			continue
+		}
+
+		entries = append(entries, cacheDumpEntry{
+			Key:    []byte(k),
+			Data:   data,
+			Subnet: subnet,
+		})
+	}
+
+	return entries
+}
+
+// DumpCache writes the non-expired cache entries to w so that they could be
+// loaded later with LoadCache.
+func (p *Proxy) DumpCache(w io.Writer) error {
+	if p.cache == nil {
+		return errors.New("cache is disabled")
+	}
+
+	d := cacheDump{
+		Entries: p.cache.dump(false),
+	}
+	if p.cacheSubnet != nil {
+		d.Entries = append(d.Entries, (*cache)(p.cacheSubnet).dump(true)...)
+	}
+
+	err := gob.NewEncoder(w).Encode(d)
+	if err != nil {
+		return errorx.Decorate(err, "couldn't write the cache dump")
+	}
+
+	log.Info("Dumped %d cache entries", len(d.Entries))
+
+	return nil
+}
+
+// LoadCache reads the cache entries written by DumpCache from r and puts them
+// into the cache.  The entries that have expired since then are skipped.
+func (p *Proxy) LoadCache(r io.Reader) error {
+	if p.cache == nil {
+		return errors.New("cache is disabled")
+	}
+
+	d := cacheDump{}
+	err := gob.NewDecoder(r).Decode(&d)
+	if err != nil {
+		return errorx.Decorate(err, "couldn't read the cache dump")
+	}
+
+	loaded := 0
+	for _, e := range d.Entries {
+		if isExpired(e.Data, p.now()) {
+			continue
+		}
+
+		if !e.Subnet {
+			p.cache.setData(e.Key, e.Data)
+		} else if p.cacheSubnet != nil {
+			(*cache)(p.cacheSubnet).setData(e.Key, e.Data)
+		} else {
+			continue
+		}
+
+		loaded++
+	}
+
+	log.Info("Loaded %d cache entries", loaded)
+
+	return nil
+}
@@ -5,7 +5,6 @@ import (
 	"net"
 	"strings"
 
-	glcache "github.com/AdguardTeam/golibs/cache"
 	"github.com/miekg/dns"
 )
 
@@ -71,14 +70,22 @@ func keyWithSubnet(m *dns.Msg, ip net.IP, mask uint8) []byte {
 // Note: it's a slow longest-prefix-match algorithm -
 //  we search in cache up to 'mask+1' times, decrementing the value with each iteration.
 func (c *cacheSubnet) GetWithSubnet(request *dns.Msg, ip net.IP, mask uint8) (*dns.Msg, bool) {
+	res, _, ok := c.getWithSubnet(request, ip, mask)
+
+	return res, ok
+}
+
+// getWithSubnet is like GetWithSubnet but it also returns true in expiring if
+// the response is about to expire.
+func (c *cacheSubnet) getWithSubnet(request *dns.Msg, ip net.IP, mask uint8) (res *dns.Msg, expiring, ok bool) {
 	if request == nil || len(request.Question) != 1 {
-		return nil, false
+		return nil, false, false
 	}
 	// create key for request
 	c.Lock()
 	if c.items == nil {
 		c.Unlock()
-		return nil, false
+		return nil, false, false
 	}
 	c.Unlock()
 
@@ -90,42 +97,26 @@ func (c *cacheSubnet) GetWithSubnet(request *dns.Msg, ip net.IP, mask uint8) (*d
 			break
 		}
 		if mask == 0 {
-			return nil, false
+			return nil, false, false
 		}
 		mask--
 	}
 
-	res := unpackResponse(data, request)
+	res, expiring = unpackResponse(data, request, (*cache)(c).now())
 	if res == nil {
-		c.items.Del(key)
-		return nil, false
+		(*cache)(c).del(key)
+		(*cache)(c).evicted(data, cacheEvictionExpired)
+		return nil, false, false
 	}
-	return res, true
+	return res, expiring, true
 }
 
 // SetWithSubnet - store DNS response
 // ip: IP subnet this response is valid for
 // mask: subnet mask
 func (c *cacheSubnet) SetWithSubnet(m *dns.Msg, ip net.IP, mask uint8) {
-	if m == nil || !isCacheable(m) {
+	if m == nil || !isCacheable(m, c.rcodes) {
 		return
 	}
-	key := keyWithSubnet(m, ip, mask)
-
-	c.Lock()
-	// lazy initialization for cache
-	if c.items == nil {
-		conf := glcache.Config{
-			MaxSize:   defaultCacheSize,
-			EnableLRU: true,
-		}
-		if c.cacheSize > 0 {
-			conf.MaxSize = uint(c.cacheSize)
-		}
-		c.items = glcache.New(conf)
-	}
-	c.Unlock()
-
-	data := packResponse(m)
-	_ = c.items.Set(key, data)
+	(*cache)(c).setData(keyWithSubnet(m, ip, mask), packResponse(m, (*cache)(c).now()))
 }
@@ -1,10 +1,13 @@
 package proxy
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -188,8 +191,10 @@ func TestCacheRace(t *testing.T) {
 }
 
 func TestCacheExpiration(t *testing.T) {
+	clock := newFakeClock()
 	dnsProxy := createTestProxy(t, nil)
 	dnsProxy.CacheEnabled = true
+	dnsProxy.TimeSource = clock.Now
 	err := dnsProxy.Start()
 	if err != nil {
 		t.Fatalf("cannot start the DNS proxy: %s", err)
@@ -239,7 +244,7 @@ func TestCacheExpiration(t *testing.T) {
 	}
 
 	// Wait for cache items expiration
-	time.Sleep(1100 * time.Millisecond)
+	clock.Add(time.Second)
 
 	// Both messages should be already removed from the cache
 	_, ok = dnsProxy.cache.Get(&yandexReply)
@@ -316,6 +321,214 @@ func TestCacheExpirationWithTTLOverride(t *testing.T) {
 	}
 }
 
+// blockingUpstream answers requests only after release is closed.
+type blockingUpstream struct {
+	release chan struct{}
+	calls   uint32
+}
+
+func (u *blockingUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddUint32(&u.calls, 1)
+	<-u.release
+
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	resp.Answer = append(resp.Answer, newRR(m.Question[0].Name+" 100 IN A 4.3.2.1"))
+
+	return resp, nil
+}
+
+func (u *blockingUpstream) Address() string {
+	return "blocking"
+}
+
+func TestOptimisticCache(t *testing.T) {
+	clock := newFakeClock()
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.OptimisticCache = true
+	dnsProxy.TimeSource = clock.Now
+	u := &blockingUpstream{release: make(chan struct{})}
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer dnsProxy.Stop()
+
+	req := createHostTestMessage("host")
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, newRR("host. 100 IN A 1.2.3.4"))
+	dnsProxy.cache.Set(resp)
+
+	// Make the cached response expire soon.
+	clock.Add(98 * time.Second)
+
+	d := &DNSContext{Req: req, Addr: &net.TCPAddr{}}
+	resolved := make(chan error, 1)
+	go func() {
+		resolved <- dnsProxy.Resolve(d)
+	}()
+
+	select {
+	case err = <-resolved:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatalf("expiring cached response wasn't served immediately")
+	}
+
+	if assert.Len(t, d.Res.Answer, 1) {
+		assert.Equal(t, net.IP{1, 2, 3, 4}, d.Res.Answer[0].(*dns.A).A.To4())
+	}
+
+	close(u.release)
+
+	refreshed := false
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		r, ok := dnsProxy.cache.Get(createHostTestMessage("host"))
+		if ok && len(r.Answer) == 1 && r.Answer[0].(*dns.A).A.Equal(net.IP{4, 3, 2, 1}) {
+			refreshed = true
+
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, refreshed)
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&u.calls))
+}
+
+func TestCacheDumpLoad(t *testing.T) {
+	clock := newFakeClock()
+	dnsProxy := &Proxy{Config: Config{CacheEnabled: true, TimeSource: clock.Now}}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	liveReq := createHostTestMessage("live")
+	resp := &dns.Msg{}
+	resp.SetReply(liveReq)
+	resp.Answer = append(resp.Answer, newRR("live. 60 IN A 1.2.3.4"))
+	dnsProxy.cache.Set(resp)
+
+	expiredReq := createHostTestMessage("expired")
+	resp = &dns.Msg{}
+	resp.SetReply(expiredReq)
+	resp.Answer = append(resp.Answer, newRR("expired. 30 IN A 1.2.3.4"))
+	dnsProxy.cache.Set(resp)
+
+	clock.Add(30 * time.Second)
+
+	buf := &bytes.Buffer{}
+	err = dnsProxy.DumpCache(buf)
+	assert.Nil(t, err)
+
+	// Load the cache into a fresh proxy to simulate the restart.
+	clock.Add(10 * time.Second)
+	dnsProxy = &Proxy{Config: Config{CacheEnabled: true, TimeSource: clock.Now}}
+	err = dnsProxy.Init()
+	assert.Nil(t, err)
+
+	err = dnsProxy.LoadCache(buf)
+	assert.Nil(t, err)
+
+	r, ok := dnsProxy.cache.Get(liveReq)
+	if assert.True(t, ok) && assert.Len(t, r.Answer, 1) {
+		assert.Equal(t, uint32(20), r.Answer[0].Header().Ttl)
+	}
+
+	_, ok = dnsProxy.cache.Get(expiredReq)
+	assert.False(t, ok)
+}
+
+func TestCacheTruncated(t *testing.T) {
+	clock := newFakeClock()
+	dnsProxy := &Proxy{Config: Config{CacheEnabled: true, TimeSource: clock.Now}}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	req := createHostTestMessage("truncated")
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Truncated = true
+	resp.Answer = append(resp.Answer, newRR("truncated. 60 IN A 1.2.3.4"))
+
+	dnsProxy.cache.Set(resp)
+	_, ok := dnsProxy.cache.Get(req)
+	assert.False(t, ok)
+
+	// The truncated responses loaded from a dump aren't served either.
+	buf := &bytes.Buffer{}
+	err = gob.NewEncoder(buf).Encode(cacheDump{Entries: []cacheDumpEntry{{
+		Key:  key(req),
+		Data: packResponse(resp, clock.Now()),
+	}}})
+	assert.Nil(t, err)
+
+	err = dnsProxy.LoadCache(buf)
+	assert.Nil(t, err)
+
+	_, ok = dnsProxy.cache.Get(req)
+	assert.False(t, ok)
+}
+
+func TestCacheEvictions(t *testing.T) {
+	type eviction struct {
+		key    string
+		reason string
+	}
+
+	var evictions []eviction
+	clock := newFakeClock()
+	dnsProxy := &Proxy{Config: Config{
+		CacheEnabled:   true,
+		CacheSizeBytes: 512,
+		TimeSource:     clock.Now,
+		CacheEvictionCallback: func(key, reason string) {
+			evictions = append(evictions, eviction{key: key, reason: reason})
+		},
+	}}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	// Fill the cache past its limit
+	for i := 0; i < 20; i++ {
+		host := fmt.Sprintf("host%d", i)
+		resp := &dns.Msg{}
+		resp.SetReply(createHostTestMessage(host))
+		resp.Answer = append(resp.Answer, newRR(host+". 60 IN A 1.2.3.4"))
+		dnsProxy.cache.Set(resp)
+	}
+
+	stats := dnsProxy.Stats()
+	assert.NotZero(t, stats.CacheCapacityEvictions)
+	assert.Zero(t, stats.CacheExpiryEvictions)
+	if assert.Len(t, evictions, int(stats.CacheCapacityEvictions)) {
+		// The least recently used entry is evicted first
+		assert.Equal(t, eviction{key: "host0. A", reason: "capacity"}, evictions[0])
+	}
+
+	// The expired entry is removed on access
+	evictions = nil
+	clock.Add(time.Minute)
+	_, ok := dnsProxy.cache.Get(createHostTestMessage("host19"))
+	assert.False(t, ok)
+
+	stats = dnsProxy.Stats()
+	assert.Equal(t, uint64(1), stats.CacheExpiryEvictions)
+	assert.Equal(t, []eviction{{key: "host19. A", reason: "expired"}}, evictions)
+}
+
+func TestCacheOversizedItem(t *testing.T) {
+	testCache := &cache{cacheSize: 64}
+
+	// The item is larger than the whole cache, so glcache rejects it.
+	testCache.setData([]byte("key"), make([]byte, 128))
+	assert.Empty(t, testCache.keys)
+
+	testCache.setData([]byte("key"), make([]byte, 8))
+	assert.Len(t, testCache.keys, 1)
+}
+
 func TestCache(t *testing.T) {
 	tests := testCases{
 		cache: []testEntry{
@@ -541,3 +754,331 @@ func TestSubnet(t *testing.T) {
 	a = resp.Answer[0].(*dns.A)
 	assert.True(t, a.A.String() == "3.3.3.3")
 }
+
+// rcodeUpstream answers all requests with rcode and counts the exchanges.
+type rcodeUpstream struct {
+	rcode int
+	calls uint32
+}
+
+func (u *rcodeUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddUint32(&u.calls, 1)
+
+	resp := &dns.Msg{}
+	resp.SetRcode(m, u.rcode)
+	if u.rcode == dns.RcodeSuccess {
+		resp.Answer = append(resp.Answer, newRR(m.Question[0].Name+" 100 IN TXT \"text\""))
+	}
+	resp.Ns = genSOA(m, 100)
+
+	return resp, nil
+}
+
+func (u *rcodeUpstream) Address() string {
+	return "rcode"
+}
+
+func TestCacheableRcodes(t *testing.T) {
+	testCases := []struct {
+		name   string
+		rcodes []int
+		calls  uint32
+	}{{
+		name:   "default",
+		rcodes: nil,
+		calls:  2,
+	}, {
+		name:   "servfail_cacheable",
+		rcodes: []int{dns.RcodeSuccess, dns.RcodeServerFailure},
+		calls:  1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u := &rcodeUpstream{rcode: dns.RcodeServerFailure}
+			dnsProxy := createTestProxy(t, nil)
+			dnsProxy.CacheEnabled = true
+			dnsProxy.CacheableRcodes = tc.rcodes
+			dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+			err := dnsProxy.Init()
+			assert.Nil(t, err)
+
+			for i := 0; i < 2; i++ {
+				d := &DNSContext{Req: createHostTestMessage("host"), Addr: &net.TCPAddr{}}
+				err = dnsProxy.Resolve(d)
+				assert.Nil(t, err)
+				assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+			}
+
+			assert.Equal(t, tc.calls, atomic.LoadUint32(&u.calls))
+		})
+	}
+}
+
+// expireUpstream answers the A requests with the EDNS0 EXPIRE option.
+type expireUpstream struct {
+	expire uint32
+}
+
+func (u *expireUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	resp.Answer = append(resp.Answer, newRR(m.Question[0].Name+" 300 IN A 1.2.3.4"))
+	resp.SetEdns0(4096, false)
+	opt := resp.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_EXPIRE{Code: dns.EDNS0EXPIRE, Expire: u.expire})
+
+	return resp, nil
+}
+
+func (u *expireUpstream) Address() string {
+	return "expire"
+}
+
+func TestCacheExpireOption(t *testing.T) {
+	clock := newFakeClock()
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.TimeSource = clock.Now
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&expireUpstream{expire: 30}}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	req := createHostTestMessage("host")
+	err = dnsProxy.Resolve(&DNSContext{Req: req, Addr: &net.TCPAddr{}})
+	assert.Nil(t, err)
+
+	// The cache entry expires along with the zone data rather than the
+	// records.
+	r, ok := dnsProxy.cache.Get(req)
+	assert.True(t, ok)
+	if assert.NotNil(t, r) && assert.Len(t, r.Answer, 1) {
+		assert.Equal(t, uint32(30), r.Answer[0].Header().Ttl)
+	}
+
+	clock.Add(31 * time.Second)
+	_, ok = dnsProxy.cache.Get(req)
+	assert.False(t, ok)
+}
+
+func TestCacheTTLOverrides(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.CacheTTLOverrides = map[string]uint32{
+		"*.dyndns.example":       30,
+		"Static.DynDNS.example.": 3600,
+	}
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&expireUpstream{expire: 86400}}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	testCases := []struct {
+		host string
+		ttl  uint32
+	}{
+		{host: "dyndns.example", ttl: 30},
+		{host: "home.dyndns.example", ttl: 30},
+		{host: "static.dyndns.example", ttl: 3600},
+		{host: "www.static.dyndns.example", ttl: 3600},
+		{host: "example", ttl: 300},
+		{host: "notdyndns.example", ttl: 300},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			req := createHostTestMessage(tc.host)
+			d := &DNSContext{Req: req, Addr: &net.TCPAddr{}}
+			err = dnsProxy.Resolve(d)
+			assert.Nil(t, err)
+			if assert.Len(t, d.Res.Answer, 1) {
+				assert.Equal(t, tc.ttl, d.Res.Answer[0].Header().Ttl)
+			}
+
+			r, ok := dnsProxy.cache.Get(req)
+			if assert.True(t, ok) && assert.Len(t, r.Answer, 1) {
+				assert.Equal(t, tc.ttl, r.Answer[0].Header().Ttl)
+			}
+		})
+	}
+}
+
+func TestClientMaxTTL(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.ClientMaxTTL = 10
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{createTestUpstream()}
+	err := dnsProxy.Start()
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	addr := dnsProxy.Addr(ProtoUDP)
+	client := &dns.Client{Net: "udp", Timeout: 500 * time.Millisecond}
+
+	// The second response comes from the cache.
+	for i := 0; i < 2; i++ {
+		req := createTestMessage()
+		reply, _, err := client.Exchange(req, addr.String())
+		assert.Nil(t, err)
+		if assert.NotNil(t, reply) && assert.Len(t, reply.Answer, 1) {
+			assert.Equal(t, uint32(10), reply.Answer[0].Header().Ttl)
+		}
+
+		r, ok := dnsProxy.cache.Get(req)
+		if assert.True(t, ok) && assert.Len(t, r.Answer, 1) {
+			assert.Equal(t, uint32(60), r.Answer[0].Header().Ttl)
+		}
+	}
+}
+
+// anyRefusingUpstream answers the A and AAAA requests and doesn't implement
+// the ANY ones like many public resolvers.
+type anyRefusingUpstream struct {
+	calls uint32
+}
+
+func (u *anyRefusingUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddUint32(&u.calls, 1)
+
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	name := m.Question[0].Name
+	switch m.Question[0].Qtype {
+	case dns.TypeA:
+		resp.Answer = append(resp.Answer, newRR(name+" 60 IN A 1.2.3.4"))
+	case dns.TypeAAAA:
+		resp.Answer = append(resp.Answer, newRR(name+" 60 IN AAAA ::1"))
+	case dns.TypeANY:
+		resp.Rcode = dns.RcodeNotImplemented
+	}
+
+	return resp, nil
+}
+
+func (u *anyRefusingUpstream) Address() string {
+	return "any-refusing"
+}
+
+func TestAnyFromCache(t *testing.T) {
+	u := &anyRefusingUpstream{}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.AnyFromCache = true
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	anyReq := &dns.Msg{}
+	anyReq.SetQuestion("host.", dns.TypeANY)
+
+	// Nothing is cached yet, so the request is forwarded.
+	d := &DNSContext{Req: anyReq.Copy(), Addr: &net.TCPAddr{}}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNotImplemented, d.Res.Rcode)
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&u.calls))
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		req := &dns.Msg{}
+		req.SetQuestion("host.", qtype)
+		err = dnsProxy.Resolve(&DNSContext{Req: req, Addr: &net.TCPAddr{}})
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, uint32(3), atomic.LoadUint32(&u.calls))
+
+	d = &DNSContext{Req: anyReq.Copy(), Addr: &net.TCPAddr{}}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Equal(t, anyReq.Question, d.Res.Question)
+	if assert.Len(t, d.Res.Answer, 2) {
+		assert.Equal(t, dns.TypeA, d.Res.Answer[0].Header().Rrtype)
+		assert.Equal(t, dns.TypeAAAA, d.Res.Answer[1].Header().Rrtype)
+	}
+	assert.Equal(t, uint32(3), atomic.LoadUint32(&u.calls))
+}
+
+// longNegativeUpstream answers all requests with NXDOMAIN and a SOA record
+// which TTL and MINIMUM are 24 hours.
+type longNegativeUpstream struct{}
+
+// longNegativeSOA is the SOA record of longNegativeUpstream's responses
+// shared between them.
+var longNegativeSOA = newRR("example.org. 86400 IN SOA ns.example.org. hostmaster.example.org. 1 3600 600 86400 86400")
+
+func (u *longNegativeUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	resp := &dns.Msg{}
+	resp.SetRcode(m, dns.RcodeNameError)
+	resp.Ns = []dns.RR{longNegativeSOA}
+
+	return resp, nil
+}
+
+func (u *longNegativeUpstream) Address() string {
+	return "long-negative"
+}
+
+func TestNegativeCacheMaxTTL(t *testing.T) {
+	clock := newFakeClock()
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.TimeSource = clock.Now
+	dnsProxy.NegativeCacheMaxTTL = 60
+	dnsProxy.NegativeCacheRewriteSOA = true
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&longNegativeUpstream{}}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	req := createHostTestMessage("host")
+	d := &DNSContext{Req: req, Addr: &net.TCPAddr{}}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+
+	// The served SOA is rewritten, the upstream's one is not.
+	if assert.Len(t, d.Res.Ns, 1) {
+		soa := d.Res.Ns[0].(*dns.SOA)
+		assert.Equal(t, uint32(60), soa.Hdr.Ttl)
+		assert.Equal(t, uint32(60), soa.Minttl)
+	}
+	assert.Equal(t, uint32(86400), longNegativeSOA.(*dns.SOA).Minttl)
+
+	r, ok := dnsProxy.cache.Get(req)
+	assert.True(t, ok)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, dns.RcodeNameError, r.Rcode)
+	}
+
+	// The negative cache entry expires after the cap.
+	clock.Add(61 * time.Second)
+	_, ok = dnsProxy.cache.Get(req)
+	assert.False(t, ok)
+}
+
+func TestNonCacheableTypes(t *testing.T) {
+	u := &rcodeUpstream{rcode: dns.RcodeSuccess}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.NonCacheableTypes = []uint16{dns.TypeTXT}
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	resolve := func(qtype uint16) {
+		req := &dns.Msg{}
+		req.SetQuestion("host.", qtype)
+		d := &DNSContext{Req: req, Addr: &net.TCPAddr{}}
+		err = dnsProxy.Resolve(d)
+		assert.Nil(t, err)
+	}
+
+	// The TXT responses are fetched fresh every time.
+	resolve(dns.TypeTXT)
+	resolve(dns.TypeTXT)
+	assert.Equal(t, uint32(2), atomic.LoadUint32(&u.calls))
+
+	// The responses to the rest of the types are still cached.
+	resolve(dns.TypeMX)
+	resolve(dns.TypeMX)
+	assert.Equal(t, uint32(3), atomic.LoadUint32(&u.calls))
+}
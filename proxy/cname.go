@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// defaultMaxCNAMEChain is the default maximum number of CNAME records in the
+// chain of a response.
+const defaultMaxCNAMEChain = 16
+
+// edeOther is the "Other" Extended DNS Error code, see RFC 8914.
+const edeOther = 0
+
+// errCNAMEChain is returned when the response contains a CNAME chain which is
+// too long or loops.
+var errCNAMEChain = errors.New("cname chain is too long or loops")
+
+// maxCNAMEChain returns the configured maximum length of the CNAME chain.
+func (p *Proxy) maxCNAMEChain() int {
+	if p.MaxCNAMEChain == 0 {
+		return defaultMaxCNAMEChain
+	}
+
+	return p.MaxCNAMEChain
+}
+
+// checkCNAMEChain follows the CNAME chain of resp starting from the question
+// name and returns errCNAMEChain if it's longer than the limit or loops.
+func (p *Proxy) checkCNAMEChain(resp *dns.Msg) error {
+	if len(resp.Question) == 0 {
+		return nil
+	}
+
+	targets := map[string]string{}
+	for _, rr := range resp.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			targets[strings.ToLower(cname.Hdr.Name)] = strings.ToLower(cname.Target)
+		}
+	}
+
+	max := p.maxCNAMEChain()
+	visited := map[string]bool{}
+	name := strings.ToLower(resp.Question[0].Name)
+	for n := 0; ; n++ {
+		target, ok := targets[name]
+		if !ok {
+			return nil
+		}
+
+		visited[name] = true
+		if n >= max || visited[target] {
+			return errCNAMEChain
+		}
+
+		name = target
+	}
+}
+
+// stripUnsolicited removes the records of the answer section of resp which
+// don't belong to the question name or the names of its CNAME chain, as well
+// as the DNAME records not applicable to these names.  It returns the number
+// of the removed records.
+func stripUnsolicited(resp *dns.Msg) (removed int) {
+	if len(resp.Question) == 0 {
+		return 0
+	}
+
+	// The records may come in any order, so the chain is followed until it
+	// stops growing.
+	names := map[string]bool{strings.ToLower(resp.Question[0].Name): true}
+	for grown := true; grown; {
+		grown = false
+		for _, rr := range resp.Answer {
+			cname, ok := rr.(*dns.CNAME)
+			if !ok || !names[strings.ToLower(cname.Hdr.Name)] {
+				continue
+			}
+
+			if target := strings.ToLower(cname.Target); !names[target] {
+				names[target] = true
+				grown = true
+			}
+		}
+	}
+
+	answer := resp.Answer[:0:0]
+	for _, rr := range resp.Answer {
+		if isSolicited(rr, names) {
+			answer = append(answer, rr)
+		}
+	}
+
+	removed = len(resp.Answer) - len(answer)
+	resp.Answer = answer
+
+	return removed
+}
+
+// isSolicited returns true if rr belongs to one of names, or if rr is a DNAME
+// record which applies to one of them.
+func isSolicited(rr dns.RR, names map[string]bool) bool {
+	owner := strings.ToLower(rr.Header().Name)
+	if names[owner] {
+		return true
+	}
+
+	if rr.Header().Rrtype == dns.TypeDNAME || isSignatureOf(rr, dns.TypeDNAME) {
+		for name := range names {
+			if name != owner && dns.IsSubDomain(owner, name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isSignatureOf returns true if rr is an RRSIG record covering the records of
+// type t.
+func isSignatureOf(rr dns.RR, t uint16) bool {
+	sig, ok := rr.(*dns.RRSIG)
+
+	return ok && sig.TypeCovered == t
+}
+
+// addEDE adds the Extended DNS Error option to the OPT record of resp, see
+// RFC 8914.  resp is left intact if it has no OPT record, i.e. the client
+// doesn't support EDNS0.
+func addEDE(resp *dns.Msg, code uint16, text string) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	data := append([]byte{byte(code >> 8), byte(code)}, text...)
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: ednsOptionEDE, Data: data})
+}
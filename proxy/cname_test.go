@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// cnameUpstream responds with the CNAME records from the chain map.
+type cnameUpstream struct {
+	chain map[string]string
+}
+
+func (u *cnameUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	for name, target := range u.chain {
+		resp.Answer = append(resp.Answer, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 10},
+			Target: target,
+		})
+	}
+
+	return resp, nil
+}
+
+func (u *cnameUpstream) Address() string {
+	return "cname"
+}
+
+func TestMaxCNAMEChain(t *testing.T) {
+	longChain := map[string]string{}
+	for i := 0; i < 5; i++ {
+		longChain[fmt.Sprintf("c%d.example.org.", i)] = fmt.Sprintf("c%d.example.org.", i+1)
+	}
+
+	testCases := []struct {
+		name     string
+		chain    map[string]string
+		max      int
+		wantCode int
+	}{{
+		name: "loop",
+		chain: map[string]string{
+			"c0.example.org.": "c1.example.org.",
+			"c1.example.org.": "C0.example.org.",
+		},
+		max:      0,
+		wantCode: dns.RcodeServerFailure,
+	}, {
+		name:     "too_long",
+		chain:    longChain,
+		max:      4,
+		wantCode: dns.RcodeServerFailure,
+	}, {
+		name:     "within_limit",
+		chain:    longChain,
+		max:      5,
+		wantCode: dns.RcodeSuccess,
+	}, {
+		name:     "default_limit",
+		chain:    longChain,
+		max:      0,
+		wantCode: dns.RcodeSuccess,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dnsProxy := createTestProxy(t, nil)
+			dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&cnameUpstream{chain: tc.chain}}
+			dnsProxy.MaxCNAMEChain = tc.max
+			err := dnsProxy.Init()
+			assert.Nil(t, err)
+
+			req := &dns.Msg{}
+			req.SetQuestion("c0.example.org.", dns.TypeA)
+			req.SetEdns0(dns.DefaultMsgSize, false)
+			d := &DNSContext{Req: req}
+			_ = dnsProxy.Resolve(d)
+			d.setResponseOPT()
+
+			if !assert.NotNil(t, d.Res) {
+				return
+			}
+			assert.Equal(t, tc.wantCode, d.Res.Rcode)
+
+			var ede *dns.EDNS0_LOCAL
+			if opt := d.Res.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					if o.Option() == ednsOptionEDE {
+						ede = o.(*dns.EDNS0_LOCAL)
+					}
+				}
+			}
+
+			if tc.wantCode == dns.RcodeSuccess {
+				assert.Nil(t, ede)
+			} else if assert.NotNil(t, ede) {
+				assert.Equal(t, uint16(edeOther), binary.BigEndian.Uint16(ede.Data))
+			}
+		})
+	}
+}
+
+// fixedAnswerUpstream responds with the answer records parsed from answer.
+type fixedAnswerUpstream struct {
+	answer []string
+}
+
+func (u *fixedAnswerUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	for _, rr := range u.answer {
+		resp.Answer = append(resp.Answer, newRR(rr))
+	}
+
+	return resp, nil
+}
+
+func (u *fixedAnswerUpstream) Address() string {
+	return "fixed"
+}
+
+func TestStripUnsolicitedAnswers(t *testing.T) {
+	testCases := []struct {
+		name   string
+		host   string
+		answer []string
+		want   []string
+	}{{
+		name: "cname_chain",
+		host: "www.example.org",
+		answer: []string{
+			"cdn.example.net. 60 IN A 1.2.3.4",
+			"evil.example.com. 60 IN A 6.6.6.6",
+			"WWW.example.org. 60 IN CNAME cdn.example.net.",
+			"example.org. 60 IN TXT \"promo\"",
+		},
+		want: []string{
+			"cdn.example.net. 60 IN A 1.2.3.4",
+			"www.example.org. 60 IN CNAME cdn.example.net.",
+		},
+	}, {
+		name: "dname",
+		host: "a.b.example.org",
+		answer: []string{
+			"b.example.org. 60 IN DNAME b.example.net.",
+			"c.example.org. 60 IN DNAME c.example.net.",
+			"a.b.example.org. 60 IN CNAME a.b.example.net.",
+			"a.b.example.net. 60 IN A 1.2.3.4",
+		},
+		want: []string{
+			"b.example.org. 60 IN DNAME b.example.net.",
+			"a.b.example.org. 60 IN CNAME a.b.example.net.",
+			"a.b.example.net. 60 IN A 1.2.3.4",
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dnsProxy := createTestProxy(t, nil)
+			dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&fixedAnswerUpstream{answer: tc.answer}}
+			dnsProxy.StripUnsolicitedAnswers = true
+			err := dnsProxy.Init()
+			assert.Nil(t, err)
+
+			d := &DNSContext{Req: createHostTestMessage(tc.host)}
+			err = dnsProxy.Resolve(d)
+			assert.Nil(t, err)
+
+			var got []string
+			for _, rr := range d.Res.Answer {
+				got = append(got, rr.String())
+			}
+
+			var want []string
+			for _, rr := range tc.want {
+				want = append(want, newRR(rr).String())
+			}
+			assert.Equal(t, want, got)
+		})
+	}
+
+	// The answers are intact by default.
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&fixedAnswerUpstream{answer: testCases[0].answer}}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	d := &DNSContext{Req: createHostTestMessage(testCases[0].host)}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	assert.Len(t, d.Res.Answer, len(testCases[0].answer))
+}
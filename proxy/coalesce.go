@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// coalescedExchange is an unfinished exchange with an upstream shared among
+// the identical requests.
+type coalescedExchange struct {
+	// done is closed when the exchange is finished.
+	done chan struct{}
+	// reply is the copy of the response for the waiters.
+	reply *dns.Msg
+	// err is the error of the exchange.
+	err error
+	// waiters is the number of the requests waiting for the exchange to
+	// finish.  It's protected by Proxy.coalesceLock.
+	waiters int
+}
+
+// coalescingUpstream is an upstream that sends only one of the identical
+// requests at a time and shares the response among all of them.
+type coalescingUpstream struct {
+	upstream.Upstream
+	p *Proxy
+}
+
+// coalesceKey returns the key of the request m to the upstream with the
+// address addr.  The whole request except for the ID is taken into account
+// so that the requests with different EDNS0 options aren't coalesced.
+func coalesceKey(addr string, m *dns.Msg) (key string, ok bool) {
+	req := m.Copy()
+	req.Id = 0
+	data, err := req.Pack()
+	if err != nil {
+		return "", false
+	}
+
+	return addr + " " + string(data), true
+}
+
+// Exchange implements the upstream.Upstream interface for *coalescingUpstream.
+func (u *coalescingUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	key, ok := coalesceKey(u.Address(), m)
+	if !ok {
+		return u.Upstream.Exchange(m)
+	}
+
+	u.p.coalesceLock.Lock()
+	if ex, found := u.p.coalesced[key]; found {
+		ex.waiters++
+		u.p.coalesceLock.Unlock()
+
+		log.Tracef("Waiting for the same request to %s", u.Address())
+		<-ex.done
+		if ex.reply == nil {
+			return nil, ex.err
+		}
+
+		reply := ex.reply.Copy()
+		reply.Id = m.Id
+
+		return reply, nil
+	}
+
+	ex := &coalescedExchange{done: make(chan struct{})}
+	if u.p.coalesced == nil {
+		u.p.coalesced = map[string]*coalescedExchange{}
+	}
+	u.p.coalesced[key] = ex
+	u.p.coalesceLock.Unlock()
+
+	reply, err := u.Upstream.Exchange(m)
+
+	u.p.coalesceLock.Lock()
+	delete(u.p.coalesced, key)
+	waiters := ex.waiters
+	u.p.coalesceLock.Unlock()
+
+	if waiters > 0 {
+		log.Tracef("Shared the response from %s with %d identical requests", u.Address(), waiters)
+	}
+
+	// Copy the reply before the caller modifies it.
+	if err == nil && reply != nil {
+		ex.reply = reply.Copy()
+	}
+	ex.err = err
+	close(ex.done)
+
+	return reply, err
+}
+
+// coalescingUpstreams wraps upstreams so that the identical requests to each
+// of them are coalesced if it's configured.
+func (p *Proxy) coalescingUpstreams(upstreams []upstream.Upstream) []upstream.Upstream {
+	if !p.CoalesceUpstreamQueries {
+		return upstreams
+	}
+
+	res := make([]upstream.Upstream, len(upstreams))
+	for i, u := range upstreams {
+		res[i] = &coalescingUpstream{Upstream: u, p: p}
+	}
+
+	return res
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingUpstream counts the exchanges and blocks them until release is
+// closed.
+type countingUpstream struct {
+	exchanges uint32
+	release   chan struct{}
+}
+
+func (u *countingUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddUint32(&u.exchanges, 1)
+	<-u.release
+
+	return createTestUpstream().Exchange(m)
+}
+
+func (u *countingUpstream) Address() string {
+	return "counting"
+}
+
+func TestCoalesceUpstreamQueries(t *testing.T) {
+	const n = 10
+
+	u := &countingUpstream{release: make(chan struct{})}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	dnsProxy.CoalesceUpstreamQueries = true
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	wg := &sync.WaitGroup{}
+	replies := make([]*dns.Msg, n)
+	reqs := make([]*dns.Msg, n)
+	for i := 0; i < n; i++ {
+		reqs[i] = createTestMessage()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			d := &DNSContext{Req: reqs[i]}
+			if rErr := dnsProxy.Resolve(d); rErr == nil {
+				replies[i] = d.Res
+			}
+		}(i)
+	}
+
+	// Wait for all the requests to join the first one
+	assert.Eventually(t, func() bool {
+		dnsProxy.coalesceLock.Lock()
+		defer dnsProxy.coalesceLock.Unlock()
+
+		for _, ex := range dnsProxy.coalesced {
+			return ex.waiters == n-1
+		}
+
+		return false
+	}, defaultTimeout, time.Millisecond)
+	close(u.release)
+	wg.Wait()
+
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&u.exchanges))
+	for i, reply := range replies {
+		if assert.NotNil(t, reply) {
+			assert.Equal(t, reqs[i].Id, reply.Id)
+			assertResponse(t, reply)
+		}
+	}
+}
@@ -3,11 +3,14 @@ package proxy
 import (
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
+	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
 )
 
 // UpstreamModeType - upstream mode
@@ -22,6 +25,20 @@ const (
 	UModeFastestAddr
 )
 
+// BlockingModeType is the way of answering the blocked requests.
+type BlockingModeType string
+
+const (
+	// BlockingModeNXDomain answers the blocked requests with NXDOMAIN.  It's
+	// the default one.
+	BlockingModeNXDomain BlockingModeType = "nxdomain"
+	// BlockingModeRedirect answers the blocked A and AAAA requests with the
+	// addresses of the server showing the block page, see BlockRedirectIPv4
+	// and BlockRedirectIPv6.  The requests of other types get empty NOERROR
+	// responses.
+	BlockingModeRedirect BlockingModeType = "redirect"
+)
+
 // BeforeRequestHandler is an optional custom handler called before DNS requests
 // If it returns false, the request won't be processed at all
 type BeforeRequestHandler func(p *Proxy, d *DNSContext) (bool, error)
@@ -36,6 +53,41 @@ type RequestHandler func(p *Proxy, d *DNSContext) error
 // err -- error (if any)
 type ResponseHandler func(d *DNSContext, err error)
 
+// UpstreamSelectedCallback is a callback method that is called each time an
+// upstream has been selected to resolve a query
+// q -- the question of the query
+// upstreamAddr -- the address of the selected upstream
+// idx -- the index of the upstream in the list it has been selected from
+// weight -- the current weight of the upstream
+// It's called synchronously, so it should be cheap
+type UpstreamSelectedCallback func(q dns.Question, upstreamAddr string, idx int, weight int)
+
+// UpstreamExchangeCallback is a callback method that is called after each
+// exchange with an upstream
+// upstreamAddr -- the address of the upstream
+// query, response -- the messages sent to and received from the upstream,
+// response is nil if err is not nil
+// rtt -- the duration of the exchange
+// It's called synchronously and the messages mustn't be modified
+type UpstreamExchangeCallback func(upstreamAddr string, query, response *dns.Msg, rtt time.Duration, err error)
+
+// CacheEvictionCallback is a callback method that is called each time an entry
+// is removed from the cache
+// key -- the question name and type of the entry, e.g. "example.org. A"
+// reason -- "capacity" if the entry has been evicted to free space and
+// "expired" if its TTL has expired
+// It's called synchronously, so it should be cheap
+type CacheEvictionCallback func(key string, reason string)
+
+// NegativeSOA is the SOA record added to the authority section of the negative
+// responses synthesized by the proxy, so that they could be cached downstream
+type NegativeSOA struct {
+	Mname  string // primary name server of the zone
+	Rname  string // mailbox of the person responsible for the zone
+	Serial uint32 // serial number of the zone
+	TTL    uint32 // negative TTL, used both as the record's TTL and MINIMUM
+}
+
 // Config contains all the fields necessary for proxy configuration
 type Config struct {
 	// Listeners
@@ -49,6 +101,26 @@ type Config struct {
 	DNSCryptUDPListenAddr []*net.UDPAddr // if nil, then it does not listen for DNSCrypt
 	DNSCryptTCPListenAddr []*net.TCPAddr // if nil, then it does not listen for DNSCrypt
 
+	// HTTPSUnixSocket is the path of the Unix socket to serve DoH on.  The
+	// requests are served over plain HTTP since TLS is supposed to be
+	// terminated by the reverse proxy, which must also set the client IP
+	// address in the X-Real-IP or X-Forwarded-For header.  If empty, it
+	// does not listen on a Unix socket.
+	HTTPSUnixSocket string
+
+	// HTTPListenAddr are the addresses to serve DoH over plain HTTP on.  It's
+	// INSECURE unless the listener is only reachable by a reverse proxy
+	// terminating TLS in front of it, which must also set the client IP
+	// address in the X-Real-IP or X-Forwarded-For header.  If nil, it
+	// does not listen for plain HTTP.
+	HTTPListenAddr []*net.TCPAddr
+
+	// ListenFDs are the file descriptors of the pre-opened sockets to serve
+	// plain DNS on, e.g. the ones passed by systemd socket activation, see
+	// SystemdListenFDs.  The stream sockets are served as TCP and the
+	// datagram ones as UDP.
+	ListenFDs []uintptr
+
 	// Encryption configuration
 	// --
 
@@ -56,12 +128,100 @@ type Config struct {
 	DNSCryptProviderName string         // DNSCrypt provider name
 	DNSCryptResolverCert *dnscrypt.Cert // DNSCrypt resolver certificate
 
+	// TLSConfigDoT and TLSConfigDoH, if set, override TLSConfig for the TLS
+	// and the HTTPS listeners respectively, e.g. to present a certificate
+	// with an IP address SAN for DoT and the one for a hostname for DoH.
+	// The OCSP stapling only applies to TLSConfig.
+	TLSConfigDoT *tls.Config
+	TLSConfigDoH *tls.Config
+
+	// OCSPStaple is the OCSP response the TLS, HTTPS, and QUIC listeners
+	// staple to the first certificate of TLSConfig, see RFC 6066.
+	OCSPStaple []byte
+	// OCSPResponderURL is the URL of the OCSP responder to fetch the staples
+	// from on start and then periodically.  The issuer's certificate must
+	// follow the leaf one in the chain unless the latter is self-signed.
+	OCSPResponderURL string
+	// OCSPRefreshInterval is the interval of fetching the staples from
+	// OCSPResponderURL.  Zero means the default value of 1 hour.
+	OCSPRefreshInterval time.Duration
+
+	// DoHAllowedUserAgents restricts the DoH endpoint to the clients which
+	// User-Agent starts with one of these values.  Other clients get 403.
+	// If empty, all clients are allowed.
+	DoHAllowedUserAgents []string
+
+	// DoHRequestIDHeader is the name of the DoH response header to echo the
+	// ID of the request in, see DNSContext.RequestID.  If empty, the ID
+	// isn't sent.
+	DoHRequestIDHeader string
+
+	// DoHCompressionMinSize is the minimum size of the DoH response body
+	// which is compressed with gzip for the clients accepting it.  Most of
+	// the responses are too small to benefit from it.  Zero disables the
+	// compression.
+	DoHCompressionMinSize int
+
+	// AllowClientUpstreamSelection lets the DoH clients choose one of the
+	// configured upstreams by its address in the "upstream" query
+	// parameter.  The clients must present one of the
+	// ClientUpstreamSelectionTokens in the "Authorization: Bearer" header.
+	// Otherwise, as well as when the selection isn't allowed, the requests
+	// with the parameter get 403.
+	AllowClientUpstreamSelection bool
+
+	// ClientUpstreamSelectionTokens are the tokens authorizing the DoH
+	// clients to choose the upstream, see AllowClientUpstreamSelection.
+	ClientUpstreamSelectionTokens []string
+
 	// Rate-limiting and anti-DNS amplification measures
 	// --
 
-	Ratelimit          int      // max number of requests per second from a given IP (0 to disable)
+	// Ratelimit is the maximum number of the UDP and DoH requests per second
+	// from a given IP, 0 disables it.  The ratelimited DoH clients get 429
+	// Too Many Requests.  The plain HTTP DoH requests without the client IP
+	// address in the X-Real-IP or X-Forwarded-For header aren't ratelimited,
+	// since they all come from the address of the reverse proxy.
+	Ratelimit int
+
 	RatelimitWhitelist []string // a list of whitelisted client IP addresses
 	RefuseAny          bool     // if true, refuse ANY requests
+	AnyFromCache       bool     // if true, answer ANY requests with the records of the name found in cache, if any
+	RequireRD          bool     // if true, refuse requests without the RD (recursion desired) bit
+	AllowedOpcodes     []int    // opcodes of the requests to forward besides QUERY, the rest get NOTIMPL
+	AllowedClasses     []uint16 // classes of the requests to forward, the rest get REFUSED (only IN if empty)
+	RejectResponses    bool     // if true, answer the messages with the QR bit set with FORMERR instead of dropping them
+	LoopDetection      bool     // if true, tag the requests to the upstreams and refuse the tagged ones coming back
+	MaxTCPConnections  int      // max number of simultaneous TCP and TLS connections (0 to disable)
+
+	// RateLimiter, if set, is used instead of the in-memory per-IP limiter
+	// configured by Ratelimit, e.g. to share the limits between several
+	// instances.  RatelimitWhitelist still applies.
+	RateLimiter RateLimiter
+
+	// UDPSingleInflightPerClient makes the proxy drop the UDP requests from
+	// the client IP which previous request is still being processed.  It
+	// limits the amplification potential of the requests with the spoofed
+	// source addresses.  RatelimitWhitelist still applies.
+	UDPSingleInflightPerClient bool
+
+	// ScanDefense makes the proxy answer the requests of the uncommon types
+	// with empty NOERROR responses to the client that has requested more
+	// than ScanDefenseThreshold distinct types of the same name within
+	// ScanDefenseWindow, which frustrates the enumeration scanners.
+	// RatelimitWhitelist still applies.
+	ScanDefense bool
+	// ScanDefenseThreshold is the number of the distinct types, zero means
+	// the default value of 8.
+	ScanDefenseThreshold int
+	// ScanDefenseWindow is the period the types are counted over, zero means
+	// the default value of one minute.
+	ScanDefenseWindow time.Duration
+
+	// StrictNameValidation makes the proxy answer the requests for the names
+	// longer than 255 octets or with the labels longer than 63 octets with
+	// FORMERR instead of processing them.
+	StrictNameValidation bool
 
 	// Upstream DNS servers and their settings
 	// --
@@ -70,10 +230,131 @@ type Config struct {
 	Fallbacks      []upstream.Upstream // list of fallback resolvers (which will be used if regular upstream failed to answer)
 	UpstreamMode   UpstreamModeType    // How to request the upstream servers
 
+	// UpstreamWeights are the weights of the default upstreams in the order
+	// of UpstreamConfig.Upstreams.  If set, in the load-balancing mode the
+	// upstreams are chosen randomly in proportion to their weights scaled by
+	// their RTTs.  The upstreams with zero weight are used as a last resort.
+	UpstreamWeights []int
+
+	// GeoUpstreams are the upstreams used instead of UpstreamConfig.Upstreams
+	// for the clients from the specific locations.  The keys are ISO 3166-1
+	// country codes or continent codes, the country match is preferred.  The
+	// domain-specific upstreams are still used for these clients.
+	GeoUpstreams map[string][]upstream.Upstream
+	// GeoLookup returns the location of the client's IP address.  It's
+	// required for GeoUpstreams.
+	GeoLookup GeoLookupFunc
+
+	// UpstreamsV4 and UpstreamsV6 are the upstreams used instead of
+	// UpstreamConfig.Upstreams for the A and AAAA requests respectively,
+	// e.g. the ones reachable over the corresponding IP family.  If empty,
+	// the default upstreams are used.  The domain-specific upstreams are
+	// still used for these requests.
+	UpstreamsV4 []upstream.Upstream
+	UpstreamsV6 []upstream.Upstream
+
+	// SkipResponseQuestionValidation makes the proxy accept the upstream
+	// responses which question section doesn't match the request.  By
+	// default, such responses are treated as failed exchanges.
+	SkipResponseQuestionValidation bool
+
+	// UpstreamFailureCooldown is the time an upstream that has failed to
+	// exchange is excluded from the selection in the load-balancing mode.
+	// Such upstreams are only used if all the others fail as well.  Zero
+	// disables it.
+	UpstreamFailureCooldown time.Duration
+
+	// ForceTCPUpstreams makes the proxy exchange with the plain DNS
+	// upstreams, including the fallback ones, over TCP only, regardless of
+	// how they were configured.
+	ForceTCPUpstreams bool
+
+	// UpstreamDialTimeout is the timeout of establishing the TCP connections
+	// to the plain DNS upstreams by the proxy itself, i.e. with
+	// ForceTCPUpstreams or when retrying the truncated responses, so that
+	// the unreachable upstreams are failed over quickly while the connected
+	// ones still have the whole exchange timeout to respond.  It's also used
+	// for the upstreams the proxy creates itself, e.g. the name servers of
+	// the stub zones.  The connections of the configured upstreams, including
+	// the DoT, DoH and DoQ ones, are limited with upstream.Options.DialTimeout
+	// passed to ParseUpstreamsConfig or AddressToUpstream.  Zero means no
+	// separate limit.
+	UpstreamDialTimeout time.Duration
+
+	// CoalesceUpstreamQueries makes the proxy send only one of the identical
+	// requests to the same upstream at a time.  The rest of them wait for
+	// the response and share it.
+	CoalesceUpstreamQueries bool
+
+	// UDPUpstreamRetries is the number of the quick retransmits of the
+	// request to the plain DNS upstreams over UDP.  They're sent each
+	// udpRetransmitInterval until one of the exchanges succeeds, so a single
+	// lost packet doesn't cost the whole upstream timeout.  Zero disables
+	// them.  It's ignored if ForceTCPUpstreams is set.
+	UDPUpstreamRetries int
+
+	// AdaptiveTimeout makes the proxy limit each exchange with an upstream
+	// to three times the upstream's average RTT of the successful
+	// exchanges, clamped between AdaptiveTimeoutMin and AdaptiveTimeoutMax,
+	// so that the dead upstreams fail fast while the slow ones still have the
+	// time to answer.  The RTT is measured in the load-balancing mode,
+	// AdaptiveTimeoutMax is used until it's known.  The timed out exchanges
+	// keep running until the upstream's own timeout.
+	AdaptiveTimeout bool
+	// AdaptiveTimeoutMin and AdaptiveTimeoutMax are the bounds of the
+	// adaptive timeout.  Zero means 100ms and 10s respectively.
+	AdaptiveTimeoutMin time.Duration
+	AdaptiveTimeoutMax time.Duration
+
+	// RttSmoothingFactor is the smoothing factor of the upstreams RTT
+	// exponential moving average used to sort the upstreams in the
+	// load-balancing mode.  Greater values make the recent RTTs weigh more.
+	// It must be in (0, 1], zero means the default value of 0.3.
+	RttSmoothingFactor float64
+
+	// RttHistoryWindow is the period over which the history of the upstreams
+	// RTTs is retained and reported by Stats.  Zero disables the history.
+	RttHistoryWindow time.Duration
+
+	// DedupAnswers makes the proxy remove the records duplicating the
+	// previous ones from the answer section of the upstream responses.
+	DedupAnswers bool
+
+	// StripUnsolicitedAnswers makes the proxy remove the records from the
+	// answer section of the upstream responses which don't belong to the
+	// requested name or its CNAME chain, e.g. the ones injected to poison
+	// the cache.
+	StripUnsolicitedAnswers bool
+
+	// AlwaysRequestDNSSEC makes the proxy set the DO bit in all the requests
+	// to the upstreams regardless of the client's one, not only in the ones
+	// answered from cache, e.g. when the cache is disabled or the custom
+	// upstreams are used.  The DNSSEC records are removed from the responses
+	// to the clients that haven't set the DO bit.
+	AlwaysRequestDNSSEC bool
+
+	// MaxCNAMEChain is the maximum number of CNAME records in the chain of
+	// the upstream response.  The responses with longer or looping chains
+	// are replaced with SERVFAIL.  Zero means the default value of 16.
+	MaxCNAMEChain int
+
 	// BogusNXDomain - transforms responses that contain at least one of the given IP addresses into NXDOMAIN
 	// Similar to dnsmasq's "bogus-nxdomain"
 	BogusNXDomain []net.IP
 
+	// StaticV6Prefix is the /96 IPv6 prefix used to synthesize AAAA records
+	// from A records when the AAAA request has no answers.  Unlike the NAT64
+	// prefix, it's not discovered but configured.  Only the first 12 bytes
+	// are used.
+	StaticV6Prefix net.IP
+
+	// DNS64Upstream is the DNS64 server the AAAA requests are sent to
+	// instead of the default upstreams, so that it synthesizes the AAAA
+	// records itself.  If it fails, the records are synthesized locally
+	// from the A records of the default upstreams using the NAT64 prefix,
+	// if it's known.
+	DNS64Upstream upstream.Upstream
+
 	// Enable EDNS Client Subnet option
 	// DNS requests to the upstream server will contain an OPT record with Client Subnet option.
 	//  If the original request already has this option set, we pass it through as is.
@@ -96,6 +377,73 @@ type Config struct {
 	EnableEDNSClientSubnet bool
 	EDNSAddr               net.IP // ECS IP used in request
 
+	// Safe search settings
+	// --
+
+	// SafeSearchEnabled makes the proxy rewrite the A and AAAA requests for
+	// the search engines to their safe search hostnames.
+	SafeSearchEnabled bool
+	// SafeSearchRules overrides the built-in safe search rules.  The keys
+	// are the hostnames of the search engines, the values are their safe
+	// search hostnames.  An empty value disables the built-in rule.
+	SafeSearchRules map[string]string
+
+	// Blocking settings
+	// --
+
+	// BlockSchedules are the domains blocked during the specified periods
+	// of time.
+	BlockSchedules []Schedule
+
+	// Allowlist are the domains that are never blocked or filtered.  A
+	// domain starting with "*." also matches all its subdomains.
+	Allowlist []string
+
+	// Blocklist are the blocked domains.  A domain starting with "*." also
+	// matches all its subdomains.
+	Blocklist []string
+	// BlocklistBloom makes the proxy keep Blocklist in a compact sorted list
+	// with a bloom filter in front of it instead of a hash set.  It takes
+	// much less memory for the lists of millions of domains, and the filter
+	// rules out most of the names which aren't blocked without searching
+	// the list.
+	BlocklistBloom bool
+
+	// BlocklistRegex are the regular expressions of the blocked domains.
+	// They're matched against the lowercased domain name without the
+	// trailing dot, e.g. `^ad[0-9]+\.` blocks "ad123.example.com".
+	BlocklistRegex []string
+
+	// BlockingMode is the way of answering the blocked requests.  If empty,
+	// BlockingModeNXDomain is used.
+	BlockingMode BlockingModeType
+	// BlockRedirectIPv4 and BlockRedirectIPv6 are the addresses the blocked
+	// A and AAAA requests are answered with in BlockingModeRedirect.  If
+	// one of them is nil, the requests of the corresponding type get empty
+	// NOERROR responses.
+	BlockRedirectIPv4 net.IP
+	BlockRedirectIPv6 net.IP
+
+	// NegativeSOA is the SOA record for the negative responses synthesized
+	// by the proxy.  If nil, a default one is used.
+	NegativeSOA *NegativeSOA
+
+	// RewriteTTL is the TTL of the answers synthesized by the proxy, i.e.
+	// the safe search rewrites and the answers about the proxy's own
+	// addresses.  Zero prevents the clients from caching them.  If nil, 10
+	// seconds is used.
+	RewriteTTL *uint32
+	// BlockTTL is the TTL of the blocked responses, i.e. the TTL and the
+	// MINIMUM field of their SOA record or the TTL of the redirect
+	// addresses.  Zero makes unblocking take effect immediately.  If nil,
+	// the TTL of NegativeSOA or RewriteTTL for the redirect addresses is
+	// used.
+	BlockTTL *uint32
+	// ClientMaxTTL caps the TTL of the records sent to the clients so that
+	// they query the proxy again sooner.  The cached responses keep their
+	// original TTL.  Zero means no limit.
+	ClientMaxTTL uint32
+
 	// Cache settings
 	// --
 
@@ -104,6 +452,38 @@ type Config struct {
 	CacheMinTTL    uint32 // Minimum TTL for DNS entries (in seconds).
 	CacheMaxTTL    uint32 // Maximum TTL for DNS entries (in seconds).
 
+	// NegativeCacheMaxTTL caps the TTL of the negative responses, i.e. the
+	// NXDOMAIN and NODATA ones, regardless of the MINIMUM field of their SOA
+	// record, see RFC 2308.  It prevents the transient NXDOMAINs from sticking
+	// around for hours.  Zero means no limit.
+	NegativeCacheMaxTTL uint32
+	// NegativeCacheRewriteSOA makes the proxy also lower the MINIMUM field of
+	// the SOA records of the negative responses to NegativeCacheMaxTTL, so
+	// that the downstream resolvers don't cache them for longer.
+	NegativeCacheRewriteSOA bool
+
+	// CacheTTLOverrides maps the domain names to the TTL of the answers for
+	// them and their subdomains, e.g. to keep the dynamic DNS names fresh.
+	// The override for the longest matching name is applied after
+	// CacheMinTTL and CacheMaxTTL.  A leading "*." is ignored.
+	CacheTTLOverrides map[string]uint32
+
+	// OptimisticCache makes the proxy serve the cached responses that are
+	// about to expire right away while refreshing them in the background.
+	OptimisticCache bool
+
+	// CacheEvictionCallback is called each time an entry is removed from
+	// the cache.  It's useful for tuning the cache size.
+	CacheEvictionCallback CacheEvictionCallback
+
+	// CacheableRcodes are the response codes of the responses which may be
+	// cached.  If empty, NOERROR and NXDOMAIN responses are cached.
+	CacheableRcodes []int
+
+	// NonCacheableTypes are the query types the responses to which are
+	// never cached.
+	NonCacheableTypes []uint16
+
 	// Handlers (for the case when dnsproxy is used as a library)
 	// --
 
@@ -111,6 +491,36 @@ type Config struct {
 	RequestHandler       RequestHandler       // callback that can handle incoming DNS requests
 	ResponseHandler      ResponseHandler      // response callback
 
+	// UpstreamSelectedCallback is called each time an upstream is selected.
+	// It's useful for debugging the upstreams selection.
+	UpstreamSelectedCallback UpstreamSelectedCallback
+
+	// UpstreamExchangeCallback is called after each exchange with an
+	// upstream, including the fallback ones.  It's useful for debugging the
+	// upstream-specific issues.
+	UpstreamExchangeCallback UpstreamExchangeCallback
+
+	// UpstreamQueryRewrite, if set, is called with a copy of each request
+	// before it's sent to the upstreams and returns the request to send
+	// instead, e.g. with a search domain appended.  The response gets the
+	// client's original question back.
+	UpstreamQueryRewrite func(req *dns.Msg) (rewritten *dns.Msg)
+
+	// DNSTap settings
+	// --
+
+	DNSTapEnabled          bool   // if true, client queries and responses are written to the DNSTap collector
+	DNSTapNetwork          string // network of the DNSTap collector: "unix" or "tcp"
+	DNSTapAddress          string // address of the DNSTap collector (socket path or host:port)
+	DNSTapResolverMessages bool   // if true, upstream exchanges are written too (RESOLVER_QUERY/RESPONSE)
+
+	// Query log settings
+	// --
+
+	QueryLogFile       string // path of the file the queries are written to as JSON lines, empty disables the query log
+	QueryLogMaxSizeMB  int    // size of the query log file in megabytes which makes it rotated, 0 means no limit
+	QueryLogMaxAgeDays int    // age of the rotated query log files in days which makes them removed, 0 means never
+
 	// Other settings
 	// --
 
@@ -122,38 +532,239 @@ type Config struct {
 	// actually limit all goroutines.
 	MaxGoroutines int
 
+	// BackgroundConcurrency is the number of the workers running the
+	// background jobs, such as refreshing the expiring cache entries, the
+	// secondary zones, and the root hints.  If zero, 4 workers are used.
+	BackgroundConcurrency int
+
+	// HealthCheckInterval is the interval of checking the health of all the
+	// upstreams, including the fallback ones, in a single sweep.  The result
+	// is reported by UpstreamHealth.  Zero disables the health checks.
+	HealthCheckInterval time.Duration
+	// HealthCheckConcurrency is the maximum number of the upstreams probed at
+	// the same time during the health check.  If zero, 4 is used.
+	HealthCheckConcurrency int
+
+	// StopDrainTimeout is the maximum time Stop waits for the requests in
+	// progress to finish before closing the listeners.  Meanwhile the new
+	// requests are refused.  Zero makes Stop close the listeners right
+	// away.
+	StopDrainTimeout time.Duration
+
+	// TimeSource returns the current time.  It's used for the cache and the
+	// blocking schedules, but not for the network deadlines.  If nil,
+	// time.Now is used.
+	TimeSource func() time.Time
+
+	// SelfPTR is the hostname to answer the PTR requests for the proxy's own
+	// listen addresses with.  Such requests aren't sent to the upstreams.
+	// If empty, they are resolved as usual.
+	SelfPTR string
+
+	// AnswerRootLocally makes the proxy answer the NS requests for the root
+	// zone with the root hints instead of forwarding them upstream.  The
+	// hints are built-in initially and then refreshed from the upstreams.
+	AnswerRootLocally bool
+	// RootHintsRefreshInterval is the interval of refreshing the root hints.
+	// Zero means the default value of 24 hours.
+	RootHintsRefreshInterval time.Duration
+
+	// SecondaryZones are the zones transferred from their primary name
+	// servers via AXFR on start and then periodically.  The requests for
+	// these zones are answered authoritatively from the transferred records
+	// and forwarded until the first transfer completes.
+	SecondaryZones []SecondaryZone
+
+	// StubZones maps the names of the zones to the addresses of their
+	// authoritative name servers.  The non-recursive requests for these
+	// zones and their subzones are sent to these servers instead of the
+	// upstreams, unless the custom upstreams are used.
+	StubZones map[string][]string
+
+	// ServerIdentity is the string to answer the CHAOS TXT requests for
+	// version.bind, hostname.bind, id.server, and version.server with.  If
+	// empty, these requests are handled according to HideIdentity.
+	ServerIdentity string
+	// HideIdentity makes the proxy refuse the server identity requests, see
+	// ServerIdentity, instead of forwarding them upstream where they may be
+	// used to fingerprint the setup.  ServerIdentity takes precedence.
+	HideIdentity bool
+
+	// ResponseJitter is the maximum random delay before writing a response.
+	// It smooths the timing differences between cached and upstream
+	// responses.  Zero disables the delay.
+	ResponseJitter time.Duration
+
+	// MaxTXTLength is the maximum total length of the strings of a TXT
+	// record in the UDP responses, for the constrained clients.  The longer
+	// records are cut to fit it, unless MaxTXTLengthTC is set.  Zero
+	// disables the limit.
+	MaxTXTLength int
+	// MaxTXTLengthTC makes the proxy mark the UDP responses with the TXT
+	// records longer than MaxTXTLength as truncated instead of cutting the
+	// records, so that the clients retry over TCP.
+	MaxTXTLengthTC bool
+
+	// AdvertisedUDPSize is the UDP payload size the proxy advertises in the
+	// OPT records of the responses, i.e. its own capacity, see RFC 6891.
+	// Zero makes it echo the one from the client's request.
+	AdvertisedUDPSize uint16
+
 	// The size of the read buffer on the underlying socket. Larger read buffers can handle
 	// larger bursts of requests before packets get dropped.
 	UDPBufferSize int
+
+	// TCPConnReadBuffer and TCPConnWriteBuffer are the sizes of the socket
+	// buffers of the accepted TCP and TLS connections.  Larger buffers help
+	// the clients pipelining many requests.  Zero keeps the OS defaults.
+	TCPConnReadBuffer  int
+	TCPConnWriteBuffer int
 }
 
-// validateConfig verifies that the supplied configuration is valid and returns an error if it's not
-func (p *Proxy) validateConfig() error {
-	if p.started {
-		return errors.New("server has been already started")
+// validateBlockingMode checks BlockingMode and the redirect addresses.
+func (c *Config) validateBlockingMode() error {
+	switch c.BlockingMode {
+	case "", BlockingModeNXDomain:
+		return nil
+	case BlockingModeRedirect:
+		// Go on.
+	default:
+		return fmt.Errorf("unknown blocking mode %q", c.BlockingMode)
+	}
+
+	if c.BlockRedirectIPv4 == nil && c.BlockRedirectIPv6 == nil {
+		return errors.New("no block redirect addresses specified")
+	}
+
+	if c.BlockRedirectIPv4 != nil && c.BlockRedirectIPv4.To4() == nil {
+		return fmt.Errorf("block redirect address %s is not an IPv4 address", c.BlockRedirectIPv4)
 	}
 
-	err := p.validateListenAddrs()
-	if err != nil {
-		return err
+	if c.BlockRedirectIPv6 != nil && (c.BlockRedirectIPv6.To16() == nil || c.BlockRedirectIPv6.To4() != nil) {
+		return fmt.Errorf("block redirect address %s is not an IPv6 address", c.BlockRedirectIPv6)
 	}
 
-	if p.UpstreamConfig == nil {
-		return errors.New("no default upstreams specified")
+	return nil
+}
+
+// Validate checks the configuration and returns all the problems found, e.g.
+// to show them at once to the user.  It returns nil if the configuration is
+// valid.
+func (c *Config) Validate() (errs []error) {
+	errs = append(errs, c.validateListenAddrs()...)
+	errs = append(errs, c.validateUpstreams()...)
+
+	if c.MaxTXTLength < 0 {
+		errs = append(errs, fmt.Errorf("invalid max TXT length %d", c.MaxTXTLength))
 	}
 
-	if len(p.UpstreamConfig.Upstreams) == 0 {
-		if len(p.UpstreamConfig.DomainReservedUpstreams) == 0 {
-			return errors.New("no upstreams specified")
+	if c.RttSmoothingFactor < 0 || c.RttSmoothingFactor > 1 {
+		errs = append(errs, fmt.Errorf("invalid RTT smoothing factor %v, must be in (0, 1]", c.RttSmoothingFactor))
+	}
+
+	if c.ScanDefenseThreshold < 0 || c.ScanDefenseWindow < 0 {
+		errs = append(errs, errors.New("scan defense limits must not be negative"))
+	}
+
+	if c.UDPUpstreamRetries < 0 {
+		errs = append(errs, fmt.Errorf("negative udp upstream retries: %d", c.UDPUpstreamRetries))
+	}
+
+	if c.AdaptiveTimeoutMin < 0 || c.AdaptiveTimeoutMax < 0 {
+		errs = append(errs, errors.New("adaptive timeout bounds must not be negative"))
+	} else if c.AdaptiveTimeoutMax != 0 && c.AdaptiveTimeoutMin > c.AdaptiveTimeoutMax {
+		errs = append(errs, fmt.Errorf("adaptive timeout min %s is greater than max %s", c.AdaptiveTimeoutMin, c.AdaptiveTimeoutMax))
+	}
+
+	if c.HealthCheckInterval < 0 || c.HealthCheckConcurrency < 0 {
+		errs = append(errs, errors.New("health check settings must not be negative"))
+	}
+
+	if c.TCPConnReadBuffer < 0 || c.TCPConnWriteBuffer < 0 {
+		errs = append(errs, errors.New("tcp connection buffer sizes must not be negative"))
+	}
+
+	if c.StopDrainTimeout < 0 {
+		errs = append(errs, fmt.Errorf("negative stop drain timeout: %s", c.StopDrainTimeout))
+	}
+
+	if c.RttHistoryWindow < 0 {
+		errs = append(errs, errors.New("RTT history window must not be negative"))
+	}
+
+	for _, z := range c.SecondaryZones {
+		if z.Name == "" || z.Primary == "" {
+			errs = append(errs, fmt.Errorf("secondary zone %q: name and primary are required", z.Name))
+		}
+
+		if z.RefreshInterval < 0 {
+			errs = append(errs, fmt.Errorf("secondary zone %q: invalid refresh interval %s", z.Name, z.RefreshInterval))
+		}
+	}
+
+	if c.StaticV6Prefix != nil && (c.StaticV6Prefix.To16() == nil || c.StaticV6Prefix.To4() != nil) {
+		errs = append(errs, fmt.Errorf("static IPv6 prefix %s is not an IPv6 address", c.StaticV6Prefix))
+	}
+
+	if err := c.validateBlockingMode(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.DNSTapEnabled {
+		if c.DNSTapNetwork != "unix" && c.DNSTapNetwork != "tcp" {
+			errs = append(errs, fmt.Errorf("unsupported DNSTap network: %q", c.DNSTapNetwork))
+		}
+
+		if c.DNSTapAddress == "" {
+			errs = append(errs, errors.New("no DNSTap address specified"))
 		}
-		return errors.New("no default upstreams specified")
+	}
+
+	if c.BackgroundConcurrency < 0 {
+		errs = append(errs, fmt.Errorf("negative background concurrency: %d", c.BackgroundConcurrency))
+	}
+
+	if (len(c.OCSPStaple) != 0 || c.OCSPResponderURL != "") &&
+		(c.TLSConfig == nil || len(c.TLSConfig.Certificates) == 0) {
+		errs = append(errs, errors.New("no TLS certificates to staple the OCSP response to"))
+	}
+
+	if c.QueryLogMaxSizeMB < 0 || c.QueryLogMaxAgeDays < 0 {
+		errs = append(errs, errors.New("query log limits must not be negative"))
+	}
+
+	// The cache options have no effect without the cache.
+	if !c.CacheEnabled {
+		if c.OptimisticCache {
+			errs = append(errs, errors.New("optimistic cache requires the cache to be enabled"))
+		}
+
+		if c.AnyFromCache {
+			errs = append(errs, errors.New("answering ANY from cache requires the cache to be enabled"))
+		}
+	}
+
+	return errs
+}
+
+// validateConfig verifies that the supplied configuration is valid and returns
+// the first problem found if it's not.
+func (p *Proxy) validateConfig() error {
+	if p.started {
+		return errors.New("server has been already started")
+	}
+
+	if errs := p.Validate(); len(errs) != 0 {
+		return errs[0]
 	}
 
 	if p.CacheMinTTL > 0 || p.CacheMaxTTL > 0 {
 		log.Info("Cache TTL override is enabled. Min=%d, Max=%d", p.CacheMinTTL, p.CacheMaxTTL)
 	}
 
-	if p.Ratelimit > 0 {
+	if p.RateLimiter != nil {
+		log.Info("Custom ratelimiter is enabled")
+	} else if p.Ratelimit > 0 {
 		log.Info("Ratelimit is enabled and set to %d rps", p.Ratelimit)
 	}
 
@@ -161,6 +772,10 @@ func (p *Proxy) validateConfig() error {
 		log.Info("The server is configured to refuse ANY requests")
 	}
 
+	if p.RequireRD {
+		log.Info("The server is configured to refuse non-recursive requests")
+	}
+
 	if len(p.BogusNXDomain) > 0 {
 		log.Info("%d bogus-nxdomain IP specified", len(p.BogusNXDomain))
 	}
@@ -168,41 +783,83 @@ func (p *Proxy) validateConfig() error {
 	return nil
 }
 
+// validateUpstreams checks the upstreams and their settings.
+func (c *Config) validateUpstreams() (errs []error) {
+	if c.UpstreamConfig == nil {
+		errs = append(errs, errors.New("no default upstreams specified"))
+	} else if len(c.UpstreamConfig.Upstreams) == 0 {
+		if len(c.UpstreamConfig.DomainReservedUpstreams) == 0 {
+			errs = append(errs, errors.New("no upstreams specified"))
+		} else {
+			errs = append(errs, errors.New("no default upstreams specified"))
+		}
+	} else if len(c.UpstreamWeights) != 0 && len(c.UpstreamWeights) != len(c.UpstreamConfig.Upstreams) {
+		errs = append(errs, fmt.Errorf("%d upstream weights specified for %d upstreams", len(c.UpstreamWeights), len(c.UpstreamConfig.Upstreams)))
+	}
+
+	if c.UpstreamDialTimeout < 0 {
+		errs = append(errs, fmt.Errorf("negative upstream dial timeout: %s", c.UpstreamDialTimeout))
+	}
+
+	if c.UpstreamFailureCooldown < 0 {
+		errs = append(errs, fmt.Errorf("negative upstream failure cooldown: %s", c.UpstreamFailureCooldown))
+	}
+
+	if c.MaxCNAMEChain < 0 {
+		errs = append(errs, fmt.Errorf("negative max cname chain: %d", c.MaxCNAMEChain))
+	}
+
+	if len(c.GeoUpstreams) != 0 && c.GeoLookup == nil {
+		errs = append(errs, errors.New("geo upstreams specified without geo lookup"))
+	}
+
+	for _, w := range c.UpstreamWeights {
+		if w < 0 {
+			errs = append(errs, fmt.Errorf("invalid upstream weight %d", w))
+		}
+	}
+
+	return errs
+}
+
 // validateListenAddrs -- checks if listen addrs are properly configured
-func (p *Proxy) validateListenAddrs() error {
-	if !p.hasListenAddrs() {
-		return errors.New("no listen address specified")
+func (c *Config) validateListenAddrs() (errs []error) {
+	if !c.hasListenAddrs() {
+		errs = append(errs, errors.New("no listen address specified"))
 	}
 
-	if p.TLSListenAddr != nil && p.TLSConfig == nil {
-		return errors.New("cannot create a TLS listener without TLS config")
+	if c.TLSListenAddr != nil && c.TLSConfig == nil && c.TLSConfigDoT == nil {
+		errs = append(errs, errors.New("cannot create a TLS listener without TLS config"))
 	}
 
-	if p.HTTPSListenAddr != nil && p.TLSConfig == nil {
-		return errors.New("cannot create an HTTPS listener without TLS config")
+	if c.HTTPSListenAddr != nil && c.TLSConfig == nil && c.TLSConfigDoH == nil {
+		errs = append(errs, errors.New("cannot create an HTTPS listener without TLS config"))
 	}
 
-	if p.QUICListenAddr != nil && p.TLSConfig == nil {
-		return errors.New("cannot create a QUIC listener without TLS config")
+	if c.QUICListenAddr != nil && c.TLSConfig == nil {
+		errs = append(errs, errors.New("cannot create a QUIC listener without TLS config"))
 	}
 
-	if (p.DNSCryptTCPListenAddr != nil || p.DNSCryptUDPListenAddr != nil) &&
-		(p.DNSCryptResolverCert == nil || p.DNSCryptProviderName == "") {
-		return errors.New("cannot create a DNSCrypt listener without DNSCrypt config")
+	if (c.DNSCryptTCPListenAddr != nil || c.DNSCryptUDPListenAddr != nil) &&
+		(c.DNSCryptResolverCert == nil || c.DNSCryptProviderName == "") {
+		errs = append(errs, errors.New("cannot create a DNSCrypt listener without DNSCrypt config"))
 	}
 
-	return nil
+	return errs
 }
 
 // hasListenAddrs - is there any addresses to listen to?
-func (p *Proxy) hasListenAddrs() bool {
-	if p.UDPListenAddr == nil &&
-		p.TCPListenAddr == nil &&
-		p.TLSListenAddr == nil &&
-		p.HTTPSListenAddr == nil &&
-		p.QUICListenAddr == nil &&
-		p.DNSCryptUDPListenAddr == nil &&
-		p.DNSCryptTCPListenAddr == nil {
+func (c *Config) hasListenAddrs() bool {
+	if c.UDPListenAddr == nil &&
+		c.TCPListenAddr == nil &&
+		c.TLSListenAddr == nil &&
+		c.HTTPSListenAddr == nil &&
+		c.QUICListenAddr == nil &&
+		c.DNSCryptUDPListenAddr == nil &&
+		c.DNSCryptTCPListenAddr == nil &&
+		c.HTTPSUnixSocket == "" &&
+		c.HTTPListenAddr == nil &&
+		len(c.ListenFDs) == 0 {
 		return false
 	}
 
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigValidate(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	assert.Empty(t, dnsProxy.Validate())
+
+	c := &Config{
+		TLSListenAddr:   []*net.TCPAddr{{IP: net.IP{127, 0, 0, 1}}},
+		HTTPSListenAddr: []*net.TCPAddr{{IP: net.IP{127, 0, 0, 1}}},
+		UpstreamConfig:  &UpstreamConfig{},
+		MaxCNAMEChain:   -1,
+		OptimisticCache: true,
+		BlockingMode:    "unknown",
+	}
+
+	var msgs []string
+	for _, err := range c.Validate() {
+		msgs = append(msgs, err.Error())
+	}
+	assert.Equal(t, []string{
+		"cannot create a TLS listener without TLS config",
+		"cannot create an HTTPS listener without TLS config",
+		"no upstreams specified",
+		"negative max cname chain: -1",
+		`unknown blocking mode "unknown"`,
+		"optimistic cache requires the cache to be enabled",
+	}, msgs)
+
+	// validateConfig reports the first problem.
+	dnsProxy = &Proxy{Config: *c}
+	err := dnsProxy.validateConfig()
+	if assert.NotNil(t, err) {
+		assert.Equal(t, msgs[0], err.Error())
+	}
+
+	c = &Config{}
+	assert.Len(t, c.Validate(), 2)
+}
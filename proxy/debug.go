@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// upstreamDebugInfo is the state of a single upstream reported by the
+// DebugHandler.
+type upstreamDebugInfo struct {
+	Address  string `json:"address"`
+	RTT      int    `json:"rtt_ms"`
+	RTTP95   int    `json:"rtt_p95_ms"`
+	Weight   int    `json:"weight"`
+	Healthy  bool   `json:"healthy"`
+	InFlight int    `json:"in_flight"`
+}
+
+// debugInfo is the snapshot of the proxy state reported by the DebugHandler.
+type debugInfo struct {
+	Upstreams []upstreamDebugInfo `json:"upstreams"`
+
+	TCPConnections         int32  `json:"tcp_connections"`
+	RejectedTCPConnections uint32 `json:"rejected_tcp_connections"`
+}
+
+// debugUpstreams returns all the configured upstreams without duplicates.
+func (p *Proxy) debugUpstreams() (upstreams []upstream.Upstream) {
+	if p.UpstreamConfig == nil {
+		return nil
+	}
+
+	seen := map[string]bool{}
+	add := func(ups []upstream.Upstream) {
+		for _, u := range ups {
+			if !seen[u.Address()] {
+				seen[u.Address()] = true
+				upstreams = append(upstreams, u)
+			}
+		}
+	}
+
+	add(p.UpstreamConfig.Upstreams)
+	for _, ups := range p.UpstreamConfig.DomainReservedUpstreams {
+		add(ups)
+	}
+
+	return upstreams
+}
+
+// debugSnapshot returns the current state of the upstreams.
+func (p *Proxy) debugSnapshot() debugInfo {
+	info := debugInfo{
+		Upstreams:              []upstreamDebugInfo{},
+		TCPConnections:         atomic.LoadInt32(&p.tcpConns),
+		RejectedTCPConnections: atomic.LoadUint32(&p.tcpConnsRejected),
+	}
+
+	p.rttLock.Lock()
+	defer p.rttLock.Unlock()
+
+	for _, u := range p.debugUpstreams() {
+		addr := u.Address()
+		info.Upstreams = append(info.Upstreams, upstreamDebugInfo{
+			Address:  addr,
+			RTT:      int(p.upstreamRttStats[addr].avg()),
+			RTTP95:   p.upstreamRttStats[addr].percentile(0.95),
+			Weight:   p.upstreamWeight(u),
+			Healthy:  !p.upstreamFailed[addr],
+			InFlight: p.upstreamInFlight[addr],
+		})
+	}
+
+	return info
+}
+
+// DebugHandler returns an HTTP handler that responds with a human-readable
+// JSON snapshot of the upstreams state: their RTTs, weights, health and the
+// number of unfinished exchanges.  It isn't served by the proxy itself, so
+// it's up to the caller where to mount it.
+func (p *Proxy) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := json.MarshalIndent(p.debugSnapshot(), "", "  ")
+		if err != nil {
+			log.Error("couldn't marshal the debug info: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(data)
+		if err != nil {
+			log.Debug("couldn't write the debug info: %s", err)
+		}
+	})
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugHandler(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{
+		&slowUpstream{addr: "slow1"},
+		&slowUpstream{addr: "slow2"},
+	}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	for i := 0; i < 5; i++ {
+		d := &DNSContext{Req: createTestMessage()}
+		err = dnsProxy.Resolve(d)
+		assert.Nil(t, err)
+	}
+
+	rw := httptest.NewRecorder()
+	dnsProxy.DebugHandler().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/debug", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+
+	info := debugInfo{}
+	err = json.Unmarshal(rw.Body.Bytes(), &info)
+	assert.Nil(t, err)
+	if !assert.Len(t, info.Upstreams, 2) {
+		return
+	}
+
+	for i, u := range info.Upstreams {
+		assert.Equal(t, dnsProxy.UpstreamConfig.Upstreams[i].Address(), u.Address)
+		assert.NotZero(t, u.RTT)
+		assert.Equal(t, defaultUpstreamWeight, u.Weight)
+		assert.True(t, u.Healthy)
+		assert.Zero(t, u.InFlight)
+	}
+}
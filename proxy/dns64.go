@@ -10,19 +10,30 @@ import (
 )
 
 // isEmptyAAAAResponse checks AAAA answer to be empty
-// returns true if NAT64 prefix already calculated and there are no answers for AAAA question
+// returns true if NAT64 prefix is available and there are no answers for AAAA question
 func (p *Proxy) isEmptyAAAAResponse(resp, req *dns.Msg) bool {
 	return p.isNAT64PrefixAvailable() &&
-		(resp == nil || len(resp.Answer) == 0) &&
+		(resp == nil || (resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0)) &&
 		req.Question[0].Qtype == dns.TypeAAAA
 }
 
-// isNAT64PrefixAvailable returns true if NAT64 prefix was calculated
+// isNAT64PrefixAvailable returns true if NAT64 prefix was calculated or the
+// static one is configured
 func (p *Proxy) isNAT64PrefixAvailable() bool {
+	return len(p.dns64Prefix()) == 12
+}
+
+// dns64Prefix returns the prefix used to synthesize AAAA records.  The static
+// prefix from the configuration takes precedence over the calculated one.
+func (p *Proxy) dns64Prefix() []byte {
+	if p.StaticV6Prefix != nil {
+		return p.StaticV6Prefix.To16()[:12]
+	}
+
 	p.nat64Lock.Lock()
-	prefixSize := len(p.nat64Prefix)
-	p.nat64Lock.Unlock()
-	return prefixSize == 12
+	defer p.nat64Lock.Unlock()
+
+	return p.nat64Prefix
 }
 
 // SetNAT64Prefix sets NAT64 prefix
@@ -42,6 +53,32 @@ func (p *Proxy) SetNAT64Prefix(prefix []byte) {
 	p.nat64Lock.Unlock()
 }
 
+// useDNS64Upstream returns true if req should be sent to DNS64Upstream.  The
+// requests with the custom upstreams are resolved as usual.
+func (p *Proxy) useDNS64Upstream(d *DNSContext, req *dns.Msg) bool {
+	return p.DNS64Upstream != nil &&
+		d.CustomUpstreamConfig == nil &&
+		req.Question[0].Qtype == dns.TypeAAAA
+}
+
+// exchangeDNS64 sends the AAAA request req to DNS64Upstream.  If it fails, the
+// response is synthesized from the A records received from upstreams using the
+// NAT64 prefix, if it's available.
+func (p *Proxy) exchangeDNS64(req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
+	reply, u, err := p.exchangeEDNSAware(req, []upstream.Upstream{p.DNS64Upstream})
+	if err == nil || !p.isNAT64PrefixAvailable() {
+		return reply, u, err
+	}
+
+	log.Debug("DNS64 upstream %s failed, synthesizing locally: %s", p.DNS64Upstream.Address(), err)
+	mappedReply, mappedU, mappedErr := p.checkDNS64(req, nil, upstreams)
+	if mappedErr != nil {
+		return nil, mappedU, mappedErr
+	}
+
+	return mappedReply, mappedU, nil
+}
+
 // createModifiedARequest returns modified question to make A DNS request
 func createModifiedARequest(d *dns.Msg) (*dns.Msg, error) {
 	if d.Question[0].Qtype != dns.TypeAAAA {
@@ -70,6 +107,7 @@ func (p *Proxy) createDNS64MappedResponse(newAResp, oldAAAAResp *dns.Msg) (*dns.
 		return nil, fmt.Errorf("no ipv4 answer")
 	}
 
+	prefix := p.dns64Prefix()
 	oldAAAAResp.Answer = []dns.RR{}
 	// add NAT 64 prefix for each ipv4 answer
 	for _, ans := range newAResp.Answer {
@@ -82,8 +120,8 @@ func (p *Proxy) createDNS64MappedResponse(newAResp, oldAAAAResp *dns.Msg) (*dns.
 		mappedAddress := make(net.IP, net.IPv6len)
 
 		// add NAT 64 prefix and append ipv4 record
-		copy(mappedAddress, p.nat64Prefix)
-		for index, b := range i.A {
+		copy(mappedAddress, prefix)
+		for index, b := range i.A.To4() {
 			mappedAddress[12+index] = b
 		}
 
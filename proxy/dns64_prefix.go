@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// nat64WellKnownName is the name used to discover the NAT64 prefix, see
+// RFC 7050.
+const nat64WellKnownName = "ipv4only.arpa."
+
+// nat64WellKnownIPs are the IPv4 addresses of nat64WellKnownName.
+var nat64WellKnownIPs = []net.IP{{192, 0, 0, 170}, {192, 0, 0, 171}}
+
+// defaultNAT64DiscoveryTimeout is the default deadline of the NAT64 prefix
+// discovery.
+const defaultNAT64DiscoveryTimeout = 5 * time.Second
+
+// NAT64DiscoveryOptions are the options of DiscoverNAT64Prefix.
+type NAT64DiscoveryOptions struct {
+	// Timeout is the deadline for the whole discovery.  If zero, 5 seconds
+	// is used.
+	Timeout time.Duration
+	// Concurrency is the maximum number of the servers queried at the same
+	// time.  If zero, all the servers are queried at once.
+	Concurrency int
+}
+
+// DiscoverNAT64Prefix queries the DNS64 servers for ipv4only.arpa in parallel
+// and returns the first valid 12-byte NAT64 prefix received.  The rest of the
+// queries are cancelled then.  servers are the addresses of plain DNS servers
+// with optional ports.
+func DiscoverNAT64Prefix(servers []string, opts NAT64DiscoveryOptions) (prefix []byte, err error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no DNS64 servers specified")
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = defaultNAT64DiscoveryTimeout
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 || concurrency > len(servers) {
+		concurrency = len(servers)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	sema := make(chan struct{}, concurrency)
+	results := make(chan []byte, len(servers))
+	for _, s := range servers {
+		go func(addr string) {
+			select {
+			case sema <- struct{}{}:
+				defer func() { <-sema }()
+			case <-ctx.Done():
+				results <- nil
+
+				return
+			}
+
+			pref, qErr := queryNAT64Prefix(ctx, addr)
+			// Don't report the queries cancelled after the discovery is
+			// over.
+			if qErr != nil && ctx.Err() == nil {
+				log.Debug("couldn't get NAT64 prefix from %s: %s", addr, qErr)
+			}
+			results <- pref
+		}(s)
+	}
+
+	for range servers {
+		select {
+		case pref := <-results:
+			if pref != nil {
+				return pref, nil
+			}
+		case <-ctx.Done():
+			return nil, fmt.Errorf("no DNS64 server responded with a valid prefix in %s", timeout)
+		}
+	}
+
+	return nil, fmt.Errorf("no DNS64 server responded with a valid prefix")
+}
+
+// queryNAT64Prefix returns the NAT64 prefix from the DNS64 server at addr.
+func queryNAT64Prefix(ctx context.Context, addr string) (prefix []byte, err error) {
+	if _, _, err = net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+
+	req := &dns.Msg{}
+	req.Id = dns.Id()
+	req.RecursionDesired = true
+	req.SetQuestion(nat64WellKnownName, dns.TypeAAAA)
+
+	resp, _, err := (&dns.Client{}).ExchangeContext(ctx, req, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rr := range resp.Answer {
+		aaaa, ok := rr.(*dns.AAAA)
+		if !ok || len(aaaa.AAAA) != net.IPv6len {
+			continue
+		}
+
+		for _, ip := range nat64WellKnownIPs {
+			if aaaa.AAAA[12:].Equal(ip) {
+				return aaaa.AAAA[:12], nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no valid NAT64 prefix in the response")
+}
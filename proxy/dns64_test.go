@@ -4,8 +4,11 @@ import (
 	"net"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 )
 
 const ipv4OnlyHost = "and.ru"
@@ -151,3 +154,219 @@ func createTestDNSContext(host string) *DNSContext {
 	d.Req = createAAAATestMessage(host)
 	return &d
 }
+
+func TestStaticV6Prefix(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.StaticV6Prefix = net.ParseIP("64:ff9b::")
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&hostsUpstream{
+		hosts: map[string]net.IP{
+			"ipv4only.example": {192, 0, 2, 1},
+		},
+	}}
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	d := &DNSContext{
+		Req:  (&dns.Msg{}).SetQuestion("ipv4only.example.", dns.TypeAAAA),
+		Addr: &net.TCPAddr{IP: net.IP{127, 0, 0, 1}},
+	}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	if !assert.NotNil(t, d.Res) || !assert.Len(t, d.Res.Answer, 1) {
+		return
+	}
+
+	aaaa, ok := d.Res.Answer[0].(*dns.AAAA)
+	if assert.True(t, ok) {
+		assert.Equal(t, "ipv4only.example.", aaaa.Hdr.Name)
+		assert.True(t, aaaa.AAAA.Equal(net.ParseIP("64:ff9b::c000:201")))
+	}
+
+	// Unknown hosts are answered with NXDOMAIN and aren't synthesized.
+	d = &DNSContext{
+		Req:  (&dns.Msg{}).SetQuestion("unknown.example.", dns.TypeAAAA),
+		Addr: &net.TCPAddr{IP: net.IP{127, 0, 0, 1}},
+	}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	if assert.NotNil(t, d.Res) {
+		assert.Equal(t, dns.RcodeNameError, d.Res.Rcode)
+		assert.Empty(t, d.Res.Answer)
+	}
+}
+
+func TestDNS64Upstream(t *testing.T) {
+	dns64Upstream := &fixedAnswerUpstream{answer: []string{"ipv4only.example. 60 IN AAAA 64:ff9b::c000:2aa"}}
+	failingUpstream := &fastUpstream{addr: "dns64", fail: true}
+
+	testCases := []struct {
+		name     string
+		upstream upstream.Upstream
+		prefix   []byte
+		want     net.IP
+	}{{
+		name:     "dns64_upstream",
+		upstream: dns64Upstream,
+		prefix:   prefix,
+		want:     net.ParseIP("64:ff9b::c000:2aa"),
+	}, {
+		name:     "local_synthesis",
+		upstream: failingUpstream,
+		prefix:   prefix,
+		want:     net.ParseIP("2001:67c:27e4:1064::c000:201"),
+	}, {
+		name:     "no_prefix",
+		upstream: failingUpstream,
+		prefix:   nil,
+		want:     nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dnsProxy := createTestProxy(t, nil)
+			dnsProxy.nat64Prefix = tc.prefix
+			dnsProxy.DNS64Upstream = tc.upstream
+			dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&hostsUpstream{
+				hosts: map[string]net.IP{
+					"ipv4only.example": {192, 0, 2, 1},
+				},
+			}}
+			err := dnsProxy.Init()
+			assert.Nil(t, err)
+
+			d := &DNSContext{
+				Req:  (&dns.Msg{}).SetQuestion("ipv4only.example.", dns.TypeAAAA),
+				Addr: &net.TCPAddr{IP: net.IP{127, 0, 0, 1}},
+			}
+			err = dnsProxy.Resolve(d)
+			if tc.want == nil {
+				assert.NotNil(t, err)
+
+				return
+			}
+
+			assert.Nil(t, err)
+			if !assert.NotNil(t, d.Res) || !assert.Len(t, d.Res.Answer, 1) {
+				return
+			}
+
+			aaaa, ok := d.Res.Answer[0].(*dns.AAAA)
+			if assert.True(t, ok) {
+				assert.True(t, aaaa.AAAA.Equal(tc.want), aaaa.AAAA.String())
+			}
+		})
+	}
+}
+
+func TestDNS64UpstreamReserved(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.nat64Prefix = prefix
+	dnsProxy.DNS64Upstream = &fastUpstream{addr: "dns64", fail: true}
+	dnsProxy.UpstreamConfig.DomainReservedUpstreams = map[string][]upstream.Upstream{
+		"internal.lan.": {&fixedAnswerUpstream{answer: []string{"host.internal.lan. 60 IN AAAA 2001:db8::1"}}},
+	}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	// The domain-specific upstreams are used instead of DNS64Upstream.
+	d := &DNSContext{
+		Req:  (&dns.Msg{}).SetQuestion("host.internal.lan.", dns.TypeAAAA),
+		Addr: &net.TCPAddr{IP: net.IP{127, 0, 0, 1}},
+	}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	if assert.NotNil(t, d.Res) && assert.Len(t, d.Res.Answer, 1) {
+		aaaa, ok := d.Res.Answer[0].(*dns.AAAA)
+		if assert.True(t, ok) {
+			assert.True(t, aaaa.AAAA.Equal(net.ParseIP("2001:db8::1")), aaaa.AAAA.String())
+		}
+	}
+}
+
+func TestStaticV6PrefixValidation(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.StaticV6Prefix = net.IP{192, 0, 2, 0}
+
+	assert.NotNil(t, dnsProxy.Start())
+}
+
+// startDNS64Server starts a UDP DNS server answering ipv4only.arpa with ip4
+// mapped into prefix.
+func startDNS64Server(t *testing.T, prefix, ip4 net.IP) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+
+	srv := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, prefix)
+			copy(ip[12:], ip4)
+
+			resp := (&dns.Msg{}).SetReply(r)
+			resp.Answer = append(resp.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
+				AAAA: ip,
+			})
+			_ = w.WriteMsg(resp)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	return conn.LocalAddr().String()
+}
+
+// startSilentServer starts a UDP server that never responds.
+func startSilentServer(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn.LocalAddr().String()
+}
+
+func TestDiscoverNAT64Prefix(t *testing.T) {
+	wantPrefix := net.ParseIP("64:ff9b::")[:12]
+	good := startDNS64Server(t, wantPrefix, net.IP{192, 0, 0, 170})
+
+	start := time.Now()
+	pref, err := DiscoverNAT64Prefix([]string{
+		startSilentServer(t),
+		good,
+		startSilentServer(t),
+	}, NAT64DiscoveryOptions{Timeout: 2 * time.Second})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(wantPrefix), pref)
+	// The silent servers aren't waited for
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	// The invalid prefix is skipped even if only one query is allowed at a
+	// time
+	bad := startDNS64Server(t, net.ParseIP("2001:db8::")[:12], net.IP{10, 0, 0, 1})
+	pref, err = DiscoverNAT64Prefix([]string{bad, good}, NAT64DiscoveryOptions{
+		Timeout:     2 * time.Second,
+		Concurrency: 1,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(wantPrefix), pref)
+
+	// None of the servers respond in time
+	start = time.Now()
+	_, err = DiscoverNAT64Prefix([]string{
+		startSilentServer(t),
+		startSilentServer(t),
+	}, NAT64DiscoveryOptions{Timeout: 200 * time.Millisecond})
+	assert.NotNil(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
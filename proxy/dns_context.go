@@ -21,6 +21,10 @@ type DNSContext struct {
 	StartTime time.Time         // processing start time
 	Upstream  upstream.Upstream // upstream that resolved DNS request
 
+	// RequestID is the ID of the request unique within the proxy.  It's
+	// included in the log lines about the request to correlate them.
+	RequestID uint64
+
 	// CustomUpstreamConfig -- custom upstream servers configuration
 	// to use for this request only.
 	// If set, Resolve() uses it instead of default servers
@@ -85,6 +89,56 @@ func (ctx *DNSContext) calcFlagsAndSize() {
 	ctx.udpSize = defaultUDPBufSize
 }
 
+// ednsOptionEDE is the code of the Extended DNS Error EDNS0 option, see
+// RFC 8914.
+const ednsOptionEDE = 15
+
+// ednsOptionZoneVersion is the code of the ZONEVERSION EDNS0 option, see
+// RFC 9660.
+const ednsOptionZoneVersion = 19
+
+// setResponseOPT replaces the OPT record of d.Res with the one built from the
+// EDNS0 parameters of the client's request, so that the options added by the
+// upstream, like ECS or padding, don't reach the client.  Only the Extended
+// DNS Error options are kept, and the ZONEVERSION ones if the client has
+// requested them.  The responses from cache have no ZONEVERSION options since
+// the cached zone version may be stale.
+func (ctx *DNSContext) setResponseOPT() {
+	if ctx.Res == nil || ctx.Req == nil {
+		return
+	}
+
+	ctx.calcFlagsAndSize()
+
+	zoneVersion := len(ednsOptions(ctx.Req, ednsOptionZoneVersion)) != 0
+	var kept []dns.EDNS0
+	extra := make([]dns.RR, 0, len(ctx.Res.Extra))
+	for _, rr := range ctx.Res.Extra {
+		opt, ok := rr.(*dns.OPT)
+		if !ok {
+			extra = append(extra, rr)
+
+			continue
+		}
+
+		for _, o := range opt.Option {
+			code := o.Option()
+			if code == ednsOptionEDE || (zoneVersion && code == ednsOptionZoneVersion) {
+				kept = append(kept, o)
+			}
+		}
+	}
+	ctx.Res.Extra = extra
+
+	// The extended rcodes can't be encoded without the OPT record.
+	if !ctx.hasEDNS0 && ctx.Res.Rcode <= 0xF {
+		return
+	}
+
+	ctx.Res.SetEdns0(ctx.udpSize, ctx.doBit)
+	ctx.Res.IsEdns0().Option = kept
+}
+
 // scrub - prepares the d.Res to be written (truncates if necessary)
 func (ctx *DNSContext) scrub() {
 	if ctx.Res == nil || ctx.Req == nil {
@@ -98,6 +152,9 @@ func (ctx *DNSContext) scrub() {
 	// RRs, and also all DNSSEC RRs otherwise.
 	filterMsg(ctx.Res, ctx.Res, ctx.adBit, ctx.doBit, 0)
 
+	// The RD bit is copied from the request into the response, see RFC 1035.
+	ctx.Res.RecursionDesired = ctx.Req.RecursionDesired
+
 	// RFC-6891 (https://tools.ietf.org/html/rfc6891) states that response
 	// mustn't contain an EDNS0 RR if the request doesn't include it.
 	//
@@ -107,5 +164,21 @@ func (ctx *DNSContext) scrub() {
 	}
 
 	ctx.Res.Truncate(proxyutil.DNSSize(ctx.Proto, ctx.Req))
+	if isStreamProto(ctx.Proto) {
+		// There is no message size limit for these protocols so the
+		// response should never be marked as truncated.
+		ctx.Res.Truncated = false
+	}
 	ctx.Res.Compress = true // some devices require DNS message compression
 }
+
+// isStreamProto returns true if proto has no DNS message size limit, so that
+// the responses mustn't be truncated.
+func isStreamProto(proto string) bool {
+	switch proto {
+	case ProtoTCP, ProtoTLS, ProtoHTTPS, ProtoQUIC:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,488 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// DNSTap is implemented without any third-party libraries since the format is
+// rather simple: each message is a protobuf-encoded Dnstap structure (see
+// https://github.com/dnstap/dnstap.pb/blob/master/dnstap.proto) written as a
+// data frame of a bidirectional Frame Streams connection (see
+// https://farsightsec.github.io/fstrm/).
+
+// dnstapContentType is the Frame Streams content type of DNSTap messages.
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// Frame Streams control frame types.
+const (
+	fstrmControlAccept = 0x01
+	fstrmControlStart  = 0x02
+	fstrmControlStop   = 0x03
+	fstrmControlReady  = 0x04
+	fstrmControlFinish = 0x05
+
+	// fstrmFieldContentType is the only control field type.
+	fstrmFieldContentType = 0x01
+
+	// fstrmMaxControlFrameSize is the maximum size of a control frame we're
+	// ready to accept.
+	fstrmMaxControlFrameSize = 512
+)
+
+// dnstapMessageType is the type of a DNSTap message.
+type dnstapMessageType uint64
+
+// DNSTap message types that the proxy writes.
+const (
+	dnstapResolverQuery    dnstapMessageType = 3
+	dnstapResolverResponse dnstapMessageType = 4
+	dnstapClientQuery      dnstapMessageType = 5
+	dnstapClientResponse   dnstapMessageType = 6
+)
+
+// DNSTap socket families.
+const (
+	dnstapFamilyINET  = 1
+	dnstapFamilyINET6 = 2
+)
+
+// DNSTap socket protocols.
+const (
+	dnstapProtoUDP         = 1
+	dnstapProtoTCP         = 2
+	dnstapProtoDOT         = 3
+	dnstapProtoDOH         = 4
+	dnstapProtoDNSCryptUDP = 5
+	dnstapProtoDNSCryptTCP = 6
+	dnstapProtoDOQ         = 7
+)
+
+// Field numbers of the Dnstap and Message protobuf structures.
+const (
+	dnstapFieldMessage = 14
+	dnstapFieldType    = 15
+
+	dnstapMsgFieldType             = 1
+	dnstapMsgFieldSocketFamily     = 2
+	dnstapMsgFieldSocketProtocol   = 3
+	dnstapMsgFieldQueryAddress     = 4
+	dnstapMsgFieldResponseAddress  = 5
+	dnstapMsgFieldQueryPort        = 6
+	dnstapMsgFieldResponsePort     = 7
+	dnstapMsgFieldQueryTimeSec     = 8
+	dnstapMsgFieldQueryTimeNsec    = 9
+	dnstapMsgFieldQueryMessage     = 10
+	dnstapMsgFieldResponseTimeSec  = 12
+	dnstapMsgFieldResponseTimeNsec = 13
+	dnstapMsgFieldResponseMessage  = 14
+)
+
+// dnstapTypeMessage is the only type of the Dnstap structure.
+const dnstapTypeMessage = 1
+
+// dnstapQueueSize is the number of messages that may wait to be written.
+// Messages are dropped when the queue is full so that logging never blocks
+// resolving.
+const dnstapQueueSize = 1024
+
+// dnstapReconnectTimeout is the time to wait before trying to reconnect to the
+// DNSTap collector after a failure.
+const dnstapReconnectTimeout = time.Second
+
+// dnstapMessage contains the data of a single DNSTap message.
+type dnstapMessage struct {
+	typ          dnstapMessageType
+	proto        uint64
+	queryAddr    net.Addr
+	responseAddr net.Addr
+	queryTime    time.Time
+	responseTime time.Time
+	query        *dns.Msg
+	response     *dns.Msg
+}
+
+// appendVarint appends the protobuf varint encoding of v to b.
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+
+	return append(b, byte(v))
+}
+
+// appendVarintField appends a protobuf varint field to b.
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = appendVarint(b, uint64(field)<<3)
+
+	return appendVarint(b, v)
+}
+
+// appendFixed32Field appends a protobuf fixed32 field to b.
+func appendFixed32Field(b []byte, field int, v uint32) []byte {
+	b = appendVarint(b, uint64(field)<<3|5)
+
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// appendBytesField appends a protobuf length-delimited field to b.
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendVarint(b, uint64(field)<<3|2)
+	b = appendVarint(b, uint64(len(v)))
+
+	return append(b, v...)
+}
+
+// appendAddr appends the address and the port of addr to b.  It also returns
+// the socket family of the address or zero if addr is not an IP address.
+func appendAddr(b []byte, addrField, portField int, addr net.Addr) ([]byte, uint64) {
+	var ip net.IP
+	var port int
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+	default:
+		return b, 0
+	}
+
+	family := uint64(dnstapFamilyINET6)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		family = dnstapFamilyINET
+	}
+
+	b = appendBytesField(b, addrField, ip)
+	b = appendVarintField(b, portField, uint64(port))
+
+	return b, family
+}
+
+// marshal returns the protobuf encoding of the Dnstap structure containing m.
+func (m *dnstapMessage) marshal() ([]byte, error) {
+	msg := appendVarintField(nil, dnstapMsgFieldType, uint64(m.typ))
+
+	var family, f uint64
+	msg, family = appendAddr(msg, dnstapMsgFieldQueryAddress, dnstapMsgFieldQueryPort, m.queryAddr)
+	msg, f = appendAddr(msg, dnstapMsgFieldResponseAddress, dnstapMsgFieldResponsePort, m.responseAddr)
+	if family == 0 {
+		family = f
+	}
+	if family != 0 {
+		msg = appendVarintField(msg, dnstapMsgFieldSocketFamily, family)
+	}
+	if m.proto != 0 {
+		msg = appendVarintField(msg, dnstapMsgFieldSocketProtocol, m.proto)
+	}
+
+	if !m.queryTime.IsZero() {
+		msg = appendVarintField(msg, dnstapMsgFieldQueryTimeSec, uint64(m.queryTime.Unix()))
+		msg = appendFixed32Field(msg, dnstapMsgFieldQueryTimeNsec, uint32(m.queryTime.Nanosecond()))
+	}
+
+	if m.query != nil {
+		packed, err := m.query.Pack()
+		if err != nil {
+			return nil, fmt.Errorf("packing query: %w", err)
+		}
+		msg = appendBytesField(msg, dnstapMsgFieldQueryMessage, packed)
+	}
+
+	if !m.responseTime.IsZero() {
+		msg = appendVarintField(msg, dnstapMsgFieldResponseTimeSec, uint64(m.responseTime.Unix()))
+		msg = appendFixed32Field(msg, dnstapMsgFieldResponseTimeNsec, uint32(m.responseTime.Nanosecond()))
+	}
+
+	if m.response != nil {
+		packed, err := m.response.Pack()
+		if err != nil {
+			return nil, fmt.Errorf("packing response: %w", err)
+		}
+		msg = appendBytesField(msg, dnstapMsgFieldResponseMessage, packed)
+	}
+
+	b := appendVarintField(nil, dnstapFieldType, dnstapTypeMessage)
+
+	return appendBytesField(b, dnstapFieldMessage, msg), nil
+}
+
+// writeControlFrame writes a Frame Streams control frame of type typ to w.
+// The content type field is written if withContentType is true.
+func writeControlFrame(w io.Writer, typ uint32, withContentType bool) error {
+	var fields []byte
+	if withContentType {
+		fields = make([]byte, 8+len(dnstapContentType))
+		binary.BigEndian.PutUint32(fields, fstrmFieldContentType)
+		binary.BigEndian.PutUint32(fields[4:], uint32(len(dnstapContentType)))
+		copy(fields[8:], dnstapContentType)
+	}
+
+	b := make([]byte, 12, 12+len(fields))
+	// The first four zero bytes are the escape sequence.
+	binary.BigEndian.PutUint32(b[4:], uint32(4+len(fields)))
+	binary.BigEndian.PutUint32(b[8:], typ)
+	b = append(b, fields...)
+
+	_, err := w.Write(b)
+
+	return err
+}
+
+// readControlFrame reads a Frame Streams control frame from r and returns its
+// type.
+func readControlFrame(r io.Reader) (typ uint32, err error) {
+	hdr := make([]byte, 8)
+	_, err = io.ReadFull(r, hdr)
+	if err != nil {
+		return 0, err
+	}
+
+	if binary.BigEndian.Uint32(hdr) != 0 {
+		return 0, errors.New("data frame received instead of a control frame")
+	}
+
+	l := binary.BigEndian.Uint32(hdr[4:])
+	if l < 4 || l > fstrmMaxControlFrameSize {
+		return 0, fmt.Errorf("bad control frame length: %d", l)
+	}
+
+	frame := make([]byte, l)
+	_, err = io.ReadFull(r, frame)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint32(frame), nil
+}
+
+// writeDataFrame writes a Frame Streams data frame containing b to w.
+func writeDataFrame(w io.Writer, b []byte) error {
+	frame := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	copy(frame[4:], b)
+
+	_, err := w.Write(frame)
+
+	return err
+}
+
+// dnstapWriter asynchronously writes DNSTap messages to a collector.
+type dnstapWriter struct {
+	network string
+	address string
+
+	async *asyncWriter
+}
+
+// newDNSTapWriter creates a new dnstapWriter and starts its writing loop.
+func newDNSTapWriter(network, address string) (w *dnstapWriter) {
+	w = &dnstapWriter{
+		network: network,
+		address: address,
+	}
+	w.async = newAsyncWriter(dnstapQueueSize, w.loop)
+
+	return w
+}
+
+// write schedules m to be written.  It never blocks and drops the message if
+// the queue is full or the writer is closed.
+func (w *dnstapWriter) write(m *dnstapMessage) {
+	b, err := m.marshal()
+	if err != nil {
+		log.Debug("dnstap: %s", err)
+
+		return
+	}
+
+	if !w.async.write(b) {
+		log.Debug("dnstap: queue is full or closed, dropping the message")
+	}
+}
+
+// close flushes the queued messages and closes the connection.
+func (w *dnstapWriter) close() {
+	w.async.close()
+}
+
+// connect establishes a Frame Streams connection to the collector.
+func (w *dnstapWriter) connect() (conn net.Conn, err error) {
+	conn, err = net.DialTimeout(w.network, w.address, defaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(defaultTimeout))
+
+	err = writeControlFrame(conn, fstrmControlReady, true)
+	if err == nil {
+		var typ uint32
+		typ, err = readControlFrame(conn)
+		if err == nil && typ != fstrmControlAccept {
+			err = fmt.Errorf("unexpected control frame type: %d", typ)
+		}
+	}
+	if err == nil {
+		err = writeControlFrame(conn, fstrmControlStart, true)
+	}
+	if err != nil {
+		_ = conn.Close()
+
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// disconnect gracefully finishes the Frame Streams connection.
+func (w *dnstapWriter) disconnect(conn net.Conn) {
+	_ = conn.SetDeadline(time.Now().Add(defaultTimeout))
+	if writeControlFrame(conn, fstrmControlStop, false) == nil {
+		_, _ = readControlFrame(conn)
+	}
+
+	_ = conn.Close()
+}
+
+// loop writes the queued messages until the queue is closed.
+func (w *dnstapWriter) loop(queue <-chan []byte) {
+	var conn net.Conn
+	var lastFailure time.Time
+	for b := range queue {
+		if conn == nil {
+			if time.Since(lastFailure) < dnstapReconnectTimeout {
+				continue
+			}
+
+			var err error
+			conn, err = w.connect()
+			if err != nil {
+				log.Debug("dnstap: connecting to %s://%s: %s", w.network, w.address, err)
+				lastFailure = time.Now()
+
+				continue
+			}
+		}
+
+		err := writeDataFrame(conn, b)
+		if err != nil {
+			log.Debug("dnstap: writing to %s://%s: %s", w.network, w.address, err)
+			_ = conn.Close()
+			conn = nil
+			lastFailure = time.Now()
+		}
+	}
+
+	if conn != nil {
+		w.disconnect(conn)
+	}
+}
+
+// dnstapProto returns the DNSTap socket protocol for the request context.
+func dnstapProto(d *DNSContext) uint64 {
+	switch d.Proto {
+	case ProtoUDP:
+		return dnstapProtoUDP
+	case ProtoTCP:
+		return dnstapProtoTCP
+	case ProtoTLS:
+		return dnstapProtoDOT
+	case ProtoHTTPS:
+		return dnstapProtoDOH
+	case ProtoQUIC:
+		return dnstapProtoDOQ
+	case ProtoDNSCrypt:
+		if _, ok := d.Addr.(*net.TCPAddr); ok {
+			return dnstapProtoDNSCryptTCP
+		}
+
+		return dnstapProtoDNSCryptUDP
+	default:
+		return 0
+	}
+}
+
+// dnstapClientQuery writes the CLIENT_QUERY message for d if DNSTap is
+// enabled.
+func (p *Proxy) dnstapClientQuery(d *DNSContext) {
+	if p.dnstap == nil {
+		return
+	}
+
+	p.dnstap.write(&dnstapMessage{
+		typ:       dnstapClientQuery,
+		proto:     dnstapProto(d),
+		queryAddr: d.Addr,
+		queryTime: d.StartTime,
+		query:     d.Req,
+	})
+}
+
+// dnstapClientResponse writes the CLIENT_RESPONSE message for d if DNSTap is
+// enabled.
+func (p *Proxy) dnstapClientResponse(d *DNSContext) {
+	if p.dnstap == nil {
+		return
+	}
+
+	p.dnstap.write(&dnstapMessage{
+		typ:          dnstapClientResponse,
+		proto:        dnstapProto(d),
+		queryAddr:    d.Addr,
+		queryTime:    d.StartTime,
+		responseTime: time.Now(),
+		query:        d.Req,
+		response:     d.Res,
+	})
+}
+
+// dnstapResolverExchange writes the RESOLVER_QUERY and RESOLVER_RESPONSE
+// messages for the upstream exchange if DNSTap is enabled and configured to
+// write them.  upsAddr is the address of the upstream, it's only written if it
+// is a plain host:port pair.
+func (p *Proxy) dnstapResolverExchange(req, reply *dns.Msg, upsAddr string, start time.Time) {
+	if p.dnstap == nil || !p.DNSTapResolverMessages {
+		return
+	}
+
+	var addr net.Addr
+	if host, port, err := net.SplitHostPort(upsAddr); err == nil {
+		ip := net.ParseIP(host)
+		portNum, perr := strconv.Atoi(port)
+		if ip != nil && perr == nil {
+			addr = &net.UDPAddr{IP: ip, Port: portNum}
+		}
+	}
+
+	p.dnstap.write(&dnstapMessage{
+		typ:          dnstapResolverQuery,
+		responseAddr: addr,
+		queryTime:    start,
+		query:        req,
+	})
+
+	if reply == nil {
+		return
+	}
+
+	p.dnstap.write(&dnstapMessage{
+		typ:          dnstapResolverResponse,
+		responseAddr: addr,
+		queryTime:    start,
+		responseTime: time.Now(),
+		query:        req,
+		response:     reply,
+	})
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// readProtoFields decodes the top-level fields of a protobuf message.  Varint
+// and fixed32 values are returned as uint64, length-delimited ones as []byte.
+func readProtoFields(t *testing.T, b []byte) map[int]interface{} {
+	fields := map[int]interface{}{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad field key")
+		}
+		b = b[n:]
+
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("bad varint in field %d", field)
+			}
+			fields[field] = v
+			b = b[n:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				t.Fatalf("bad length in field %d", field)
+			}
+			fields[field] = b[n : n+int(l)]
+			b = b[n+int(l):]
+		case 5:
+			fields[field] = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			t.Fatalf("unexpected wire type in field %d", field)
+		}
+	}
+
+	return fields
+}
+
+// readFrame reads a single Frame Streams data frame from r.  If a control
+// frame is read, the returned frame is empty.
+func readFrame(r io.Reader) ([]byte, error) {
+	hdr := make([]byte, 4)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := binary.BigEndian.Uint32(hdr)
+	if l == 0 {
+		_, err = io.ReadFull(r, hdr)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = io.ReadFull(r, make([]byte, binary.BigEndian.Uint32(hdr)))
+
+		return nil, err
+	}
+
+	frame := make([]byte, l)
+	_, err = io.ReadFull(r, frame)
+
+	return frame, err
+}
+
+func TestDNSTap(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "dnstap.sock")
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer l.Close()
+
+	frames := make(chan []byte, 10)
+	go func() {
+		conn, lerr := l.Accept()
+		if lerr != nil {
+			return
+		}
+		defer conn.Close()
+
+		typ, rerr := readControlFrame(conn)
+		if rerr != nil || typ != fstrmControlReady {
+			return
+		}
+		if writeControlFrame(conn, fstrmControlAccept, true) != nil {
+			return
+		}
+		typ, rerr = readControlFrame(conn)
+		if rerr != nil || typ != fstrmControlStart {
+			return
+		}
+
+		for {
+			frame, ferr := readFrame(conn)
+			if ferr != nil {
+				return
+			}
+
+			if len(frame) == 0 {
+				// An escape sequence, so it's the STOP control frame.
+				_ = writeControlFrame(conn, fstrmControlFinish, false)
+
+				return
+			}
+
+			frames <- frame
+		}
+	}()
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.DNSTapEnabled = true
+	dnsProxy.DNSTapNetwork = "unix"
+	dnsProxy.DNSTapAddress = sockPath
+	u := &testUpstream{aResp: &dns.A{
+		Hdr: dns.RR_Header{Name: "google-public-dns-a.google.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IP{8, 8, 8, 8},
+	}}
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+
+	err = dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer dnsProxy.Stop()
+
+	conn, err := dns.Dial("udp", dnsProxy.Addr(ProtoUDP).String())
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err)
+	}
+	defer conn.Close()
+
+	req := createTestMessage()
+	err = conn.WriteMsg(req)
+	assert.Nil(t, err)
+	_, err = conn.ReadMsg()
+	assert.Nil(t, err)
+
+	var frame []byte
+	select {
+	case frame = <-frames:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no DNSTap frames received")
+	}
+
+	tap := readProtoFields(t, frame)
+	assert.Equal(t, uint64(dnstapTypeMessage), tap[dnstapFieldType])
+
+	msgData, ok := tap[dnstapFieldMessage].([]byte)
+	if !ok {
+		t.Fatalf("no message in the DNSTap frame")
+	}
+
+	msg := readProtoFields(t, msgData)
+	assert.Equal(t, uint64(dnstapClientQuery), msg[dnstapMsgFieldType])
+	assert.Equal(t, uint64(dnstapProtoUDP), msg[dnstapMsgFieldSocketProtocol])
+	assert.Equal(t, uint64(dnstapFamilyINET), msg[dnstapMsgFieldSocketFamily])
+	assert.Equal(t, []byte(net.ParseIP(listenIP).To4()), msg[dnstapMsgFieldQueryAddress])
+
+	packed, ok := msg[dnstapMsgFieldQueryMessage].([]byte)
+	if !ok {
+		t.Fatalf("no query message in the DNSTap frame")
+	}
+
+	query := &dns.Msg{}
+	err = query.Unpack(packed)
+	assert.Nil(t, err)
+	assert.Equal(t, req.Id, query.Id)
+	assert.Equal(t, req.Question, query.Question)
+}
+
+func TestDNSTapWriter_closed(t *testing.T) {
+	w := newDNSTapWriter("unix", filepath.Join(t.TempDir(), "dnstap.sock"))
+	w.close()
+
+	// The handlers may outlive the writer, so writing to the closed one
+	// must not panic.
+	w.write(&dnstapMessage{typ: dnstapClientQuery, query: createTestMessage()})
+	w.close()
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// beginRequest registers a request in progress.  It returns false if the
+// proxy is stopping and the request should be refused.
+func (p *Proxy) beginRequest() (ok bool) {
+	if p.StopDrainTimeout == 0 {
+		return true
+	}
+
+	p.drainLock.Lock()
+	defer p.drainLock.Unlock()
+
+	if p.draining {
+		return false
+	}
+	p.requestsInFlight++
+
+	return true
+}
+
+// endRequest unregisters the request registered by beginRequest.
+func (p *Proxy) endRequest() {
+	if p.StopDrainTimeout == 0 {
+		return
+	}
+
+	p.drainLock.Lock()
+	defer p.drainLock.Unlock()
+
+	p.requestsInFlight--
+	if p.draining && p.requestsInFlight == 0 && p.drained != nil {
+		close(p.drained)
+		p.drained = nil
+	}
+}
+
+// drain makes the proxy refuse the new requests and waits up to
+// StopDrainTimeout for the ones in progress to finish.
+func (p *Proxy) drain() {
+	if p.StopDrainTimeout == 0 {
+		return
+	}
+
+	p.drainLock.Lock()
+	p.draining = true
+	drained := make(chan struct{})
+	if p.requestsInFlight == 0 {
+		close(drained)
+	} else {
+		p.drained = drained
+	}
+	p.drainLock.Unlock()
+
+	timer := time.NewTimer(p.StopDrainTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-drained:
+	case <-timer.C:
+		log.Info("Stopping with the requests still in progress after %s", p.StopDrainTimeout)
+	}
+}
+
+// resetDrain makes the proxy accept the requests again after it has been
+// stopped.
+func (p *Proxy) resetDrain() {
+	p.drainLock.Lock()
+	defer p.drainLock.Unlock()
+
+	p.draining = false
+	p.drained = nil
+}
+
+// genShutdownRefused returns the response refusing req since the proxy is
+// stopping.
+func (p *Proxy) genShutdownRefused(req *dns.Msg) (resp *dns.Msg) {
+	resp = p.genRefused(req)
+	resp.SetEdns0(dns.DefaultMsgSize, false)
+	addEDE(resp, edeOther, "server shutting down")
+
+	return resp
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStopDrain(t *testing.T) {
+	u := &blockingUpstream{release: make(chan struct{})}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	dnsProxy.StopDrainTimeout = 5 * time.Second
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+
+	addr := dnsProxy.Addr(ProtoUDP).String()
+	client := &dns.Client{Net: "udp", Timeout: 5 * time.Second}
+
+	type result struct {
+		reply *dns.Msg
+		err   error
+	}
+	inFlight := make(chan result, 1)
+	go func() {
+		reply, _, rErr := client.Exchange(createHostTestMessage("inflight.example"), addr)
+		inFlight <- result{reply: reply, err: rErr}
+	}()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadUint32(&u.calls) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- dnsProxy.Stop() }()
+	assert.Eventually(t, func() bool {
+		dnsProxy.drainLock.Lock()
+		defer dnsProxy.drainLock.Unlock()
+
+		return dnsProxy.draining
+	}, time.Second, 10*time.Millisecond)
+
+	// The new request is refused right away.
+	req := createHostTestMessage("new.example")
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	reply, _, err := client.Exchange(req, addr)
+	if assert.Nil(t, err) {
+		assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+		if opt := reply.IsEdns0(); assert.NotNil(t, opt) && assert.Len(t, opt.Option, 1) {
+			assert.Equal(t, uint16(ednsOptionEDE), opt.Option[0].Option())
+			assert.Equal(t, "\x00\x00server shutting down", string(opt.Option[0].(*dns.EDNS0_LOCAL).Data))
+		}
+	}
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&u.calls))
+
+	// The request in progress is completed before the listeners are
+	// closed.
+	close(u.release)
+	res := <-inFlight
+	if assert.Nil(t, res.err) && assert.Len(t, res.reply.Answer, 1) {
+		assert.Equal(t, dns.RcodeSuccess, res.reply.Rcode)
+	}
+	assert.Nil(t, <-stopped)
+}
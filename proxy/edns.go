@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+// ednsIncapableTTL is the time during which an upstream that failed to
+// process an EDNS request is queried without EDNS.
+const ednsIncapableTTL = 10 * time.Minute
+
+// noEDNSUpstream is an upstream that removes the OPT record from requests
+// before exchanging them with the underlying upstream.
+type noEDNSUpstream struct {
+	upstream.Upstream
+}
+
+// Exchange implements the upstream.Upstream interface for *noEDNSUpstream.
+func (u *noEDNSUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return u.Upstream.Exchange(withoutEDNS(m))
+}
+
+// withoutEDNS returns a copy of m without the OPT record.
+func withoutEDNS(m *dns.Msg) (c *dns.Msg) {
+	c = m.Copy()
+	c.Extra = c.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			c.Extra = append(c.Extra, dns.Copy(rr))
+		}
+	}
+
+	return c
+}
+
+// ednsOptions returns the EDNS0 options of m with code.
+func ednsOptions(m *dns.Msg, code uint16) (opts []dns.EDNS0) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if o.Option() == code {
+			opts = append(opts, o)
+		}
+	}
+
+	return opts
+}
+
+// isEDNSIncapable returns true if the upstream with the specified address
+// has recently failed to process an EDNS request.
+func (p *Proxy) isEDNSIncapable(address string) bool {
+	p.ednsIncapableLock.Lock()
+	defer p.ednsIncapableLock.Unlock()
+
+	if p.ednsIncapable == nil {
+		return false
+	}
+
+	_, found := p.ednsIncapable.Get(address)
+
+	return found
+}
+
+// setEDNSIncapable remembers that the upstream with the specified address
+// can't process EDNS requests.
+func (p *Proxy) setEDNSIncapable(address string) {
+	p.ednsIncapableLock.Lock()
+	defer p.ednsIncapableLock.Unlock()
+
+	if p.ednsIncapable == nil {
+		p.ednsIncapable = gocache.New(ednsIncapableTTL, ednsIncapableTTL)
+	}
+
+	p.ednsIncapable.Set(address, struct{}{}, ednsIncapableTTL)
+}
+
+// ednsAwareUpstreams returns upstreams with the ones known to be incapable of
+// EDNS wrapped so that they're queried without it.
+func (p *Proxy) ednsAwareUpstreams(upstreams []upstream.Upstream) []upstream.Upstream {
+	var res []upstream.Upstream
+	for i, u := range upstreams {
+		if !p.isEDNSIncapable(u.Address()) {
+			continue
+		}
+
+		if res == nil {
+			res = make([]upstream.Upstream, len(upstreams))
+			copy(res, upstreams)
+		}
+		res[i] = &noEDNSUpstream{Upstream: u}
+	}
+
+	if res == nil {
+		return upstreams
+	}
+
+	return res
+}
+
+// exchangeEDNSAware exchanges req with upstreams taking into account their
+// EDNS capabilities.  If the upstream responds with FORMERR to an EDNS
+// request, it's marked as incapable of EDNS and the request is retried
+// without it.
+func (p *Proxy) exchangeEDNSAware(req *dns.Msg, upstreams []upstream.Upstream) (reply *dns.Msg, u upstream.Upstream, err error) {
+	if req.IsEdns0() == nil {
+		return p.exchange(req, upstreams)
+	}
+
+	reply, u, err = p.exchange(req, p.ednsAwareUpstreams(upstreams))
+	if w, ok := u.(*noEDNSUpstream); ok {
+		return reply, w.Upstream, err
+	}
+
+	if err != nil || u == nil || reply.Rcode != dns.RcodeFormatError {
+		return reply, u, err
+	}
+
+	log.Debug("upstream %s failed to process an EDNS request, retrying without EDNS", u.Address())
+
+	noEDNSReply, _, noEDNSErr := p.exchange(withoutEDNS(req), []upstream.Upstream{u})
+	if noEDNSErr != nil || noEDNSReply.Rcode == dns.RcodeFormatError {
+		// The upstream is broken regardless of EDNS, return the original
+		// response.
+		return reply, u, err
+	}
+
+	p.setEDNSIncapable(u.Address())
+
+	return noEDNSReply, u, nil
+}
+
+// advertiseUDPSize sets the UDP payload size in the OPT record of d.Res to
+// AdvertisedUDPSize, if it's configured.
+func (p *Proxy) advertiseUDPSize(d *DNSContext) {
+	if p.AdvertisedUDPSize == 0 {
+		return
+	}
+
+	if opt := d.Res.IsEdns0(); opt != nil {
+		opt.SetUDPSize(p.AdvertisedUDPSize)
+	}
+}
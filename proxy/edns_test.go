@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// ednsIntolerantUpstream responds with FORMERR to any request with EDNS.
+type ednsIntolerantUpstream struct {
+	ednsRequests   uint32
+	noEDNSRequests uint32
+}
+
+func (u *ednsIntolerantUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	resp := &dns.Msg{}
+	if m.IsEdns0() != nil {
+		atomic.AddUint32(&u.ednsRequests, 1)
+
+		return resp.SetRcode(m, dns.RcodeFormatError), nil
+	}
+
+	atomic.AddUint32(&u.noEDNSRequests, 1)
+	resp.SetReply(m)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IP{1, 2, 3, 4},
+	})
+
+	return resp, nil
+}
+
+func (u *ednsIntolerantUpstream) Address() string {
+	return "edns-intolerant"
+}
+
+func TestEDNSIncapableUpstream(t *testing.T) {
+	u := &ednsIntolerantUpstream{}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+
+	// The retry is exchanged the same way as the first request.
+	var exchanged []bool
+	dnsProxy.UpstreamExchangeCallback = func(_ string, req, _ *dns.Msg, _ time.Duration, _ error) {
+		exchanged = append(exchanged, req.IsEdns0() != nil)
+	}
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer dnsProxy.Stop()
+
+	newContext := func() *DNSContext {
+		req := createHostTestMessage("host")
+		req.SetEdns0(defaultUDPBufSize, false)
+
+		return &DNSContext{
+			Proto: ProtoUDP,
+			Req:   req,
+			Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		}
+	}
+
+	// The first request fails with EDNS and is retried without it.
+	d := newContext()
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Len(t, d.Res.Answer, 1)
+	assert.NotNil(t, d.Res.IsEdns0())
+	assert.Equal(t, u, d.Upstream)
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&u.ednsRequests))
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&u.noEDNSRequests))
+	assert.True(t, dnsProxy.isEDNSIncapable(u.Address()))
+	assert.Equal(t, []bool{true, false}, exchanged)
+
+	// The capability is cached so the second request goes without EDNS
+	// right away.
+	d = newContext()
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Equal(t, u, d.Upstream)
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&u.ednsRequests))
+	assert.Equal(t, uint32(2), atomic.LoadUint32(&u.noEDNSRequests))
+}
+
+func TestAdvertisedUDPSize(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{createTestUpstream()}
+	dnsProxy.AdvertisedUDPSize = 1232
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer dnsProxy.Stop()
+
+	client := &dns.Client{Net: "udp", Timeout: defaultTimeout}
+	addr := dnsProxy.Addr(ProtoUDP).String()
+
+	req := createTestMessage()
+	req.SetEdns0(4096, false)
+	reply, _, err := client.Exchange(req, addr)
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	assertResponse(t, reply)
+	if opt := reply.IsEdns0(); assert.NotNil(t, opt) {
+		assert.Equal(t, uint16(1232), opt.UDPSize())
+	}
+
+	// The OPT record isn't added to the responses to the requests without
+	// it.
+	reply, _, err = client.Exchange(createTestMessage(), addr)
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	assertResponse(t, reply)
+	assert.Nil(t, reply.IsEdns0())
+}
+
+// zoneVersionUpstream responds with the ZONEVERSION option of the zone's SOA
+// serial and counts the requests with the ZONEVERSION option.
+type zoneVersionUpstream struct {
+	requested uint32
+}
+
+// zoneVersion is the ZONEVERSION option data of the serial 2024010101 of a
+// zone with two labels, see RFC 9660.
+var zoneVersion = []byte{2, 0, 0x78, 0xa3, 0xf1, 0x75}
+
+func (u *zoneVersionUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if o.Option() == ednsOptionZoneVersion {
+				atomic.AddUint32(&u.requested, 1)
+			}
+		}
+	}
+
+	resp, _ := createTestUpstream().Exchange(m)
+	resp.SetEdns0(defaultUDPBufSize, false)
+	opt := resp.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: ednsOptionZoneVersion, Data: zoneVersion})
+
+	return resp, nil
+}
+
+func (u *zoneVersionUpstream) Address() string {
+	return "zoneversion"
+}
+
+func TestZoneVersion(t *testing.T) {
+	u := &zoneVersionUpstream{}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer dnsProxy.Stop()
+
+	client := &dns.Client{Net: "udp", Timeout: defaultTimeout}
+	addr := dnsProxy.Addr(ProtoUDP).String()
+
+	req := createTestMessage()
+	req.SetEdns0(defaultUDPBufSize, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: ednsOptionZoneVersion})
+	reply, _, err := client.Exchange(req, addr)
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	assertResponse(t, reply)
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&u.requested))
+	if opt = reply.IsEdns0(); assert.NotNil(t, opt) && assert.Len(t, opt.Option, 1) {
+		assert.Equal(t, uint16(ednsOptionZoneVersion), opt.Option[0].Option())
+		assert.Equal(t, zoneVersion, opt.Option[0].(*dns.EDNS0_LOCAL).Data)
+	}
+
+	// The option isn't returned to the clients that haven't requested it.
+	req = createTestMessage()
+	req.SetEdns0(defaultUDPBufSize, false)
+	reply, _, err = client.Exchange(req, addr)
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	assertResponse(t, reply)
+	if opt = reply.IsEdns0(); assert.NotNil(t, opt) {
+		assert.Empty(t, opt.Option)
+	}
+}
@@ -1,7 +1,13 @@
 package proxy
 
 import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
 	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
@@ -10,8 +16,400 @@ import (
 	"github.com/miekg/dns"
 )
 
+// errNoUpstreams is returned when there are no upstreams to exchange the
+// request with.  It may happen if the upstreams configuration was changed
+// after the proxy had been started.
+var errNoUpstreams = errors.New("no upstreams specified")
+
+// errQuestionMismatch is returned when the question section of the response
+// doesn't match the one of the request.
+var errQuestionMismatch = errors.New("response question doesn't match the request")
+
+// validatingUpstream is an upstream that rejects the responses with the
+// question section not matching the request.
+type validatingUpstream struct {
+	upstream.Upstream
+}
+
+// Exchange implements the upstream.Upstream interface for *validatingUpstream.
+func (u *validatingUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	reply, err := u.Upstream.Exchange(m)
+	if err == nil && !questionMatches(m, reply) {
+		log.Debug("upstream %s returned a response with mismatched question", u.Address())
+
+		return nil, errQuestionMismatch
+	}
+
+	return reply, err
+}
+
+// questionMatches returns true if the question section of resp matches the
+// one of req.  FORMERR responses are allowed to omit the question section.
+func questionMatches(req, resp *dns.Msg) bool {
+	if len(resp.Question) == 0 && resp.Rcode == dns.RcodeFormatError {
+		return true
+	}
+
+	if len(resp.Question) != len(req.Question) {
+		return false
+	}
+
+	for i, q := range req.Question {
+		rq := resp.Question[i]
+		if !strings.EqualFold(q.Name, rq.Name) || q.Qtype != rq.Qtype || q.Qclass != rq.Qclass {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validatingUpstreams wraps upstreams so that they reject the responses with
+// mismatched question unless it's disabled.
+func (p *Proxy) validatingUpstreams(upstreams []upstream.Upstream) []upstream.Upstream {
+	if p.SkipResponseQuestionValidation {
+		return upstreams
+	}
+
+	res := make([]upstream.Upstream, len(upstreams))
+	for i, u := range upstreams {
+		res[i] = &validatingUpstream{Upstream: u}
+	}
+
+	return res
+}
+
+// tcpUpstream is a plain DNS upstream that always exchanges over TCP.
+type tcpUpstream struct {
+	upstream.Upstream
+	dialTimeout time.Duration
+}
+
+// Exchange implements the upstream.Upstream interface for *tcpUpstream.
+func (u *tcpUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return exchangeOverTCP(m, u.Upstream, u.dialTimeout)
+}
+
+// tcpUpstreams wraps the plain DNS upstreams so that they exchange over TCP
+// if it's configured.  The encrypted upstreams are left as is.
+func (p *Proxy) tcpUpstreams(upstreams []upstream.Upstream) []upstream.Upstream {
+	if !p.ForceTCPUpstreams {
+		return upstreams
+	}
+
+	res := make([]upstream.Upstream, len(upstreams))
+	for i, u := range upstreams {
+		if strings.Contains(u.Address(), "://") {
+			res[i] = u
+		} else {
+			res[i] = &tcpUpstream{Upstream: u, dialTimeout: p.UpstreamDialTimeout}
+		}
+	}
+
+	return res
+}
+
+// udpRetransmitInterval is the delay after which the request to a plain DNS
+// upstream is retransmitted if there is still no response.
+const udpRetransmitInterval = 200 * time.Millisecond
+
+// retransmittingUpstream is a plain DNS upstream that retransmits the request
+// if the response doesn't come quickly or the exchange fails.
+type retransmittingUpstream struct {
+	upstream.Upstream
+	retries int
+}
+
+// Exchange implements the upstream.Upstream interface for
+// *retransmittingUpstream.  The first successful response is returned, the
+// exchanges still in progress are left to finish on their own.
+func (u *retransmittingUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	type result struct {
+		reply *dns.Msg
+		err   error
+	}
+
+	// The channel is buffered so that the abandoned exchanges don't block.
+	results := make(chan result, u.retries+1)
+	send := func() {
+		reply, err := u.Upstream.Exchange(m.Copy())
+		results <- result{reply: reply, err: err}
+	}
+
+	go send()
+	sent, done := 1, 0
+
+	timer := time.NewTimer(udpRetransmitInterval)
+	defer timer.Stop()
+
+	var err error
+	for {
+		select {
+		case res := <-results:
+			if res.err == nil {
+				return res.reply, nil
+			}
+
+			err = res.err
+			done++
+			if done < sent {
+				continue
+			}
+
+			if sent > u.retries {
+				return nil, err
+			}
+
+			// All the exchanges have failed, so don't wait for the
+			// timer.
+			log.Tracef("retransmitting request to %s: %s", u.Address(), err)
+			sent++
+			go send()
+		case <-timer.C:
+			if sent <= u.retries {
+				log.Tracef("retransmitting request to %s: no response yet", u.Address())
+				sent++
+				go send()
+				timer.Reset(udpRetransmitInterval)
+			}
+		}
+	}
+}
+
+// retransmittingUpstreams wraps the plain DNS upstreams so that the requests
+// to them are retransmitted if it's configured.  The encrypted upstreams and
+// the ones forced to use TCP are left as is.
+func (p *Proxy) retransmittingUpstreams(upstreams []upstream.Upstream) []upstream.Upstream {
+	if p.UDPUpstreamRetries <= 0 || p.ForceTCPUpstreams {
+		return upstreams
+	}
+
+	res := make([]upstream.Upstream, len(upstreams))
+	for i, u := range upstreams {
+		if strings.Contains(u.Address(), "://") {
+			res[i] = u
+		} else {
+			res[i] = &retransmittingUpstream{Upstream: u, retries: p.UDPUpstreamRetries}
+		}
+	}
+
+	return res
+}
+
+// adaptiveTimeoutFactor is the multiple of the upstream's average RTT its
+// exchanges are limited to, see Config.AdaptiveTimeout.
+const adaptiveTimeoutFactor = 3
+
+// defaultAdaptiveTimeoutMin and defaultAdaptiveTimeoutMax are the bounds of
+// the adaptive timeout used when the configured ones are zero.
+const (
+	defaultAdaptiveTimeoutMin = 100 * time.Millisecond
+	defaultAdaptiveTimeoutMax = defaultTimeout
+)
+
+// maxAbandonedExchanges is the number of the timed out exchanges still running
+// after which the adaptive timeouts aren't applied until some of them finish.
+const maxAbandonedExchanges = 1024
+
+// States of an exchange of timeoutUpstream.
+const (
+	exchangeRunning int32 = iota
+	exchangeFinished
+	exchangeAbandoned
+)
+
+// timeoutUpstream is an upstream that fails the exchanges taking longer than
+// timeout.
+type timeoutUpstream struct {
+	upstream.Upstream
+	timeout time.Duration
+	// abandoned is the number of the timed out exchanges still running,
+	// accessed atomically.
+	abandoned *int32
+}
+
+// Exchange implements the upstream.Upstream interface for *timeoutUpstream.
+// The upstream interface can't cancel the exchange, so the one that has timed
+// out is left to finish on its own within the upstream's own timeout.  Such
+// exchanges are counted in u.abandoned to bound their number.
+func (u *timeoutUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	type result struct {
+		reply *dns.Msg
+		err   error
+	}
+
+	// The channel is buffered so that the abandoned exchange doesn't block.
+	results := make(chan result, 1)
+	state := exchangeRunning
+	go func(m *dns.Msg) {
+		reply, err := u.Upstream.Exchange(m)
+		results <- result{reply: reply, err: err}
+
+		if !atomic.CompareAndSwapInt32(&state, exchangeRunning, exchangeFinished) {
+			atomic.AddInt32(u.abandoned, -1)
+		}
+	}(m.Copy())
+
+	timer := time.NewTimer(u.timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-results:
+		return res.reply, res.err
+	case <-timer.C:
+		if !atomic.CompareAndSwapInt32(&state, exchangeRunning, exchangeAbandoned) {
+			// The exchange has just finished.
+			res := <-results
+
+			return res.reply, res.err
+		}
+		atomic.AddInt32(u.abandoned, 1)
+
+		return nil, fmt.Errorf("upstream %s timed out after %s", u.Address(), u.timeout)
+	}
+}
+
+// upstreamTimeout returns the adaptive timeout of the exchanges with the
+// upstream with address, see Config.AdaptiveTimeout.
+func (p *Proxy) upstreamTimeout(address string) time.Duration {
+	minTimeout, maxTimeout := p.AdaptiveTimeoutMin, p.AdaptiveTimeoutMax
+	if minTimeout == 0 {
+		minTimeout = defaultAdaptiveTimeoutMin
+	}
+	if maxTimeout == 0 {
+		maxTimeout = defaultAdaptiveTimeoutMax
+	}
+
+	// The failed exchanges aren't taken into account, so that the timeout
+	// of an upstream that stops responding doesn't grow.
+	p.rttLock.Lock()
+	s := p.upstreamRttStats[address]
+	if s == nil || !s.succeeded {
+		p.rttLock.Unlock()
+
+		return maxTimeout
+	}
+	timeout := time.Duration(adaptiveTimeoutFactor * s.succeededEMA * float64(time.Millisecond))
+	p.rttLock.Unlock()
+
+	if timeout < minTimeout {
+		return minTimeout
+	} else if timeout > maxTimeout {
+		return maxTimeout
+	}
+
+	return timeout
+}
+
+// timeoutUpstreams wraps upstreams so that their exchanges are limited to the
+// adaptive timeouts if it's configured.  The upstreams' own timeouts are used
+// while there are too many timed out exchanges still running.
+func (p *Proxy) timeoutUpstreams(upstreams []upstream.Upstream) []upstream.Upstream {
+	if !p.AdaptiveTimeout {
+		return upstreams
+	}
+
+	if atomic.LoadInt32(&p.abandonedExchanges) >= maxAbandonedExchanges {
+		log.Debug("Too many timed out exchanges are still running, not applying the adaptive timeouts")
+
+		return upstreams
+	}
+
+	res := make([]upstream.Upstream, len(upstreams))
+	for i, u := range upstreams {
+		res[i] = &timeoutUpstream{
+			Upstream:  u,
+			timeout:   p.upstreamTimeout(u.Address()),
+			abandoned: &p.abandonedExchanges,
+		}
+	}
+
+	return res
+}
+
+// trackingUpstream is an upstream that keeps track of its unfinished
+// exchanges and of the result of the last one.  It also reports the exchanges
+// to UpstreamExchangeCallback.
+type trackingUpstream struct {
+	upstream.Upstream
+	p *Proxy
+}
+
+// Exchange implements the upstream.Upstream interface for *trackingUpstream.
+func (u *trackingUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	addr := u.Address()
+	u.p.rttLock.Lock()
+	if u.p.upstreamInFlight == nil {
+		u.p.upstreamInFlight = map[string]int{}
+		u.p.upstreamFailed = map[string]bool{}
+	}
+	u.p.upstreamInFlight[addr]++
+	u.p.rttLock.Unlock()
+
+	start := time.Now()
+	reply, err := u.Upstream.Exchange(m)
+	if u.p.UpstreamExchangeCallback != nil {
+		u.p.UpstreamExchangeCallback(addr, m, reply, time.Since(start), err)
+	}
+
+	u.p.rttLock.Lock()
+	u.p.upstreamInFlight[addr]--
+	u.p.upstreamFailed[addr] = err != nil
+	u.p.rttLock.Unlock()
+
+	return reply, err
+}
+
+// trackingUpstreams wraps upstreams so that their state could be inspected
+// with the DebugHandler.
+func (p *Proxy) trackingUpstreams(upstreams []upstream.Upstream) []upstream.Upstream {
+	res := make([]upstream.Upstream, len(upstreams))
+	for i, u := range upstreams {
+		res[i] = &trackingUpstream{Upstream: u, p: p}
+	}
+
+	return res
+}
+
+// unwrapUpstream returns the upstream wrapped by tcpUpstreams,
+// retransmittingUpstreams, timeoutUpstreams, validatingUpstreams,
+// trackingUpstreams and coalescingUpstreams.
+func unwrapUpstream(u upstream.Upstream) upstream.Upstream {
+	for {
+		switch w := u.(type) {
+		case *validatingUpstream:
+			u = w.Upstream
+		case *trackingUpstream:
+			u = w.Upstream
+		case *coalescingUpstream:
+			u = w.Upstream
+		case *tcpUpstream:
+			u = w.Upstream
+		case *retransmittingUpstream:
+			u = w.Upstream
+		case *timeoutUpstream:
+			u = w.Upstream
+		default:
+			return u
+		}
+	}
+}
+
 // exchange -- sends DNS query to the upstream DNS server and returns the response
 func (p *Proxy) exchange(req *dns.Msg, upstreams []upstream.Upstream) (reply *dns.Msg, u upstream.Upstream, err error) {
+	if len(upstreams) == 0 {
+		return nil, nil, errNoUpstreams
+	}
+
+	upstreams = p.validatingUpstreams(p.timeoutUpstreams(p.retransmittingUpstreams(p.tcpUpstreams(upstreams))))
+	upstreams = p.coalescingUpstreams(p.trackingUpstreams(upstreams))
+	reply, u, err = p.exchangeValidated(req, upstreams)
+
+	return reply, unwrapUpstream(u), err
+}
+
+// exchangeValidated sends req to upstreams according to the upstream mode.
+func (p *Proxy) exchangeValidated(req *dns.Msg, upstreams []upstream.Upstream) (reply *dns.Msg, u upstream.Upstream, err error) {
 	qtype := req.Question[0].Qtype
 	if p.UpstreamMode == UModeFastestAddr && (qtype == dns.TypeA || qtype == dns.TypeAAAA) {
 		reply, u, err = p.fastestAddr.ExchangeFastest(req, upstreams)
@@ -42,7 +440,8 @@ func (p *Proxy) exchange(req *dns.Msg, upstreams []upstream.Upstream) (reply *dn
 			return reply, dnsUpstream, err
 		}
 		errs = append(errs, err)
-		p.updateRtt(dnsUpstream.Address(), int(defaultTimeout/time.Millisecond))
+		p.updateFailedRtt(dnsUpstream.Address())
+		p.penalize(dnsUpstream.Address())
 	}
 	return nil, nil, errorx.DecorateMany("all upstreams failed to exchange request", errs...)
 }
@@ -54,16 +453,116 @@ func (p *Proxy) getSortedUpstreams(u []upstream.Upstream) []upstream.Upstream {
 	copy(clone, u)
 
 	sort.Slice(clone, func(i, j int) bool {
-		if p.upstreamRttStats[clone[i].Address()] < p.upstreamRttStats[clone[j].Address()] {
+		if p.upstreamRttStats[clone[i].Address()].avg() < p.upstreamRttStats[clone[j].Address()].avg() {
 			return true
 		}
 		return false
 	})
+
+	if len(p.UpstreamWeights) != 0 {
+		clone = p.upstreamsWeighted(clone)
+	}
+	clone = p.penalizedLast(clone)
 	p.rttLock.Unlock()
 
 	return clone
 }
 
+// upstreamsWeighted returns the upstreams sorted by RTT in a random order
+// according to their weights.  The upstreams with zero weight are put last.
+// It must be called with rttLock held.
+func (p *Proxy) upstreamsWeighted(sorted []upstream.Upstream) []upstream.Upstream {
+	var weighted []upstream.Upstream
+	var weights []float64
+	var lastResort []upstream.Upstream
+	total := 0.0
+	for i, w := range p.effectiveWeights(sorted) {
+		if w == 0 {
+			lastResort = append(lastResort, sorted[i])
+
+			continue
+		}
+
+		weighted = append(weighted, sorted[i])
+		weights = append(weights, w)
+		total += w
+	}
+
+	res := make([]upstream.Upstream, 0, len(sorted))
+	for len(weighted) > 0 {
+		i := 0
+		for r := rand.Float64() * total; i < len(weighted)-1; i++ {
+			r -= weights[i]
+			if r < 0 {
+				break
+			}
+		}
+
+		res = append(res, weighted[i])
+		total -= weights[i]
+		weighted = append(weighted[:i], weighted[i+1:]...)
+		weights = append(weights[:i], weights[i+1:]...)
+	}
+
+	return append(res, lastResort...)
+}
+
+// effectiveWeights returns the weights of ups configured in UpstreamWeights
+// scaled by how fast each upstream is compared to the others.  It must be
+// called with rttLock held.
+func (p *Proxy) effectiveWeights(ups []upstream.Upstream) (weights []float64) {
+	meanRtt := 0.0
+	for _, u := range ups {
+		meanRtt += p.upstreamRttStats[u.Address()].avg()
+	}
+	meanRtt /= float64(len(ups))
+
+	weights = make([]float64, len(ups))
+	for i, u := range ups {
+		base := p.upstreamWeight(u)
+		weights[i] = float64(base) * (meanRtt + 1) / (p.upstreamRttStats[u.Address()].avg() + 1)
+	}
+
+	return weights
+}
+
+// defaultUpstreamWeight is the weight of the upstreams which weight isn't
+// configured.
+const defaultUpstreamWeight = 1
+
+// upstreamWeight returns the weight of u configured in UpstreamWeights.  The
+// upstreams are matched by address since u may be wrapped.
+func (p *Proxy) upstreamWeight(u upstream.Upstream) int {
+	if len(p.UpstreamWeights) == 0 || p.UpstreamConfig == nil {
+		return defaultUpstreamWeight
+	}
+
+	addr := u.Address()
+	for i, ups := range p.UpstreamConfig.Upstreams {
+		if ups.Address() == addr && i < len(p.UpstreamWeights) {
+			return p.UpstreamWeights[i]
+		}
+	}
+
+	return defaultUpstreamWeight
+}
+
+// reportUpstreamSelected calls the UpstreamSelectedCallback, if any, for the
+// upstream u selected from upstreams.
+func (p *Proxy) reportUpstreamSelected(q dns.Question, u upstream.Upstream, upstreams []upstream.Upstream) {
+	if p.UpstreamSelectedCallback == nil || u == nil {
+		return
+	}
+
+	for i, ups := range upstreams {
+		if ups == u {
+			p.UpstreamSelectedCallback(q, u.Address(), i, p.upstreamWeight(u))
+
+			return
+		}
+	}
+}
+
 // exchangeWithUpstream returns result of Exchange with elapsed time
 func exchangeWithUpstream(u upstream.Upstream, req *dns.Msg) (*dns.Msg, int, error) {
 	startTime := time.Now()
@@ -77,12 +576,138 @@ func exchangeWithUpstream(u upstream.Upstream, req *dns.Msg) (*dns.Msg, int, err
 	return reply, elapsed, err
 }
 
+// ResolveUpstream sends req to the default upstream with index idx, bypassing
+// the upstream selection and the cache, and returns the reply along with the
+// round-trip time.  It's intended for diagnostics and health checks.
+func (p *Proxy) ResolveUpstream(req *dns.Msg, idx int) (reply *dns.Msg, rtt time.Duration, err error) {
+	if p.UpstreamConfig == nil {
+		return nil, 0, errNoUpstreams
+	}
+
+	ups := p.UpstreamConfig.Upstreams
+	if idx < 0 || idx >= len(ups) {
+		return nil, 0, fmt.Errorf("upstream index %d is out of range, there are %d upstreams", idx, len(ups))
+	}
+
+	if len(req.Question) != 1 {
+		return nil, 0, fmt.Errorf("invalid number of questions: %d", len(req.Question))
+	}
+
+	u := ups[idx]
+	start := time.Now()
+	reply, err = u.Exchange(req)
+	rtt = time.Since(start)
+	if err != nil {
+		return nil, rtt, errorx.Decorate(err, "exchanging with %s", u.Address())
+	}
+
+	return reply, rtt, nil
+}
+
+// penalize excludes the upstream with address from the selection for
+// UpstreamFailureCooldown.
+func (p *Proxy) penalize(address string) {
+	if p.UpstreamFailureCooldown == 0 {
+		return
+	}
+
+	p.rttLock.Lock()
+	if p.upstreamPenalized == nil {
+		p.upstreamPenalized = map[string]time.Time{}
+	}
+	p.upstreamPenalized[address] = p.now().Add(p.UpstreamFailureCooldown)
+	p.rttLock.Unlock()
+}
+
+// penalizedLast moves the upstreams that have failed recently to the end of
+// sorted, so that they are only used if all the others fail.  p.rttLock must
+// be locked.
+func (p *Proxy) penalizedLast(sorted []upstream.Upstream) []upstream.Upstream {
+	if len(p.upstreamPenalized) == 0 {
+		return sorted
+	}
+
+	now := p.now()
+	res := make([]upstream.Upstream, 0, len(sorted))
+	var penalized []upstream.Upstream
+	for _, u := range sorted {
+		addr := u.Address()
+		until, ok := p.upstreamPenalized[addr]
+		if !ok {
+			res = append(res, u)
+		} else if now.Before(until) {
+			penalized = append(penalized, u)
+		} else {
+			delete(p.upstreamPenalized, addr)
+			res = append(res, u)
+		}
+	}
+
+	return append(res, penalized...)
+}
+
 // updateRtt updates rtt in upstreamRttStats for given address
 func (p *Proxy) updateRtt(address string, rtt int) {
+	p.addRtt(address, rtt, true)
+}
+
+// updateFailedRtt updates upstreamRttStats for the given address after a
+// failed exchange, which is counted as taking defaultTimeout.
+func (p *Proxy) updateFailedRtt(address string) {
+	p.addRtt(address, int(defaultTimeout/time.Millisecond), false)
+}
+
+// addRtt adds rtt of the exchange with the upstream with address to
+// upstreamRttStats.
+func (p *Proxy) addRtt(address string, rtt int, succeeded bool) {
 	p.rttLock.Lock()
 	if p.upstreamRttStats == nil {
-		p.upstreamRttStats = map[string]int{}
+		p.upstreamRttStats = map[string]*rttStats{}
+	}
+	s, ok := p.upstreamRttStats[address]
+	if !ok {
+		s = &rttStats{}
+		p.upstreamRttStats[address] = s
+	}
+	s.add(rtt, p.rttSmoothing())
+	if succeeded {
+		s.addSucceeded(rtt, p.rttSmoothing())
+	}
+	if p.RttHistoryWindow > 0 {
+		s.addHistory(p.now(), rtt, p.RttHistoryWindow)
 	}
-	p.upstreamRttStats[address] = (p.upstreamRttStats[address] + rtt) / 2
 	p.rttLock.Unlock()
 }
+
+// exchangeOverTCP sends req to the plain DNS upstream u over TCP.  It's used
+// when the upstream has truncated the response to a client that has no message
+// size limit, see isStreamProto.  The connection is established within
+// dialTimeout if it's not zero.
+func exchangeOverTCP(req *dns.Msg, u upstream.Upstream, dialTimeout time.Duration) (reply *dns.Msg, err error) {
+	addr := u.Address()
+	if strings.Contains(addr, "://") {
+		return nil, fmt.Errorf("upstream %s is not a plain DNS upstream", addr)
+	}
+
+	_, _, err = net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	client := dns.Client{Net: "tcp", Timeout: defaultTimeout}
+	if dialTimeout == 0 {
+		reply, _, err = client.Exchange(req, addr)
+
+		return reply, err
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	reply, _, err = client.ExchangeWithConn(req, &dns.Conn{Conn: conn})
+
+	return reply, err
+}
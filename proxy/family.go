@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// initFamilyUpstreams builds the upstream configurations used for the A and
+// AAAA requests from UpstreamsV4 and UpstreamsV6.  The domain-specific
+// upstreams of UpstreamConfig are still used for these requests.
+func (p *Proxy) initFamilyUpstreams() {
+	p.v4UpstreamConfig, p.v6UpstreamConfig = nil, nil
+	if p.UpstreamConfig == nil {
+		return
+	}
+
+	newConfig := func(ups []upstream.Upstream) *UpstreamConfig {
+		if len(ups) == 0 {
+			return nil
+		}
+
+		return &UpstreamConfig{
+			Upstreams:               ups,
+			DomainReservedUpstreams: p.UpstreamConfig.DomainReservedUpstreams,
+		}
+	}
+
+	p.v4UpstreamConfig = newConfig(p.UpstreamsV4)
+	p.v6UpstreamConfig = newConfig(p.UpstreamsV6)
+}
+
+// defaultUpstreamConfig returns the default upstream configuration for the
+// requests of qtype from the client of d.  The upstreams for the client's
+// location take precedence over the ones for the address family.
+func (p *Proxy) defaultUpstreamConfig(d *DNSContext, qtype uint16) *UpstreamConfig {
+	if uc := p.geoUpstreamConfig(d); uc != nil {
+		return uc
+	}
+
+	switch {
+	case qtype == dns.TypeA && p.v4UpstreamConfig != nil:
+		return p.v4UpstreamConfig
+	case qtype == dns.TypeAAAA && p.v6UpstreamConfig != nil:
+		return p.v6UpstreamConfig
+	default:
+		return p.UpstreamConfig
+	}
+}
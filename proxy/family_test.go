@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFamilyUpstreams(t *testing.T) {
+	def := &rcodeUpstream{rcode: dns.RcodeSuccess}
+	v4 := &rcodeUpstream{rcode: dns.RcodeSuccess}
+	v6 := &rcodeUpstream{rcode: dns.RcodeSuccess}
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{def}
+	dnsProxy.UpstreamsV4 = []upstream.Upstream{v4}
+	dnsProxy.UpstreamsV6 = []upstream.Upstream{v6}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	resolve := func(qtype uint16) {
+		req := &dns.Msg{}
+		req.SetQuestion("host.", qtype)
+		err = dnsProxy.Resolve(&DNSContext{Req: req, Addr: &net.TCPAddr{}})
+		assert.Nil(t, err)
+	}
+
+	resolve(dns.TypeA)
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&v4.calls))
+	assert.Equal(t, uint32(0), atomic.LoadUint32(&v6.calls))
+
+	resolve(dns.TypeAAAA)
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&v4.calls))
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&v6.calls))
+
+	// The rest of the requests use the default upstreams.
+	resolve(dns.TypeMX)
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&def.calls))
+
+	// The default upstreams are used if a family-specific list is empty.
+	dnsProxy.UpstreamsV6 = nil
+	err = dnsProxy.Init()
+	assert.Nil(t, err)
+
+	resolve(dns.TypeAAAA)
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&v6.calls))
+	assert.Equal(t, uint32(2), atomic.LoadUint32(&def.calls))
+}
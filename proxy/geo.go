@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// GeoLookupFunc returns the ISO 3166-1 country code and the continent code of
+// ip.  Empty strings mean that the location is unknown.
+type GeoLookupFunc func(ip net.IP) (country, continent string)
+
+// initGeoUpstreams builds the upstream configurations used for the clients
+// from the locations listed in GeoUpstreams.  The domain-specific upstreams
+// of UpstreamConfig are still used for these clients.
+func (p *Proxy) initGeoUpstreams() {
+	p.geoUpstreamConfigs = nil
+	if len(p.GeoUpstreams) == 0 || p.GeoLookup == nil || p.UpstreamConfig == nil {
+		return
+	}
+
+	p.geoUpstreamConfigs = make(map[string]*UpstreamConfig, len(p.GeoUpstreams))
+	for code, ups := range p.GeoUpstreams {
+		p.geoUpstreamConfigs[strings.ToUpper(code)] = &UpstreamConfig{
+			Upstreams:               ups,
+			DomainReservedUpstreams: p.UpstreamConfig.DomainReservedUpstreams,
+		}
+	}
+
+	log.Info("Geo routing is enabled for %d locations", len(p.geoUpstreamConfigs))
+}
+
+// geoUpstreamConfig returns the upstream configuration for the client's
+// location or nil if the default one should be used.  The country takes
+// precedence over the continent.
+func (p *Proxy) geoUpstreamConfig(d *DNSContext) *UpstreamConfig {
+	if len(p.geoUpstreamConfigs) == 0 {
+		return nil
+	}
+
+	ip := net.ParseIP(getIPString(d.Addr))
+	if ip == nil {
+		return nil
+	}
+
+	country, continent := p.GeoLookup(ip)
+	for _, code := range []string{country, continent} {
+		if code == "" {
+			continue
+		}
+
+		if uc, ok := p.geoUpstreamConfigs[strings.ToUpper(code)]; ok {
+			log.Tracef("Routing the request from %s to the upstreams for %s", ip, code)
+
+			return uc
+		}
+	}
+
+	return nil
+}
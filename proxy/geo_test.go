@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeoUpstreams(t *testing.T) {
+	var used []string
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&fastUpstream{addr: "default"}}
+	dnsProxy.GeoUpstreams = map[string][]upstream.Upstream{
+		"de": {&fastUpstream{addr: "de"}},
+		"EU": {&fastUpstream{addr: "eu"}},
+		"NA": {&fastUpstream{addr: "na"}},
+	}
+	dnsProxy.GeoLookup = func(ip net.IP) (country, continent string) {
+		switch ip.String() {
+		case "1.1.1.1":
+			return "DE", "EU"
+		case "2.2.2.2":
+			return "FR", "EU"
+		case "3.3.3.3":
+			return "JP", "AS"
+		default:
+			return "", ""
+		}
+	}
+	dnsProxy.UpstreamSelectedCallback = func(_ dns.Question, upstreamAddr string, _, _ int) {
+		used = append(used, upstreamAddr)
+	}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	testCases := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "1.1.1.1", want: "de"},
+		{ip: "2.2.2.2", want: "eu"},
+		{ip: "3.3.3.3", want: "default"},
+		{ip: "4.4.4.4", want: "default"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.ip, func(t *testing.T) {
+			used = nil
+			d := &DNSContext{
+				Proto:              ProtoHTTPS,
+				Req:                createTestMessage(),
+				Addr:               &net.TCPAddr{IP: net.ParseIP(tc.ip), Port: 443},
+				HTTPResponseWriter: httptest.NewRecorder(),
+			}
+			err = dnsProxy.handleDNSRequest(d)
+			assert.Nil(t, err)
+			assert.Equal(t, []string{tc.want}, used)
+		})
+	}
+}
+
+func TestGeoUpstreamsCache(t *testing.T) {
+	var used []string
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.GeoUpstreams = map[string][]upstream.Upstream{
+		"DE": {createTestUpstream()},
+	}
+	dnsProxy.GeoLookup = func(_ net.IP) (country, continent string) {
+		return "DE", "EU"
+	}
+	dnsProxy.UpstreamSelectedCallback = func(_ dns.Question, upstreamAddr string, _, _ int) {
+		used = append(used, upstreamAddr)
+	}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		d := &DNSContext{
+			Proto:              ProtoHTTPS,
+			Req:                createTestMessage(),
+			Addr:               &net.TCPAddr{IP: net.ParseIP("1.1.1.1"), Port: 443},
+			HTTPResponseWriter: httptest.NewRecorder(),
+		}
+		err = dnsProxy.handleDNSRequest(d)
+		assert.Nil(t, err)
+		assert.Len(t, d.Res.Answer, 1)
+	}
+
+	// The second response is served from the cache.
+	assert.Len(t, used, 1)
+}
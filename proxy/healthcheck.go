@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// defaultHealthCheckConcurrency is the number of the upstreams probed at the
+// same time used when Config.HealthCheckConcurrency is zero.
+const defaultHealthCheckConcurrency = 4
+
+// HealthSnapshot is the health of the upstreams checked in a single sweep, see
+// HealthCheckInterval.
+type HealthSnapshot struct {
+	// Time is the time the sweep has started at.
+	Time time.Time
+	// Results are the results of probing the upstreams in the same order as
+	// the ones of TestUpstreams.
+	Results []UpstreamTestResult
+}
+
+// UpstreamHealth returns the health of the upstreams checked by the last
+// finished sweep or nil if there is none yet.  The snapshot must not be
+// modified.
+func (p *Proxy) UpstreamHealth() (s *HealthSnapshot) {
+	p.healthLock.RLock()
+	defer p.healthLock.RUnlock()
+
+	return p.health
+}
+
+// startHealthChecks starts checking the health of the upstreams each
+// HealthCheckInterval if it's configured.
+func (p *Proxy) startHealthChecks() {
+	if p.HealthCheckInterval == 0 {
+		return
+	}
+
+	p.background.submit(p.checkHealth)
+
+	go p.healthCheckLoop(p.HealthCheckInterval, p.shutdown)
+}
+
+// healthCheckLoop schedules the health check sweeps each interval until
+// shutdown is closed.
+func (p *Proxy) healthCheckLoop(interval time.Duration, shutdown chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.background.submit(p.checkHealth)
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// checkHealth probes all the upstreams, at most HealthCheckConcurrency of them
+// at a time, and replaces the health snapshot once all of them are probed.  It
+// does nothing if the previous sweep is still running.
+func (p *Proxy) checkHealth() {
+	if !atomic.CompareAndSwapUint32(&p.healthChecking, 0, 1) {
+		log.Debug("The previous health check is still running, skipping")
+
+		return
+	}
+	defer atomic.StoreUint32(&p.healthChecking, 0)
+
+	ups := append(p.debugUpstreams(), p.Fallbacks...)
+	s := &HealthSnapshot{
+		Time:    time.Now(),
+		Results: make([]UpstreamTestResult, len(ups)),
+	}
+
+	concurrency := p.HealthCheckConcurrency
+	if concurrency == 0 {
+		concurrency = defaultHealthCheckConcurrency
+	}
+
+	sema := make(chan struct{}, concurrency)
+	wg := &sync.WaitGroup{}
+	for i, u := range ups {
+		sema <- struct{}{}
+		wg.Add(1)
+		go func(idx int, u upstream.Upstream) {
+			defer func() {
+				<-sema
+				wg.Done()
+			}()
+
+			s.Results[idx] = probeUpstream(u)
+		}(i, u)
+	}
+	wg.Wait()
+
+	p.healthLock.Lock()
+	p.health = s
+	p.healthLock.Unlock()
+
+	log.Debug("Checked the health of %d upstreams in %s", len(ups), time.Since(s.Time))
+}
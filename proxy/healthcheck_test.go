@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// probedUpstream counts the exchanges and the maximum number of the ones
+// running at the same time.  The exchanges wait for release if it's not nil.
+type probedUpstream struct {
+	addr       string
+	fail       bool
+	release    chan struct{}
+	calls      *int32
+	running    *int32
+	maxRunning *int32
+}
+
+func (u *probedUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(u.calls, 1)
+	n := atomic.AddInt32(u.running, 1)
+	defer atomic.AddInt32(u.running, -1)
+	for {
+		max := atomic.LoadInt32(u.maxRunning)
+		if n <= max || atomic.CompareAndSwapInt32(u.maxRunning, max, n) {
+			break
+		}
+	}
+
+	if u.release != nil {
+		<-u.release
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if u.fail {
+		return nil, fmt.Errorf("%s failed", u.addr)
+	}
+
+	return (&dns.Msg{}).SetReply(m), nil
+}
+
+func (u *probedUpstream) Address() string {
+	return u.addr
+}
+
+func TestHealthCheck(t *testing.T) {
+	const n = 8
+
+	var calls, running, maxRunning int32
+	release := make(chan struct{})
+	ups := make([]upstream.Upstream, n)
+	for i := range ups {
+		ups[i] = &probedUpstream{
+			addr:       fmt.Sprintf("upstream-%d", i),
+			fail:       i == n-1,
+			release:    release,
+			calls:      &calls,
+			running:    &running,
+			maxRunning: &maxRunning,
+		}
+	}
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = ups[:n-1]
+	dnsProxy.Fallbacks = ups[n-1:]
+	dnsProxy.HealthCheckConcurrency = 3
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+	assert.Nil(t, dnsProxy.UpstreamHealth())
+
+	close(release)
+	dnsProxy.checkHealth()
+
+	// A single sweep probes all the upstreams, but only some of them at a
+	// time.
+	assert.Equal(t, int32(n), atomic.LoadInt32(&calls))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&maxRunning))
+
+	first := dnsProxy.UpstreamHealth()
+	if assert.NotNil(t, first) && assert.Len(t, first.Results, n) {
+		for i, res := range first.Results {
+			assert.Equal(t, ups[i].Address(), res.Address)
+			assert.Equal(t, i != n-1, res.OK, res.Address)
+		}
+	}
+
+	// The snapshot is only replaced once the next sweep is finished.
+	block := make(chan struct{})
+	for _, u := range ups {
+		u.(*probedUpstream).release = block
+	}
+
+	done := make(chan struct{})
+	go func() {
+		dnsProxy.checkHealth()
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&running) == 3
+	}, time.Second, time.Millisecond)
+	assert.Same(t, first, dnsProxy.UpstreamHealth())
+
+	// The sweeps don't overlap.
+	dnsProxy.checkHealth()
+	assert.Equal(t, int32(n+3), atomic.LoadInt32(&calls))
+
+	close(block)
+	<-done
+	second := dnsProxy.UpstreamHealth()
+	assert.NotSame(t, first, second)
+	assert.Equal(t, int32(2*n), atomic.LoadInt32(&calls))
+}
@@ -10,6 +10,19 @@ import (
 
 const retryNoError = 60 // Retry time for NoError SOA
 
+// defaultRewriteTTL is the default TTL of the answers synthesized by the
+// proxy, see Config.RewriteTTL.
+const defaultRewriteTTL = 10
+
+// rewriteTTL returns the TTL of the answers synthesized by the proxy.
+func (p *Proxy) rewriteTTL() uint32 {
+	if p.RewriteTTL != nil {
+		return *p.RewriteTTL
+	}
+
+	return defaultRewriteTTL
+}
+
 // CheckDisabledAAAARequest checks if AAAA requests should be disabled or not and sets NoError empty response to given DNSContext if needed
 func CheckDisabledAAAARequest(ctx *DNSContext, ipv6Disabled bool) bool {
 	if ipv6Disabled && ctx.Req.Question[0].Qtype == dns.TypeAAAA {
@@ -67,6 +80,88 @@ func genSOA(request *dns.Msg, retry uint32) []dns.RR {
 	return []dns.RR{&soa}
 }
 
+// genNegativeSOA returns SOA for an authority section of the negative response
+// synthesized by the proxy.  It's built from NegativeSOA if it's configured.
+func (p *Proxy) genNegativeSOA(request *dns.Msg, retry uint32) []dns.RR {
+	if p.NegativeSOA == nil {
+		return genSOA(request, retry)
+	}
+
+	rrs := genSOA(request, retry)
+	soa := rrs[0].(*dns.SOA)
+	soa.Ns = dns.Fqdn(p.NegativeSOA.Mname)
+	soa.Mbox = dns.Fqdn(p.NegativeSOA.Rname)
+	soa.Serial = p.NegativeSOA.Serial
+	// The negative TTL is the minimum of the SOA's TTL and MINIMUM fields,
+	// see RFC 2308.
+	soa.Hdr.Ttl = p.NegativeSOA.TTL
+	soa.Minttl = p.NegativeSOA.TTL
+
+	return rrs
+}
+
+// normalizeNames makes the owner names of the question and answer sections of
+// resp that match the query name spell it exactly as the client did.  The
+// rest of the owner names are only made fully qualified.  The rdata, e.g.
+// CNAME targets, is never changed.
+func normalizeNames(req, resp *dns.Msg) {
+	if resp == nil || len(req.Question) == 0 {
+		return
+	}
+
+	qName := req.Question[0].Name
+	normalize := func(name string) string {
+		name = dns.Fqdn(strings.TrimSpace(name))
+		if strings.EqualFold(name, dns.Fqdn(qName)) {
+			return qName
+		}
+
+		return name
+	}
+
+	for i := range resp.Question {
+		resp.Question[i].Name = normalize(resp.Question[i].Name)
+	}
+	for i, rr := range resp.Answer {
+		// Copy the records that need renaming since they may be shared with
+		// the cache or the upstream.
+		if name := normalize(rr.Header().Name); name != rr.Header().Name {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			resp.Answer[i] = rr
+		}
+	}
+}
+
+// dedupRRs returns rrs without the records duplicating the previous ones by
+// the owner name, type, class, and rdata.  The order of the first occurrences
+// is preserved and the RRSIG records are always kept.
+func dedupRRs(rrs []dns.RR) []dns.RR {
+	res := rrs[:0:0]
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			res = append(res, rr)
+
+			continue
+		}
+
+		dup := false
+		for _, prev := range res {
+			if dns.IsDuplicate(prev, rr) {
+				dup = true
+
+				break
+			}
+		}
+
+		if !dup {
+			res = append(res, rr)
+		}
+	}
+
+	return res
+}
+
 // getIPString is a helper function that extracts IP address from net.Addr
 func getIPString(addr net.Addr) string {
 	switch addr := addr.(type) {
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// identityNames are the names of the CHAOS TXT requests for the server
+// identity and version, see RFC 4892.
+var identityNames = map[string]bool{
+	"version.bind.":   true,
+	"hostname.bind.":  true,
+	"id.server.":      true,
+	"version.server.": true,
+}
+
+// genIdentity returns the response to the server identity request according
+// to ServerIdentity and HideIdentity or nil if req is not such a request or it
+// should be forwarded.
+func (p *Proxy) genIdentity(req *dns.Msg) *dns.Msg {
+	if (p.ServerIdentity == "" && !p.HideIdentity) || len(req.Question) != 1 {
+		return nil
+	}
+
+	q := req.Question[0]
+	if q.Qclass != dns.ClassCHAOS || !identityNames[strings.ToLower(q.Name)] {
+		return nil
+	}
+
+	if p.ServerIdentity == "" || (q.Qtype != dns.TypeTXT && q.Qtype != dns.TypeANY) {
+		return p.genRefused(req)
+	}
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Authoritative = true
+	resp.Answer = append(resp.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassCHAOS,
+			Ttl:    0,
+		},
+		Txt: []string{p.ServerIdentity},
+	})
+
+	return resp
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentity(t *testing.T) {
+	// exchange sends the CHAOS TXT request for name to a new proxy configured
+	// with identity and hide.
+	exchange := func(t *testing.T, identity string, hide bool, name string) *dns.Msg {
+		dnsProxy := createTestProxy(t, nil)
+		u := &rcodeUpstream{rcode: dns.RcodeSuccess}
+		dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+		dnsProxy.ServerIdentity = identity
+		dnsProxy.HideIdentity = hide
+
+		err := dnsProxy.Start()
+		if err != nil {
+			t.Fatalf("cannot start the DNS proxy: %s", err)
+		}
+		defer func() {
+			assert.Nil(t, dnsProxy.Stop())
+		}()
+
+		req := &dns.Msg{}
+		req.SetQuestion(name, dns.TypeTXT)
+		req.Question[0].Qclass = dns.ClassCHAOS
+
+		client := &dns.Client{Net: "udp", Timeout: defaultTimeout}
+		reply, _, err := client.Exchange(req, dnsProxy.Addr(ProtoUDP).String())
+		if err != nil {
+			t.Fatalf("cannot exchange: %s", err)
+		}
+
+		// The identity requests are never forwarded.
+		assert.Zero(t, atomic.LoadUint32(&u.calls))
+
+		return reply
+	}
+
+	t.Run("hidden", func(t *testing.T) {
+		for _, name := range []string{"version.bind.", "HOSTNAME.bind.", "id.server."} {
+			reply := exchange(t, "", true, name)
+			assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+			assert.Empty(t, reply.Answer)
+		}
+	})
+
+	t.Run("identity", func(t *testing.T) {
+		// The configured identity takes precedence.
+		reply := exchange(t, "dnsproxy", true, "version.bind.")
+		assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+		if assert.Len(t, reply.Answer, 1) {
+			txt := reply.Answer[0].(*dns.TXT)
+			assert.Equal(t, uint16(dns.ClassCHAOS), txt.Hdr.Class)
+			assert.Equal(t, []string{"dnsproxy"}, txt.Txt)
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// ednsOptionLoop is the code of the EDNS0 option the requests to the
+// upstreams are tagged with when LoopDetection is enabled.  It's from the
+// range reserved for the local use, see RFC 6891.
+const ednsOptionLoop = 65001
+
+// loopTagLen is the length of the random tag identifying the proxy instance.
+const loopTagLen = 8
+
+// initLoopDetection generates the tag of this proxy instance if
+// LoopDetection is enabled.
+func (p *Proxy) initLoopDetection() (err error) {
+	p.loopTag = nil
+	if !p.LoopDetection {
+		return nil
+	}
+
+	tag := make([]byte, loopTagLen)
+	_, err = rand.Read(tag)
+	if err != nil {
+		return errorx.Decorate(err, "generating loop detection tag")
+	}
+	p.loopTag = tag
+
+	log.Info("Loop detection is enabled")
+
+	return nil
+}
+
+// isLooped returns true if req is tagged by this proxy instance, i.e. it has
+// been sent to the upstreams by the proxy and has come back.
+func (p *Proxy) isLooped(req *dns.Msg) bool {
+	if p.loopTag == nil {
+		return false
+	}
+
+	opt := req.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	for _, o := range opt.Option {
+		if o.Option() != ednsOptionLoop {
+			continue
+		}
+
+		if l, ok := o.(*dns.EDNS0_LOCAL); ok && bytes.Equal(l.Data, p.loopTag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tagLoop returns a copy of req tagged by this proxy instance or req itself if
+// LoopDetection is disabled or it's already tagged.
+func (p *Proxy) tagLoop(req *dns.Msg) (tagged *dns.Msg) {
+	if p.loopTag == nil || p.isLooped(req) {
+		return req
+	}
+
+	tagged = req.Copy()
+	opt := tagged.IsEdns0()
+	if opt == nil {
+		tagged.SetEdns0(defaultUDPBufSize, false)
+		opt = tagged.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: ednsOptionLoop, Data: p.loopTag})
+
+	return tagged
+}
+
+// genLoopRefused returns REFUSED with the Extended DNS Error explaining the
+// reason for the looped request.
+func (p *Proxy) genLoopRefused(req *dns.Msg) (resp *dns.Msg) {
+	resp = p.genRefused(req)
+	resp.SetEdns0(dns.DefaultMsgSize, false)
+	addEDE(resp, edeOther, "loop detected")
+
+	return resp
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// assertLoopRefused checks that resp refuses the looped request.
+func assertLoopRefused(t *testing.T, resp *dns.Msg) {
+	t.Helper()
+
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+	if opt := resp.IsEdns0(); assert.NotNil(t, opt) && assert.Len(t, opt.Option, 1) {
+		assert.Equal(t, uint16(ednsOptionEDE), opt.Option[0].Option())
+		assert.Equal(t, "\x00\x00loop detected", string(opt.Option[0].(*dns.EDNS0_LOCAL).Data))
+	}
+}
+
+func TestLoopDetection(t *testing.T) {
+	u := &rcodeUpstream{}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	dnsProxy.LoopDetection = true
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	// The requests to the upstreams are tagged, but the client's one isn't
+	// changed.
+	req := createTestMessage()
+	tagged := dnsProxy.tagLoop(req)
+	assert.True(t, dnsProxy.isLooped(tagged))
+	assert.False(t, dnsProxy.isLooped(req))
+
+	d := &DNSContext{Req: tagged, Addr: &net.TCPAddr{}}
+	err = dnsProxy.handleDNSRequest(d)
+	assert.Nil(t, err)
+	assertLoopRefused(t, d.Res)
+	assert.Zero(t, u.calls)
+
+	// The tags of other instances don't matter.
+	other := createTestProxy(t, nil)
+	other.LoopDetection = true
+	err = other.Init()
+	assert.Nil(t, err)
+
+	d = &DNSContext{Req: other.tagLoop(req), Addr: &net.TCPAddr{}}
+	err = dnsProxy.handleDNSRequest(d)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Equal(t, uint32(1), u.calls)
+}
+
+func TestLoopDetectionSelfUpstream(t *testing.T) {
+	// Take a free port to make the proxy its own upstream.
+	conn, err := net.ListenPacket("udp", listenIP+":0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	_ = conn.Close()
+
+	self, err := upstream.AddressToUpstream(addr.String(), upstream.Options{Timeout: defaultTimeout})
+	if err != nil {
+		t.Fatalf("cannot create the upstream: %s", err)
+	}
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UDPListenAddr = []*net.UDPAddr{addr}
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{self}
+	dnsProxy.LoopDetection = true
+
+	err = dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	req := createTestMessage()
+	req.SetEdns0(defaultUDPBufSize, false)
+	client := &dns.Client{Net: "udp", Timeout: defaultTimeout}
+	reply, _, err := client.Exchange(req, addr.String())
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+
+	// The looped request is refused by the proxy and the refusal is
+	// forwarded to the client.
+	assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+}
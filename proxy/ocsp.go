@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"golang.org/x/crypto/ocsp"
+)
+
+// defaultOCSPRefresh is the interval of fetching the OCSP staples used when
+// Config.OCSPRefreshInterval is zero.
+const defaultOCSPRefresh = time.Hour
+
+// maxOCSPResponseSize is the maximum size of the OCSP responder's response.
+const maxOCSPResponseSize = 64 * 1024
+
+// initServerTLSConfig makes the listeners choose the certificate of TLSConfig
+// with getCertificate, so that it could be replaced with SetCertificate and the
+// OCSP responses could be stapled to it.
+func (p *Proxy) initServerTLSConfig() {
+	p.listenTLSConfig = nil
+	if p.TLSConfig == nil {
+		return
+	}
+
+	if p.currentCertificate() == nil {
+		p.setOCSPStaple(p.OCSPStaple)
+	}
+
+	// The certificates are removed from the listeners' configuration so
+	// that the current certificate with the current staple is always
+	// chosen by GetCertificate.
+	orig := p.TLSConfig
+	conf := orig.Clone()
+	conf.Certificates = nil
+	conf.NameToCertificate = nil //nolint:staticcheck
+	conf.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return p.getCertificate(orig, hello)
+	}
+	p.listenTLSConfig = conf
+}
+
+// serverTLSConfig returns the TLS configuration of the TLS, HTTPS, and QUIC
+// listeners.
+func (p *Proxy) serverTLSConfig() *tls.Config {
+	if p.listenTLSConfig != nil {
+		return p.listenTLSConfig
+	}
+
+	return p.TLSConfig
+}
+
+// getCertificate chooses the certificate from conf for the client and staples
+// the current OCSP response to it if it's the first one.  The certificate set
+// with SetCertificate is chosen instead of the ones from conf.
+func (p *Proxy) getCertificate(conf *tls.Config, hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if rotated := p.currentCertificate(); rotated != nil {
+		cert := *rotated
+		if staple := p.currentOCSPStaple(); len(staple) != 0 {
+			cert.OCSPStaple = staple
+		}
+
+		return &cert, nil
+	}
+
+	if conf.GetCertificate != nil {
+		return conf.GetCertificate(hello)
+	}
+
+	if len(conf.Certificates) == 0 {
+		return nil, errors.New("no certificates configured")
+	}
+
+	// Choose the certificate the way crypto/tls does, the first one is the
+	// default.
+	if len(conf.Certificates) > 1 {
+		for i := range conf.Certificates {
+			if hello.SupportsCertificate(&conf.Certificates[i]) != nil {
+				continue
+			}
+
+			if i != 0 {
+				return &conf.Certificates[i], nil
+			}
+
+			break
+		}
+	}
+
+	cert := conf.Certificates[0]
+	if staple := p.currentOCSPStaple(); len(staple) != 0 {
+		cert.OCSPStaple = staple
+	}
+
+	return &cert, nil
+}
+
+// setOCSPStaple sets the OCSP response to staple.
+func (p *Proxy) setOCSPStaple(staple []byte) {
+	p.ocspLock.Lock()
+	defer p.ocspLock.Unlock()
+
+	p.ocspStaple = staple
+}
+
+// SetCertificate replaces the certificate of TLSConfig for the new connections
+// of the TLS, HTTPS, and QUIC listeners, e.g. when it's renewed, without
+// restarting them.  The established connections keep the previous one.
+// TLSConfigDoT and TLSConfigDoH aren't affected.  The OCSP staple of the
+// previous certificate is dropped and the new one is fetched if
+// OCSPResponderURL is set.
+func (p *Proxy) SetCertificate(cert tls.Certificate) {
+	p.ocspLock.Lock()
+	p.certificate = &cert
+	p.ocspStaple = nil
+	p.ocspLock.Unlock()
+
+	log.Info("The TLS certificate has been replaced")
+
+	if p.OCSPResponderURL != "" && p.background != nil {
+		p.background.submit(p.refreshOCSP)
+	}
+}
+
+// currentCertificate returns the certificate set with SetCertificate or nil if
+// there is none.
+func (p *Proxy) currentCertificate() *tls.Certificate {
+	p.ocspLock.RLock()
+	defer p.ocspLock.RUnlock()
+
+	return p.certificate
+}
+
+// currentOCSPStaple returns the OCSP response to staple.
+func (p *Proxy) currentOCSPStaple() []byte {
+	p.ocspLock.RLock()
+	defer p.ocspLock.RUnlock()
+
+	return p.ocspStaple
+}
+
+// startOCSPRefresh starts fetching the OCSP staple from OCSPResponderURL and
+// refreshing it in the background, since an unreachable responder may take a
+// while to time out.
+func (p *Proxy) startOCSPRefresh() {
+	if p.listenTLSConfig == nil || p.OCSPResponderURL == "" {
+		return
+	}
+
+	p.background.submit(p.refreshOCSP)
+
+	interval := p.OCSPRefreshInterval
+	if interval == 0 {
+		interval = defaultOCSPRefresh
+	}
+
+	go p.refreshOCSPLoop(interval, p.shutdown)
+}
+
+// refreshOCSPLoop refreshes the OCSP staple each interval until shutdown is
+// closed.
+func (p *Proxy) refreshOCSPLoop(interval time.Duration, shutdown chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.background.submit(p.refreshOCSP)
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// refreshOCSP fetches the OCSP staple for the certificate set with
+// SetCertificate or the first certificate of TLSConfig.  The current staple is
+// kept if it fails.
+func (p *Proxy) refreshOCSP() {
+	cert := p.currentCertificate()
+	if cert == nil {
+		cert = &p.TLSConfig.Certificates[0]
+	}
+
+	staple, err := fetchOCSPStaple(p.OCSPResponderURL, *cert)
+	if err != nil {
+		log.Error("couldn't refresh the OCSP staple: %s", err)
+
+		return
+	}
+
+	p.ocspLock.Lock()
+	defer p.ocspLock.Unlock()
+
+	// Don't staple the response to another certificate if the one has been
+	// replaced meanwhile.
+	if p.certificate != nil && p.certificate != cert {
+		log.Debug("The certificate has been replaced, dropping the OCSP staple")
+
+		return
+	}
+
+	p.ocspStaple = staple
+	log.Debug("Refreshed the OCSP staple from %s", p.OCSPResponderURL)
+}
+
+// fetchOCSPStaple requests the OCSP response for cert from the responder at
+// url.  The issuer's certificate must follow the leaf one in the chain unless
+// the leaf is self-signed.
+func fetchOCSPStaple(url string, cert tls.Certificate) (staple []byte, err error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("empty certificate chain")
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, errorx.Decorate(err, "parsing certificate")
+	}
+
+	issuer := leaf
+	if len(cert.Certificate) > 1 {
+		issuer, err = x509.ParseCertificate(cert.Certificate[1])
+		if err != nil {
+			return nil, errorx.Decorate(err, "parsing issuer certificate")
+		}
+	}
+
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, errorx.Decorate(err, "creating request")
+	}
+
+	client := &http.Client{Timeout: defaultTimeout}
+	resp, err := client.Post(url, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("responder returned status %d", resp.StatusCode)
+	}
+
+	staple, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, errorx.Decorate(err, "reading response")
+	}
+
+	// Staple the revoked status as well since it's still valid, but warn
+	// about it.
+	r, err := ocsp.ParseResponseForCert(staple, leaf, issuer)
+	if err != nil {
+		return nil, errorx.Decorate(err, "parsing response")
+	}
+	if r.Status != ocsp.Good {
+		log.Error("OCSP responder %s reports status %d of the certificate", url, r.Status)
+	}
+
+	return staple, nil
+}
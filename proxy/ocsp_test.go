@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ocsp"
+)
+
+// stapledResponse returns the OCSP response stapled by the TLS listener of
+// dnsProxy.
+func stapledResponse(t *testing.T, dnsProxy *Proxy, caPem []byte) []byte {
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPem)
+
+	conn, err := tls.Dial("tcp", dnsProxy.Addr(ProtoTLS).String(), &tls.Config{
+		ServerName: tlsServerName,
+		RootCAs:    roots,
+	})
+	if err != nil {
+		t.Fatalf("cannot connect: %s", err)
+	}
+	defer conn.Close()
+
+	return conn.ConnectionState().OCSPResponse
+}
+
+func TestOCSPStaple(t *testing.T) {
+	serverConfig, caPem := createServerTLSConfig(t)
+	dnsProxy := createTestProxy(t, serverConfig)
+	dnsProxy.OCSPStaple = []byte("staple")
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	cert, err := dnsProxy.serverTLSConfig().GetCertificate(&tls.ClientHelloInfo{ServerName: tlsServerName})
+	assert.Nil(t, err)
+	if assert.NotNil(t, cert) {
+		assert.Equal(t, []byte("staple"), cert.OCSPStaple)
+	}
+
+	assert.Equal(t, []byte("staple"), stapledResponse(t, dnsProxy, caPem))
+
+	// The user's configuration isn't changed.
+	assert.Nil(t, serverConfig.Certificates[0].OCSPStaple)
+}
+
+func TestOCSPResponder(t *testing.T) {
+	serverConfig, caPem := createServerTLSConfig(t)
+	cert := serverConfig.Certificates[0]
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("cannot parse the certificate: %s", err)
+	}
+
+	// The test certificate is self-signed, so it's the issuer and the
+	// responder as well.
+	staple, err := ocsp.CreateResponse(leaf, leaf, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: leaf.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Hour),
+		NextUpdate:   time.Now().Add(time.Hour),
+	}, cert.PrivateKey.(crypto.Signer))
+	if err != nil {
+		t.Fatalf("cannot create the OCSP response: %s", err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req, pErr := ocsp.ParseRequest(body)
+		if pErr != nil || req.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		_, _ = w.Write(staple)
+	}))
+	defer srv.Close()
+
+	dnsProxy := createTestProxy(t, serverConfig)
+	dnsProxy.OCSPResponderURL = srv.URL
+
+	err = dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	// The staple is fetched in the background.
+	assert.Eventually(t, func() bool {
+		return dnsProxy.currentOCSPStaple() != nil
+	}, defaultTimeout, 10*time.Millisecond)
+	assert.Equal(t, staple, stapledResponse(t, dnsProxy, caPem))
+}
+
+func TestSetCertificate(t *testing.T) {
+	serverConfig, caPem := createServerTLSConfig(t)
+	newConfig, newCAPem := createServerTLSConfig(t)
+
+	dnsProxy := createTestProxy(t, serverConfig)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{createTestUpstream()}
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPem)
+	roots.AppendCertsFromPEM(newCAPem)
+
+	dial := func() *dns.Conn {
+		conn, dErr := tls.Dial("tcp", dnsProxy.Addr(ProtoTLS).String(), &tls.Config{
+			ServerName: tlsServerName,
+			RootCAs:    roots,
+		})
+		if dErr != nil {
+			t.Fatalf("cannot connect: %s", dErr)
+		}
+
+		return &dns.Conn{Conn: conn}
+	}
+	peerCert := func(conn *dns.Conn) []byte {
+		return conn.Conn.(*tls.Conn).ConnectionState().PeerCertificates[0].Raw
+	}
+
+	oldConn := dial()
+	defer oldConn.Close()
+	assert.Equal(t, serverConfig.Certificates[0].Certificate[0], peerCert(oldConn))
+
+	dnsProxy.SetCertificate(newConfig.Certificates[0])
+
+	newConn := dial()
+	defer newConn.Close()
+	assert.Equal(t, newConfig.Certificates[0].Certificate[0], peerCert(newConn))
+
+	// The established connection keeps working with the previous
+	// certificate.
+	for _, conn := range []*dns.Conn{oldConn, newConn} {
+		err = conn.WriteMsg(createTestMessage())
+		assert.Nil(t, err)
+		reply, rErr := conn.ReadMsg()
+		if assert.Nil(t, rErr) {
+			assertResponse(t, reply)
+		}
+	}
+	assert.Equal(t, serverConfig.Certificates[0].Certificate[0], peerCert(oldConn))
+}
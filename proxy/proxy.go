@@ -3,9 +3,13 @@
 package proxy
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"regexp"
 	"sync"
 	"time"
 
@@ -38,6 +42,10 @@ const (
 	ProtoTLS = "tls"
 	// ProtoHTTPS is DNS-over-HTTPS
 	ProtoHTTPS = "https"
+	// ProtoHTTP is DNS-over-HTTPS served over plain HTTP, see
+	// Config.HTTPListenAddr.  It's only used to get the listen addresses,
+	// the requests have ProtoHTTPS.
+	ProtoHTTP = "http"
 	// ProtoQUIC is QUIC transport
 	ProtoQUIC = "quic"
 	// ProtoDNSCrypt is DNSCrypt
@@ -48,26 +56,78 @@ const (
 
 // Proxy combines the proxy server state and configuration
 type Proxy struct {
-	started bool // Started flag
+	started  bool          // Started flag
+	shutdown chan struct{} // closed when the proxy is stopped
 
 	// Listeners
 	// --
 
 	udpListen         []*net.UDPConn   // UDP listen connections
 	tcpListen         []net.Listener   // TCP listeners
-	tlsListen         []net.Listener   // TLS listeners
+	tlsListen         []net.Listener   // TCP listeners for the TLS connections
 	quicListen        []quic.Listener  // QUIC listeners
 	httpsListen       []net.Listener   // HTTPS listeners
 	httpsServer       []*http.Server   // HTTPS server instance
+	httpListen        []net.Listener   // plain HTTP listeners
+	httpServer        []*http.Server   // plain HTTP server instances
 	dnsCryptUDPListen []*net.UDPConn   // UDP listen connections for DNSCrypt
 	dnsCryptTCPListen []net.Listener   // TCP listeners for DNSCrypt
 	dnsCryptServer    *dnscrypt.Server // DNSCrypt server instance
 
+	selfPTRNames       map[string]bool            // reverse names of the listen addresses, see SelfPTR
+	geoUpstreamConfigs map[string]*UpstreamConfig // upstreams by location, see GeoUpstreams
+	v4UpstreamConfig   *UpstreamConfig            // upstreams for A requests, see UpstreamsV4
+	v6UpstreamConfig   *UpstreamConfig            // upstreams for AAAA requests, see UpstreamsV6
+	rootHints          *rootHints                 // root NS answer, see AnswerRootLocally
+	rootHintsLock      sync.RWMutex               // protects rootHints
+	secondaryZones     map[string]*zoneData       // transferred zones by name, see SecondaryZones
+	secondaryZonesLock sync.RWMutex               // protects secondaryZones
+	typeHandlers       map[uint16]TypeHandler     // handlers by request type, see RegisterTypeHandler
+	typeHandlersLock   sync.RWMutex               // protects typeHandlers
+	blocklist          *blocklist                 // blocked domains, see Blocklist
+	blocklistRegex     []*regexp.Regexp           // compiled BlocklistRegex
+	listenTLSConfig    *tls.Config                // listeners' TLS configuration choosing the current certificate
+	certificate        *tls.Certificate           // certificate replacing the one of TLSConfig, see SetCertificate
+	ocspStaple         []byte                     // current OCSP response to staple
+	ocspLock           sync.RWMutex               // protects certificate and ocspStaple
+
+	subscribers     map[chan QueryEvent]struct{} // channels of the subscribers, see Subscribe
+	subscribersLock sync.RWMutex                 // protects subscribers
+
+	health         *HealthSnapshot // result of the last health check, see HealthCheckInterval
+	healthLock     sync.RWMutex    // protects health
+	healthChecking uint32          // 1 while the health check is running, accessed atomically
+
+	ready       chan struct{}  // closed once the proxy is started, see Ready
+	readyLock   sync.Mutex     // protects ready
+	listenersWG sync.WaitGroup // done once all the listener loops have exited
+
+	draining         bool          // true while Stop waits for the requests in progress, see StopDrainTimeout
+	drained          chan struct{} // closed once there are no requests in progress while draining
+	requestsInFlight int           // number of the requests in progress, see StopDrainTimeout
+	drainLock        sync.Mutex    // protects draining, drained and requestsInFlight
+
+	lastRequestID uint64 // ID of the last request handled, accessed atomically
+
+	tcpConns         int32  // number of the TCP and TLS connections being handled, accessed atomically
+	tcpConnsRejected uint32 // number of the TCP and TLS connections closed due to MaxTCPConnections, accessed atomically
+
 	// Upstream
 	// --
 
-	upstreamRttStats map[string]int // Map of upstream addresses and their rtt. Used to sort upstreams "from fast to slow"
-	rttLock          sync.Mutex     // Synchronizes access to the upstreamRttStats map
+	upstreamRttStats  map[string]*rttStats // Map of upstream addresses and their rtt. Used to sort upstreams "from fast to slow"
+	upstreamInFlight  map[string]int       // Map of upstream addresses and the number of their unfinished exchanges
+	upstreamFailed    map[string]bool      // Map of upstream addresses which last exchange has failed
+	upstreamPenalized map[string]time.Time // Map of upstream addresses and the time until which they are excluded from the selection
+	rttLock           sync.Mutex           // Synchronizes access to the upstreamRttStats, upstreamInFlight, upstreamFailed and upstreamPenalized maps
+
+	abandonedExchanges int32 // number of the timed out exchanges still running, accessed atomically, see AdaptiveTimeout
+
+	coalesced    map[string]*coalescedExchange // unfinished exchanges by upstream and request, see CoalesceUpstreamQueries
+	coalesceLock sync.Mutex                    // protects coalesced
+
+	ednsIncapable     *gocache.Cache // addresses of upstreams that failed to process EDNS requests
+	ednsIncapableLock sync.Mutex     // Synchronizes access to ednsIncapable
 
 	// DNS64 (in case dnsproxy works in a NAT64/DNS64 network)
 	// --
@@ -78,8 +138,13 @@ type Proxy struct {
 	// Ratelimit
 	// --
 
-	ratelimitBuckets *gocache.Cache // where the ratelimiters are stored, per IP
-	ratelimitLock    sync.Mutex     // Synchronizes access to ratelimitBuckets
+	ratelimitBuckets *gocache.Cache      // where the ratelimiters are stored, per IP
+	ratelimitLock    sync.Mutex          // Synchronizes access to ratelimitBuckets
+	udpInflight      map[string]struct{} // client IPs with UDP requests in flight, see UDPSingleInflightPerClient
+	udpInflightLock  sync.Mutex          // protects udpInflight
+	loopTag          []byte              // tag of the requests to the upstreams, see LoopDetection
+	scanQtypes       *gocache.Cache      // types requested by the clients per name, see ScanDefense
+	scanLock         sync.Mutex          // protects scanQtypes and its values
 
 	// DNS cache
 	// --
@@ -87,17 +152,42 @@ type Proxy struct {
 	cache       *cache       // cache instance (nil if cache is disabled)
 	cacheSubnet *cacheSubnet // cache instance (nil if cache is disabled)
 
+	cacheTTLOverrides map[string]uint32 // normalized CacheTTLOverrides
+
+	refreshing     map[string]struct{} // keys of the cache entries being refreshed
+	refreshingLock sync.Mutex          // Synchronizes access to refreshing
+
+	// Stub zones
+	// --
+
+	stubZones map[string][]upstream.Upstream // name servers of the normalized StubZones
+
 	// FastestAddr module
 	// --
 
 	fastestAddr *fastip.FastestAddr // fastest-addr module
 
+	// DNSTap
+	// --
+
+	dnstap *dnstapWriter // DNSTap writer (nil if DNSTap is disabled)
+
+	// Query log
+	// --
+
+	queryLog *queryLogWriter // query log writer (nil if the query log is disabled)
+
 	// Other
 	// --
 
-	bytesPool    *sync.Pool // bytes pool to avoid unnecessary allocations when reading DNS packets
-	udpOOBSize   int        // size for received OOB data
-	sync.RWMutex            // protects parallel access to proxy structures
+	background   *backgroundPool // workers running the background jobs
+	bytesPool    *sync.Pool      // bytes pool to avoid unnecessary allocations when reading DNS packets
+	udpOOBSize   int             // size for received OOB data
+	sync.RWMutex                 // protects parallel access to proxy structures
+
+	// udpReadFunc reads the UDP packets, proxyutil.UDPRead is used if nil.
+	// It's only set in tests.
+	udpReadFunc func(conn *net.UDPConn, b []byte, oobSize int) (int, net.IP, *net.UDPAddr, error)
 
 	// requestGoroutinesSema limits the number of simultaneous requests.
 	//
@@ -119,19 +209,48 @@ func (p *Proxy) Init() (err error) {
 
 		p.cache = &cache{
 			cacheSize: p.CacheSizeBytes,
+			clock:     p.now,
+			onEvict:   p.CacheEvictionCallback,
+			rcodes:    p.CacheableRcodes,
 		}
 
 		if p.Config.EnableEDNSClientSubnet {
 			p.cacheSubnet = &cacheSubnet{
 				cacheSize: p.CacheSizeBytes,
+				clock:     p.now,
+				onEvict:   p.CacheEvictionCallback,
+				rcodes:    p.CacheableRcodes,
 			}
 		}
 	}
 
-	if p.TLSConfig != nil && len(p.TLSConfig.NextProtos) == 0 {
-		p.TLSConfig.NextProtos = append([]string{
-			"http/1.1", http2.NextProtoTLS, NextProtoDQ,
-		}, compatProtoDQ...)
+	p.initCacheTTLOverrides()
+
+	for _, conf := range []*tls.Config{p.TLSConfig, p.TLSConfigDoT, p.TLSConfigDoH} {
+		if conf != nil && len(conf.NextProtos) == 0 {
+			conf.NextProtos = append([]string{
+				"http/1.1", http2.NextProtoTLS, NextProtoDQ,
+			}, compatProtoDQ...)
+		}
+	}
+
+	p.initServerTLSConfig()
+
+	err = p.initLoopDetection()
+	if err != nil {
+		return err
+	}
+
+	err = p.initStubZones()
+	if err != nil {
+		return err
+	}
+
+	p.initBlocklist()
+
+	err = p.initBlocklistRegex()
+	if err != nil {
+		return err
 	}
 
 	if p.MaxGoroutines > 0 {
@@ -171,9 +290,63 @@ func (p *Proxy) Init() (err error) {
 		p.fastestAddr = fastip.NewFastestAddr()
 	}
 
+	p.initGeoUpstreams()
+	p.initFamilyUpstreams()
+
+	return nil
+}
+
+// startBackground starts the background workers and the DNSTap and query log
+// writers.  It releases the started ones on error.
+func (p *Proxy) startBackground() (err error) {
+	workers := p.BackgroundConcurrency
+	if workers == 0 {
+		workers = defaultBackgroundConcurrency
+	}
+	p.background = newBackgroundPool(workers)
+
+	if p.DNSTapEnabled {
+		log.Info("DNSTap is enabled: %s://%s", p.DNSTapNetwork, p.DNSTapAddress)
+		p.dnstap = newDNSTapWriter(p.DNSTapNetwork, p.DNSTapAddress)
+	}
+
+	if p.QueryLogFile != "" {
+		log.Info("Query log is enabled: %s", p.QueryLogFile)
+		var queryLog *queryLogWriter
+		queryLog, err = newQueryLogWriter(
+			p.QueryLogFile,
+			int64(p.QueryLogMaxSizeMB)*1024*1024,
+			time.Duration(p.QueryLogMaxAgeDays)*24*time.Hour,
+		)
+		if err != nil {
+			p.stopBackground()
+
+			return errorx.Decorate(err, "opening query log")
+		}
+		p.queryLog = queryLog
+	}
+
 	return nil
 }
 
+// stopBackground waits for the running background jobs to finish and closes
+// the DNSTap and query log writers.  The handlers of the already accepted
+// connections may still write to them, but the closed writers drop their
+// messages.
+func (p *Proxy) stopBackground() {
+	if p.background != nil {
+		p.background.close()
+	}
+
+	if p.dnstap != nil {
+		p.dnstap.close()
+	}
+
+	if p.queryLog != nil {
+		p.queryLog.close()
+	}
+}
+
 // Start initializes the proxy server and starts listening
 func (p *Proxy) Start() (err error) {
 	p.Lock()
@@ -190,12 +363,29 @@ func (p *Proxy) Start() (err error) {
 		return err
 	}
 
+	err = p.startBackground()
+	if err != nil {
+		return err
+	}
+
+	p.shutdown = make(chan struct{})
+	p.resetDrain()
+	p.initSelfPTR()
+	p.initRootHints()
+	p.initSecondaryZones()
+	p.startOCSPRefresh()
+	p.startHealthChecks()
+
 	err = p.startListeners()
 	if err != nil {
+		p.releaseFailedStart()
+
 		return err
 	}
 
 	p.started = true
+	p.setReady(true)
+
 	return nil
 }
 
@@ -203,6 +393,40 @@ func (p *Proxy) Start() (err error) {
 func (p *Proxy) Stop() error {
 	log.Info("Stopping the DNS proxy server")
 
+	p.drain()
+
+	err := p.closeListeners()
+
+	// The listener loops exit once their listeners are closed.  Wait for
+	// them outside of the lock since they use it.
+	p.listenersWG.Wait()
+
+	p.stopBackground()
+
+	return err
+}
+
+// releaseFailedStart releases everything Start has acquired before it has
+// failed to start the listeners.  No listener loops are running at this
+// point.  p must be locked.
+func (p *Proxy) releaseFailedStart() {
+	close(p.shutdown)
+
+	// The servers don't own the listeners until they serve them.
+	for _, l := range append(p.httpsListen, p.httpListen...) {
+		_ = l.Close()
+	}
+
+	err := p.closeListenersLocked()
+	if err != nil {
+		log.Debug("closing the listeners: %s", err)
+	}
+
+	p.stopBackground()
+}
+
+// closeListeners closes all the listeners of the started proxy.
+func (p *Proxy) closeListeners() error {
 	p.Lock()
 	defer p.Unlock()
 	if !p.started {
@@ -210,6 +434,19 @@ func (p *Proxy) Stop() error {
 		return nil
 	}
 
+	close(p.shutdown)
+	p.setReady(false)
+
+	err := p.closeListenersLocked()
+
+	p.started = false
+	log.Println("Stopped the DNS proxy server")
+
+	return err
+}
+
+// closeListenersLocked closes all the listeners.  p must be locked.
+func (p *Proxy) closeListenersLocked() error {
 	errs := []error{}
 
 	for _, l := range p.tcpListen {
@@ -222,7 +459,8 @@ func (p *Proxy) Stop() error {
 
 	for _, l := range p.udpListen {
 		err := l.Close()
-		if err != nil {
+		// The socket which is being restarted is already closed.
+		if err != nil && !proxyutil.IsConnClosed(err) {
 			errs = append(errs, errorx.Decorate(err, "couldn't close UDP listening socket"))
 		}
 	}
@@ -245,6 +483,22 @@ func (p *Proxy) Stop() error {
 	p.httpsListen = nil
 	p.httpsServer = nil
 
+	for _, srv := range p.httpServer {
+		err := srv.Close()
+		if err != nil {
+			errs = append(errs, errorx.Decorate(err, "couldn't close HTTP server"))
+		}
+	}
+	p.httpListen = nil
+	p.httpServer = nil
+
+	if p.HTTPSUnixSocket != "" {
+		err := os.Remove(p.HTTPSUnixSocket)
+		if err != nil && !os.IsNotExist(err) {
+			errs = append(errs, errorx.Decorate(err, "couldn't remove HTTPS Unix socket"))
+		}
+	}
+
 	for _, l := range p.quicListen {
 		err := l.Close()
 		if err != nil {
@@ -269,8 +523,6 @@ func (p *Proxy) Stop() error {
 	}
 	p.dnsCryptTCPListen = nil
 
-	p.started = false
-	log.Println("Stopped the DNS proxy server")
 	if len(errs) != 0 {
 		return errorx.DecorateMany("Failed to stop DNS proxy server", errs...)
 	}
@@ -278,7 +530,7 @@ func (p *Proxy) Stop() error {
 }
 
 // Addrs returns all listen addresses for the specified proto or nil if the proxy does not listen to it.
-// proto must be "tcp", "tls", "https", "quic", or "udp"
+// proto must be "tcp", "tls", "https", "http", "quic", or "udp"
 func (p *Proxy) Addrs(proto string) []net.Addr {
 	p.RLock()
 	defer p.RUnlock()
@@ -301,6 +553,11 @@ func (p *Proxy) Addrs(proto string) []net.Addr {
 			addrs = append(addrs, l.Addr())
 		}
 
+	case ProtoHTTP:
+		for _, l := range p.httpListen {
+			addrs = append(addrs, l.Addr())
+		}
+
 	case ProtoUDP:
 		for _, l := range p.udpListen {
 			addrs = append(addrs, l.LocalAddr())
@@ -321,14 +578,14 @@ func (p *Proxy) Addrs(proto string) []net.Addr {
 		}
 
 	default:
-		panic("proto must be 'tcp', 'tls', 'https', 'quic', 'dnscrypt' or 'udp'")
+		panic("proto must be 'tcp', 'tls', 'https', 'http', 'quic', 'dnscrypt' or 'udp'")
 	}
 
 	return addrs
 }
 
 // Addr returns the first listen address for the specified proto or null if the proxy does not listen to it
-// proto must be "tcp", "tls", "https", "quic", or "udp"
+// proto must be "tcp", "tls", "https", "http", "quic", or "udp"
 func (p *Proxy) Addr(proto string) net.Addr {
 	p.RLock()
 	defer p.RUnlock()
@@ -351,6 +608,12 @@ func (p *Proxy) Addr(proto string) net.Addr {
 		}
 		return p.httpsListen[0].Addr()
 
+	case ProtoHTTP:
+		if len(p.httpListen) == 0 {
+			return nil
+		}
+		return p.httpListen[0].Addr()
+
 	case ProtoUDP:
 		if len(p.udpListen) == 0 {
 			return nil
@@ -369,7 +632,7 @@ func (p *Proxy) Addr(proto string) net.Addr {
 		}
 		return p.dnsCryptUDPListen[0].LocalAddr()
 	default:
-		panic("proto must be 'tcp', 'tls', 'https', 'quic', 'dnscrypt' or 'udp'")
+		panic("proto must be 'tcp', 'tls', 'https', 'http', 'quic', 'dnscrypt' or 'udp'")
 	}
 }
 
@@ -386,6 +649,15 @@ func addDO(msg *dns.Msg) {
 	msg.SetEdns0(defaultUDPBufSize, true)
 }
 
+// now returns the current time using the configured time source.
+func (p *Proxy) now() time.Time {
+	if p.TimeSource != nil {
+		return p.TimeSource()
+	}
+
+	return time.Now()
+}
+
 // defaultUDPBufSize defines the default size of UDP buffer for EDNS0 RRs.
 const defaultUDPBufSize = 2048
 
@@ -402,47 +674,153 @@ func (p *Proxy) Resolve(d *DNSContext) error {
 	// upstreams.
 	cacheWorks := p.cache != nil && d.CustomUpstreamConfig == nil
 	if cacheWorks {
-		if p.replyFromCache(d) {
+		if hit, expiring := p.replyFromCache(d); hit {
+			if expiring && p.OptimisticCache {
+				p.refreshCache(d)
+			}
+
 			// Complete the response from cache.
+			normalizeNames(d.Req, d.Res)
 			d.scrub()
 
 			return nil
 		}
 
-		// On cache miss request for DNSSEC from the upstream to cache it
-		// afterwards.
+		if p.replyAnyFromCache(d) {
+			d.scrub()
+
+			return nil
+		}
+	}
+
+	// On cache miss request for DNSSEC from the upstream to cache it
+	// afterwards.  The DNSSEC records are removed from the response by
+	// scrub if the client hasn't requested them.
+	if cacheWorks || p.AlwaysRequestDNSSEC {
 		addDO(d.Req)
 	}
 
-	host := d.Req.Question[0].Name
+	reply, err := p.resolveUpstream(d, cacheWorks)
+	if reply == nil {
+		d.Res = p.genServerFailure(d.Req)
+		if errors.Is(err, errNoUpstreams) {
+			// There is nothing to recurse to at all, so don't pretend
+			// that recursion is available.
+			d.Res.RecursionAvailable = false
+		}
+		if !errors.Is(err, errCNAMEChain) {
+			d.hasEDNS0 = false
+		}
+	} else {
+		d.Res = reply
+	}
+
+	// scrub removes the upstream's OPT record, so keep the ZONEVERSION
+	// options if the client has requested them, see setResponseOPT.
+	var zoneVersion []dns.EDNS0
+	if len(ednsOptions(d.Req, ednsOptionZoneVersion)) != 0 {
+		zoneVersion = ednsOptions(d.Res, ednsOptionZoneVersion)
+	}
+
+	// Complete the response.
+	normalizeNames(d.Req, d.Res)
+	d.scrub()
+
+	if opt := d.Res.IsEdns0(); opt != nil && len(zoneVersion) != 0 {
+		opt.Option = append(opt.Option, zoneVersion...)
+	}
+
+	if errors.Is(err, errCNAMEChain) {
+		addEDE(d.Res, edeOther, err.Error())
+	}
+
+	if p.ResponseHandler != nil {
+		p.ResponseHandler(d, err)
+	}
+
+	return err
+}
+
+// resolveUpstream exchanges d.Req with the upstreams and returns the processed
+// response, which is also put into the cache if cacheWorks is true.  It also
+// sets d.Upstream to the upstream that has resolved the request.
+func (p *Proxy) resolveUpstream(d *DNSContext, cacheWorks bool) (reply *dns.Msg, err error) {
+	req := p.upstreamRequest(d)
+	host := req.Question[0].Name
 	var upstreams []upstream.Upstream
+	var stub, reserved bool
 
-	// Get custom upstreams first -- note that they might be empty
+	// Get custom upstreams first -- note that they might be empty, then the
+	// name servers of the stub zones
 	if d.CustomUpstreamConfig != nil {
 		upstreams = d.CustomUpstreamConfig.getUpstreamsForDomain(host)
+	} else if upstreams = p.stubZoneUpstreams(host); upstreams != nil {
+		stub = true
+		req = stubRequest(req)
 	}
 	// If nothing found in the custom upstreams, start using the default ones
-	if upstreams == nil {
-		upstreams = p.UpstreamConfig.getUpstreamsForDomain(host)
+	if upstreams == nil && p.UpstreamConfig != nil {
+		upstreams, reserved = p.defaultUpstreamConfig(d, req.Question[0].Qtype).upstreamsForDomain(host)
 	}
 
 	// execute the DNS request
 	startTime := time.Now()
-	reply, u, err := p.exchange(d.Req, upstreams)
-	if p.isEmptyAAAAResponse(reply, d.Req) {
-		log.Tracef("Received empty AAAA response, checking DNS64")
-		reply, u, err = p.checkDNS64(d.Req, reply, upstreams)
+	var u upstream.Upstream
+	// DNS64Upstream only replaces the default upstreams, the ones reserved for
+	// the domain may serve the private zones it doesn't know about.
+	if p.useDNS64Upstream(d, req) && !stub && !reserved {
+		reply, u, err = p.exchangeDNS64(req, upstreams)
+	} else {
+		reply, u, err = p.exchangeEDNSAware(req, upstreams)
+	}
+	if u != nil {
+		p.dnstapResolverExchange(req, reply, u.Address(), startTime)
+		p.reportUpstreamSelected(req.Question[0], u, upstreams)
+	}
+
+	if p.isEmptyAAAAResponse(reply, req) {
+		log.Tracef("[%d] Received empty AAAA response, checking DNS64", d.RequestID)
+		mappedReply, mappedU, mappedErr := p.checkDNS64(req, reply, upstreams)
+		if mappedErr == nil || reply == nil {
+			reply, u, err = mappedReply, mappedU, mappedErr
+		}
 	} else if p.isBogusNXDomain(reply) {
-		log.Tracef("Received IP from the bogus-nxdomain list, replacing response")
+		log.Tracef("[%d] Received IP from the bogus-nxdomain list, replacing response", d.RequestID)
 		reply = p.genNXDomain(reply)
 	}
 
 	rtt := int(time.Since(startTime) / time.Millisecond)
-	log.Tracef("RTT: %d ms", rtt)
+	log.Tracef("[%d] RTT: %d ms", d.RequestID, rtt)
+
+	// The fallbacks are recursive resolvers which can't replace the name
+	// servers of the stub zones.
+	if err != nil && p.Fallbacks != nil && !stub {
+		log.Tracef("[%d] Using the fallback upstream due to %s", d.RequestID, err)
+		reply, u, err = upstream.ExchangeParallel(p.trackingUpstreams(p.validatingUpstreams(p.retransmittingUpstreams(p.tcpUpstreams(p.Fallbacks)))), req)
+		u = unwrapUpstream(u)
+	}
 
-	if err != nil && p.Fallbacks != nil {
-		log.Tracef("Using the fallback upstream due to %s", err)
-		reply, u, err = upstream.ExchangeParallel(p.Fallbacks, d.Req)
+	if reply != nil && u != nil && reply.Truncated && isStreamProto(d.Proto) {
+		log.Tracef("[%d] Truncated response for %s client, retrying over TCP", d.RequestID, d.Proto)
+		tcpReply, tcpErr := exchangeOverTCP(req, u, p.UpstreamDialTimeout)
+		if tcpErr == nil {
+			reply = tcpReply
+		} else {
+			log.Debug("[%d] Failed to retry over TCP: %s", d.RequestID, tcpErr)
+		}
+	}
+
+	if reply != nil {
+		if err = p.checkCNAMEChain(reply); err != nil {
+			log.Debug("[%d] Dropping the response for %s: %s", d.RequestID, host, err)
+			reply = nil
+		}
+	}
+
+	if reply != nil && p.StripUnsolicitedAnswers {
+		if n := stripUnsolicited(reply); n > 0 {
+			log.Debug("[%d] Removed %d unsolicited answers for %s", d.RequestID, n, host)
+		}
 	}
 
 	if reply != nil {
@@ -451,29 +829,49 @@ func (p *Proxy) Resolve(d *DNSContext) error {
 		// Set upstream that have resolved the request to DNSContext.
 		d.Upstream = u
 
+		if stub {
+			fixStubResponse(reply)
+		}
+
+		if req != d.Req {
+			// The client must get the answer to its own question.
+			reply.Id = d.Req.Id
+			reply.Question = append([]dns.Question(nil), d.Req.Question...)
+		}
+
 		p.setMinMaxTTL(reply)
+		p.capNegativeTTL(reply)
+		p.overrideCacheTTL(reply)
 
-		if cacheWorks {
+		if p.DedupAnswers {
+			reply.Answer = dedupRRs(reply.Answer)
+		}
+
+		if cacheWorks && p.isCacheableType(d.Req) {
 			// Cache the response with DNSSEC RRs.
 			p.setInCache(d, reply)
 		}
 	}
 
-	if reply == nil {
-		d.Res = p.genServerFailure(d.Req)
-		d.hasEDNS0 = false
-	} else {
-		d.Res = reply
+	return reply, err
+}
+
+// upstreamRequest returns the request to send to the upstreams instead of
+// d.Req, which is rewritten by UpstreamQueryRewrite if it's set and tagged if
+// LoopDetection is enabled.
+func (p *Proxy) upstreamRequest(d *DNSContext) (req *dns.Msg) {
+	if p.UpstreamQueryRewrite == nil {
+		return p.tagLoop(d.Req)
 	}
 
-	// Complete the response.
-	d.scrub()
+	req = p.UpstreamQueryRewrite(d.Req.Copy())
+	if req == nil || len(req.Question) != 1 {
+		log.Debug("[%d] Invalid rewritten upstream query, using the original one", d.RequestID)
 
-	if p.ResponseHandler != nil {
-		p.ResponseHandler(d, err)
+		return p.tagLoop(d.Req)
 	}
 
-	return err
+	return p.tagLoop(req)
 }
 
 // Set EDNS Client-Subnet data in DNS request
@@ -498,10 +896,10 @@ func (p *Proxy) processECS(d *DNSContext) {
 
 		if clientIP != nil && isPublicIP(clientIP) {
 			ip, mask = setECS(d.Req, clientIP, 0)
-			log.Debug("Set ECS data: %s/%d", ip, mask)
+			log.Debug("[%d] Set ECS data: %s/%d", d.RequestID, ip, mask)
 		}
 	} else {
-		log.Debug("Passing through ECS data: %s/%d", ip, mask)
+		log.Debug("[%d] Passing through ECS data: %s/%d", d.RequestID, ip, mask)
 	}
 
 	d.ecsReqIP = ip
@@ -1,44 +1,196 @@
 package proxy
 
 import (
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
 )
 
 // replyFromCache tries to get the response from general or subnet cache.
-// Returns true on success.
-func (p *Proxy) replyFromCache(d *DNSContext) (hit bool) {
+// Returns true on success.  expiring is true if the response is about to
+// expire.
+func (p *Proxy) replyFromCache(d *DNSContext) (hit, expiring bool) {
+	var val *dns.Msg
 	if !p.Config.EnableEDNSClientSubnet {
-		val, ok := p.cache.Get(d.Req)
-		if ok && val != nil {
+		val, expiring, hit = p.cache.get(d.Req)
+		if hit && val != nil {
 			d.Res = val
 			log.Debug("Serving cached response")
 
-			return true
+			return true, expiring
 		}
 
-		return false
+		return false, false
 	}
 
 	if d.ecsReqMask != 0 && p.cacheSubnet != nil {
-		val, ok := p.cacheSubnet.GetWithSubnet(d.Req, d.ecsReqIP, d.ecsReqMask)
-		if ok && val != nil {
+		val, expiring, hit = p.cacheSubnet.getWithSubnet(d.Req, d.ecsReqIP, d.ecsReqMask)
+		if hit && val != nil {
 			d.Res = val
 			log.Debug("Serving response from subnet cache")
 
-			return true
+			return true, expiring
 		}
 	} else if d.ecsReqMask == 0 && p.cache != nil {
-		val, ok := p.cache.Get(d.Req)
-		if ok && val != nil {
+		val, expiring, hit = p.cache.get(d.Req)
+		if hit && val != nil {
 			d.Res = val
 			log.Debug("Serving response from general cache")
 
-			return true
+			return true, expiring
 		}
 	}
 
-	return false
+	return false, false
+}
+
+// anyCacheTypes are the types of the records looked up in cache to answer the
+// ANY requests, see Config.AnyFromCache.
+var anyCacheTypes = func() (types []uint16) {
+	for t := range dns.TypeToString {
+		switch t {
+		case dns.TypeNone, dns.TypeReserved, dns.TypeOPT, dns.TypeTKEY, dns.TypeTSIG,
+			dns.TypeIXFR, dns.TypeAXFR, dns.TypeMAILB, dns.TypeMAILA, dns.TypeANY:
+			// Skip the meta types and the query types.
+		default:
+			types = append(types, t)
+		}
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	return types
+}()
+
+// replyAnyFromCache sets d.Res to the response to the ANY request aggregated
+// from the cached records of the requested name.  It returns false if
+// AnyFromCache is disabled, the request isn't ANY, or there are no such
+// records.
+func (p *Proxy) replyAnyFromCache(d *DNSContext) (ok bool) {
+	if !p.AnyFromCache || len(d.Req.Question) != 1 || d.Req.Question[0].Qtype != dns.TypeANY {
+		return false
+	}
+
+	name := d.Req.Question[0].Name
+	req := d.Req.Copy()
+	cd := &DNSContext{
+		Req:        req,
+		ecsReqIP:   d.ecsReqIP,
+		ecsReqMask: d.ecsReqMask,
+	}
+
+	var answers []dns.RR
+	for _, t := range anyCacheTypes {
+		req.Question[0].Qtype = t
+		if hit, _ := p.replyFromCache(cd); !hit || cd.Res.Rcode != dns.RcodeSuccess {
+			continue
+		}
+
+		// Only take the records of the requested name and not, for
+		// example, the ones of CNAME targets.
+		for _, rr := range cd.Res.Answer {
+			if strings.EqualFold(rr.Header().Name, name) {
+				answers = append(answers, rr)
+			}
+		}
+	}
+
+	if len(answers) == 0 {
+		return false
+	}
+
+	log.Debug("Serving ANY response for %s from %d cached records", name, len(answers))
+
+	d.Res = &dns.Msg{}
+	d.Res.SetReply(d.Req)
+	d.Res.RecursionAvailable = true
+	d.Res.Answer = dedupRRs(answers)
+
+	return true
+}
+
+// isCacheableType returns false if the responses to req mustn't be cached
+// according to the NonCacheableTypes setting.
+func (p *Proxy) isCacheableType(req *dns.Msg) bool {
+	if len(req.Question) == 0 {
+		return true
+	}
+
+	qtype := req.Question[0].Qtype
+	for _, t := range p.NonCacheableTypes {
+		if t == qtype {
+			log.Tracef("%s: not caching response of type %s", req.Question[0].Name, dns.TypeToString[qtype])
+
+			return false
+		}
+	}
+
+	return true
+}
+
+// initCacheTTLOverrides normalizes the domain names of CacheTTLOverrides.
+func (p *Proxy) initCacheTTLOverrides() {
+	p.cacheTTLOverrides = nil
+	if len(p.CacheTTLOverrides) == 0 {
+		return
+	}
+
+	p.cacheTTLOverrides = make(map[string]uint32, len(p.CacheTTLOverrides))
+	for name, ttl := range p.CacheTTLOverrides {
+		name = strings.TrimPrefix(strings.ToLower(strings.TrimSuffix(name, ".")), "*.")
+		p.cacheTTLOverrides[name] = ttl
+	}
+
+	log.Info("Cache TTL overrides are enabled for %d domains", len(p.cacheTTLOverrides))
+}
+
+// cacheTTLOverride returns the TTL configured for the longest domain name in
+// CacheTTLOverrides that host is equal to or is a subdomain of.
+func (p *Proxy) cacheTTLOverride(host string) (ttl uint32, ok bool) {
+	if len(p.cacheTTLOverrides) == 0 {
+		return 0, false
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for {
+		if ttl, ok = p.cacheTTLOverrides[host]; ok {
+			return ttl, true
+		}
+
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return 0, false
+		}
+		host = host[i+1:]
+	}
+}
+
+// overrideCacheTTL sets the TTL of the answers in r to the one configured in
+// CacheTTLOverrides for the requested name, if any.
+func (p *Proxy) overrideCacheTTL(r *dns.Msg) {
+	if len(r.Question) != 1 {
+		return
+	}
+
+	ttl, ok := p.cacheTTLOverride(r.Question[0].Name)
+	if !ok {
+		return
+	}
+
+	for i, rr := range r.Answer {
+		if rr.Header().Ttl == ttl {
+			continue
+		}
+
+		log.Debug("Override TTL of %s from %d to %d", rr.Header().Name, rr.Header().Ttl, ttl)
+
+		// Don't change the record which may be shared with the upstream.
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = ttl
+		r.Answer[i] = rr
+	}
 }
 
 // setInCache stores the response in general or subnet cache.
@@ -64,3 +216,51 @@ func (p *Proxy) setInCache(d *DNSContext, resp *dns.Msg) {
 		p.cache.Set(resp) // use general cache
 	}
 }
+
+// refreshCache asynchronously resolves the request from d and updates the
+// cache.  It does nothing if the same request is already being refreshed.
+func (p *Proxy) refreshCache(d *DNSContext) {
+	rd := &DNSContext{
+		Proto:      d.Proto,
+		Req:        d.Req.Copy(),
+		Addr:       d.Addr,
+		StartTime:  time.Now(),
+		ecsReqIP:   d.ecsReqIP,
+		ecsReqMask: d.ecsReqMask,
+	}
+	addDO(rd.Req)
+
+	k := string(keyWithSubnet(rd.Req, rd.ecsReqIP, rd.ecsReqMask))
+
+	p.refreshingLock.Lock()
+	if _, ok := p.refreshing[k]; ok {
+		p.refreshingLock.Unlock()
+
+		return
+	}
+	if p.refreshing == nil {
+		p.refreshing = map[string]struct{}{}
+	}
+	p.refreshing[k] = struct{}{}
+	p.refreshingLock.Unlock()
+
+	done := func() {
+		p.refreshingLock.Lock()
+		delete(p.refreshing, k)
+		p.refreshingLock.Unlock()
+	}
+
+	ok := p.background.submit(func() {
+		defer done()
+
+		log.Tracef("Refreshing the expiring cache entry for %s", rd.Req.Question[0].Name)
+		_, err := p.resolveUpstream(rd, true)
+		if err != nil {
+			log.Debug("Failed to refresh the cache entry: %s", err)
+		}
+	})
+	if !ok {
+		log.Debug("Background queue is full, not refreshing the cache entry for %s", rd.Req.Question[0].Name)
+		done()
+	}
+}
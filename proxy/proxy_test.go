@@ -1,20 +1,31 @@
 package proxy
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/binary"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"math/big"
 	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
 	"github.com/ameshkov/dnscrypt/v2"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
@@ -58,6 +69,91 @@ func TestProxyRace(t *testing.T) {
 	}
 }
 
+func TestReady(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{createTestUpstream()}
+	ready := dnsProxy.Ready()
+
+	select {
+	case <-ready:
+		t.Fatalf("the proxy is ready before start")
+	default:
+	}
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatalf("the proxy isn't ready after start")
+	}
+
+	// Send the queries right away without sleeping.
+	for _, proto := range []string{ProtoUDP, ProtoTCP} {
+		conn, err := dns.Dial(proto, dnsProxy.Addr(proto).String())
+		if err != nil {
+			t.Fatalf("cannot connect to the proxy: %s", err)
+		}
+		sendTestMessages(t, conn)
+		_ = conn.Close()
+	}
+
+	err = dnsProxy.Stop()
+	if err != nil {
+		t.Fatalf("cannot stop the DNS proxy: %s", err)
+	}
+
+	// The proxy isn't ready after it's stopped.
+	select {
+	case <-dnsProxy.Ready():
+		t.Fatalf("the proxy is ready after stop")
+	default:
+	}
+}
+
+// delayedUpstream answers the requests after the delay.
+type delayedUpstream struct {
+	rcodeUpstream
+	delay time.Duration
+}
+
+func (u *delayedUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	time.Sleep(u.delay)
+
+	return u.rcodeUpstream.Exchange(m)
+}
+
+func TestResolveUpstream(t *testing.T) {
+	first := &rcodeUpstream{rcode: dns.RcodeSuccess}
+	second := &delayedUpstream{delay: 50 * time.Millisecond}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{first, second}
+	dnsProxy.CacheEnabled = true
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	req := createHostTestMessage("host")
+	for i := 0; i < 2; i++ {
+		reply, rtt, err := dnsProxy.ResolveUpstream(req, 1)
+		assert.Nil(t, err)
+		assert.NotNil(t, reply)
+		assert.GreaterOrEqual(t, int64(rtt), int64(second.delay))
+		assert.Less(t, int64(rtt), int64(time.Second))
+	}
+
+	// The cache is bypassed.
+	assert.Equal(t, uint32(0), atomic.LoadUint32(&first.calls))
+	assert.Equal(t, uint32(2), atomic.LoadUint32(&second.calls))
+
+	for _, idx := range []int{-1, 2} {
+		_, _, err = dnsProxy.ResolveUpstream(req, idx)
+		assert.NotNil(t, err)
+	}
+}
+
 func TestUpstreamsSort(t *testing.T) {
 	testProxy := createTestProxy(t, nil)
 	upstreams := []upstream.Upstream{}
@@ -73,11 +169,9 @@ func TestUpstreamsSort(t *testing.T) {
 	}
 
 	// create upstreamRttStats for 3 upstreams
-	upstreamRttStats := map[string]int{}
-	upstreamRttStats["1.1.1.1:53"] = 10
-	upstreamRttStats["2.3.4.5:53"] = 20
-	upstreamRttStats["1.2.3.4:53"] = 30
-	testProxy.upstreamRttStats = upstreamRttStats
+	testProxy.updateRtt("1.1.1.1:53", 10)
+	testProxy.updateRtt("2.3.4.5:53", 20)
+	testProxy.updateRtt("1.2.3.4:53", 30)
 
 	sortedUpstreams := testProxy.getSortedUpstreams(upstreams)
 
@@ -411,6 +505,181 @@ func TestRefuseAny(t *testing.T) {
 	}
 }
 
+func TestRequireRD(t *testing.T) {
+	for _, requireRD := range []bool{false, true} {
+		dnsProxy := createTestProxy(t, nil)
+		dnsProxy.RequireRD = requireRD
+		dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{createTestUpstream()}
+		err := dnsProxy.Init()
+		assert.Nil(t, err)
+
+		// Recursive requests are always resolved
+		d := &DNSContext{Req: createTestMessage(), Addr: &net.TCPAddr{}}
+		err = dnsProxy.handleDNSRequest(d)
+		assert.Nil(t, err)
+		assertResponse(t, d.Res)
+		assert.True(t, d.Res.RecursionDesired)
+
+		req := createTestMessage()
+		req.RecursionDesired = false
+		d = &DNSContext{Req: req, Addr: &net.TCPAddr{}}
+		err = dnsProxy.handleDNSRequest(d)
+		assert.Nil(t, err)
+		assert.False(t, d.Res.RecursionDesired)
+		if requireRD {
+			assert.Equal(t, dns.RcodeRefused, d.Res.Rcode)
+			assert.True(t, d.Res.RecursionAvailable)
+			assert.Empty(t, d.Res.Answer)
+		} else {
+			// Non-recursive requests are passed through
+			assertResponse(t, d.Res)
+		}
+	}
+}
+
+func TestAllowedOpcodes(t *testing.T) {
+	u := &flappingUpstream{fastUpstream: fastUpstream{addr: "counting"}}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	update := &dns.Msg{}
+	update.SetUpdate("example.org.")
+	update.Insert([]dns.RR{newRR("www.example.org. 60 IN A 1.2.3.4")})
+
+	// UPDATE isn't forwarded by default
+	d := &DNSContext{Req: update, Addr: &net.TCPAddr{}}
+	err = dnsProxy.handleDNSRequest(d)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNotImplemented, d.Res.Rcode)
+	assert.Equal(t, dns.OpcodeUpdate, d.Res.Opcode)
+	assert.Zero(t, u.calls)
+
+	// The standard queries are still forwarded
+	d = &DNSContext{Req: createTestMessage(), Addr: &net.TCPAddr{}}
+	err = dnsProxy.handleDNSRequest(d)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Equal(t, 1, u.calls)
+
+	// UPDATE is forwarded when allowed
+	dnsProxy.AllowedOpcodes = []int{dns.OpcodeUpdate}
+	d = &DNSContext{Req: update, Addr: &net.TCPAddr{}}
+	err = dnsProxy.handleDNSRequest(d)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Equal(t, 2, u.calls)
+}
+
+func TestAllowedClasses(t *testing.T) {
+	u := &flappingUpstream{fastUpstream: fastUpstream{addr: "counting"}}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	hesiod := createTestMessage()
+	hesiod.Question[0].Qclass = dns.ClassHESIOD
+
+	// Only IN is forwarded by default
+	d := &DNSContext{Req: hesiod, Addr: &net.TCPAddr{}}
+	err = dnsProxy.handleDNSRequest(d)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeRefused, d.Res.Rcode)
+	assert.Zero(t, u.calls)
+
+	d = &DNSContext{Req: createTestMessage(), Addr: &net.TCPAddr{}}
+	err = dnsProxy.handleDNSRequest(d)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Equal(t, 1, u.calls)
+
+	// HS is forwarded when allowed
+	dnsProxy.AllowedClasses = []uint16{dns.ClassINET, dns.ClassHESIOD}
+	d = &DNSContext{Req: hesiod, Addr: &net.TCPAddr{}}
+	err = dnsProxy.handleDNSRequest(d)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Equal(t, 2, u.calls)
+}
+
+func TestStrictNameValidation(t *testing.T) {
+	u := &flappingUpstream{fastUpstream: fastUpstream{addr: "counting"}}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	dnsProxy.StrictNameValidation = true
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	label63 := strings.Repeat("a", 63)
+	testCases := []struct {
+		name  string
+		host  string
+		rcode int
+	}{{
+		name:  "valid",
+		host:  label63 + ".example",
+		rcode: dns.RcodeSuccess,
+	}, {
+		name:  "long_label",
+		host:  label63 + "a.example",
+		rcode: dns.RcodeFormatError,
+	}, {
+		// 4 labels of 63 octets take 256 octets with the root label.
+		name:  "long_name",
+		host:  strings.Repeat(label63+".", 3) + label63,
+		rcode: dns.RcodeFormatError,
+	}, {
+		name:  "max_name",
+		host:  strings.Repeat(label63+".", 3) + label63[:61],
+		rcode: dns.RcodeSuccess,
+	}}
+
+	calls := 0
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &DNSContext{Req: createHostTestMessage(tc.host), Addr: &net.TCPAddr{}}
+			err = dnsProxy.handleDNSRequest(d)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.rcode, d.Res.Rcode)
+
+			// The invalid names aren't sent to the upstream.
+			if tc.rcode == dns.RcodeSuccess {
+				calls++
+			}
+			assert.Equal(t, calls, u.calls)
+		})
+	}
+}
+
+func TestUpstreamQueryRewrite(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&anyRefusingUpstream{}}
+	dnsProxy.UpstreamQueryRewrite = func(req *dns.Msg) *dns.Msg {
+		// The request is a copy, so it may be changed in place.
+		req.Question[0].Qtype = dns.TypeAAAA
+		req.Id = 1
+
+		return req
+	}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	req := createHostTestMessage("host")
+	origQuestion := req.Question[0]
+	d := &DNSContext{Req: req, Addr: &net.TCPAddr{}}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+
+	assert.Equal(t, origQuestion, d.Req.Question[0])
+	assert.Equal(t, req.Id, d.Res.Id)
+	assert.Equal(t, []dns.Question{origQuestion}, d.Res.Question)
+	if assert.Len(t, d.Res.Answer, 1) {
+		assert.Equal(t, dns.TypeAAAA, d.Res.Answer[0].Header().Rrtype)
+	}
+}
+
 func TestInvalidDNSRequest(t *testing.T) {
 	// Prepare the proxy server
 	dnsProxy := createTestProxy(t, nil)
@@ -449,7 +718,9 @@ func TestInvalidDNSRequest(t *testing.T) {
 
 // Server must drop incoming Response messages
 func TestResponseInRequest(t *testing.T) {
+	u := &rcodeUpstream{rcode: dns.RcodeSuccess}
 	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
 	err := dnsProxy.Start()
 	assert.Nil(t, err)
 
@@ -462,6 +733,31 @@ func TestResponseInRequest(t *testing.T) {
 	r, _, err := client.Exchange(req, addr.String())
 	assert.NotNil(t, err)
 	assert.Nil(t, r)
+	assert.Zero(t, atomic.LoadUint32(&u.calls))
+
+	_ = dnsProxy.Stop()
+}
+
+func TestRejectResponses(t *testing.T) {
+	u := &rcodeUpstream{rcode: dns.RcodeSuccess}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	dnsProxy.RejectResponses = true
+	err := dnsProxy.Start()
+	assert.Nil(t, err)
+
+	addr := dnsProxy.Addr(ProtoUDP)
+	client := &dns.Client{Net: "udp", Timeout: 500 * time.Millisecond}
+
+	req := createTestMessage()
+	req.Response = true
+
+	r, _, err := client.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, dns.RcodeFormatError, r.Rcode)
+	}
+	assert.Zero(t, atomic.LoadUint32(&u.calls))
 
 	_ = dnsProxy.Stop()
 }
@@ -485,6 +781,262 @@ func TestNoQuestion(t *testing.T) {
 	_ = dnsProxy.Stop()
 }
 
+// Server must respond with SERVFAIL instead of crashing when there are no
+// upstreams to send the request to
+func TestNoUpstreams(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	// Emulate the upstreams configuration being broken after the start
+	dnsProxy.UpstreamConfig.Upstreams = nil
+
+	// The response isn't written anywhere since there is no connection
+	d := &DNSContext{Req: createTestMessage(), Addr: &net.TCPAddr{}}
+	err = dnsProxy.handleDNSRequest(d)
+	assert.NotNil(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+
+	// The same goes for the direct Resolve call
+	d = &DNSContext{Req: createTestMessage()}
+	err = dnsProxy.Resolve(d)
+	assert.Equal(t, errNoUpstreams, err)
+	assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+	assert.False(t, d.Res.RecursionAvailable)
+
+	// Recursion is available if the upstreams exist but fail
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&mismatchedUpstream{}}
+	d = &DNSContext{Req: createTestMessage()}
+	err = dnsProxy.Resolve(d)
+	assert.NotNil(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+	assert.True(t, d.Res.RecursionAvailable)
+}
+
+// mismatchedUpstream always responds with the question for another name.
+type mismatchedUpstream struct{}
+
+func (u *mismatchedUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	resp.Question[0].Name = "evil.example.org."
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "evil.example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IP{6, 6, 6, 6},
+	})
+
+	return resp, nil
+}
+
+func (u *mismatchedUpstream) Address() string {
+	return "mismatched"
+}
+
+func TestValidateResponseQuestion(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	// The only upstream misbehaves
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&mismatchedUpstream{}}
+	d := &DNSContext{Req: createTestMessage()}
+	err = dnsProxy.Resolve(d)
+	assert.NotNil(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+	assert.Empty(t, d.Res.Answer)
+
+	// The valid response from another upstream is used
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&mismatchedUpstream{}, createTestUpstream()}
+	for _, mode := range []UpstreamModeType{UModeLoadBalance, UModeParallel} {
+		dnsProxy.UpstreamMode = mode
+		d = &DNSContext{Req: createTestMessage()}
+		err = dnsProxy.Resolve(d)
+		assert.Nil(t, err)
+		assertResponse(t, d.Res)
+		assert.Equal(t, "google-public-dns-a.google.com.", d.Res.Question[0].Name)
+	}
+
+	// The mismatched response is accepted if the validation is skipped
+	dnsProxy.SkipResponseQuestionValidation = true
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&mismatchedUpstream{}}
+	d = &DNSContext{Req: createTestMessage()}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	assert.Len(t, d.Res.Answer, 1)
+}
+
+// slowUpstream responds with an empty message after a short delay.
+type slowUpstream struct {
+	addr string
+}
+
+func (u *slowUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	time.Sleep(2 * time.Millisecond)
+
+	return (&dns.Msg{}).SetReply(m), nil
+}
+
+func (u *slowUpstream) Address() string {
+	return u.addr
+}
+
+func TestUpstreamSelectedCallback(t *testing.T) {
+	upstreams := []upstream.Upstream{
+		&slowUpstream{addr: "slow1"},
+		&slowUpstream{addr: "slow2"},
+		&slowUpstream{addr: "slow3"},
+	}
+
+	selected := map[int]int{}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = upstreams
+	dnsProxy.UpstreamSelectedCallback = func(q dns.Question, upstreamAddr string, idx int, weight int) {
+		assert.Equal(t, "google-public-dns-a.google.com.", q.Name)
+		assert.Equal(t, upstreams[idx].Address(), upstreamAddr)
+		assert.Equal(t, defaultUpstreamWeight, weight)
+		selected[idx]++
+	}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	for i := 0; i < 30; i++ {
+		d := &DNSContext{Req: createTestMessage()}
+		err = dnsProxy.Resolve(d)
+		assert.Nil(t, err)
+	}
+
+	// The upstreams that have never been used have zero RTT and are sorted
+	// first, so each upstream is selected at least once.
+	assert.Len(t, selected, len(upstreams))
+	total := 0
+	for _, n := range selected {
+		total += n
+	}
+	assert.Equal(t, 30, total)
+}
+
+// fastUpstream responds with an empty message right away.
+type fastUpstream struct {
+	addr string
+	fail bool
+}
+
+func (u *fastUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if u.fail {
+		return nil, errors.New("upstream failed")
+	}
+
+	return (&dns.Msg{}).SetReply(m), nil
+}
+
+func (u *fastUpstream) Address() string {
+	return u.addr
+}
+
+// flappingUpstream is like fastUpstream but it also counts the exchanges.
+type flappingUpstream struct {
+	fastUpstream
+	calls int
+}
+
+func (u *flappingUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	u.calls++
+
+	return u.fastUpstream.Exchange(m)
+}
+
+func TestUpstreamFailureCooldown(t *testing.T) {
+	flapping := &flappingUpstream{fastUpstream: fastUpstream{addr: "flapping", fail: true}}
+	healthy := &fastUpstream{addr: "healthy"}
+
+	clock := newFakeClock()
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{flapping, healthy}
+	dnsProxy.UpstreamFailureCooldown = time.Minute
+	dnsProxy.TimeSource = clock.Now
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	// Make the flapping upstream the fastest one, so that it's chosen first
+	for i := 0; i < 10; i++ {
+		dnsProxy.updateRtt(flapping.addr, 1)
+		dnsProxy.updateRtt(healthy.addr, 1000)
+	}
+
+	d := &DNSContext{Req: createTestMessage()}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, flapping.calls)
+
+	// Even if the upstream recovers and is still faster, it's skipped during
+	// the cooldown
+	flapping.fail = false
+	for i := 0; i < 10; i++ {
+		dnsProxy.updateRtt(flapping.addr, 1)
+	}
+	for i := 0; i < 5; i++ {
+		d = &DNSContext{Req: createTestMessage()}
+		err = dnsProxy.Resolve(d)
+		assert.Nil(t, err)
+		assert.Equal(t, healthy.addr, d.Upstream.Address())
+	}
+	assert.Equal(t, 1, flapping.calls)
+
+	// And is used again after it
+	clock.Add(time.Minute)
+	d = &DNSContext{Req: createTestMessage()}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	assert.Equal(t, flapping.addr, d.Upstream.Address())
+	assert.Equal(t, 2, flapping.calls)
+}
+
+func TestUpstreamWeights(t *testing.T) {
+	const queries = 1100
+
+	heavy := &fastUpstream{addr: "heavy"}
+	light := &fastUpstream{addr: "light"}
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{heavy, light}
+	dnsProxy.UpstreamWeights = []int{10, 1}
+	selected := map[string]int{}
+	dnsProxy.UpstreamSelectedCallback = func(_ dns.Question, upstreamAddr string, idx int, weight int) {
+		assert.Equal(t, dnsProxy.UpstreamWeights[idx], weight)
+		selected[upstreamAddr]++
+	}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	for i := 0; i < queries; i++ {
+		err = dnsProxy.Resolve(&DNSContext{Req: createTestMessage()})
+		assert.Nil(t, err)
+	}
+
+	// The expected numbers are 1000 and 100
+	assert.Equal(t, queries, selected["heavy"]+selected["light"])
+	assert.Greater(t, selected["heavy"], 900)
+	assert.Greater(t, selected["light"], 40)
+
+	// The upstream with zero weight is only used when the others fail
+	dnsProxy.UpstreamWeights = []int{0, 1}
+	selected = map[string]int{}
+	for i := 0; i < 100; i++ {
+		err = dnsProxy.Resolve(&DNSContext{Req: createTestMessage()})
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 100, selected["light"])
+
+	light.fail = true
+	err = dnsProxy.Resolve(&DNSContext{Req: createTestMessage()})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, selected["heavy"])
+
+	// The number of weights must match the number of upstreams
+	dnsProxy.UpstreamWeights = []int{1}
+	assert.NotNil(t, dnsProxy.validateConfig())
+}
+
 func TestExchangeCustomUpstreamConfig(t *testing.T) {
 	dnsProxy := createTestProxy(t, nil)
 	err := dnsProxy.Start()
@@ -611,6 +1163,57 @@ func TestECSProxy(t *testing.T) {
 	_ = dnsProxy.Stop()
 }
 
+func TestResponseOPT(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.EnableEDNSClientSubnet = true
+	u := &testUpstream{
+		aResp: &dns.A{
+			Hdr: dns.RR_Header{Rrtype: dns.TypeA, Name: "host.", Ttl: 60},
+			A:   net.IP{4, 3, 2, 1},
+		},
+		ecsIP: net.IP{1, 2, 3, 0},
+	}
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	// The client without EDNS0 gets no OPT even though the proxy has added
+	// ECS to the upstream request
+	d := &DNSContext{Req: createHostTestMessage("host"), Addr: &net.TCPAddr{IP: net.IP{1, 2, 3, 4}}}
+	_ = dnsProxy.handleDNSRequest(d)
+	assert.True(t, u.ecsReqIP.Equal(net.IP{1, 2, 3, 0}))
+	assert.True(t, getIPFromResponse(d.Res).Equal(net.IP{4, 3, 2, 1}))
+	assert.Nil(t, d.Res.IsEdns0())
+
+	// The client with EDNS0 gets the OPT with its own parameters and without
+	// the upstream's ECS
+	req := createHostTestMessage("host")
+	req.SetEdns0(1232, true)
+	d = &DNSContext{Req: req, Addr: &net.TCPAddr{IP: net.IP{1, 2, 3, 4}}}
+	_ = dnsProxy.handleDNSRequest(d)
+	opt := d.Res.IsEdns0()
+	if assert.NotNil(t, opt) {
+		assert.Equal(t, uint16(1232), opt.UDPSize())
+		assert.True(t, opt.Do())
+		assert.Empty(t, opt.Option)
+	}
+
+	// Extended DNS errors are kept
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.SetEdns0(4096, false)
+	res.IsEdns0().Option = []dns.EDNS0{
+		&dns.EDNS0_LOCAL{Code: ednsOptionEDE, Data: []byte{0, 18}},
+		&dns.EDNS0_PADDING{Padding: make([]byte, 16)},
+	}
+	d = &DNSContext{Req: req, Res: res}
+	d.setResponseOPT()
+	opt = d.Res.IsEdns0()
+	if assert.NotNil(t, opt) && assert.Len(t, opt.Option, 1) {
+		assert.Equal(t, uint16(ednsOptionEDE), opt.Option[0].Option())
+	}
+}
+
 func TestECSProxyCacheMinMaxTTL(t *testing.T) {
 	dnsProxy := createTestProxy(t, nil)
 	dnsProxy.EnableEDNSClientSubnet = true
@@ -699,6 +1302,28 @@ func getFreePort() uint {
 	return port
 }
 
+func TestStartFailureRelease(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(listenIP)})
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer l.Close()
+
+	// The UDP listener is created, but the TCP address is already in use.
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.TCPListenAddr = []*net.TCPAddr{l.Addr().(*net.TCPAddr)}
+	dnsProxy.QueryLogFile = filepath.Join(t.TempDir(), "querylog.json")
+	err = dnsProxy.Start()
+	assert.NotNil(t, err)
+
+	dnsProxy.RLock()
+	defer dnsProxy.RUnlock()
+
+	assert.Empty(t, dnsProxy.udpListen)
+	assert.True(t, dnsProxy.background.closed)
+	assert.True(t, dnsProxy.queryLog.async.closed)
+}
+
 func createTestProxy(t *testing.T, tlsConfig *tls.Config) *Proxy {
 	p := Proxy{}
 
@@ -793,6 +1418,57 @@ func createHostTestMessage(host string) *dns.Msg {
 	return &req
 }
 
+// createTestUpstream returns a local upstream answering the test message in
+// the same way the real one does, so that assertResponse could be used.
+func createTestUpstream() *testUpstream {
+	return &testUpstream{
+		aResp: &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   "google-public-dns-a.google.com.",
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			A: net.IP{8, 8, 8, 8},
+		},
+	}
+}
+
+// fakeClock is a clock for tests that only moves when advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// newFakeClock returns a new fakeClock set to an arbitrary moment.
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+// Now returns the current time of the clock.
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Set sets the current time of the clock.
+func (c *fakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = t
+}
+
+// Add advances the clock by d.
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
 func assertResponse(t *testing.T, reply *dns.Msg) {
 	if len(reply.Answer) != 1 {
 		t.Fatalf("DNS upstream returned reply with wrong number of answers - %d", len(reply.Answer))
@@ -909,3 +1585,505 @@ func (u *testUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
 func (u *testUpstream) Address() string {
 	return ""
 }
+
+// mixedCaseUpstream responds with the names spelled differently from the
+// query.
+type mixedCaseUpstream struct{}
+
+func (u *mixedCaseUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	resp.Question[0].Name = strings.ToLower(m.Question[0].Name)
+	resp.Answer = []dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: "WWW.EXAMPLE.ORG", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 10},
+		Target: "Cdn.Example.NET.",
+	}, &dns.A{
+		Hdr: dns.RR_Header{Name: "cdn.example.net", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+		A:   net.IP{1, 2, 3, 4},
+	}}
+
+	return resp, nil
+}
+
+func (u *mixedCaseUpstream) Address() string {
+	return "mixed-case"
+}
+
+func TestResponseNamesNormalization(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&mixedCaseUpstream{}}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	req := &dns.Msg{}
+	req.SetQuestion("wWw.ExAmPlE.oRg.", dns.TypeA)
+	d := &DNSContext{Req: req}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "wWw.ExAmPlE.oRg.", d.Res.Question[0].Name)
+	if !assert.Len(t, d.Res.Answer, 2) {
+		return
+	}
+
+	cname := d.Res.Answer[0].(*dns.CNAME)
+	assert.Equal(t, "wWw.ExAmPlE.oRg.", cname.Hdr.Name)
+	assert.Equal(t, "Cdn.Example.NET.", cname.Target)
+	assert.Equal(t, "cdn.example.net.", d.Res.Answer[1].Header().Name)
+}
+
+func TestNormalizeNamesShared(t *testing.T) {
+	req := (&dns.Msg{}).SetQuestion("wWw.ExAmPlE.oRg.", dns.TypeA)
+	shared := newRR("www.example.org. 10 IN A 1.2.3.4")
+	resp := (&dns.Msg{}).SetReply(req)
+	resp.Answer = []dns.RR{shared}
+
+	// The renamed record is a copy, so the shared one stays intact.
+	normalizeNames(req, resp)
+	assert.Equal(t, "wWw.ExAmPlE.oRg.", resp.Answer[0].Header().Name)
+	assert.Equal(t, "www.example.org.", shared.Header().Name)
+}
+
+// duplicatingUpstream responds with the duplicated A records.
+type duplicatingUpstream struct{}
+
+func (u *duplicatingUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	name := m.Question[0].Name
+	resp.Answer = []dns.RR{
+		newRR(name + " 10 IN A 1.2.3.4"),
+		newRR(name + " 10 IN A 5.6.7.8"),
+		newRR(name + " 20 IN A 1.2.3.4"),
+		newRR(name + " 10 IN A 5.6.7.8"),
+		newRR(name + " 10 IN A 9.10.11.12"),
+	}
+
+	return resp, nil
+}
+
+func (u *duplicatingUpstream) Address() string {
+	return "duplicating"
+}
+
+func TestDedupAnswers(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&duplicatingUpstream{}}
+	dnsProxy.DedupAnswers = true
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	d := &DNSContext{Req: createHostTestMessage("host")}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+
+	var ips []string
+	for _, rr := range d.Res.Answer {
+		ips = append(ips, rr.(*dns.A).A.String())
+	}
+	assert.Equal(t, []string{"1.2.3.4", "5.6.7.8", "9.10.11.12"}, ips)
+}
+
+func TestUpstreamExchangeCallback(t *testing.T) {
+	type exchange struct {
+		addr     string
+		query    *dns.Msg
+		response *dns.Msg
+		rtt      time.Duration
+		err      error
+	}
+
+	var exchanges []exchange
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&delayedUpstream{delay: 10 * time.Millisecond}}
+	dnsProxy.UpstreamExchangeCallback = func(addr string, query, response *dns.Msg, rtt time.Duration, err error) {
+		exchanges = append(exchanges, exchange{addr, query, response, rtt, err})
+	}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	req := createHostTestMessage("host")
+	d := &DNSContext{Req: req}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+
+	if !assert.Len(t, exchanges, 1) {
+		return
+	}
+
+	ex := exchanges[0]
+	assert.Equal(t, "rcode", ex.addr)
+	assert.Nil(t, ex.err)
+	assert.GreaterOrEqual(t, int64(ex.rtt), int64(10*time.Millisecond))
+	assert.Equal(t, req.Question, ex.query.Question)
+	if assert.NotNil(t, ex.response) {
+		assert.Equal(t, ex.query.Id, ex.response.Id)
+		assert.Equal(t, req.Question, ex.response.Question)
+	}
+}
+
+func TestGenResponseExtendedRcode(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+
+	testCases := []struct {
+		name     string
+		rcode    int
+		wantBits uint16
+		wantExt  uint8
+	}{{
+		name:     "refused",
+		rcode:    dns.RcodeRefused,
+		wantBits: dns.RcodeRefused,
+		wantExt:  0,
+	}, {
+		name:     "badvers",
+		rcode:    dns.RcodeBadVers,
+		wantBits: 0,
+		wantExt:  1,
+	}, {
+		name:     "badcookie",
+		rcode:    dns.RcodeBadCookie,
+		wantBits: 7,
+		wantExt:  1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := createTestMessage()
+			req.SetEdns0(1232, false)
+
+			resp := dnsProxy.genResponse(req, tc.rcode)
+			data, err := resp.Pack()
+			if !assert.Nil(t, err) {
+				return
+			}
+
+			// The lower 4 bits are in the header
+			assert.Equal(t, tc.wantBits, binary.BigEndian.Uint16(data[2:4])&0xF)
+
+			unpacked := &dns.Msg{}
+			err = unpacked.Unpack(data)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.rcode, unpacked.Rcode)
+
+			if tc.rcode <= 0xF {
+				return
+			}
+
+			// The upper 8 bits are the first byte of the OPT record's TTL
+			if opt := unpacked.IsEdns0(); assert.NotNil(t, opt) {
+				assert.Equal(t, tc.wantExt, uint8(opt.Hdr.Ttl>>24))
+				assert.Equal(t, uint16(1232), opt.UDPSize())
+			}
+
+			// The OPT record is kept for the clients without EDNS0 since
+			// the rcode can't be encoded otherwise
+			d := &DNSContext{Req: createTestMessage()}
+			d.Res = dnsProxy.genResponse(d.Req, tc.rcode)
+			d.setResponseOPT()
+			_, err = d.Res.Pack()
+			assert.Nil(t, err)
+		})
+	}
+}
+
+// startDualStackServer starts a DNS server listening on both UDP and TCP on
+// the same port and counting the requests received over each of them.
+func startDualStackServer(t *testing.T, udpReqs, tcpReqs *uint32) string {
+	var conn net.PacketConn
+	var l net.Listener
+	for i := 0; l == nil && i < 10; i++ {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("cannot listen udp: %s", err)
+		}
+
+		l, err = net.Listen("tcp", c.LocalAddr().String())
+		if err != nil {
+			// The port may be busy for TCP, try another one
+			_ = c.Close()
+			continue
+		}
+		conn = c
+	}
+	if l == nil {
+		t.Fatalf("cannot listen on the same port for udp and tcp")
+	}
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+			atomic.AddUint32(tcpReqs, 1)
+		} else {
+			atomic.AddUint32(udpReqs, 1)
+		}
+
+		resp, _ := createTestUpstream().Exchange(r)
+		_ = w.WriteMsg(resp)
+	})
+
+	udpSrv := &dns.Server{PacketConn: conn, Handler: handler}
+	tcpSrv := &dns.Server{Listener: l, Handler: handler}
+	for _, srv := range []*dns.Server{udpSrv, tcpSrv} {
+		go func(srv *dns.Server) { _ = srv.ActivateAndServe() }(srv)
+	}
+	t.Cleanup(func() {
+		_ = udpSrv.Shutdown()
+		_ = tcpSrv.Shutdown()
+	})
+
+	return conn.LocalAddr().String()
+}
+
+func TestForceTCPUpstreams(t *testing.T) {
+	for _, forceTCP := range []bool{false, true} {
+		t.Run(fmt.Sprintf("force_tcp_%t", forceTCP), func(t *testing.T) {
+			var udpReqs, tcpReqs uint32
+			addr := startDualStackServer(t, &udpReqs, &tcpReqs)
+
+			u, err := upstream.AddressToUpstream(addr, upstream.Options{Timeout: defaultTimeout})
+			if err != nil {
+				t.Fatalf("cannot create the upstream: %s", err)
+			}
+
+			dnsProxy := createTestProxy(t, nil)
+			dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+			dnsProxy.ForceTCPUpstreams = forceTCP
+			// The connections to the local server are established fast.
+			dnsProxy.UpstreamDialTimeout = 100 * time.Millisecond
+			err = dnsProxy.Init()
+			assert.Nil(t, err)
+
+			d := &DNSContext{Req: createTestMessage()}
+			err = dnsProxy.Resolve(d)
+			if assert.Nil(t, err) {
+				assertResponse(t, d.Res)
+			}
+			assert.Equal(t, u, d.Upstream)
+
+			if forceTCP {
+				assert.Equal(t, uint32(0), atomic.LoadUint32(&udpReqs))
+				assert.Equal(t, uint32(1), atomic.LoadUint32(&tcpReqs))
+			} else {
+				assert.Equal(t, uint32(1), atomic.LoadUint32(&udpReqs))
+				assert.Equal(t, uint32(0), atomic.LoadUint32(&tcpReqs))
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	logBuf := &bytes.Buffer{}
+	log.SetOutput(logBuf)
+	level := log.GetLevel()
+	log.SetLevel(log.DEBUG)
+	defer log.SetLevel(level)
+
+	var handled []uint64
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{createTestUpstream()}
+	dnsProxy.DoHRequestIDHeader = "X-Request-Id"
+	dnsProxy.ResponseHandler = func(d *DNSContext, _ error) {
+		handled = append(handled, d.RequestID)
+	}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	var headers []string
+	for i := 0; i < 2; i++ {
+		rw := httptest.NewRecorder()
+		d := &DNSContext{
+			Proto:              ProtoHTTPS,
+			Req:                createTestMessage(),
+			Addr:               &net.TCPAddr{IP: net.IP{127, 0, 0, 1}},
+			HTTPResponseWriter: rw,
+		}
+		err = dnsProxy.handleDNSRequest(d)
+		assert.Nil(t, err)
+		headers = append(headers, rw.Header().Get("X-Request-Id"))
+	}
+
+	// Stop writing to the buffer before reading it
+	log.SetOutput(os.Stderr)
+	logs := logBuf.String()
+
+	// Each request has its own ID
+	if !assert.Len(t, handled, 2) {
+		return
+	}
+	assert.NotEqual(t, handled[0], handled[1])
+
+	for i, id := range handled {
+		assert.Equal(t, strconv.FormatUint(id, 10), headers[i])
+
+		prefix := fmt.Sprintf("[%d] ", id)
+		assert.Contains(t, logs, prefix+"IN: ")
+		assert.Contains(t, logs, prefix+"RTT: ")
+		assert.Contains(t, logs, prefix+"OUT: ")
+	}
+}
+
+func TestUDPUpstreamRetries(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen udp: %s", err)
+	}
+
+	// The first request is dropped as if the packet was lost.
+	var reqs uint32
+	srv := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if atomic.AddUint32(&reqs, 1) == 1 {
+			return
+		}
+
+		resp, _ := createTestUpstream().Exchange(r)
+		_ = w.WriteMsg(resp)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer func() { _ = srv.Shutdown() }()
+
+	u, err := upstream.AddressToUpstream(conn.LocalAddr().String(), upstream.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("cannot create the upstream: %s", err)
+	}
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	dnsProxy.UDPUpstreamRetries = 2
+	err = dnsProxy.Init()
+	assert.Nil(t, err)
+
+	start := time.Now()
+	d := &DNSContext{Req: createTestMessage()}
+	err = dnsProxy.Resolve(d)
+	if assert.Nil(t, err) {
+		assertResponse(t, d.Res)
+	}
+	assert.Equal(t, u, d.Upstream)
+
+	// The retransmit is answered long before the upstream timeout and the
+	// second retransmit isn't sent.
+	assert.True(t, time.Since(start) < time.Second)
+	time.Sleep(2 * udpRetransmitInterval)
+	assert.Equal(t, uint32(2), atomic.LoadUint32(&reqs))
+}
+
+// signingUpstream answers with the RRSIG records if the request has the DO bit
+// set and counts the exchanges.
+type signingUpstream struct {
+	exchanges uint32
+	signed    uint32
+}
+
+func (u *signingUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddUint32(&u.exchanges, 1)
+
+	resp, _ := createTestUpstream().Exchange(m)
+	if o := m.IsEdns0(); o != nil && o.Do() {
+		atomic.AddUint32(&u.signed, 1)
+		resp.Answer = append(resp.Answer, newRR(m.Question[0].Name+
+			" 60 IN RRSIG A 8 2 60 20300101000000 20200101000000 12345 example. c2lnbmF0dXJl"))
+		resp.SetEdns0(defaultUDPBufSize, true)
+	}
+
+	return resp, nil
+}
+
+func (u *signingUpstream) Address() string {
+	return "signing"
+}
+
+func TestAlwaysRequestDNSSEC(t *testing.T) {
+	resolve := func(dnsProxy *Proxy, do bool) *dns.Msg {
+		req := createTestMessage()
+		req.SetEdns0(defaultUDPBufSize, do)
+		d := &DNSContext{Req: req}
+		err := dnsProxy.Resolve(d)
+		assert.Nil(t, err)
+
+		return d.Res
+	}
+	hasRRSIG := func(m *dns.Msg) bool {
+		for _, rr := range m.Answer {
+			if _, ok := rr.(*dns.RRSIG); ok {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for _, cacheEnabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("cache_%t", cacheEnabled), func(t *testing.T) {
+			u := &signingUpstream{}
+			dnsProxy := createTestProxy(t, nil)
+			dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+			dnsProxy.CacheEnabled = cacheEnabled
+			dnsProxy.AlwaysRequestDNSSEC = true
+			err := dnsProxy.Init()
+			assert.Nil(t, err)
+
+			res := resolve(dnsProxy, false)
+			assert.False(t, hasRRSIG(res))
+			assert.False(t, res.IsEdns0().Do())
+			assert.Len(t, res.Answer, 1)
+
+			res = resolve(dnsProxy, true)
+			assert.True(t, hasRRSIG(res))
+			assert.True(t, res.IsEdns0().Do())
+			assert.Len(t, res.Answer, 2)
+
+			// DNSSEC is requested for both clients, and they're answered
+			// with the single cached response.
+			wantExchanges := uint32(2)
+			if cacheEnabled {
+				wantExchanges = 1
+			}
+			assert.Equal(t, wantExchanges, atomic.LoadUint32(&u.exchanges))
+			assert.Equal(t, wantExchanges, atomic.LoadUint32(&u.signed))
+		})
+	}
+}
+
+func TestAdaptiveTimeout(t *testing.T) {
+	hanging := &blockingUpstream{release: make(chan struct{})}
+	defer close(hanging.release)
+	slow := &delayedUpstream{delay: 100 * time.Millisecond}
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{hanging, slow}
+	dnsProxy.AdaptiveTimeout = true
+	dnsProxy.AdaptiveTimeoutMin = 20 * time.Millisecond
+	dnsProxy.AdaptiveTimeoutMax = 2 * time.Second
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	// There is no RTT measured yet.
+	assert.Equal(t, 2*time.Second, dnsProxy.upstreamTimeout(slow.Address()))
+
+	// The upstream that has been fast so far is tried first and given
+	// little time, the slow one is given more.
+	dnsProxy.updateRtt(hanging.Address(), 10)
+	dnsProxy.updateRtt(slow.Address(), 100)
+	assert.Equal(t, 30*time.Millisecond, dnsProxy.upstreamTimeout(hanging.Address()))
+	assert.Equal(t, 300*time.Millisecond, dnsProxy.upstreamTimeout(slow.Address()))
+
+	start := time.Now()
+	d := &DNSContext{Req: createTestMessage()}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	assert.Equal(t, slow, d.Upstream)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&hanging.calls))
+
+	// The failure doesn't make the dead upstream's timeout grow.
+	assert.Equal(t, 30*time.Millisecond, dnsProxy.upstreamTimeout(hanging.Address()))
+
+	// The timed out exchange is still running, but it's counted.
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dnsProxy.abandonedExchanges))
+
+	// The timeouts are clamped.
+	dnsProxy.updateRtt("tiny", 1)
+	assert.Equal(t, 20*time.Millisecond, dnsProxy.upstreamTimeout("tiny"))
+	dnsProxy.updateRtt("dead", 10_000)
+	assert.Equal(t, 2*time.Second, dnsProxy.upstreamTimeout("dead"))
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// queryLogQueueSize is the number of entries that may wait to be written.
+// Entries are dropped when the queue is full so that logging never blocks
+// resolving.
+const queryLogQueueSize = 1024
+
+// queryLogBackupTimeFormat is the format of the time in the names of the
+// rotated query log files.
+const queryLogBackupTimeFormat = "2006-01-02T15-04-05.000"
+
+// queryLogEntry is a single record of the query log written as a JSON line.
+type queryLogEntry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client,omitempty"`
+	Proto     string    `json:"proto"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Rcode     string    `json:"rcode"`
+	Answers   []string  `json:"answers,omitempty"`
+	Upstream  string    `json:"upstream,omitempty"`
+	ElapsedMs float64   `json:"elapsed_ms"`
+}
+
+// newQueryLogEntry returns the query log entry for the request and response
+// of d.
+func newQueryLogEntry(d *DNSContext) *queryLogEntry {
+	e := &queryLogEntry{
+		Time:      d.StartTime,
+		Proto:     d.Proto,
+		ElapsedMs: float64(time.Since(d.StartTime)) / float64(time.Millisecond),
+	}
+
+	if d.Addr != nil {
+		e.Client = d.Addr.String()
+	}
+	if len(d.Req.Question) != 0 {
+		q := d.Req.Question[0]
+		e.Name = q.Name
+		e.Type = dns.Type(q.Qtype).String()
+	}
+	if d.Upstream != nil {
+		e.Upstream = d.Upstream.Address()
+	}
+
+	e.Rcode = dns.RcodeToString[d.Res.Rcode]
+	for _, rr := range d.Res.Answer {
+		e.Answers = append(e.Answers, rr.String())
+	}
+
+	return e
+}
+
+// queryLogWriter asynchronously writes the query log entries to a file and
+// rotates it.
+type queryLogWriter struct {
+	path string
+	// maxSize is the size of the file which makes it rotated, zero means no
+	// limit.
+	maxSize int64
+	// maxAge is the age of the rotated files which makes them removed, zero
+	// means that they're kept forever.
+	maxAge time.Duration
+
+	file *os.File
+	buf  *bufio.Writer
+	size int64
+
+	async *asyncWriter
+}
+
+// newQueryLogWriter opens the query log file and starts the writing loop.
+func newQueryLogWriter(path string, maxSize int64, maxAge time.Duration) (w *queryLogWriter, err error) {
+	w = &queryLogWriter{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+	}
+
+	err = w.open()
+	if err != nil {
+		return nil, err
+	}
+	w.removeOld()
+
+	w.async = newAsyncWriter(queryLogQueueSize, w.loop)
+
+	return w, nil
+}
+
+// write schedules e to be written.  It never blocks and drops the entry if
+// the queue is full or the writer is closed.
+func (w *queryLogWriter) write(e *queryLogEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Debug("querylog: %s", err)
+
+		return
+	}
+
+	if !w.async.write(append(b, '\n')) {
+		log.Debug("querylog: queue is full or closed, dropping the entry")
+	}
+}
+
+// close flushes the queued entries and closes the file.
+func (w *queryLogWriter) close() {
+	w.async.close()
+}
+
+// open opens the query log file for appending.
+func (w *queryLogWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+
+		return err
+	}
+
+	w.file = f
+	w.buf = bufio.NewWriter(f)
+	w.size = fi.Size()
+
+	return nil
+}
+
+// rotate renames the current file to a backup one with the current time in
+// its name and opens a new file.
+func (w *queryLogWriter) rotate() error {
+	err := w.closeFile()
+	if err != nil {
+		return err
+	}
+
+	// Several rotations may happen within a millisecond, so make sure that
+	// the existing backup isn't overwritten.
+	ext := filepath.Ext(w.path)
+	prefix := strings.TrimSuffix(w.path, ext) + "-" + time.Now().Format(queryLogBackupTimeFormat)
+	backup := prefix + ext
+	for i := 1; ; i++ {
+		if _, sErr := os.Stat(backup); os.IsNotExist(sErr) {
+			break
+		}
+		backup = fmt.Sprintf("%s-%d%s", prefix, i, ext)
+	}
+
+	err = os.Rename(w.path, backup)
+	if err != nil {
+		return err
+	}
+
+	w.removeOld()
+
+	return w.open()
+}
+
+// removeOld removes the backup files older than maxAge.
+func (w *queryLogWriter) removeOld() {
+	if w.maxAge <= 0 {
+		return
+	}
+
+	ext := filepath.Ext(w.path)
+	backups, err := filepath.Glob(strings.TrimSuffix(w.path, ext) + "-*" + ext)
+	if err != nil {
+		log.Debug("querylog: %s", err)
+
+		return
+	}
+
+	for _, b := range backups {
+		fi, sErr := os.Stat(b)
+		if sErr != nil || time.Since(fi.ModTime()) < w.maxAge {
+			continue
+		}
+
+		if rErr := os.Remove(b); rErr != nil {
+			log.Debug("querylog: removing %s: %s", b, rErr)
+		}
+	}
+}
+
+// closeFile flushes the buffer and closes the current file.
+func (w *queryLogWriter) closeFile() error {
+	err := w.buf.Flush()
+	if cErr := w.file.Close(); err == nil {
+		err = cErr
+	}
+
+	return err
+}
+
+// loop writes the queued entries until the queue is closed.  The buffer is
+// flushed each time the queue is drained.
+func (w *queryLogWriter) loop(queue <-chan []byte) {
+	for b := range queue {
+		if w.file != nil && w.maxSize > 0 && w.size > 0 && w.size+int64(len(b)) > w.maxSize {
+			err := w.rotate()
+			if err != nil {
+				// The file is closed whatever step has failed, so reopen
+				// it below and keep writing to it.
+				log.Error("querylog: rotating %s: %s", w.path, err)
+				w.file = nil
+			}
+		}
+
+		if w.file == nil {
+			// Retry opening the file on each entry.
+			err := w.open()
+			if err != nil {
+				log.Debug("querylog: opening %s: %s", w.path, err)
+
+				continue
+			}
+		}
+
+		n, err := w.buf.Write(b)
+		w.size += int64(n)
+		if err == nil && len(queue) == 0 {
+			err = w.buf.Flush()
+		}
+		if err != nil {
+			log.Error("querylog: writing to %s: %s", w.path, err)
+		}
+	}
+
+	if w.file != nil {
+		if err := w.closeFile(); err != nil {
+			log.Error("querylog: closing %s: %s", w.path, err)
+		}
+	}
+}
+
+// writeQueryLog writes the query log entry for d if the query log is enabled.
+func (p *Proxy) writeQueryLog(d *DNSContext) {
+	if p.queryLog == nil {
+		return
+	}
+
+	p.queryLog.write(newQueryLogEntry(d))
+}
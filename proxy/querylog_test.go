@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// readQueryLog returns the entries of the query log file.
+func readQueryLog(t *testing.T, path string) (entries []queryLogEntry) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("cannot open %s: %s", path, err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		e := queryLogEntry{}
+		err = json.Unmarshal(s.Bytes(), &e)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", s.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries
+}
+
+func TestQueryLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "querylog.json")
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{createTestUpstream()}
+	dnsProxy.QueryLogFile = path
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+
+	client := &dns.Client{Net: "udp", Timeout: defaultTimeout}
+	for i := 0; i < 3; i++ {
+		_, _, err = client.Exchange(createTestMessage(), dnsProxy.Addr(ProtoUDP).String())
+		if err != nil {
+			t.Fatalf("cannot exchange: %s", err)
+		}
+	}
+
+	// The entries are flushed on stop.
+	assert.Nil(t, dnsProxy.Stop())
+
+	entries := readQueryLog(t, path)
+	if assert.Len(t, entries, 3) {
+		e := entries[0]
+		assert.Equal(t, "google-public-dns-a.google.com.", e.Name)
+		assert.Equal(t, "A", e.Type)
+		assert.Equal(t, "NOERROR", e.Rcode)
+		assert.Equal(t, ProtoUDP, e.Proto)
+		assert.Len(t, e.Answers, 1)
+		assert.NotEmpty(t, e.Client)
+	}
+}
+
+func TestQueryLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "querylog.json")
+
+	// A small size limit makes each entry rotate the file.
+	w, err := newQueryLogWriter(path, 10, 0)
+	if err != nil {
+		t.Fatalf("cannot create the query log: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		w.write(&queryLogEntry{Time: time.Now(), Proto: ProtoTCP, Name: "example.org.", Type: "A", Rcode: "NOERROR"})
+	}
+	w.close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "querylog*.json"))
+	assert.Nil(t, err)
+	if assert.Len(t, files, 3) {
+		for _, f := range files {
+			entries := readQueryLog(t, f)
+			if assert.Len(t, entries, 1) {
+				assert.Equal(t, "example.org.", entries[0].Name)
+			}
+		}
+	}
+
+	// The rotated files older than the maximum age are removed.
+	old := time.Now().Add(-48 * time.Hour)
+	for _, f := range files {
+		if f != path {
+			assert.Nil(t, os.Chtimes(f, old, old))
+		}
+	}
+
+	w, err = newQueryLogWriter(path, 0, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("cannot reopen the query log: %s", err)
+	}
+	w.close()
+
+	files, err = filepath.Glob(filepath.Join(dir, "querylog*.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{path}, files)
+}
+
+func TestQueryLogRotationFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "querylog.json")
+
+	w, err := newQueryLogWriter(path, 10, 0)
+	if err != nil {
+		t.Fatalf("cannot create the query log: %s", err)
+	}
+
+	e := &queryLogEntry{Time: time.Now(), Proto: ProtoTCP, Name: "example.org.", Type: "A", Rcode: "NOERROR"}
+	w.write(e)
+	assert.Eventually(t, func() bool {
+		fi, sErr := os.Stat(path)
+
+		return sErr == nil && fi.Size() > 0
+	}, time.Second, 10*time.Millisecond)
+
+	// The file can't be renamed once it's removed, so the rotation fails,
+	// but the following entries are still written.
+	assert.Nil(t, os.Remove(path))
+	w.write(e)
+	w.write(e)
+	w.close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "querylog*.json"))
+	assert.Nil(t, err)
+
+	var entries []queryLogEntry
+	for _, f := range files {
+		entries = append(entries, readQueryLog(t, f)...)
+	}
+	assert.Len(t, entries, 2)
+}
@@ -10,6 +10,17 @@ import (
 	gocache "github.com/patrickmn/go-cache"
 )
 
+// RateLimiter limits the rate of the requests from the clients, e.g. across
+// several proxy instances.  It must be safe for concurrent use.
+type RateLimiter interface {
+	// Allow returns false if the request from ip should be dropped.
+	Allow(ip net.IP) bool
+}
+
+// ratelimitWindow is the period over which Ratelimit requests are allowed from
+// a single IP.
+const ratelimitWindow = time.Second
+
 func (p *Proxy) limiterForIP(ip string) interface{} {
 	p.ratelimitLock.Lock()
 	defer p.ratelimitLock.Unlock()
@@ -20,7 +31,7 @@ func (p *Proxy) limiterForIP(ip string) interface{} {
 	// check if ratelimiter for that IP already exists, if not, create
 	value, found := p.ratelimitBuckets.Get(ip)
 	if !found {
-		value = rate.New(p.Ratelimit, time.Second)
+		value = rate.New(p.Ratelimit, ratelimitWindow)
 		p.ratelimitBuckets.Set(ip, value, time.Hour)
 	}
 
@@ -29,32 +40,100 @@ func (p *Proxy) limiterForIP(ip string) interface{} {
 
 // isRatelimited checks if the specified IP is ratelimited
 func (p *Proxy) isRatelimited(addr net.Addr) bool {
-	if p.Ratelimit <= 0 { // 0 -- disabled
-		return false
+	limited, _ := p.checkRatelimit(addr)
+
+	return limited
+}
+
+// checkRatelimit returns true if the request from addr should be dropped and
+// the time after which the client may retry.
+func (p *Proxy) checkRatelimit(addr net.Addr) (limited bool, retryAfter time.Duration) {
+	if p.Ratelimit <= 0 && p.RateLimiter == nil { // 0 -- disabled
+		return false, 0
 	}
 
 	ip := getIPString(addr)
 	if ip == "" {
 		log.Printf("failed to split %v into host/port", addr)
-		return false
+		return false, 0
 	}
 
-	if len(p.RatelimitWhitelist) > 0 {
-		i := sort.SearchStrings(p.RatelimitWhitelist, ip)
+	if p.isRatelimitWhitelisted(ip) {
+		return false, 0
+	}
 
-		if i < len(p.RatelimitWhitelist) && p.RatelimitWhitelist[i] == ip {
-			// found, don't ratelimit
-			return false
-		}
+	if p.RateLimiter != nil {
+		// The custom limiters don't report the time, so suggest the
+		// whole window.
+		return !p.RateLimiter.Allow(net.ParseIP(ip)), ratelimitWindow
 	}
 
 	value := p.limiterForIP(ip)
 	rl, ok := value.(*rate.RateLimiter)
 	if !ok {
 		log.Println("SHOULD NOT HAPPEN: non-bool entry found in safebrowsing lookup cache")
+		return false, 0
+	}
+
+	allow, remaining := rl.Try()
+	return !allow, remaining
+}
+
+// isRatelimitWhitelisted returns true if ip is in RatelimitWhitelist.
+func (p *Proxy) isRatelimitWhitelisted(ip string) bool {
+	i := sort.SearchStrings(p.RatelimitWhitelist, ip)
+
+	return i < len(p.RatelimitWhitelist) && p.RatelimitWhitelist[i] == ip
+}
+
+// udpMaxInflightClients is the maximum number of the clients tracked for
+// UDPSingleInflightPerClient.  The requests from the other clients are
+// dropped while that many clients have requests in flight.
+const udpMaxInflightClients = 4096
+
+// acquireUDPInflight marks the UDP request from addr as being processed.  It
+// returns false if the request should be dropped since UDPSingleInflightPerClient
+// is enabled and another request from the same IP is still being processed.
+func (p *Proxy) acquireUDPInflight(addr *net.UDPAddr) bool {
+	if !p.UDPSingleInflightPerClient {
+		return true
+	}
+
+	ip := addr.IP.String()
+	if p.isRatelimitWhitelisted(ip) {
+		return true
+	}
+
+	p.udpInflightLock.Lock()
+	defer p.udpInflightLock.Unlock()
+
+	if _, ok := p.udpInflight[ip]; ok {
+		log.Tracef("Dropping UDP request from %s while its previous one is in flight", ip)
+
+		return false
+	}
+
+	if len(p.udpInflight) >= udpMaxInflightClients {
+		log.Tracef("Dropping UDP request from %s, too many clients in flight", ip)
+
 		return false
 	}
 
-	allow, _ := rl.Try()
-	return !allow
+	if p.udpInflight == nil {
+		p.udpInflight = map[string]struct{}{}
+	}
+	p.udpInflight[ip] = struct{}{}
+
+	return true
+}
+
+// releaseUDPInflight marks the UDP request from addr as processed.
+func (p *Proxy) releaseUDPInflight(addr *net.UDPAddr) {
+	if !p.UDPSingleInflightPerClient {
+		return
+	}
+
+	p.udpInflightLock.Lock()
+	delete(p.udpInflight, addr.IP.String())
+	p.udpInflightLock.Unlock()
 }
@@ -2,10 +2,13 @@ package proxy
 
 import (
 	"net"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestRatelimitingProxy(t *testing.T) {
@@ -87,3 +90,94 @@ func TestWhitelist(t *testing.T) {
 		t.Fatal("Second request must have been allowed due to whitelist")
 	}
 }
+
+// testRateLimiter allows the first limit requests and records the IP
+// addresses it's consulted for.
+type testRateLimiter struct {
+	mu    sync.Mutex
+	ips   []string
+	limit int
+}
+
+func (l *testRateLimiter) Allow(ip net.IP) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.ips = append(l.ips, ip.String())
+
+	return len(l.ips) <= l.limit
+}
+
+func TestCustomRateLimiter(t *testing.T) {
+	l := &testRateLimiter{limit: 2}
+	p := Proxy{}
+	p.RateLimiter = l
+	p.RatelimitWhitelist = []string{"127.0.0.2"}
+
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1232}
+	for i := 0; i < 2; i++ {
+		if p.isRatelimited(addr) {
+			t.Fatalf("request #%d must have been allowed", i)
+		}
+	}
+	if !p.isRatelimited(addr) {
+		t.Fatal("third request must have been ratelimited")
+	}
+
+	// The whitelisted addresses aren't passed to the limiter.
+	if p.isRatelimited(&net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 1232}) {
+		t.Fatal("whitelisted request must have been allowed")
+	}
+
+	assert.Equal(t, []string{"127.0.0.1", "127.0.0.1", "127.0.0.1"}, l.ips)
+}
+
+func TestUDPSingleInflightPerClient(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{
+		&delayedUpstream{delay: 200 * time.Millisecond},
+	}
+	dnsProxy.UDPSingleInflightPerClient = true
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	conn, err := dns.Dial("udp", dnsProxy.Addr(ProtoUDP).String())
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err)
+	}
+	defer conn.Close()
+
+	write := func(id uint16) {
+		req := createHostTestMessage("host")
+		req.Id = id
+		assert.Nil(t, conn.WriteMsg(req))
+	}
+
+	// The second request arrives while the first one is in flight.
+	write(1)
+	write(2)
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply, err := conn.ReadMsg()
+	if assert.Nil(t, err) {
+		assert.Equal(t, uint16(1), reply.Id)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	_, err = conn.ReadMsg()
+	assert.NotNil(t, err)
+
+	// The requests are accepted again once the previous one is answered.
+	write(3)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply, err = conn.ReadMsg()
+	if assert.Nil(t, err) {
+		assert.Equal(t, uint16(3), reply.Id)
+	}
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// rootHintsTTL is the TTL of the built-in root hints, the same as in the root
+// zone.
+const rootHintsTTL = 518400
+
+// defaultRootHintsRefresh is the default interval of refreshing the root hints
+// from the upstreams.
+const defaultRootHintsRefresh = 24 * time.Hour
+
+// rootServer is a root name server with its addresses.
+type rootServer struct {
+	name string
+	ipv4 net.IP
+	ipv6 net.IP
+}
+
+// builtinRootServers are the root name servers from the IANA root hints file.
+var builtinRootServers = []rootServer{
+	{"a.root-servers.net.", net.IP{198, 41, 0, 4}, net.ParseIP("2001:503:ba3e::2:30")},
+	{"b.root-servers.net.", net.IP{170, 247, 170, 2}, net.ParseIP("2801:1b8:10::b")},
+	{"c.root-servers.net.", net.IP{192, 33, 4, 12}, net.ParseIP("2001:500:2::c")},
+	{"d.root-servers.net.", net.IP{199, 7, 91, 13}, net.ParseIP("2001:500:2d::d")},
+	{"e.root-servers.net.", net.IP{192, 203, 230, 10}, net.ParseIP("2001:500:a8::e")},
+	{"f.root-servers.net.", net.IP{192, 5, 5, 241}, net.ParseIP("2001:500:2f::f")},
+	{"g.root-servers.net.", net.IP{192, 112, 36, 4}, net.ParseIP("2001:500:12::d0d")},
+	{"h.root-servers.net.", net.IP{198, 97, 190, 53}, net.ParseIP("2001:500:1::53")},
+	{"i.root-servers.net.", net.IP{192, 36, 148, 17}, net.ParseIP("2001:7fe::53")},
+	{"j.root-servers.net.", net.IP{192, 58, 128, 30}, net.ParseIP("2001:503:c27::2:30")},
+	{"k.root-servers.net.", net.IP{193, 0, 14, 129}, net.ParseIP("2001:7fd::1")},
+	{"l.root-servers.net.", net.IP{199, 7, 83, 42}, net.ParseIP("2001:500:9f::42")},
+	{"m.root-servers.net.", net.IP{202, 12, 27, 33}, net.ParseIP("2001:dc3::35")},
+}
+
+// rootHints is the root NS answer with the addresses of the name servers.
+type rootHints struct {
+	ns   []dns.RR
+	glue []dns.RR
+}
+
+// builtinRootHints returns the root hints built from builtinRootServers.
+func builtinRootHints() *rootHints {
+	h := &rootHints{}
+	for _, s := range builtinRootServers {
+		h.ns = append(h.ns, &dns.NS{
+			Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: rootHintsTTL},
+			Ns:  s.name,
+		})
+		h.glue = append(h.glue, &dns.A{
+			Hdr: dns.RR_Header{Name: s.name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: rootHintsTTL},
+			A:   s.ipv4,
+		}, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: s.name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: rootHintsTTL},
+			AAAA: s.ipv6,
+		})
+	}
+
+	return h
+}
+
+// isRootNSRequest returns true if req is the NS request for the root zone.
+func isRootNSRequest(req *dns.Msg) bool {
+	return len(req.Question) == 1 &&
+		req.Question[0].Name == "." &&
+		req.Question[0].Qtype == dns.TypeNS &&
+		req.Question[0].Qclass == dns.ClassINET
+}
+
+// genRootNS returns the response to the root NS request from the root hints
+// or nil if req is not such a request or AnswerRootLocally is disabled.
+func (p *Proxy) genRootNS(req *dns.Msg) *dns.Msg {
+	if !p.AnswerRootLocally || !isRootNSRequest(req) {
+		return nil
+	}
+
+	p.rootHintsLock.RLock()
+	h := p.rootHints
+	p.rootHintsLock.RUnlock()
+
+	if h == nil {
+		return nil
+	}
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	for _, rr := range h.ns {
+		resp.Answer = append(resp.Answer, dns.Copy(rr))
+	}
+	for _, rr := range h.glue {
+		resp.Extra = append(resp.Extra, dns.Copy(rr))
+	}
+
+	return resp
+}
+
+// initRootHints sets the built-in root hints and starts refreshing them if
+// AnswerRootLocally is enabled.
+func (p *Proxy) initRootHints() {
+	if !p.AnswerRootLocally {
+		return
+	}
+
+	p.rootHintsLock.Lock()
+	p.rootHints = builtinRootHints()
+	p.rootHintsLock.Unlock()
+
+	interval := p.RootHintsRefreshInterval
+	if interval == 0 {
+		interval = defaultRootHintsRefresh
+	}
+
+	go p.refreshRootHintsLoop(interval, p.shutdown)
+}
+
+// refreshRootHintsLoop refreshes the root hints each interval until shutdown is
+// closed.
+func (p *Proxy) refreshRootHintsLoop(interval time.Duration, shutdown chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.background.submit(p.refreshRootHints)
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// refreshRootHints requests the root NS records from the upstreams and
+// replaces the root hints with them.  The current hints are kept if the
+// response has no NS records for the root zone.
+func (p *Proxy) refreshRootHints() {
+	if p.UpstreamConfig == nil {
+		return
+	}
+
+	req := &dns.Msg{}
+	req.Id = dns.Id()
+	req.RecursionDesired = true
+	req.SetQuestion(".", dns.TypeNS)
+
+	reply, _, err := p.exchange(req, p.UpstreamConfig.Upstreams)
+	if err != nil {
+		log.Debug("couldn't refresh the root hints: %s", err)
+
+		return
+	}
+
+	h := &rootHints{}
+	for _, rr := range reply.Answer {
+		if ns, ok := rr.(*dns.NS); ok && ns.Hdr.Name == "." {
+			h.ns = append(h.ns, ns)
+		}
+	}
+	if len(h.ns) == 0 {
+		log.Debug("no root ns records in the response, keeping the root hints")
+
+		return
+	}
+
+	for _, rr := range reply.Extra {
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA:
+			h.glue = append(h.glue, rr)
+		}
+	}
+
+	p.rootHintsLock.Lock()
+	p.rootHints = h
+	p.rootHintsLock.Unlock()
+
+	log.Tracef("Refreshed the root hints: %d name servers", len(h.ns))
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// rootUpstream responds to the root NS requests with a single name server.
+type rootUpstream struct {
+	calls uint32
+}
+
+func (u *rootUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddUint32(&u.calls, 1)
+
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	resp.Answer = append(resp.Answer, &dns.NS{
+		Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60},
+		Ns:  "new.root-servers.net.",
+	})
+	resp.Extra = append(resp.Extra, &dns.A{
+		Hdr: dns.RR_Header{Name: "new.root-servers.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   []byte{1, 2, 3, 4},
+	})
+
+	return resp, nil
+}
+
+func (u *rootUpstream) Address() string {
+	return "root"
+}
+
+func TestAnswerRootLocally(t *testing.T) {
+	u := &rootUpstream{}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	dnsProxy.AnswerRootLocally = true
+	dnsProxy.RootHintsRefreshInterval = time.Hour
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	req := &dns.Msg{}
+	req.SetQuestion(".", dns.TypeNS)
+	req.SetEdns0(4096, false)
+
+	client := &dns.Client{Net: "udp", Timeout: defaultTimeout}
+	reply, _, err := client.Exchange(req, dnsProxy.Addr(ProtoUDP).String())
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+
+	// The built-in hints are used and the request isn't sent upstream
+	assert.Equal(t, uint32(0), atomic.LoadUint32(&u.calls))
+	if assert.Len(t, reply.Answer, len(builtinRootServers)) {
+		for i, rr := range reply.Answer {
+			assert.Equal(t, builtinRootServers[i].name, rr.(*dns.NS).Ns)
+		}
+	}
+	// Two addresses for each server plus the OPT record
+	assert.Len(t, reply.Extra, 2*len(builtinRootServers)+1)
+
+	// The refreshed hints are used afterwards
+	dnsProxy.refreshRootHints()
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&u.calls))
+
+	reply, _, err = client.Exchange(req, dnsProxy.Addr(ProtoUDP).String())
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	if assert.Len(t, reply.Answer, 1) {
+		assert.Equal(t, "new.root-servers.net.", reply.Answer[0].(*dns.NS).Ns)
+	}
+
+	// The other requests are resolved as usual
+	req.SetQuestion("example.org.", dns.TypeNS)
+	_, _, err = client.Exchange(req, dnsProxy.Addr(ProtoUDP).String())
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), atomic.LoadUint32(&u.calls))
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// defaultSafeSearchRules maps the hostnames of search engines to the
+// hostnames of their safe search versions.
+var defaultSafeSearchRules = map[string]string{
+	"google.com":     "forcesafesearch.google.com",
+	"www.google.com": "forcesafesearch.google.com",
+
+	"bing.com":     "strict.bing.com",
+	"www.bing.com": "strict.bing.com",
+
+	"duckduckgo.com":       "safe.duckduckgo.com",
+	"www.duckduckgo.com":   "safe.duckduckgo.com",
+	"start.duckduckgo.com": "safe.duckduckgo.com",
+
+	"youtube.com":              "restrict.youtube.com",
+	"www.youtube.com":          "restrict.youtube.com",
+	"m.youtube.com":            "restrict.youtube.com",
+	"youtubei.googleapis.com":  "restrict.youtube.com",
+	"youtube.googleapis.com":   "restrict.youtube.com",
+	"www.youtube-nocookie.com": "restrict.youtube.com",
+}
+
+// safeSearchTarget returns the safe search hostname for host or an empty
+// string if there is none.  The rules from the configuration take precedence
+// over the built-in ones.
+func (p *Proxy) safeSearchTarget(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if target, ok := p.SafeSearchRules[host]; ok {
+		return target
+	}
+
+	return defaultSafeSearchRules[host]
+}
+
+// rewriteSafeSearch replaces the question of the A and AAAA requests for the
+// search engines with their safe search hostnames.  It returns the original
+// question name if the request has been rewritten and an empty string
+// otherwise.
+func (p *Proxy) rewriteSafeSearch(d *DNSContext) (origName string) {
+	if !p.SafeSearchEnabled || len(d.Req.Question) != 1 {
+		return ""
+	}
+
+	q := &d.Req.Question[0]
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return ""
+	}
+
+	target := p.safeSearchTarget(q.Name)
+	if target == "" {
+		return ""
+	}
+
+	log.Tracef("Rewriting %s to %s for safe search", q.Name, target)
+	origName = q.Name
+	q.Name = dns.Fqdn(target)
+
+	return origName
+}
+
+// restoreSafeSearch restores the original question name in the request and
+// the response and returns the addresses of the safe search hostname under
+// the original name with ttl.
+func restoreSafeSearch(d *DNSContext, origName string, ttl uint32) {
+	qtype := d.Req.Question[0].Qtype
+	d.Req.Question[0].Name = origName
+
+	if d.Res == nil {
+		return
+	}
+
+	if len(d.Res.Question) == 1 {
+		d.Res.Question[0].Name = origName
+	}
+
+	var answer []dns.RR
+	for _, rr := range d.Res.Answer {
+		if rr.Header().Rrtype != qtype {
+			continue
+		}
+
+		rr = dns.Copy(rr)
+		rr.Header().Name = origName
+		rr.Header().Ttl = ttl
+		answer = append(answer, rr)
+	}
+	d.Res.Answer = answer
+}
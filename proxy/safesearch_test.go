@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// hostsUpstream answers A requests with the addresses from hosts.  Requests
+// of other types for the known hosts get empty NOERROR responses.
+type hostsUpstream struct {
+	hosts map[string]net.IP
+}
+
+func (u *hostsUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+
+	q := m.Question[0]
+	ip, ok := u.hosts[strings.TrimSuffix(q.Name, ".")]
+	if !ok {
+		resp.Rcode = dns.RcodeNameError
+
+		return resp, nil
+	} else if q.Qtype != dns.TypeA {
+		return resp, nil
+	}
+
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   ip,
+	})
+
+	return resp, nil
+}
+
+func (u *hostsUpstream) Address() string {
+	return "hosts"
+}
+
+func TestSafeSearch(t *testing.T) {
+	googleIP := net.IP{216, 239, 38, 120}
+	youtubeIP := net.IP{216, 239, 38, 119}
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.SafeSearchEnabled = true
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&hostsUpstream{
+		hosts: map[string]net.IP{
+			"forcesafesearch.google.com": googleIP,
+			"restrict.youtube.com":       youtubeIP,
+			"example.org":                {1, 2, 3, 4},
+		},
+	}}
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	client := dns.Client{Net: "udp", Timeout: defaultTimeout}
+	addr := dnsProxy.Addr(ProtoUDP).String()
+
+	testCases := []struct {
+		host string
+		want net.IP
+	}{{
+		host: "www.google.com",
+		want: googleIP,
+	}, {
+		host: "www.youtube.com",
+		want: youtubeIP,
+	}, {
+		host: "m.youtube.com",
+		want: youtubeIP,
+	}, {
+		host: "example.org",
+		want: net.IP{1, 2, 3, 4},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			reply, _, err := client.Exchange(createHostTestMessage(tc.host), addr)
+			if err != nil {
+				t.Fatalf("cannot exchange the message: %s", err)
+			}
+
+			assert.Equal(t, tc.host+".", reply.Question[0].Name)
+			if assert.Len(t, reply.Answer, 1) {
+				a, ok := reply.Answer[0].(*dns.A)
+				if assert.True(t, ok) {
+					assert.Equal(t, tc.host+".", a.Hdr.Name)
+					assert.True(t, tc.want.Equal(a.A))
+				}
+			}
+		})
+	}
+}
+
+func TestSafeSearchRules(t *testing.T) {
+	p := &Proxy{}
+	p.SafeSearchRules = map[string]string{
+		"www.google.com":  "",
+		"www.example.org": "safe.example.org",
+	}
+
+	assert.Equal(t, "", p.safeSearchTarget("www.google.com."))
+	assert.Equal(t, "forcesafesearch.google.com", p.safeSearchTarget("Google.com."))
+	assert.Equal(t, "safe.example.org", p.safeSearchTarget("www.example.org."))
+	assert.Equal(t, "restrict.youtube.com", p.safeSearchTarget("www.youtube.com."))
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+// Default values of the ScanDefense settings.
+const (
+	defaultScanDefenseThreshold = 8
+	defaultScanDefenseWindow    = time.Minute
+)
+
+// scanDefenseMaxEntries is the maximum number of the client and name pairs
+// tracked for ScanDefense.  The new pairs aren't tracked while that many are.
+const scanDefenseMaxEntries = 65536
+
+// commonQtypes are the types of the requests which are answered as usual
+// even for the scanning clients.
+var commonQtypes = map[uint16]bool{
+	dns.TypeA:      true,
+	dns.TypeAAAA:   true,
+	dns.TypeCNAME:  true,
+	dns.TypeMX:     true,
+	dns.TypeTXT:    true,
+	dns.TypeNS:     true,
+	dns.TypeSOA:    true,
+	dns.TypePTR:    true,
+	dns.TypeSRV:    true,
+	dns.TypeSVCB:   true,
+	dns.TypeHTTPS:  true,
+	dns.TypeCAA:    true,
+	dns.TypeDS:     true,
+	dns.TypeDNSKEY: true,
+}
+
+// isScanning remembers the type of d's request and returns true if the client
+// has requested too many distinct types of the name and this one is uncommon,
+// see ScanDefense.
+func (p *Proxy) isScanning(d *DNSContext) bool {
+	if !p.ScanDefense || len(d.Req.Question) != 1 {
+		return false
+	}
+
+	ip := getIPString(d.Addr)
+	if ip == "" || p.isRatelimitWhitelisted(ip) {
+		return false
+	}
+
+	threshold := p.ScanDefenseThreshold
+	if threshold == 0 {
+		threshold = defaultScanDefenseThreshold
+	}
+
+	q := d.Req.Question[0]
+	key := ip + " " + strings.ToLower(q.Name)
+
+	p.scanLock.Lock()
+	defer p.scanLock.Unlock()
+
+	if p.scanQtypes == nil {
+		window := p.ScanDefenseWindow
+		if window == 0 {
+			window = defaultScanDefenseWindow
+		}
+		p.scanQtypes = gocache.New(window, window)
+	}
+
+	var types map[uint16]struct{}
+	if v, ok := p.scanQtypes.Get(key); ok {
+		types = v.(map[uint16]struct{})
+	} else if p.scanQtypes.ItemCount() < scanDefenseMaxEntries {
+		types = map[uint16]struct{}{}
+		p.scanQtypes.SetDefault(key, types)
+	} else {
+		return false
+	}
+
+	types[q.Qtype] = struct{}{}
+
+	return len(types) > threshold && !commonQtypes[q.Qtype]
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanDefense(t *testing.T) {
+	u := &rcodeUpstream{}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	dnsProxy.ScanDefense = true
+	dnsProxy.ScanDefenseThreshold = 3
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	scanner := &net.TCPAddr{IP: net.IP{1, 2, 3, 4}}
+	resolve := func(addr net.Addr, host string, qtype uint16) *dns.Msg {
+		req := createHostTestMessage(host)
+		req.Question[0].Qtype = qtype
+		d := &DNSContext{Req: req, Addr: addr}
+		err = dnsProxy.handleDNSRequest(d)
+		assert.Nil(t, err)
+
+		return d.Res
+	}
+
+	// The scan doesn't look like one until the threshold is exceeded.
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeLOC, dns.TypeHINFO} {
+		resp := resolve(scanner, "host", qtype)
+		assert.NotEmpty(t, resp.Answer)
+	}
+	assert.Equal(t, uint32(3), atomic.LoadUint32(&u.calls))
+
+	// The repeated types don't count.
+	resp := resolve(scanner, "host", dns.TypeLOC)
+	assert.NotEmpty(t, resp.Answer)
+	assert.Equal(t, uint32(4), atomic.LoadUint32(&u.calls))
+
+	// The uncommon types get the empty responses.
+	for _, qtype := range []uint16{dns.TypeRP, dns.TypeAFSDB, dns.TypeLOC} {
+		resp = resolve(scanner, "host", qtype)
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Empty(t, resp.Answer)
+	}
+	assert.Equal(t, uint32(4), atomic.LoadUint32(&u.calls))
+
+	// The common types are still resolved.
+	resp = resolve(scanner, "host", dns.TypeMX)
+	assert.NotEmpty(t, resp.Answer)
+	assert.Equal(t, uint32(5), atomic.LoadUint32(&u.calls))
+
+	// Other names and other clients aren't affected.
+	resp = resolve(scanner, "other", dns.TypeRP)
+	assert.NotEmpty(t, resp.Answer)
+	resp = resolve(&net.TCPAddr{IP: net.IP{1, 2, 3, 5}}, "host", dns.TypeRP)
+	assert.NotEmpty(t, resp.Answer)
+	assert.Equal(t, uint32(7), atomic.LoadUint32(&u.calls))
+}
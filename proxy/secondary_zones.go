@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// defaultZoneRefresh is the interval of refreshing a secondary zone used when
+// neither SecondaryZone.RefreshInterval nor the zone's SOA specify it.
+const defaultZoneRefresh = time.Hour
+
+// SecondaryZone is a zone transferred from the primary name server via AXFR
+// and answered by the proxy authoritatively.
+type SecondaryZone struct {
+	// Name is the name of the zone.
+	Name string
+	// Primary is the address of the primary name server, "host:port".
+	Primary string
+	// RefreshInterval is the interval of checking the zone's SOA serial and
+	// transferring it again if it has changed.  Zero means the refresh
+	// interval of the zone's SOA.
+	RefreshInterval time.Duration
+}
+
+// zoneData are the records of a transferred secondary zone.
+type zoneData struct {
+	soa *dns.SOA
+	// records are the zone's records by the lowercased owner name.
+	records map[string][]dns.RR
+	// cuts are the lowercased names of the delegated subzones, which the
+	// zone isn't authoritative for.
+	cuts map[string]bool
+}
+
+// newZoneData returns the zone data built from the records of a zone
+// transfer.  rrs must contain the zone's SOA record.
+func newZoneData(zone string, rrs []dns.RR) (z *zoneData, err error) {
+	z = &zoneData{
+		records: map[string][]dns.RR{},
+		cuts:    map[string]bool{},
+	}
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		if soa, ok := rr.(*dns.SOA); ok && name == zone {
+			// The SOA record is both the first and the last one in the
+			// transfer.
+			if z.soa == nil {
+				z.soa = soa
+				z.records[name] = append(z.records[name], rr)
+			}
+
+			continue
+		}
+
+		if !dns.IsSubDomain(zone, name) {
+			log.Debug("secondary zone %s: ignoring out-of-zone record %s", zone, rr)
+
+			continue
+		}
+
+		if rr.Header().Rrtype == dns.TypeNS && name != zone {
+			z.cuts[name] = true
+		}
+
+		z.records[name] = append(z.records[name], rr)
+	}
+
+	if z.soa == nil {
+		return nil, fmt.Errorf("no soa record for zone %s", zone)
+	}
+
+	// Add the empty non-terminals so that they get NODATA instead of
+	// NXDOMAIN.
+	var ents []string
+	for name := range z.records {
+		for _, off := range dns.Split(name)[1:] {
+			parent := name[off:]
+			if parent == zone {
+				break
+			}
+
+			ents = append(ents, parent)
+		}
+	}
+
+	for _, name := range ents {
+		if _, ok := z.records[name]; !ok {
+			z.records[name] = nil
+		}
+	}
+
+	return z, nil
+}
+
+// answer returns the authoritative response to req from the zone's records or
+// nil if the name is delegated to a subzone and the request should be
+// forwarded.
+func (z *zoneData) answer(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+	if z.isDelegated(name) {
+		return nil
+	}
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+
+	rrs, ok := z.records[name]
+	if !ok {
+		resp.Rcode = dns.RcodeNameError
+		resp.Ns = []dns.RR{z.negativeSOA()}
+
+		return resp
+	}
+
+	for _, rr := range rrs {
+		rrType := rr.Header().Rrtype
+		if rrType == q.Qtype || q.Qtype == dns.TypeANY || rrType == dns.TypeCNAME {
+			resp.Answer = append(resp.Answer, dns.Copy(rr))
+		}
+	}
+
+	if len(resp.Answer) == 0 {
+		resp.Ns = []dns.RR{z.negativeSOA()}
+	}
+
+	return resp
+}
+
+// isDelegated returns true if the lowercased name is at or below a zone cut.
+func (z *zoneData) isDelegated(name string) bool {
+	zone := strings.ToLower(z.soa.Hdr.Name)
+	for _, off := range dns.Split(name) {
+		parent := name[off:]
+		if parent == zone {
+			return false
+		}
+
+		if z.cuts[parent] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// negativeSOA returns the zone's SOA record for the negative responses, with
+// the TTL set according to RFC 2308.
+func (z *zoneData) negativeSOA() dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+
+	return soa
+}
+
+// genSecondaryZone returns the response to req from the closest enclosing
+// secondary zone or nil if there is no such zone, it isn't transferred yet, or
+// the name is delegated from it.
+func (p *Proxy) genSecondaryZone(req *dns.Msg) *dns.Msg {
+	if len(p.SecondaryZones) == 0 || len(req.Question) != 1 || req.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+
+	p.secondaryZonesLock.RLock()
+	defer p.secondaryZonesLock.RUnlock()
+
+	name := strings.ToLower(req.Question[0].Name)
+	for _, off := range dns.Split(name) {
+		if z := p.secondaryZones[name[off:]]; z != nil {
+			return z.answer(req)
+		}
+	}
+
+	return nil
+}
+
+// initSecondaryZones starts transferring and refreshing the secondary zones.
+// The requests for a zone are forwarded until it's transferred.
+func (p *Proxy) initSecondaryZones() {
+	p.secondaryZonesLock.Lock()
+	p.secondaryZones = map[string]*zoneData{}
+	p.secondaryZonesLock.Unlock()
+
+	for _, zone := range p.SecondaryZones {
+		go p.refreshZoneLoop(zone, p.shutdown)
+	}
+}
+
+// refreshZoneLoop transfers zone right away and then each refresh interval
+// until shutdown is closed.  The first transfer doesn't block the proxy's
+// start, since an unreachable primary may take a while to time out.
+func (p *Proxy) refreshZoneLoop(zone SecondaryZone, shutdown chan struct{}) {
+	err := p.transferZone(zone)
+	if err != nil {
+		log.Error("secondary zone %s: %s", zone.Name, err)
+	}
+
+	for {
+		timer := time.NewTimer(p.zoneRefreshInterval(zone))
+		select {
+		case <-timer.C:
+			p.background.submit(func() {
+				err := p.transferZone(zone)
+				if err != nil {
+					log.Error("secondary zone %s: %s", zone.Name, err)
+				}
+			})
+		case <-shutdown:
+			timer.Stop()
+
+			return
+		}
+	}
+}
+
+// zoneRefreshInterval returns the interval of refreshing zone.
+func (p *Proxy) zoneRefreshInterval(zone SecondaryZone) time.Duration {
+	if zone.RefreshInterval > 0 {
+		return zone.RefreshInterval
+	}
+
+	p.secondaryZonesLock.RLock()
+	z := p.secondaryZones[dns.CanonicalName(zone.Name)]
+	p.secondaryZonesLock.RUnlock()
+
+	if z != nil && z.soa.Refresh > 0 {
+		return time.Duration(z.soa.Refresh) * time.Second
+	}
+
+	return defaultZoneRefresh
+}
+
+// transferZone requests the SOA record of zone from its primary and transfers
+// the zone if its serial differs from the one of the zone's current data.
+func (p *Proxy) transferZone(zone SecondaryZone) error {
+	name := dns.CanonicalName(zone.Name)
+
+	p.secondaryZonesLock.RLock()
+	current := p.secondaryZones[name]
+	p.secondaryZonesLock.RUnlock()
+
+	if current != nil {
+		serial, err := querySOASerial(name, zone.Primary)
+		if err != nil {
+			return errorx.Decorate(err, "querying soa")
+		}
+
+		if serial == current.soa.Serial {
+			log.Tracef("secondary zone %s: serial %d is unchanged", name, serial)
+
+			return nil
+		}
+	}
+
+	req := &dns.Msg{}
+	req.SetAxfr(name)
+
+	t := &dns.Transfer{
+		DialTimeout: defaultTimeout,
+		ReadTimeout: defaultTimeout,
+	}
+	envs, err := t.In(req, zone.Primary)
+	if err != nil {
+		return errorx.Decorate(err, "starting transfer")
+	}
+
+	var rrs []dns.RR
+	for env := range envs {
+		if env.Error != nil {
+			return errorx.Decorate(env.Error, "transferring")
+		}
+		rrs = append(rrs, env.RR...)
+	}
+
+	z, err := newZoneData(name, rrs)
+	if err != nil {
+		return err
+	}
+
+	p.secondaryZonesLock.Lock()
+	p.secondaryZones[name] = z
+	p.secondaryZonesLock.Unlock()
+
+	log.Info("secondary zone %s: transferred %d records with serial %d", name, len(rrs), z.soa.Serial)
+
+	return nil
+}
+
+// querySOASerial returns the serial of the SOA record of zone from primary.
+func querySOASerial(zone, primary string) (serial uint32, err error) {
+	req := &dns.Msg{}
+	req.SetQuestion(zone, dns.TypeSOA)
+
+	client := &dns.Client{Net: "tcp", Timeout: defaultTimeout}
+	reply, _, err := client.Exchange(req, primary)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, rr := range reply.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no soa record in response with rcode %s", dns.RcodeToString[reply.Rcode])
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// startAXFRServer starts a TCP DNS server which serves the zone example.org.
+// with serial and counts its transfers.
+func startAXFRServer(t *testing.T, serial *uint32, transfers *uint32) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+
+	srv := &dns.Server{Listener: l, Net: "tcp"}
+	srv.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		soa := &dns.SOA{
+			Hdr:     dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+			Ns:      "ns.example.org.",
+			Mbox:    "hostmaster.example.org.",
+			Serial:  atomic.LoadUint32(serial),
+			Refresh: 3600,
+			Minttl:  60,
+		}
+
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Answer = append(resp.Answer, soa)
+		if req.Question[0].Qtype == dns.TypeAXFR {
+			atomic.AddUint32(transfers, 1)
+			resp.Answer = append(resp.Answer,
+				newRR("www.example.org. 300 IN A 1.2.3.4"),
+				newRR("alias.example.org. 300 IN CNAME www.example.org."),
+				newRR("host.sub.example.org. 300 IN A 5.6.7.8"),
+				newRR("child.example.org. 300 IN NS ns.child.example.org."),
+				newRR("ns.child.example.org. 300 IN A 9.9.9.9"),
+				soa,
+			)
+		}
+		_ = w.WriteMsg(resp)
+	})
+
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	return l.Addr().String()
+}
+
+func TestSecondaryZones(t *testing.T) {
+	serial, transfers := uint32(1), uint32(0)
+	primary := startAXFRServer(t, &serial, &transfers)
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.SecondaryZones = []SecondaryZone{{
+		Name:            "Example.org",
+		Primary:         primary,
+		RefreshInterval: time.Hour,
+	}}
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	// The zone is transferred in the background.
+	assert.Eventually(t, func() bool {
+		dnsProxy.secondaryZonesLock.RLock()
+		defer dnsProxy.secondaryZonesLock.RUnlock()
+
+		return dnsProxy.secondaryZones["example.org."] != nil
+	}, defaultTimeout, 10*time.Millisecond)
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&transfers))
+
+	client := &dns.Client{Net: "udp", Timeout: defaultTimeout}
+	exchange := func(name string, qtype uint16) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion(name, qtype)
+		reply, _, err := client.Exchange(req, dnsProxy.Addr(ProtoUDP).String())
+		if err != nil {
+			t.Fatalf("cannot exchange: %s", err)
+		}
+
+		return reply
+	}
+
+	// The transferred records are served locally.
+	reply := exchange("WWW.example.org.", dns.TypeA)
+	assert.True(t, reply.Authoritative)
+	if assert.Len(t, reply.Answer, 1) {
+		assert.Equal(t, net.IP{1, 2, 3, 4}, reply.Answer[0].(*dns.A).A.To4())
+	}
+
+	reply = exchange("alias.example.org.", dns.TypeA)
+	if assert.Len(t, reply.Answer, 1) {
+		assert.Equal(t, "www.example.org.", reply.Answer[0].(*dns.CNAME).Target)
+	}
+
+	reply = exchange("www.example.org.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Empty(t, reply.Answer)
+	if assert.Len(t, reply.Ns, 1) {
+		assert.Equal(t, uint32(60), reply.Ns[0].Header().Ttl)
+	}
+
+	reply = exchange("none.example.org.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+
+	// The empty non-terminal exists.
+	reply = exchange("sub.example.org.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Empty(t, reply.Answer)
+	assert.Len(t, reply.Ns, 1)
+
+	// The names at and below the zone cut are forwarded.
+	for _, name := range []string{"child.example.org.", "x.child.example.org.", "ns.child.example.org."} {
+		req := (&dns.Msg{}).SetQuestion(name, dns.TypeA)
+		assert.Nil(t, dnsProxy.genSecondaryZone(req), name)
+	}
+
+	// The unchanged zone isn't transferred again.
+	err = dnsProxy.transferZone(dnsProxy.SecondaryZones[0])
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&transfers))
+
+	atomic.StoreUint32(&serial, 2)
+	err = dnsProxy.transferZone(dnsProxy.SecondaryZones[0])
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), atomic.LoadUint32(&transfers))
+}
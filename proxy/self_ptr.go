@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// listenIPs returns the IP addresses of all the configured listeners.  The
+// unspecified addresses are replaced with the addresses of the network
+// interfaces.
+func (p *Proxy) listenIPs() (ips []net.IP) {
+	for _, a := range p.UDPListenAddr {
+		ips = append(ips, a.IP)
+	}
+	for _, a := range p.QUICListenAddr {
+		ips = append(ips, a.IP)
+	}
+	for _, a := range p.DNSCryptUDPListenAddr {
+		ips = append(ips, a.IP)
+	}
+	for _, addrs := range [][]*net.TCPAddr{
+		p.TCPListenAddr,
+		p.TLSListenAddr,
+		p.HTTPSListenAddr,
+		p.HTTPListenAddr,
+		p.DNSCryptTCPListenAddr,
+	} {
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	res := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if ip != nil && !ip.IsUnspecified() {
+			res = append(res, ip)
+
+			continue
+		}
+
+		ifaceAddrs, err := net.InterfaceAddrs()
+		if err != nil {
+			log.Debug("couldn't get the interfaces addresses: %s", err)
+
+			continue
+		}
+
+		for _, a := range ifaceAddrs {
+			if ipNet, ok := a.(*net.IPNet); ok {
+				res = append(res, ipNet.IP)
+			}
+		}
+	}
+
+	return res
+}
+
+// initSelfPTR builds the set of the reverse names of the proxy's own listen
+// addresses to answer with SelfPTR.
+func (p *Proxy) initSelfPTR() {
+	p.selfPTRNames = nil
+	if p.SelfPTR == "" {
+		return
+	}
+
+	p.selfPTRNames = map[string]bool{}
+	for _, ip := range p.listenIPs() {
+		name, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			log.Debug("couldn't get the reverse name of %s: %s", ip, err)
+
+			continue
+		}
+
+		p.selfPTRNames[name] = true
+	}
+
+	log.Info("Answering PTR requests for %d own addresses with %s", len(p.selfPTRNames), p.SelfPTR)
+}
+
+// genSelfPTR returns the response to the PTR request for one of the proxy's
+// own listen addresses or nil if req is not such a request.
+func (p *Proxy) genSelfPTR(req *dns.Msg) *dns.Msg {
+	if len(p.selfPTRNames) == 0 || len(req.Question) != 1 {
+		return nil
+	}
+
+	q := req.Question[0]
+	if q.Qtype != dns.TypePTR || !p.selfPTRNames[strings.ToLower(q.Name)] {
+		return nil
+	}
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+	resp.Answer = append(resp.Answer, &dns.PTR{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypePTR,
+			Class:  dns.ClassINET,
+			Ttl:    p.rewriteTTL(),
+		},
+		Ptr: dns.Fqdn(p.SelfPTR),
+	})
+
+	return resp
+}
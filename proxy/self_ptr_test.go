@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelfPTR(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&hostsUpstream{hosts: map[string]net.IP{}}}
+	dnsProxy.SelfPTR = "resolver.example.org"
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	client := dns.Client{Net: "udp", Timeout: defaultTimeout}
+	addr := dnsProxy.Addr(ProtoUDP).String()
+
+	req := (&dns.Msg{}).SetQuestion("1.0.0.127.in-addr.arpa.", dns.TypePTR)
+	reply, _, err := client.Exchange(req, addr)
+	if err != nil {
+		t.Fatalf("cannot exchange the message: %s", err)
+	}
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	if assert.Len(t, reply.Answer, 1) {
+		ptr, ok := reply.Answer[0].(*dns.PTR)
+		if assert.True(t, ok) {
+			assert.Equal(t, "resolver.example.org.", ptr.Ptr)
+			assert.Equal(t, "1.0.0.127.in-addr.arpa.", ptr.Hdr.Name)
+		}
+	}
+
+	// Other addresses are resolved by the upstream
+	req = (&dns.Msg{}).SetQuestion("2.0.0.127.in-addr.arpa.", dns.TypePTR)
+	reply, _, err = client.Exchange(req, addr)
+	if err != nil {
+		t.Fatalf("cannot exchange the message: %s", err)
+	}
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+	assert.Empty(t, reply.Answer)
+}
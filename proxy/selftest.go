@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// UpstreamTestResult is the result of probing a single upstream with
+// TestUpstreams.
+type UpstreamTestResult struct {
+	// Address is the address of the upstream.
+	Address string
+	// OK is true if the upstream has responded to the probe.
+	OK bool
+	// RTT is the round-trip time of the probe.
+	RTT time.Duration
+	// Err is the error occurred if OK is false.
+	Err error
+}
+
+// TestUpstreams sends a probe request to each configured upstream, including
+// the domain-specific and the fallback ones, and returns the results in the
+// same order.  The upstreams that haven't responded until ctx is done fail
+// with its error.  It allows the embedders to report the unreachable upstreams
+// before the first request.
+func (p *Proxy) TestUpstreams(ctx context.Context) (results []UpstreamTestResult) {
+	ups := append(p.debugUpstreams(), p.Fallbacks...)
+
+	type probe struct {
+		idx int
+		res UpstreamTestResult
+	}
+
+	// The channel is buffered so that the probes still running when ctx
+	// is done don't block forever.
+	ch := make(chan probe, len(ups))
+	for i, u := range ups {
+		go func(idx int, u upstream.Upstream) {
+			ch <- probe{idx: idx, res: probeUpstream(u)}
+		}(i, u)
+	}
+
+	results = make([]UpstreamTestResult, len(ups))
+	done := make([]bool, len(ups))
+	for left := len(ups); left > 0; left-- {
+		select {
+		case pr := <-ch:
+			results[pr.idx] = pr.res
+			done[pr.idx] = true
+		case <-ctx.Done():
+			for i, u := range ups {
+				if !done[i] {
+					results[i] = UpstreamTestResult{Address: u.Address(), Err: ctx.Err()}
+				}
+			}
+
+			return results
+		}
+	}
+
+	return results
+}
+
+// probeUpstream sends the probe request to u.
+func probeUpstream(u upstream.Upstream) (res UpstreamTestResult) {
+	req := &dns.Msg{}
+	req.Id = dns.Id()
+	req.RecursionDesired = true
+	req.SetQuestion(".", dns.TypeNS)
+
+	res.Address = u.Address()
+	start := time.Now()
+	reply, err := u.Exchange(req)
+	res.RTT = time.Since(start)
+	if err != nil {
+		res.Err = errorx.Decorate(err, "probing %s", res.Address)
+		log.Debug("Upstream test failed: %s", res.Err)
+
+		return res
+	}
+
+	if reply == nil {
+		res.Err = fmt.Errorf("probing %s: no response", res.Address)
+
+		return res
+	}
+
+	res.OK = true
+
+	return res
+}
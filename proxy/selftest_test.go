@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTestUpstreams(t *testing.T) {
+	// Take a free port and close it so that the upstream is unreachable.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	unreachableAddr := "https://" + l.Addr().String() + "/dns-query"
+	_ = l.Close()
+
+	unreachable, err := upstream.AddressToUpstream(unreachableAddr, upstream.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("cannot create the upstream: %s", err)
+	}
+
+	reachable := &rcodeUpstream{}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{reachable, unreachable}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	results := dnsProxy.TestUpstreams(ctx)
+	if !assert.Len(t, results, 2) {
+		return
+	}
+
+	assert.Equal(t, reachable.Address(), results[0].Address)
+	assert.True(t, results[0].OK)
+	assert.Nil(t, results[0].Err)
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&reachable.calls))
+
+	assert.Equal(t, unreachableAddr, results[1].Address)
+	assert.False(t, results[1].OK)
+	assert.NotNil(t, results[1].Err)
+}
@@ -2,8 +2,10 @@ package proxy
 
 import (
 	"fmt"
-	"net"
+	"math/rand"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
@@ -13,7 +15,16 @@ import (
 
 // startListeners configures and starts listener loops
 func (p *Proxy) startListeners() error {
-	err := p.createUDPListeners()
+	err := p.createFDListeners()
+	if err != nil {
+		return err
+	}
+
+	// The UDP sockets inherited from the file descriptors go first, they
+	// can't be re-created.
+	fdUDPNum := len(p.udpListen)
+
+	err = p.createUDPListeners()
 	if err != nil {
 		return err
 	}
@@ -43,51 +54,137 @@ func (p *Proxy) startListeners() error {
 		return err
 	}
 
-	for _, l := range p.udpListen {
-		go p.udpPacketLoop(l, p.requestGoroutinesSema)
+	// started is done once all the listener loops are running.
+	started := &sync.WaitGroup{}
+	sema := p.requestGoroutinesSema
+
+	for i, l := range p.udpListen {
+		l, restartable := l, i >= fdUDPNum
+		p.goListenerLoop(started, func() { p.udpPacketLoop(l, sema, restartable) })
 	}
 
 	for _, l := range p.tcpListen {
-		go p.tcpPacketLoop(l, ProtoTCP, p.requestGoroutinesSema)
+		l := l
+		p.goListenerLoop(started, func() { p.tcpPacketLoop(l, ProtoTCP, sema) })
 	}
 
 	for _, l := range p.tlsListen {
-		go p.tcpPacketLoop(l, ProtoTLS, p.requestGoroutinesSema)
+		l := l
+		p.goListenerLoop(started, func() { p.tcpPacketLoop(l, ProtoTLS, sema) })
 	}
 
 	for i := range p.httpsServer {
-		go p.listenHTTPS(p.httpsServer[i], p.httpsListen[i])
+		srv, l := p.httpsServer[i], p.httpsListen[i]
+		p.goListenerLoop(started, func() { p.listenHTTPS(srv, l) })
+	}
+
+	for i := range p.httpServer {
+		srv, l := p.httpServer[i], p.httpListen[i]
+		p.goListenerLoop(started, func() { p.listenHTTPS(srv, l) })
 	}
 
 	for _, l := range p.quicListen {
-		go p.quicPacketLoop(l, p.requestGoroutinesSema)
+		l := l
+		p.goListenerLoop(started, func() { p.quicPacketLoop(l, sema) })
 	}
 
 	for _, l := range p.dnsCryptUDPListen {
-		go func(l *net.UDPConn) { _ = p.dnsCryptServer.ServeUDP(l) }(l)
+		l := l
+		p.goListenerLoop(started, func() { _ = p.dnsCryptServer.ServeUDP(l) })
 	}
 
 	for _, l := range p.dnsCryptTCPListen {
-		go func(l net.Listener) { _ = p.dnsCryptServer.ServeTCP(l) }(l)
+		l := l
+		p.goListenerLoop(started, func() { _ = p.dnsCryptServer.ServeTCP(l) })
 	}
 
+	started.Wait()
+
 	return nil
 }
 
+// goListenerLoop runs loop in a new goroutine and marks it started in wg once
+// the goroutine is running.  The sockets are already bound at this point, so
+// the packets received before loop reads them are queued by the system.
+func (p *Proxy) goListenerLoop(wg *sync.WaitGroup, loop func()) {
+	wg.Add(1)
+	p.listenersWG.Add(1)
+	go func() {
+		defer p.listenersWG.Done()
+
+		wg.Done()
+		loop()
+	}()
+}
+
+// Ready returns the channel which is closed once the listener loops of the
+// started proxy are running, so that the queries may be sent to it right
+// away.
+func (p *Proxy) Ready() <-chan struct{} {
+	p.readyLock.Lock()
+	defer p.readyLock.Unlock()
+
+	if p.ready == nil {
+		p.ready = make(chan struct{})
+	}
+
+	return p.ready
+}
+
+// setReady closes the channel returned by Ready if ready is true, or replaces
+// it with a new one for the next start of the proxy otherwise.
+func (p *Proxy) setReady(ready bool) {
+	p.readyLock.Lock()
+	defer p.readyLock.Unlock()
+
+	if !ready {
+		p.ready = nil
+
+		return
+	}
+
+	if p.ready == nil {
+		p.ready = make(chan struct{})
+	}
+	close(p.ready)
+}
+
 // handleDNSRequest processes the incoming packet bytes and returns with an optional response packet.
 func (p *Proxy) handleDNSRequest(d *DNSContext) error {
 	d.StartTime = time.Now()
-	p.logDNSMessage(d.Req)
+	d.RequestID = atomic.AddUint64(&p.lastRequestID, 1)
+	p.logDNSMessage(d.RequestID, d.Req)
+	p.dnstapClientQuery(d)
+
+	// Remember the client's EDNS0 parameters before the request is modified.
+	d.calcFlagsAndSize()
+
+	if !p.beginRequest() {
+		log.Debug("[%d] Refusing request from %s since the proxy is stopping", d.RequestID, d.Addr)
+		d.Res = p.genShutdownRefused(d.Req)
+		p.respond(d)
+
+		return nil
+	}
+	defer p.endRequest()
 
 	if d.Req.Response {
-		log.Debug("Dropping incoming Reply packet from %s", d.Addr.String())
+		if p.RejectResponses {
+			log.Debug("[%d] Rejecting incoming Reply packet from %s", d.RequestID, d.Addr.String())
+			d.Res = p.genFormErr(d.Req)
+			p.respond(d)
+
+			return nil
+		}
+
+		log.Debug("[%d] Dropping incoming Reply packet from %s", d.RequestID, d.Addr.String())
 		return nil
 	}
 
 	if p.BeforeRequestHandler != nil {
 		ok, err := p.BeforeRequestHandler(p, d)
 		if err != nil {
-			log.Error("Error in the BeforeRequestHandler: %s", err)
+			log.Error("[%d] Error in the BeforeRequestHandler: %s", d.RequestID, err)
 			d.Res = p.genServerFailure(d.Req)
 			p.respond(d)
 			return nil
@@ -99,26 +196,93 @@ func (p *Proxy) handleDNSRequest(d *DNSContext) error {
 
 	// ratelimit based on IP only, protects CPU cycles and outbound connections
 	if d.Proto == ProtoUDP && p.isRatelimited(d.Addr) {
-		log.Tracef("Ratelimiting %v based on IP only", d.Addr)
+		log.Tracef("[%d] Ratelimiting %v based on IP only", d.RequestID, d.Addr)
 		return nil // do nothing, don't reply, we got ratelimited
 	}
 
 	if len(d.Req.Question) != 1 {
-		log.Debug("got invalid number of questions: %v", len(d.Req.Question))
+		log.Debug("[%d] got invalid number of questions: %v", d.RequestID, len(d.Req.Question))
 		d.Res = p.genServerFailure(d.Req)
 	}
 
+	if d.Res == nil && p.StrictNameValidation && !isValidName(d.Req.Question[0].Name) {
+		log.Debug("[%d] Invalid name in request from %s", d.RequestID, d.Addr)
+		d.Res = p.genFormErr(d.Req)
+	}
+
+	// the requests sent by the proxy itself are refused to break the loop
+	if d.Res == nil && p.isLooped(d.Req) {
+		log.Debug("[%d] Refusing looped request from %s", d.RequestID, d.Addr)
+		d.Res = p.genLoopRefused(d.Req)
+	}
+
+	// the proxy only forwards the standard queries by default
+	if d.Res == nil && !p.isOpcodeAllowed(d.Req.Opcode) {
+		log.Tracef("[%d] Refusing request with opcode %s", d.RequestID, dns.OpcodeToString[d.Req.Opcode])
+		d.Res = p.genNotImpl(d.Req)
+	}
+
 	// refuse ANY requests (anti-DDOS measure)
 	if p.RefuseAny && len(d.Req.Question) > 0 && d.Req.Question[0].Qtype == dns.TypeANY {
-		log.Tracef("Refusing type=ANY request")
+		log.Tracef("[%d] Refusing type=ANY request", d.RequestID)
 		d.Res = p.genNotImpl(d.Req)
 	}
 
+	// the proxy only resolves recursively, so refuse the requests which
+	// don't desire recursion instead of misleadingly recursing
+	if d.Res == nil && p.RequireRD && !d.Req.RecursionDesired {
+		log.Tracef("[%d] Refusing non-recursive request", d.RequestID)
+		d.Res = p.genRefused(d.Req)
+	}
+
+	if d.Res == nil {
+		d.Res = p.genSelfPTR(d.Req)
+	}
+
+	if d.Res == nil {
+		d.Res = p.genIdentity(d.Req)
+	}
+
+	// the proxy doesn't answer the classes other than the allowed ones
+	// itself, so refuse them instead of forwarding, except for the
+	// identity requests handled above
+	if d.Res == nil && !p.isClassAllowed(d.Req.Question[0].Qclass) {
+		log.Tracef("[%d] Refusing request with class %s", d.RequestID, dns.Class(d.Req.Question[0].Qclass))
+		d.Res = p.genRefused(d.Req)
+	}
+
+	if d.Res == nil && p.isScanning(d) {
+		log.Debug("[%d] Client %s is scanning types of %s, answering with empty response", d.RequestID, d.Addr, d.Req.Question[0].Name)
+		d.Res = p.genResponse(d.Req, dns.RcodeSuccess)
+	}
+
+	if d.Res == nil {
+		d.Res = p.genRootNS(d.Req)
+	}
+
+	if d.Res == nil {
+		d.Res = p.genSecondaryZone(d.Req)
+	}
+
+	if d.Res == nil {
+		p.handleType(d)
+	}
+
+	// Allowlisted requests skip all the blocking and filtering.
+	filter := !p.isAllowlisted(d.Req)
+
+	// The regular expressions are only matched if the faster checks miss.
+	if d.Res == nil && filter &&
+		(p.isBlockedBySchedule(d.Req) || p.isBlocklisted(d.Req) || p.isBlockedByRegex(d.Req)) {
+		d.Res = p.genBlocked(d.Req)
+	}
+
 	var err error
 
 	if d.Res == nil {
-		if len(p.UpstreamConfig.Upstreams) == 0 {
-			panic("SHOULD NOT HAPPEN: no default upstreams specified")
+		origName := ""
+		if filter {
+			origName = p.rewriteSafeSearch(d)
 		}
 
 		// execute the DNS request
@@ -129,12 +293,16 @@ func (p *Proxy) handleDNSRequest(d *DNSContext) error {
 			err = p.Resolve(d)
 		}
 
+		if origName != "" {
+			restoreSafeSearch(d, origName, p.rewriteTTL())
+		}
+
 		if err != nil {
 			err = errorx.Decorate(err, "talking to dnsUpstream failed")
 		}
 	}
 
-	p.logDNSMessage(d.Res)
+	p.logDNSMessage(d.RequestID, d.Res)
 	p.respond(d)
 	return err
 }
@@ -145,6 +313,17 @@ func (p *Proxy) respond(d *DNSContext) {
 		return
 	}
 
+	d.setResponseOPT()
+	p.advertiseUDPSize(d)
+	p.limitTXT(d)
+	p.capClientTTL(d)
+
+	p.dnstapClientResponse(d)
+	p.writeQueryLog(d)
+	p.publishQuery(d)
+
+	p.delayResponse()
+
 	// d.Conn can be nil in the case of a DOH request
 	if d.Conn != nil {
 		d.Conn.SetWriteDeadline(time.Now().Add(defaultTimeout)) //nolint
@@ -173,13 +352,34 @@ func (p *Proxy) respond(d *DNSContext) {
 		if isNonCriticalError(err) {
 			// We're probably restarting, so log this with the debug
 			// level.
-			log.Debug("error while responding to a dns request: %s", err)
+			log.Debug("[%d] error while responding to a dns request: %s", d.RequestID, err)
 		} else {
-			log.Printf("error while responding to a dns request: %s", err)
+			log.Printf("[%d] error while responding to a dns request: %s", d.RequestID, err)
 		}
 	}
 }
 
+// delayResponse waits for a random duration up to p.ResponseJitter.  It stops
+// waiting when the proxy is shutting down.
+func (p *Proxy) delayResponse() {
+	if p.ResponseJitter <= 0 {
+		return
+	}
+
+	p.RLock()
+	shutdown := p.shutdown
+	p.RUnlock()
+
+	delay := time.Duration(rand.Int63n(int64(p.ResponseJitter) + 1))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-shutdown:
+	}
+}
+
 func isNonCriticalError(err error) (ok bool) {
 	// TODO(a.garipov): When Go 1.16 is released, replace the error string
 	// check with proper error handling.
@@ -202,36 +402,156 @@ func (p *Proxy) setMinMaxTTL(r *dns.Msg) {
 	}
 }
 
-func (p *Proxy) genServerFailure(request *dns.Msg) *dns.Msg {
+// capNegativeTTL caps the TTL of the SOA records of the negative response r
+// and, if configured, their MINIMUM field with NegativeCacheMaxTTL.
+func (p *Proxy) capNegativeTTL(r *dns.Msg) {
+	maxTTL := p.NegativeCacheMaxTTL
+	if maxTTL == 0 || !isNegative(r) {
+		return
+	}
+
+	for i, rr := range r.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok || (soa.Hdr.Ttl <= maxTTL && (!p.NegativeCacheRewriteSOA || soa.Minttl <= maxTTL)) {
+			continue
+		}
+
+		// Don't change the record which may be shared with the upstream.
+		soa = dns.Copy(soa).(*dns.SOA)
+		if soa.Hdr.Ttl > maxTTL {
+			log.Debug("Override negative TTL from %d to %d", soa.Hdr.Ttl, maxTTL)
+			soa.Hdr.Ttl = maxTTL
+		}
+		if p.NegativeCacheRewriteSOA && soa.Minttl > maxTTL {
+			soa.Minttl = maxTTL
+		}
+		r.Ns[i] = soa
+	}
+}
+
+// capClientTTL caps the TTL of the records of the response sent to the client
+// with ClientMaxTTL.
+func (p *Proxy) capClientTTL(d *DNSContext) {
+	maxTTL := p.ClientMaxTTL
+	if maxTTL == 0 {
+		return
+	}
+
+	for _, rrs := range [][]dns.RR{d.Res.Answer, d.Res.Ns, d.Res.Extra} {
+		for i, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT || rr.Header().Ttl <= maxTTL {
+				continue
+			}
+
+			// Don't change the record which may be shared with the
+			// upstream or the other requests.
+			rr = dns.Copy(rr)
+			rr.Header().Ttl = maxTTL
+			rrs[i] = rr
+		}
+	}
+}
+
+// isNegative returns true if r is an NXDOMAIN or a NODATA response.
+func isNegative(r *dns.Msg) bool {
+	return r.Rcode == dns.RcodeNameError || (r.Rcode == dns.RcodeSuccess && len(r.Answer) == 0)
+}
+
+// isValidName returns true if name doesn't exceed the limits of RFC 1035
+// section 2.3.4 in the wire format, i.e. 255 octets for the name and 63 octets
+// for each of its labels.
+func isValidName(name string) bool {
+	// The buffer only fits the names of the valid length.
+	var buf [255]byte
+	_, err := dns.PackDomainName(dns.Fqdn(name), buf[:], 0, nil, false)
+
+	return err == nil
+}
+
+// isClassAllowed returns true if the requests of class qclass should be
+// forwarded.
+func (p *Proxy) isClassAllowed(qclass uint16) bool {
+	if len(p.AllowedClasses) == 0 {
+		return qclass == dns.ClassINET
+	}
+
+	for _, c := range p.AllowedClasses {
+		if c == qclass {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isOpcodeAllowed returns true if the requests with opcode should be
+// forwarded.
+func (p *Proxy) isOpcodeAllowed(opcode int) bool {
+	if opcode == dns.OpcodeQuery {
+		return true
+	}
+
+	for _, o := range p.AllowedOpcodes {
+		if o == opcode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// genResponse returns the empty response to request with rcode.  The extended
+// rcodes, i.e. the ones greater than 15, need the OPT record to be encoded, so
+// it's added in this case, see RFC 6891.
+func (p *Proxy) genResponse(request *dns.Msg, rcode int) *dns.Msg {
 	resp := dns.Msg{}
-	resp.SetRcode(request, dns.RcodeServerFailure)
+	resp.SetRcode(request, rcode)
 	resp.RecursionAvailable = true
+
+	if rcode > 0xF {
+		udpSize := uint16(dns.DefaultMsgSize)
+		if opt := request.IsEdns0(); opt != nil {
+			udpSize = opt.UDPSize()
+		}
+		resp.SetEdns0(udpSize, false)
+		// The upper 8 bits are stored in the OPT record while packing.
+		resp.IsEdns0().SetExtendedRcode(uint16(rcode))
+	}
+
 	return &resp
 }
 
+func (p *Proxy) genServerFailure(request *dns.Msg) *dns.Msg {
+	return p.genResponse(request, dns.RcodeServerFailure)
+}
+
 func (p *Proxy) genNotImpl(request *dns.Msg) *dns.Msg {
-	resp := dns.Msg{}
-	resp.SetRcode(request, dns.RcodeNotImplemented)
-	resp.RecursionAvailable = true
+	resp := p.genResponse(request, dns.RcodeNotImplemented)
 	resp.SetEdns0(1452, false) // NOTIMPL without EDNS is treated as 'we don't support EDNS', so explicitly set it
-	return &resp
+	return resp
+}
+
+func (p *Proxy) genRefused(request *dns.Msg) *dns.Msg {
+	return p.genResponse(request, dns.RcodeRefused)
+}
+
+func (p *Proxy) genFormErr(req *dns.Msg) *dns.Msg {
+	return p.genResponse(req, dns.RcodeFormatError)
 }
 
 func (p *Proxy) genNXDomain(req *dns.Msg) *dns.Msg {
-	resp := dns.Msg{}
-	resp.SetRcode(req, dns.RcodeNameError)
-	resp.RecursionAvailable = true
-	return &resp
+	return p.genResponse(req, dns.RcodeNameError)
 }
 
-func (p *Proxy) logDNSMessage(m *dns.Msg) {
+// logDNSMessage writes m to the trace log along with the ID of the request.
+func (p *Proxy) logDNSMessage(id uint64, m *dns.Msg) {
 	if m == nil {
 		return
 	}
 
 	if m.Response {
-		log.Tracef("OUT: %s", m)
+		log.Tracef("[%d] OUT: %s", id, m)
 	} else {
-		log.Tracef("IN: %s", m)
+		log.Tracef("[%d] IN: %s", id, m)
 	}
 }
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd, see
+// sd_listen_fds(3).
+const listenFDsStart = 3
+
+// SystemdListenFDs returns the file descriptors passed to the current process
+// by systemd socket activation using the LISTEN_PID and LISTEN_FDS
+// environment variables.  It returns nil if there are none.
+func SystemdListenFDs() (fds []uintptr) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		fds = append(fds, uintptr(fd))
+	}
+
+	return fds
+}
+
+// createFDListeners wraps the pre-opened sockets from ListenFDs.  The stream
+// sockets are served as plain TCP and the datagram ones as plain UDP.
+func (p *Proxy) createFDListeners() error {
+	for _, fd := range p.ListenFDs {
+		f := os.NewFile(fd, fmt.Sprintf("fd%d", fd))
+		if f == nil {
+			return fmt.Errorf("invalid listen file descriptor %d", fd)
+		}
+
+		err := p.fdCreate(f)
+		// The listeners use the duplicates of the descriptor.
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fdCreate creates a TCP or UDP listener from the socket file f.
+func (p *Proxy) fdCreate(f *os.File) error {
+	if l, err := net.FileListener(f); err == nil {
+		tcpListen, ok := l.(*net.TCPListener)
+		if !ok {
+			_ = l.Close()
+			return fmt.Errorf("%s is not a TCP socket", f.Name())
+		}
+
+		p.tcpListen = append(p.tcpListen, tcpListen)
+		log.Printf("Listening to tcp://%s from %s", tcpListen.Addr(), f.Name())
+
+		return nil
+	}
+
+	c, err := net.FilePacketConn(f)
+	if err != nil {
+		return errorx.Decorate(err, "couldn't use %s as a listener", f.Name())
+	}
+
+	udpListen, ok := c.(*net.UDPConn)
+	if !ok {
+		_ = c.Close()
+		return fmt.Errorf("%s is not a UDP socket", f.Name())
+	}
+
+	err = p.udpSetup(udpListen)
+	if err != nil {
+		return err
+	}
+
+	p.udpListen = append(p.udpListen, udpListen)
+	log.Printf("Listening to udp://%s from %s", udpListen.LocalAddr(), f.Name())
+
+	return nil
+}
@@ -0,0 +1,117 @@
+// +build !windows
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenFDs(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(listenIP)})
+	if err != nil {
+		t.Fatalf("cannot listen udp: %s", err)
+	}
+	defer udpConn.Close()
+	udpFile, err := udpConn.File()
+	if err != nil {
+		t.Fatalf("cannot get the udp socket file: %s", err)
+	}
+	defer udpFile.Close()
+
+	tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(listenIP)})
+	if err != nil {
+		t.Fatalf("cannot listen tcp: %s", err)
+	}
+	defer tcpListener.Close()
+	tcpFile, err := tcpListener.File()
+	if err != nil {
+		t.Fatalf("cannot get the tcp socket file: %s", err)
+	}
+	defer tcpFile.Close()
+
+	dnsProxy := &Proxy{Config: Config{
+		ListenFDs:      []uintptr{udpFile.Fd(), tcpFile.Fd()},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{createTestUpstream()}},
+	}}
+	err = dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	assert.Equal(t, udpConn.LocalAddr().String(), dnsProxy.Addr(ProtoUDP).String())
+	assert.Equal(t, tcpListener.Addr().String(), dnsProxy.Addr(ProtoTCP).String())
+
+	for _, network := range []string{"udp", "tcp"} {
+		addr := udpConn.LocalAddr().String()
+		if network == "tcp" {
+			addr = tcpListener.Addr().String()
+		}
+
+		client := &dns.Client{Net: network, Timeout: defaultTimeout}
+		reply, _, eErr := client.Exchange(createTestMessage(), addr)
+		if assert.Nil(t, eErr, network) {
+			assertResponse(t, reply)
+		}
+	}
+}
+
+func TestListenFDsReadError(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(listenIP)})
+	if err != nil {
+		t.Fatalf("cannot listen udp: %s", err)
+	}
+	defer udpConn.Close()
+	udpFile, err := udpConn.File()
+	if err != nil {
+		t.Fatalf("cannot get the udp socket file: %s", err)
+	}
+	defer udpFile.Close()
+
+	var failed int32
+	dnsProxy := &Proxy{Config: Config{
+		ListenFDs:      []uintptr{udpFile.Fd()},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{createTestUpstream()}},
+	}}
+	dnsProxy.udpReadFunc = func(conn *net.UDPConn, b []byte, oobSize int) (int, net.IP, *net.UDPAddr, error) {
+		if atomic.CompareAndSwapInt32(&failed, 0, 1) {
+			return 0, nil, nil, errors.New("socket is broken")
+		}
+
+		return proxyutil.UDPRead(conn, b, oobSize)
+	}
+
+	err = dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	dnsProxy.RLock()
+	inherited := dnsProxy.udpListen[0]
+	dnsProxy.RUnlock()
+
+	client := &dns.Client{Net: "udp", Timeout: defaultTimeout}
+	reply, _, err := client.Exchange(createTestMessage(), udpConn.LocalAddr().String())
+	if assert.Nil(t, err) {
+		assertResponse(t, reply)
+	}
+
+	// The inherited socket isn't re-created.
+	assert.EqualValues(t, 1, atomic.LoadInt32(&failed))
+	dnsProxy.RLock()
+	assert.Same(t, inherited, dnsProxy.udpListen[0])
+	dnsProxy.RUnlock()
+}
@@ -1,13 +1,21 @@
 package proxy
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
@@ -24,7 +32,7 @@ func (p *Proxy) createHTTPSListeners() error {
 		log.Info("Listening to https://%s", tcpListen.Addr())
 
 		srv := &http.Server{
-			TLSConfig:         p.TLSConfig.Clone(),
+			TLSConfig:         p.dohTLSConfig().Clone(),
 			Handler:           p,
 			ReadHeaderTimeout: defaultTimeout,
 			WriteTimeout:      defaultTimeout,
@@ -32,13 +40,80 @@ func (p *Proxy) createHTTPSListeners() error {
 		p.httpsServer = append(p.httpsServer, srv)
 	}
 
+	for _, a := range p.HTTPListenAddr {
+		log.Info("Creating a plain HTTP server for DoH")
+		tcpListen, err := net.ListenTCP("tcp", a)
+		if err != nil {
+			return errorx.Decorate(err, "could not start HTTP listener")
+		}
+		p.httpListen = append(p.httpListen, tcpListen)
+		log.Info("Listening to http://%s", tcpListen.Addr())
+
+		srv := &http.Server{
+			Handler:           p,
+			ReadHeaderTimeout: defaultTimeout,
+			WriteTimeout:      defaultTimeout,
+		}
+		p.httpServer = append(p.httpServer, srv)
+	}
+
+	if p.HTTPSUnixSocket != "" {
+		return p.createHTTPSUnixListener()
+	}
+
+	return nil
+}
+
+// createHTTPSUnixListener creates the plain HTTP listener for DoH on the Unix
+// socket.  TLS is supposed to be terminated by the reverse proxy in front of
+// it.
+func (p *Proxy) createHTTPSUnixListener() error {
+	log.Info("Creating an HTTPS server on a Unix socket")
+
+	// Remove the socket left from the previous run, if any
+	if fi, err := os.Lstat(p.HTTPSUnixSocket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(p.HTTPSUnixSocket)
+		if err != nil {
+			return errorx.Decorate(err, "could not remove the stale Unix socket")
+		}
+	}
+
+	unixListen, err := net.Listen("unix", p.HTTPSUnixSocket)
+	if err != nil {
+		return errorx.Decorate(err, "could not start HTTPS Unix socket listener")
+	}
+	p.httpsListen = append(p.httpsListen, unixListen)
+	log.Info("Listening to https+unix://%s", unixListen.Addr())
+
+	srv := &http.Server{
+		Handler:           p,
+		ReadHeaderTimeout: defaultTimeout,
+		WriteTimeout:      defaultTimeout,
+	}
+	p.httpsServer = append(p.httpsServer, srv)
+
 	return nil
 }
 
-// serveHttps starts the HTTPS server
+// dohTLSConfig returns the TLS configuration of the HTTPS listeners.
+func (p *Proxy) dohTLSConfig() *tls.Config {
+	if p.TLSConfigDoH != nil {
+		return p.TLSConfigDoH
+	}
+
+	return p.serverTLSConfig()
+}
+
+// serveHttps starts the HTTPS server.  The servers without TLS configuration
+// serve plain HTTP.
 func (p *Proxy) listenHTTPS(srv *http.Server, l net.Listener) {
 	log.Info("Listening to DNS-over-HTTPS on %s", l.Addr())
-	err := srv.ServeTLS(l, "", "")
+	var err error
+	if srv.TLSConfig == nil {
+		err = srv.Serve(l)
+	} else {
+		err = srv.ServeTLS(l, "", "")
+	}
 
 	if err != http.ErrServerClosed {
 		log.Info("HTTPS server was closed unexpectedly: %s", err)
@@ -51,10 +126,19 @@ func (p *Proxy) listenHTTPS(srv *http.Server, l net.Listener) {
 // Here is what it returns:
 // http.StatusBadRequest - if there is no DNS request data
 // http.StatusUnsupportedMediaType - if request content type is not application/dns-message
-// http.StatusMethodNotAllowed - if request method is not GET or POST
+// http.StatusMethodNotAllowed - if request method is not GET, POST or HEAD
+// http.StatusOK without body - if request method is HEAD, no DNS query is made
+// http.StatusTooManyRequests - if the client is ratelimited, with the Retry-After header
+// http.StatusForbidden - if the client's user agent isn't allowed or the client isn't allowed to choose the upstream
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Tracef("Incoming HTTPS request on %s", r.URL)
 
+	if !p.isUserAgentAllowed(r.UserAgent()) {
+		log.Tracef("User agent is not allowed: %q", r.UserAgent())
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
 	var buf []byte
 	var err error
 
@@ -82,6 +166,13 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		defer r.Body.Close()
+	case http.MethodHead:
+		// HEAD is used by the monitoring systems to check that the
+		// endpoint is alive.
+		w.Header().Set("Server", "AdGuard DNS")
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.WriteHeader(http.StatusOK)
+		return
 	default:
 		log.Tracef("Wrong HTTP method: %s", r.Method)
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
@@ -95,14 +186,40 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	addr, _ := p.remoteAddr(r)
+	addr, err := p.remoteAddr(r)
+	if err != nil {
+		log.Tracef("Cannot get the client address: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// Unlike the UDP requests, the ratelimited DoH ones are answered so
+	// that the clients know when to retry.  Neither MaxGoroutines nor
+	// MaxTCPConnections apply to DoH, so the ratelimit is the only reason to
+	// shed its load.
+	if !isClientAddrKnown(r) {
+		log.Tracef("Not ratelimiting DoH request from %s without the client address", r.RemoteAddr)
+	} else if limited, retryAfter := p.checkRatelimit(addr); limited {
+		log.Tracef("Ratelimiting DoH client %v", addr)
+		w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	upsConf, status := p.clientUpstreamConfig(r)
+	if status != http.StatusOK {
+		log.Tracef("Client upstream selection rejected with %d", status)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
 
 	d := &DNSContext{
-		Proto:              ProtoHTTPS,
-		Req:                msg,
-		Addr:               addr,
-		HTTPRequest:        r,
-		HTTPResponseWriter: w,
+		Proto:                ProtoHTTPS,
+		Req:                  msg,
+		Addr:                 addr,
+		HTTPRequest:          r,
+		HTTPResponseWriter:   w,
+		CustomUpstreamConfig: upsConf,
 	}
 
 	err = p.handleDNSRequest(d)
@@ -111,6 +228,24 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// retryAfterSeconds returns the value of the Retry-After header for d, i.e. the
+// number of seconds rounded up, but at least one.
+func retryAfterSeconds(d time.Duration) string {
+	secs := int64((d + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+
+	return strconv.FormatInt(secs, 10)
+}
+
+// isClientAddrKnown returns true if the address of the DoH client is known, so
+// that it can be ratelimited.  The plain HTTP requests without the client
+// address in the headers come from a reverse proxy shared by many clients.
+func isClientAddrKnown(r *http.Request) bool {
+	return r.TLS != nil || getIPFromHTTPRequest(r) != nil
+}
+
 // Get a client IP address from HTTP headers that proxy servers may set
 func getIPFromHTTPRequest(r *http.Request) net.IP {
 	names := []string{
@@ -146,15 +281,85 @@ func (p *Proxy) respondHTTPS(d *DNSContext) error {
 		return errorx.Decorate(err, "couldn't convert message into wire format: %s", resp.String())
 	}
 
+	if p.DoHRequestIDHeader != "" {
+		w.Header().Set(p.DoHRequestIDHeader, strconv.FormatUint(d.RequestID, 10))
+	}
 	w.Header().Set("Server", "AdGuard DNS")
 	w.Header().Set("Content-Type", "application/dns-message")
+
+	if p.DoHCompressionMinSize > 0 && len(bytes) >= p.DoHCompressionMinSize {
+		w.Header().Set("Vary", "Accept-Encoding")
+		if d.HTTPRequest != nil && acceptsGzip(d.HTTPRequest) {
+			compressed, gzErr := gzipBody(bytes)
+			if gzErr == nil {
+				w.Header().Set("Content-Encoding", "gzip")
+				bytes = compressed
+			} else {
+				log.Debug("couldn't compress the response: %s", gzErr)
+			}
+		}
+	}
+
 	_, err = w.Write(bytes)
 	return err
 }
 
+// acceptsGzip returns true if the client accepts the gzip-encoded responses
+// according to the Accept-Encoding header of r.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			name, params := enc, ""
+			if i := strings.IndexByte(enc, ';'); i >= 0 {
+				name, params = enc[:i], enc[i+1:]
+			}
+
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+
+			// The zero quality value means the encoding isn't acceptable,
+			// see RFC 7231.
+			params = strings.TrimSpace(params)
+			if !strings.HasPrefix(params, "q=") {
+				return true
+			}
+
+			q, err := strconv.ParseFloat(params[len("q="):], 64)
+
+			return err == nil && q > 0
+		}
+	}
+
+	return false
+}
+
+// gzipBody returns data compressed with gzip.
+func gzipBody(data []byte) (compressed []byte, err error) {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	_, err = gw.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = gw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
 func (p *Proxy) remoteAddr(r *http.Request) (net.Addr, error) {
 	host, port, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
+		// The requests coming over a Unix socket have no remote IP address,
+		// so it can only be taken from the headers set by the reverse proxy
+		if ip := getIPFromHTTPRequest(r); ip != nil {
+			return &net.TCPAddr{IP: ip}, nil
+		}
+
 		return nil, err
 	}
 
@@ -175,3 +380,64 @@ func (p *Proxy) remoteAddr(r *http.Request) (net.Addr, error) {
 
 	return &net.TCPAddr{IP: ip, Port: portValue}, nil
 }
+
+// clientUpstreamConfig returns the configuration of the upstream chosen by the
+// DoH client with the "upstream" query parameter or nil if the client hasn't
+// chosen any.  status is http.StatusOK unless the choice is rejected.
+func (p *Proxy) clientUpstreamConfig(r *http.Request) (conf *UpstreamConfig, status int) {
+	addr := r.URL.Query().Get("upstream")
+	if addr == "" {
+		return nil, http.StatusOK
+	}
+
+	if !p.AllowClientUpstreamSelection || !p.isUpstreamTokenValid(r) {
+		return nil, http.StatusForbidden
+	}
+
+	if p.UpstreamConfig != nil {
+		for _, u := range p.UpstreamConfig.Upstreams {
+			if u.Address() == addr {
+				return &UpstreamConfig{Upstreams: []upstream.Upstream{u}}, http.StatusOK
+			}
+		}
+	}
+
+	log.Tracef("Unknown upstream chosen by the client: %q", addr)
+
+	return nil, http.StatusBadRequest
+}
+
+// isUpstreamTokenValid returns true if r presents one of the
+// ClientUpstreamSelectionTokens.
+func (p *Proxy) isUpstreamTokenValid(r *http.Request) bool {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return false
+	}
+
+	token := []byte(h[len(prefix):])
+	for _, t := range p.ClientUpstreamSelectionTokens {
+		if t != "" && subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isUserAgentAllowed returns true if the DoH client with the specified user
+// agent is allowed to use the endpoint.
+func (p *Proxy) isUserAgentAllowed(ua string) bool {
+	if len(p.DoHAllowedUserAgents) == 0 {
+		return true
+	}
+
+	for _, allowed := range p.DoHAllowedUserAgents {
+		if strings.HasPrefix(ua, allowed) {
+			return true
+		}
+	}
+
+	return false
+}
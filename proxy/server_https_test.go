@@ -2,14 +2,23 @@ package proxy
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
@@ -26,6 +35,96 @@ func TestHttpsProxy(t *testing.T) {
 		assert.Nil(t, dnsProxy.Stop())
 	}()
 
+	msg := createTestMessage()
+	reply := sendTestDoHMessage(t, dnsProxy, caPem, msg)
+
+	assertResponse(t, reply)
+}
+
+func TestHttpsProxyTruncatedUpstream(t *testing.T) {
+	// Prepare the upstream server that truncates responses over UDP
+	var tcpRequests uint32
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := &dns.Msg{}
+		resp.SetReply(r)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			resp.Truncated = true
+		} else {
+			atomic.AddUint32(&tcpRequests, 1)
+			for i := 0; i < 64; i++ {
+				resp.Answer = append(resp.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IP{10, 0, 0, byte(i)},
+				})
+			}
+		}
+		_ = w.WriteMsg(resp)
+	})
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	tcpListener, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	udpServer := &dns.Server{PacketConn: udpConn, Handler: handler}
+	tcpServer := &dns.Server{Listener: tcpListener, Handler: handler}
+	go func() { _ = udpServer.ActivateAndServe() }()
+	go func() { _ = tcpServer.ActivateAndServe() }()
+	defer func() {
+		_ = udpServer.Shutdown()
+		_ = tcpServer.Shutdown()
+	}()
+
+	// Prepare the proxy server
+	serverConfig, caPem := createServerTLSConfig(t)
+	dnsProxy := createTestProxy(t, serverConfig)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{
+		&udpOnlyUpstream{addr: udpConn.LocalAddr().String()},
+	}
+	dnsProxy.CacheEnabled = true
+
+	// Start listening
+	err = dnsProxy.Start()
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	// The second response is served from cache and must be complete as
+	// well.
+	for i := 0; i < 2; i++ {
+		msg := createTestMessage()
+		reply := sendTestDoHMessage(t, dnsProxy, caPem, msg)
+
+		assert.False(t, reply.Truncated)
+		assert.Len(t, reply.Answer, 64)
+	}
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&tcpRequests))
+}
+
+// udpOnlyUpstream is a plain DNS upstream that never retries truncated
+// responses over TCP.
+type udpOnlyUpstream struct {
+	addr string
+}
+
+func (u *udpOnlyUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	client := dns.Client{Net: "udp", Timeout: defaultTimeout}
+	reply, _, err := client.Exchange(m, u.addr)
+
+	return reply, err
+}
+
+func (u *udpOnlyUpstream) Address() string {
+	return u.addr
+}
+
+// sendTestDoHMessage sends msg to the DNS-over-HTTPS listener of dnsProxy and
+// returns the response.
+func sendTestDoHMessage(t *testing.T, dnsProxy *Proxy, caPem []byte, msg *dns.Msg) *dns.Msg {
 	roots := x509.NewCertPool()
 	roots.AppendCertsFromPEM(caPem)
 	tlsConfig := &tls.Config{ServerName: tlsServerName, RootCAs: roots}
@@ -46,7 +145,6 @@ func TestHttpsProxy(t *testing.T) {
 		DialContext:        dialContext,
 	}
 
-	msg := createTestMessage()
 	buf, err := msg.Pack()
 	assert.Nil(t, err)
 
@@ -65,16 +163,416 @@ func TestHttpsProxy(t *testing.T) {
 		Timeout:   defaultTimeout,
 	}
 	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("cannot send the DoH request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	reply := &dns.Msg{}
+	err = reply.Unpack(body)
+	assert.Nil(t, err)
+
+	return reply
+}
+
+func TestHttpsProxyAllowedUserAgents(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{createTestUpstream()}
+	dnsProxy.DoHAllowedUserAgents = []string{"good-client/"}
+	err := dnsProxy.Init()
 	assert.Nil(t, err)
-	if resp != nil && resp.Body != nil {
-		defer resp.Body.Close()
+
+	buf, err := createTestMessage().Pack()
+	assert.Nil(t, err)
+	target := "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(buf)
+
+	// Disallowed user agent
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set("User-Agent", "scraper/2.0")
+	rw := httptest.NewRecorder()
+	dnsProxy.ServeHTTP(rw, r)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+
+	// No user agent at all
+	r = httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Del("User-Agent")
+	rw = httptest.NewRecorder()
+	dnsProxy.ServeHTTP(rw, r)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+
+	// Allowed user agent
+	r = httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set("User-Agent", "good-client/1.2")
+	rw = httptest.NewRecorder()
+	dnsProxy.ServeHTTP(rw, r)
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	reply := &dns.Msg{}
+	err = reply.Unpack(rw.Body.Bytes())
+	assert.Nil(t, err)
+	assertResponse(t, reply)
+}
+
+func TestHttpsProxyUnixSocket(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "doh.sock")
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{createTestUpstream()}
+	dnsProxy.HTTPSUnixSocket = sockPath
+
+	var clientIP net.IP
+	var clientIPLock sync.Mutex
+	dnsProxy.ResponseHandler = func(d *DNSContext, _ error) {
+		clientIPLock.Lock()
+		defer clientIPLock.Unlock()
+		clientIP = d.Addr.(*net.TCPAddr).IP
+	}
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
 	}
 
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", sockPath)
+			},
+		},
+		Timeout: defaultTimeout,
+	}
+
+	buf, err := createTestMessage().Pack()
+	assert.Nil(t, err)
+	req, err := http.NewRequest(http.MethodGet, "http://unix/dns-query?dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+	assert.Nil(t, err)
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("cannot make the DoH request: %s", err)
+	}
 	body, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
 	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
 	reply := &dns.Msg{}
 	err = reply.Unpack(body)
 	assert.Nil(t, err)
+	assertResponse(t, reply)
+
+	clientIPLock.Lock()
+	assert.True(t, clientIP.Equal(net.IP{192, 0, 2, 1}))
+	clientIPLock.Unlock()
+
+	// The client address is required
+	req.Header.Del("X-Forwarded-For")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("cannot make the DoH request: %s", err)
+	}
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	client.CloseIdleConnections()
+	err = dnsProxy.Stop()
+	assert.Nil(t, err)
+
+	_, err = os.Stat(sockPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestHttpProxy(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{createTestUpstream()}
+	dnsProxy.HTTPListenAddr = []*net.TCPAddr{{IP: net.ParseIP(listenIP), Port: 0}}
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	addr := dnsProxy.Addr(ProtoHTTP)
+	if !assert.NotNil(t, addr) {
+		return
+	}
+	assert.Nil(t, dnsProxy.Addr(ProtoHTTPS))
+
+	buf, err := createTestMessage().Pack()
+	assert.Nil(t, err)
+
+	client := http.Client{Timeout: defaultTimeout}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Post("http://"+addr.String()+"/dns-query", "application/dns-message", bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("cannot make the DoH request: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/dns-message", resp.Header.Get("Content-Type"))
 
+	reply := &dns.Msg{}
+	err = reply.Unpack(body)
+	assert.Nil(t, err)
 	assertResponse(t, reply)
 }
+
+func TestHttpsProxyClientUpstreamSelection(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{
+		createTestUpstream(),
+		&rcodeUpstream{rcode: dns.RcodeNameError},
+	}
+	dnsProxy.ClientUpstreamSelectionTokens = []string{"secret"}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	buf, err := createTestMessage().Pack()
+	assert.Nil(t, err)
+	query := "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(buf)
+
+	serve := func(ups, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, query+"&upstream="+ups, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rw := httptest.NewRecorder()
+		dnsProxy.ServeHTTP(rw, r)
+
+		return rw
+	}
+
+	// The selection is disabled.
+	assert.Equal(t, http.StatusForbidden, serve("rcode", "secret").Code)
+
+	dnsProxy.AllowClientUpstreamSelection = true
+
+	// The client isn't authorized.
+	assert.Equal(t, http.StatusForbidden, serve("rcode", "").Code)
+	assert.Equal(t, http.StatusForbidden, serve("rcode", "wrong").Code)
+
+	// The upstream isn't configured.
+	assert.Equal(t, http.StatusBadRequest, serve("8.8.8.8:53", "secret").Code)
+
+	// Only the chosen upstream is used.
+	for i := 0; i < 5; i++ {
+		rw := serve("rcode", "secret")
+		if !assert.Equal(t, http.StatusOK, rw.Code) {
+			return
+		}
+
+		reply := &dns.Msg{}
+		err = reply.Unpack(rw.Body.Bytes())
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+	}
+}
+
+// largeUpstream answers the requests with many A records.
+type largeUpstream struct{}
+
+func (u *largeUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	for i := 0; i < 100; i++ {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IP{10, 0, 0, byte(i)},
+		})
+	}
+
+	return resp, nil
+}
+
+func (u *largeUpstream) Address() string {
+	return "large"
+}
+
+func TestHttpsProxyCompression(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&largeUpstream{}}
+	dnsProxy.DoHCompressionMinSize = 512
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	serve := func(host, acceptEncoding string) *httptest.ResponseRecorder {
+		buf, pErr := createHostTestMessage(host).Pack()
+		assert.Nil(t, pErr)
+
+		r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(buf))
+		r.Header.Set("Content-Type", "application/dns-message")
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rw := httptest.NewRecorder()
+		dnsProxy.ServeHTTP(rw, r)
+		assert.Equal(t, http.StatusOK, rw.Code)
+
+		return rw
+	}
+
+	rw := serve("large", "br, gzip;q=0.8")
+	assert.Equal(t, "gzip", rw.Header().Get("Content-Encoding"))
+
+	zr, err := gzip.NewReader(rw.Body)
+	if err != nil {
+		t.Fatalf("cannot read the gzip body: %s", err)
+	}
+	body, err := ioutil.ReadAll(zr)
+	assert.Nil(t, err)
+
+	reply := &dns.Msg{}
+	err = reply.Unpack(body)
+	assert.Nil(t, err)
+	assert.Len(t, reply.Answer, 100)
+
+	// The clients not accepting gzip get the uncompressed response.
+	for _, enc := range []string{"", "identity", "gzip;q=0"} {
+		rw = serve("large", enc)
+		assert.Empty(t, rw.Header().Get("Content-Encoding"))
+		err = reply.Unpack(rw.Body.Bytes())
+		assert.Nil(t, err)
+	}
+
+	// The small responses aren't compressed.
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{createTestUpstream()}
+	rw = serve("google-public-dns-a.google.com", "gzip")
+	assert.Empty(t, rw.Header().Get("Content-Encoding"))
+}
+
+func TestPerListenerTLSConfig(t *testing.T) {
+	dotConfig, dotCA := createServerTLSConfig(t)
+	dohConfig, dohCA := createServerTLSConfig(t)
+
+	dnsProxy := &Proxy{}
+	dnsProxy.TLSListenAddr = []*net.TCPAddr{{IP: net.ParseIP(listenIP), Port: 0}}
+	dnsProxy.HTTPSListenAddr = []*net.TCPAddr{{IP: net.ParseIP(listenIP), Port: 0}}
+	dnsProxy.TLSConfigDoT = dotConfig
+	dnsProxy.TLSConfigDoH = dohConfig
+	dnsProxy.UpstreamConfig = &UpstreamConfig{Upstreams: []upstream.Upstream{createTestUpstream()}}
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	// peerCert returns the certificate the listener at addr presents when
+	// verified with the certificate authority caPem.
+	peerCert := func(addr net.Addr, caPem []byte) []byte {
+		roots := x509.NewCertPool()
+		roots.AppendCertsFromPEM(caPem)
+
+		conn, dErr := tls.Dial("tcp", addr.String(), &tls.Config{ServerName: tlsServerName, RootCAs: roots})
+		if dErr != nil {
+			t.Fatalf("cannot connect to %s: %s", addr, dErr)
+		}
+		defer conn.Close()
+
+		return conn.ConnectionState().PeerCertificates[0].Raw
+	}
+
+	assert.Equal(t, dotConfig.Certificates[0].Certificate[0], peerCert(dnsProxy.Addr(ProtoTLS), dotCA))
+	assert.Equal(t, dohConfig.Certificates[0].Certificate[0], peerCert(dnsProxy.Addr(ProtoHTTPS), dohCA))
+}
+
+func TestHttpsProxyHead(t *testing.T) {
+	var handled int32
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{createTestUpstream()}
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		atomic.AddInt32(&handled, 1)
+
+		return p.Resolve(d)
+	}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	r := httptest.NewRequest(http.MethodHead, "/dns-query", nil)
+	rw := httptest.NewRecorder()
+	dnsProxy.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "application/dns-message", rw.Header().Get("Content-Type"))
+	assert.Equal(t, 0, rw.Body.Len())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&handled))
+
+	// The other methods are still not allowed.
+	r = httptest.NewRequest(http.MethodPut, "/dns-query", nil)
+	rw = httptest.NewRecorder()
+	dnsProxy.ServeHTTP(rw, r)
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+}
+
+func TestHttpsProxyRatelimit(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{createTestUpstream()}
+	dnsProxy.Ratelimit = 1
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	// serve serves the request over HTTPS if realIP is empty and over plain
+	// HTTP with the X-Real-IP header otherwise.
+	serve := func(realIP string) *httptest.ResponseRecorder {
+		buf, pErr := createTestMessage().Pack()
+		assert.Nil(t, pErr)
+
+		r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(buf))
+		r.Header.Set("Content-Type", "application/dns-message")
+		if realIP == "" {
+			r.TLS = &tls.ConnectionState{}
+		} else {
+			r.Header.Set("X-Real-IP", realIP)
+		}
+		rw := httptest.NewRecorder()
+		dnsProxy.ServeHTTP(rw, r)
+
+		return rw
+	}
+
+	rw := serve("")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Empty(t, rw.Header().Get("Retry-After"))
+
+	rw = serve("")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "1", rw.Header().Get("Retry-After"))
+
+	// The clients behind the reverse proxy are ratelimited separately.
+	rw = serve("192.0.2.2")
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	rw = serve("192.0.2.2")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+
+	// The plain HTTP requests without the client address aren't
+	// ratelimited, since they all come from the reverse proxy.
+	for i := 0; i < 3; i++ {
+		buf, pErr := createTestMessage().Pack()
+		assert.Nil(t, pErr)
+
+		r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(buf))
+		r.Header.Set("Content-Type", "application/dns-message")
+		rw = httptest.NewRecorder()
+		dnsProxy.ServeHTTP(rw, r)
+		assert.Equal(t, http.StatusOK, rw.Code)
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	assert.Equal(t, "1", retryAfterSeconds(0))
+	assert.Equal(t, "1", retryAfterSeconds(300*time.Millisecond))
+	assert.Equal(t, "1", retryAfterSeconds(time.Second))
+	assert.Equal(t, "2", retryAfterSeconds(1500*time.Millisecond))
+}
@@ -28,7 +28,7 @@ var compatProtoDQ = []string{"doq-i00", "dq", "doq"}
 func (p *Proxy) createQUICListeners() error {
 	for _, a := range p.QUICListenAddr {
 		log.Info("Creating a QUIC listener")
-		quicListen, err := quic.ListenAddr(a.String(), p.TLSConfig, &quic.Config{MaxIdleTimeout: maxQuicIdleTimeout})
+		quicListen, err := quic.ListenAddr(a.String(), p.serverTLSConfig(), &quic.Config{MaxIdleTimeout: maxQuicIdleTimeout})
 		if err != nil {
 			return errorx.Decorate(err, "could not start QUIC listener")
 		}
@@ -3,6 +3,7 @@ package proxy
 import (
 	"crypto/tls"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
@@ -31,15 +32,25 @@ func (p *Proxy) createTLSListeners() error {
 		if err != nil {
 			return errorx.Decorate(err, "could not start TLS listener")
 		}
-		l := tls.NewListener(tcpListen, p.TLSConfig)
-		p.tlsListen = append(p.tlsListen, l)
-		log.Printf("Listening to tls://%s", l.Addr())
+		// The connections are wrapped into TLS in tcpPacketLoop, see
+		// setConnBuffers.
+		p.tlsListen = append(p.tlsListen, tcpListen)
+		log.Printf("Listening to tls://%s", tcpListen.Addr())
 	}
 	return nil
 }
 
+// dotTLSConfig returns the TLS configuration of the TLS listeners.
+func (p *Proxy) dotTLSConfig() *tls.Config {
+	if p.TLSConfigDoT != nil {
+		return p.TLSConfigDoT
+	}
+
+	return p.serverTLSConfig()
+}
+
 // tcpPacketLoop listens for incoming TCP packets.  proto must be either "tcp"
-// or "tls".
+// or "tls", in which case the accepted connections are wrapped into TLS.
 //
 // See also the comment on Proxy.requestGoroutinesSema.
 func (p *Proxy) tcpPacketLoop(l net.Listener, proto string, requestGoroutinesSema semaphore) {
@@ -55,8 +66,20 @@ func (p *Proxy) tcpPacketLoop(l net.Listener, proto string, requestGoroutinesSem
 			}
 			break
 		} else {
+			if !p.acquireTCPConn() {
+				log.Debug("Too many TCP connections, closing %s connection from %s", proto, clientConn.RemoteAddr())
+				_ = clientConn.Close()
+				continue
+			}
+
+			p.setConnBuffers(clientConn)
+			if proto == ProtoTLS {
+				clientConn = tls.Server(clientConn, p.dotTLSConfig())
+			}
+
 			requestGoroutinesSema.acquire()
 			go func() {
+				defer p.releaseTCPConn()
 				p.handleTCPConnection(clientConn, proto)
 				requestGoroutinesSema.release()
 			}()
@@ -64,6 +87,27 @@ func (p *Proxy) tcpPacketLoop(l net.Listener, proto string, requestGoroutinesSem
 	}
 }
 
+// acquireTCPConn returns true if a new TCP or TLS connection can be handled
+// according to MaxTCPConnections.  It increments the number of the rejected
+// connections otherwise.
+func (p *Proxy) acquireTCPConn() bool {
+	n := atomic.AddInt32(&p.tcpConns, 1)
+	if p.MaxTCPConnections > 0 && int(n) > p.MaxTCPConnections {
+		atomic.AddInt32(&p.tcpConns, -1)
+		atomic.AddUint32(&p.tcpConnsRejected, 1)
+
+		return false
+	}
+
+	return true
+}
+
+// releaseTCPConn must be called when a connection acquired with acquireTCPConn
+// is closed.
+func (p *Proxy) releaseTCPConn() {
+	atomic.AddInt32(&p.tcpConns, -1)
+}
+
 // handleTCPConnection starts a loop that handles an incoming TCP connection
 // proto is either "tcp" or "tls"
 func (p *Proxy) handleTCPConnection(conn net.Conn, proto string) {
@@ -104,6 +148,37 @@ func (p *Proxy) handleTCPConnection(conn net.Conn, proto string) {
 	}
 }
 
+// setConnBuffers sets the sizes of the socket buffers of conn according to
+// TCPConnReadBuffer and TCPConnWriteBuffer.  conn must not be wrapped into TLS
+// yet.
+func (p *Proxy) setConnBuffers(conn net.Conn) {
+	if p.TCPConnReadBuffer == 0 && p.TCPConnWriteBuffer == 0 {
+		return
+	}
+
+	bc, ok := conn.(interface {
+		SetReadBuffer(bytes int) error
+		SetWriteBuffer(bytes int) error
+	})
+	if !ok {
+		log.Debug("Cannot set the buffer sizes of %T connection", conn)
+
+		return
+	}
+
+	if p.TCPConnReadBuffer > 0 {
+		if err := bc.SetReadBuffer(p.TCPConnReadBuffer); err != nil {
+			log.Debug("Setting the read buffer of connection from %s: %s", conn.RemoteAddr(), err)
+		}
+	}
+
+	if p.TCPConnWriteBuffer > 0 {
+		if err := bc.SetWriteBuffer(p.TCPConnWriteBuffer); err != nil {
+			log.Debug("Setting the write buffer of connection from %s: %s", conn.RemoteAddr(), err)
+		}
+	}
+}
+
 // Writes a response to the TCP (or TLS) client
 func (p *Proxy) respondTCP(d *DNSContext) error {
 	resp := d.Res
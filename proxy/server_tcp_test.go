@@ -3,9 +3,15 @@ package proxy
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"net"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestTcpProxy(t *testing.T) {
@@ -64,3 +70,191 @@ func TestTlsProxy(t *testing.T) {
 		t.Fatalf("cannot stop the DNS proxy: %s", err)
 	}
 }
+
+func TestTcpProxyMaxConnections(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{createTestUpstream()}
+	dnsProxy.MaxTCPConnections = 2
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	addr := dnsProxy.Addr(ProtoTCP).String()
+	dial := func() *dns.Conn {
+		conn, dErr := dns.Dial("tcp", addr)
+		if dErr != nil {
+			t.Fatalf("cannot connect to the proxy: %s", dErr)
+		}
+
+		return conn
+	}
+	exchange := func(conn *dns.Conn) (*dns.Msg, error) {
+		_ = conn.SetDeadline(time.Now().Add(time.Second))
+		eErr := conn.WriteMsg(createTestMessage())
+		if eErr != nil {
+			return nil, eErr
+		}
+
+		return conn.ReadMsg()
+	}
+
+	// The connections within the limit are served
+	conns := []*dns.Conn{dial(), dial()}
+	for _, conn := range conns {
+		reply, eErr := exchange(conn)
+		assert.Nil(t, eErr)
+		assertResponse(t, reply)
+	}
+
+	// The excess connection is closed
+	excess := dial()
+	_, err = exchange(excess)
+	assert.NotNil(t, err)
+	_ = excess.Close()
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&dnsProxy.tcpConnsRejected))
+
+	// Closing a connection frees the slot
+	_ = conns[0].Close()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&dnsProxy.tcpConns) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	conn := dial()
+	reply, err := exchange(conn)
+	assert.Nil(t, err)
+	assertResponse(t, reply)
+
+	_ = conn.Close()
+	_ = conns[1].Close()
+}
+
+// bufferRecordingConn records the socket buffer sizes set.
+type bufferRecordingConn struct {
+	net.Conn
+	read  int
+	write int
+}
+
+func (c *bufferRecordingConn) SetReadBuffer(bytes int) error {
+	c.read = bytes
+
+	return nil
+}
+
+func (c *bufferRecordingConn) SetWriteBuffer(bytes int) error {
+	c.write = bytes
+
+	return nil
+}
+
+func TestSetConnBuffers(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.TCPConnReadBuffer = 1 << 20
+	dnsProxy.TCPConnWriteBuffer = 2 << 20
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	conn := &bufferRecordingConn{Conn: server}
+	dnsProxy.setConnBuffers(conn)
+	assert.Equal(t, 1<<20, conn.read)
+	assert.Equal(t, 2<<20, conn.write)
+
+	// Zero keeps the OS defaults.
+	dnsProxy.TCPConnWriteBuffer = 0
+	conn = &bufferRecordingConn{Conn: server}
+	dnsProxy.setConnBuffers(conn)
+	assert.Equal(t, 1<<20, conn.read)
+	assert.Zero(t, conn.write)
+}
+
+// singleConnListener accepts conn once and fails afterwards.
+type singleConnListener struct {
+	conn net.Conn
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	if l.conn == nil {
+		return nil, errors.New("no more connections")
+	}
+
+	conn := l.conn
+	l.conn = nil
+
+	return conn, nil
+}
+
+func (l *singleConnListener) Close() error {
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func TestSetConnBuffersTLS(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.TCPConnReadBuffer = 1 << 20
+	dnsProxy.TCPConnWriteBuffer = 2 << 20
+	dnsProxy.TLSConfig = &tls.Config{}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	// The buffers are set before the connection is wrapped into TLS.
+	conn := &bufferRecordingConn{Conn: server}
+	dnsProxy.tcpPacketLoop(&singleConnListener{conn: conn}, ProtoTLS, newNoopSemaphore())
+	assert.Equal(t, 1<<20, conn.read)
+	assert.Equal(t, 2<<20, conn.write)
+}
+
+func TestTcpProxyPipelined(t *testing.T) {
+	const n = 100
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{createTestUpstream()}
+	dnsProxy.TCPConnReadBuffer = 256 * 1024
+	dnsProxy.TCPConnWriteBuffer = 256 * 1024
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	conn, err := dns.Dial("tcp", dnsProxy.Addr(ProtoTCP).String())
+	if err != nil {
+		t.Fatalf("cannot connect to the proxy: %s", err)
+	}
+	defer conn.Close()
+
+	// All the requests are written before reading the responses.
+	ids := map[uint16]bool{}
+	for i := 0; i < n; i++ {
+		req := createTestMessage()
+		req.Id = uint16(i + 1)
+		ids[req.Id] = true
+		err = conn.WriteMsg(req)
+		if err != nil {
+			t.Fatalf("cannot write the request: %s", err)
+		}
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < n; i++ {
+		reply, rErr := conn.ReadMsg()
+		if rErr != nil {
+			t.Fatalf("cannot read the response: %s", rErr)
+		}
+		assertResponse(t, reply)
+		delete(ids, reply.Id)
+	}
+	assert.Empty(t, ids)
+}
@@ -1,8 +1,10 @@
 package proxy
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
 
@@ -31,57 +33,176 @@ func (p *Proxy) udpCreate(udpAddr *net.UDPAddr) (*net.UDPConn, error) {
 		return nil, errorx.Decorate(err, "couldn't listen to UDP socket")
 	}
 
+	err = p.udpSetup(udpListen)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("Listening to udp://%s", udpListen.LocalAddr())
+	return udpListen, nil
+}
+
+// udpSetup sets the buffer size and the options of the UDP listening socket.
+// It closes udpListen on error.
+func (p *Proxy) udpSetup(udpListen *net.UDPConn) (err error) {
 	if p.Config.UDPBufferSize > 0 {
 		err = udpListen.SetReadBuffer(p.Config.UDPBufferSize)
 		if err != nil {
 			_ = udpListen.Close()
-			return nil, errorx.Decorate(err, "setting UDP buffer size failed")
+			return errorx.Decorate(err, "setting UDP buffer size failed")
 		}
 	}
 
 	err = proxyutil.UDPSetOptions(udpListen)
 	if err != nil {
 		_ = udpListen.Close()
-		return nil, errorx.Decorate(err, "udpSetOptions failed")
+		return errorx.Decorate(err, "udpSetOptions failed")
 	}
 
-	log.Info("Listening to udp://%s", udpListen.LocalAddr())
-	return udpListen, nil
+	return nil
 }
 
-// udpPacketLoop listens for incoming UDP packets.
+// UDP read errors handling settings.
+const (
+	// udpMinBackoff is the initial time to wait after a failed read.
+	udpMinBackoff = 10 * time.Millisecond
+	// udpMaxBackoff is the maximum time to wait after a failed read and
+	// between the attempts to re-create the socket.
+	udpMaxBackoff = time.Second
+)
+
+// udpPacketLoop listens for incoming UDP packets.  Temporary read errors are
+// retried and the socket is re-created on the same address after the other
+// ones, unless restartable is false, e.g. for the sockets inherited from the
+// file descriptors.  The repeated errors are retried with a growing delay.
 //
 // See also the comment on Proxy.requestGoroutinesSema.
-func (p *Proxy) udpPacketLoop(conn *net.UDPConn, requestGoroutinesSema semaphore) {
+func (p *Proxy) udpPacketLoop(conn *net.UDPConn, requestGoroutinesSema semaphore, restartable bool) {
 	log.Info("Entering the UDP listener loop on %s", conn.LocalAddr())
 	b := make([]byte, dns.MaxMsgSize)
+	backoff := time.Duration(0)
 	for {
 		p.RLock()
-		if !p.started {
+		started := p.started
+		p.RUnlock()
+		if !started {
 			return
 		}
-		p.RUnlock()
 
-		n, localIP, remoteAddr, err := proxyutil.UDPRead(conn, b, p.udpOOBSize)
+		n, localIP, remoteAddr, err := p.udpRead(conn, b, p.udpOOBSize)
 		// documentation says to handle the packet even if err occurs, so do that first
-		if n > 0 {
+		if n > 0 && p.acquireUDPInflight(remoteAddr) {
 			// make a copy of all bytes because ReadFrom() will overwrite contents of b on next call
 			// we need the contents to survive the call because we're handling them in goroutine
 			packet := make([]byte, n)
 			copy(packet, b)
 			requestGoroutinesSema.acquire()
-			go func() {
+			go func(conn *net.UDPConn) {
 				p.udpHandlePacket(packet, localIP, remoteAddr, conn)
+				p.releaseUDPInflight(remoteAddr)
 				requestGoroutinesSema.release()
-			}()
+			}(conn)
 		}
-		if err != nil {
-			if proxyutil.IsConnClosed(err) {
-				log.Info("udpListen.ReadFrom() returned because we're reading from a closed connection, exiting loop")
-			} else {
-				log.Info("got error when reading from UDP listen: %s", err)
+
+		if err == nil {
+			backoff = 0
+
+			continue
+		}
+
+		if proxyutil.IsConnClosed(err) {
+			log.Info("udpListen.ReadFrom() returned because we're reading from a closed connection, exiting loop")
+
+			return
+		}
+
+		// Only wait if the errors repeat, so that a single transient error
+		// doesn't delay the other clients.
+		time.Sleep(backoff)
+		backoff = nextUDPBackoff(backoff)
+
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Temporary() {
+			log.Debug("got temporary error when reading from UDP listen: %s", err)
+
+			continue
+		}
+
+		if !restartable {
+			log.Error("got error when reading from UDP listen: %s", err)
+
+			continue
+		}
+
+		log.Info("got error when reading from UDP listen: %s, restarting the socket", err)
+		conn = p.udpRestart(conn)
+		if conn == nil {
+			return
+		}
+	}
+}
+
+// nextUDPBackoff returns the delay to wait after a failed read given the
+// previous one.
+func nextUDPBackoff(prev time.Duration) time.Duration {
+	if prev < udpMinBackoff {
+		return udpMinBackoff
+	}
+
+	next := prev * 2
+	if next > udpMaxBackoff {
+		return udpMaxBackoff
+	}
+
+	return next
+}
+
+// udpRead reads a packet from conn.
+func (p *Proxy) udpRead(conn *net.UDPConn, b []byte, oobSize int) (int, net.IP, *net.UDPAddr, error) {
+	if p.udpReadFunc != nil {
+		return p.udpReadFunc(conn, b, oobSize)
+	}
+
+	return proxyutil.UDPRead(conn, b, oobSize)
+}
+
+// udpRestart closes conn and creates a new listening socket on the same
+// address.  It retries every udpMaxBackoff until it succeeds and returns nil
+// only if the proxy is stopped.
+func (p *Proxy) udpRestart(conn *net.UDPConn) *net.UDPConn {
+	addr, _ := conn.LocalAddr().(*net.UDPAddr)
+	_ = conn.Close()
+
+	for {
+		p.Lock()
+		if !p.started {
+			p.Unlock()
+
+			return nil
+		}
+		shutdown := p.shutdown
+
+		newConn, err := p.udpCreate(addr)
+		if err == nil {
+			for i, l := range p.udpListen {
+				if l == conn {
+					p.udpListen[i] = newConn
+
+					break
+				}
 			}
-			break
+			p.Unlock()
+
+			return newConn
+		}
+		p.Unlock()
+
+		log.Error("restarting the UDP listener on %s: %s, retrying in %s", addr, err, udpMaxBackoff)
+
+		select {
+		case <-shutdown:
+			return nil
+		case <-time.After(udpMaxBackoff):
 		}
 	}
 }
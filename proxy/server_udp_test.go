@@ -1,9 +1,16 @@
 package proxy
 
 import (
+	"errors"
+	"net"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestUdpProxy(t *testing.T) {
@@ -31,3 +38,109 @@ func TestUdpProxy(t *testing.T) {
 		t.Fatalf("cannot stop the DNS proxy: %s", err)
 	}
 }
+
+func TestUdpProxyResponseJitter(t *testing.T) {
+	const jitter = 50 * time.Millisecond
+
+	// Prepare the proxy server
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{createTestUpstream()}
+	dnsProxy.ResponseJitter = jitter
+
+	// Start listening
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	client := dns.Client{Net: "udp", Timeout: defaultTimeout}
+	addr := dnsProxy.Addr(ProtoUDP).String()
+	var maxRTT time.Duration
+	for i := 0; i < 10; i++ {
+		reply, rtt, err := client.Exchange(createTestMessage(), addr)
+		if err != nil {
+			t.Fatalf("cannot exchange the message: %s", err)
+		}
+
+		assertResponse(t, reply)
+		// Allow some extra time for the processing itself.
+		assert.Less(t, int64(rtt), int64(jitter+100*time.Millisecond))
+
+		if rtt > maxRTT {
+			maxRTT = rtt
+		}
+	}
+
+	// The chance that none of the responses has been delayed by at least a
+	// tenth of jitter is negligible.
+	assert.GreaterOrEqual(t, int64(maxRTT), int64(jitter/10))
+}
+
+// temporaryError is a net.Error that is temporary.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func TestUdpProxyReadErrors(t *testing.T) {
+	// The reads fail a few times with temporary errors and then the socket
+	// breaks, so it should be re-created.
+	injected := []error{
+		temporaryError{},
+		temporaryError{},
+		temporaryError{},
+		errors.New("socket is broken"),
+	}
+
+	var mu sync.Mutex
+	var errTimes []time.Time
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{createTestUpstream()}
+	dnsProxy.udpReadFunc = func(conn *net.UDPConn, b []byte, oobSize int) (int, net.IP, *net.UDPAddr, error) {
+		mu.Lock()
+		if len(errTimes) < len(injected) {
+			err := injected[len(errTimes)]
+			errTimes = append(errTimes, time.Now())
+			mu.Unlock()
+
+			return 0, nil, nil, err
+		}
+		mu.Unlock()
+
+		return proxyutil.UDPRead(conn, b, oobSize)
+	}
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	// The proxy recovers and answers over the re-created socket.
+	client := dns.Client{Net: "udp", Timeout: 200 * time.Millisecond}
+	var reply *dns.Msg
+	for i := 0; i < 10 && reply == nil; i++ {
+		reply, _, err = client.Exchange(createTestMessage(), dnsProxy.Addr(ProtoUDP).String())
+	}
+	if reply == nil {
+		t.Fatalf("the proxy hasn't recovered: %s", err)
+	}
+	assertResponse(t, reply)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// The loop doesn't spin between the errors.
+	if assert.Len(t, errTimes, len(injected)) {
+		elapsed := errTimes[len(errTimes)-1].Sub(errTimes[0])
+		// The first error is retried right away.
+		assert.GreaterOrEqual(t, int64(elapsed), int64(udpMinBackoff*(1+2)))
+	}
+}
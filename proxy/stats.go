@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// defaultRttSmoothing is the default smoothing factor of the upstreams RTT
+// exponential moving average.
+const defaultRttSmoothing = 0.3
+
+// rttWindowSize is the number of the latest RTT samples the percentiles are
+// calculated over.
+const rttWindowSize = 64
+
+// rttHistoryResolution is the duration of the intervals of the RTT history.
+const rttHistoryResolution = 10 * time.Second
+
+// RTTPoint is the RTT of an upstream averaged over an interval.
+type RTTPoint struct {
+	// Time is the start of the interval.
+	Time time.Time
+	// RTT is the average RTT in milliseconds.
+	RTT float64
+	// Count is the number of the RTTs measured during the interval.
+	Count int
+}
+
+// UpstreamStats contains the RTT statistics of an upstream.
+type UpstreamStats struct {
+	// RTT is the exponential moving average of the RTT in milliseconds.
+	RTT float64
+	// RTTP95 is the 95th percentile of the latest RTTs in milliseconds.
+	RTTP95 int
+	// History is the RTT over the last RttHistoryWindow, oldest first.  It's
+	// empty if the history is disabled.
+	History []RTTPoint
+}
+
+// Stats contains the statistics of the proxy.
+type Stats struct {
+	// Upstreams are the RTT statistics of the upstreams that have been
+	// used in the load-balancing mode, mapped by their addresses.
+	Upstreams map[string]UpstreamStats
+	// CacheCapacityEvictions is the number of the cache entries evicted to
+	// free space for the new ones.
+	CacheCapacityEvictions uint64
+	// CacheExpiryEvictions is the number of the expired cache entries
+	// removed.
+	CacheExpiryEvictions uint64
+}
+
+// rttStats accumulates the RTT statistics of a single upstream.
+type rttStats struct {
+	// ema is the exponential moving average of the RTT.
+	ema float64
+	// succeededEMA is the exponential moving average of the RTT of the
+	// successful exchanges only.
+	succeededEMA float64
+	// succeeded is true if there has been a successful exchange.
+	succeeded bool
+	// samples is the ring buffer of the latest RTTs.
+	samples [rttWindowSize]int
+	// n is the number of the samples stored.
+	n int
+	// next is the index of samples to store the next RTT at.
+	next int
+	// history is the RTT history, see Config.RttHistoryWindow.
+	history []RTTPoint
+}
+
+// add adds rtt to the statistics.  alpha is the smoothing factor of the
+// moving average.
+func (s *rttStats) add(rtt int, alpha float64) {
+	if s.n == 0 {
+		s.ema = float64(rtt)
+	} else {
+		s.ema = alpha*float64(rtt) + (1-alpha)*s.ema
+	}
+
+	s.samples[s.next] = rtt
+	s.next = (s.next + 1) % rttWindowSize
+	if s.n < rttWindowSize {
+		s.n++
+	}
+}
+
+// addSucceeded adds rtt of a successful exchange to the moving average of
+// those.  alpha is the smoothing factor of the moving average.
+func (s *rttStats) addSucceeded(rtt int, alpha float64) {
+	if !s.succeeded {
+		s.succeededEMA = float64(rtt)
+		s.succeeded = true
+	} else {
+		s.succeededEMA = alpha*float64(rtt) + (1-alpha)*s.succeededEMA
+	}
+}
+
+// addHistory adds rtt measured at now to the history and removes the
+// intervals older than window.
+func (s *rttStats) addHistory(now time.Time, rtt int, window time.Duration) {
+	start := now.Truncate(rttHistoryResolution)
+	if n := len(s.history); n > 0 && s.history[n-1].Time.Equal(start) {
+		last := &s.history[n-1]
+		last.Count++
+		last.RTT += (float64(rtt) - last.RTT) / float64(last.Count)
+	} else {
+		s.history = append(s.history, RTTPoint{Time: start, RTT: float64(rtt), Count: 1})
+	}
+
+	s.trimHistory(now, window)
+}
+
+// trimHistory removes the intervals of the history that have ended before
+// window from now.
+func (s *rttStats) trimHistory(now time.Time, window time.Duration) {
+	cutoff := now.Add(-window)
+	i := 0
+	for ; i < len(s.history); i++ {
+		if s.history[i].Time.Add(rttHistoryResolution).After(cutoff) {
+			break
+		}
+	}
+
+	if i > 0 {
+		s.history = append(s.history[:0], s.history[i:]...)
+	}
+}
+
+// percentile returns the q-th percentile of the latest RTTs using the
+// nearest-rank method.  It returns zero if s is nil.
+func (s *rttStats) percentile(q float64) int {
+	if s == nil || s.n == 0 {
+		return 0
+	}
+
+	sorted := make([]int, s.n)
+	copy(sorted, s.samples[:s.n])
+	sort.Ints(sorted)
+
+	rank := int(math.Ceil(q * float64(s.n)))
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
+
+// avg returns the moving average of the RTT or zero if s is nil.
+func (s *rttStats) avg() float64 {
+	if s == nil {
+		return 0
+	}
+
+	return s.ema
+}
+
+// rttSmoothing returns the configured smoothing factor of the RTT moving
+// average.
+func (p *Proxy) rttSmoothing() float64 {
+	if p.RttSmoothingFactor == 0 {
+		return defaultRttSmoothing
+	}
+
+	return p.RttSmoothingFactor
+}
+
+// Stats returns the RTT statistics of the upstreams and the cache eviction
+// counters of both the general and the subnet caches.
+func (p *Proxy) Stats() Stats {
+	p.rttLock.Lock()
+	defer p.rttLock.Unlock()
+
+	stats := Stats{
+		Upstreams: make(map[string]UpstreamStats, len(p.upstreamRttStats)),
+	}
+	for addr, s := range p.upstreamRttStats {
+		us := UpstreamStats{
+			RTT:    s.ema,
+			RTTP95: s.percentile(0.95),
+		}
+
+		if p.RttHistoryWindow > 0 {
+			s.trimHistory(p.now(), p.RttHistoryWindow)
+			us.History = append([]RTTPoint(nil), s.history...)
+		}
+
+		stats.Upstreams[addr] = us
+	}
+
+	for _, c := range []*cache{p.cache, (*cache)(p.cacheSubnet)} {
+		capacity, expiry := c.evictions()
+		stats.CacheCapacityEvictions += capacity
+		stats.CacheExpiryEvictions += expiry
+	}
+
+	return stats
+}
+
+// ResetUpstreamStats forgets the RTTs, the RTT history, and the failures of
+// the upstreams, so that they're chosen as if no exchanges have happened yet.
+// It's useful after the network has changed.
+func (p *Proxy) ResetUpstreamStats() {
+	p.rttLock.Lock()
+	defer p.rttLock.Unlock()
+
+	p.upstreamRttStats = nil
+	p.upstreamPenalized = nil
+
+	// The exchanges in flight are still to be finished, so only the
+	// failures are reset.
+	for addr := range p.upstreamFailed {
+		p.upstreamFailed[addr] = false
+	}
+
+	log.Info("Upstream statistics have been reset")
+}
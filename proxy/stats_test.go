@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRttStats(t *testing.T) {
+	s := &rttStats{}
+	assert.Zero(t, s.percentile(0.95))
+
+	for _, rtt := range []int{10, 20, 30} {
+		s.add(rtt, 0.5)
+	}
+	// 10, then 0.5*20 + 0.5*10 = 15, then 0.5*30 + 0.5*15 = 22.5
+	assert.InDelta(t, 22.5, s.ema, 1e-9)
+	assert.Equal(t, 30, s.percentile(0.95))
+
+	// Only the latest samples are taken into account
+	s = &rttStats{}
+	for rtt := 1; rtt <= 100; rtt++ {
+		s.add(rtt, 0.5)
+	}
+	// The window contains 37..100, the rank of p95 is ceil(0.95*64) = 61
+	assert.Equal(t, 97, s.percentile(0.95))
+	assert.Equal(t, 37, s.percentile(0))
+}
+
+func TestProxyStats(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.RttSmoothingFactor = 0.25
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+	assert.Empty(t, dnsProxy.Stats().Upstreams)
+
+	for _, rtt := range []int{100, 100, 100, 500} {
+		dnsProxy.updateRtt("1.1.1.1:53", rtt)
+	}
+	dnsProxy.updateRtt("8.8.8.8:53", 40)
+
+	stats := dnsProxy.Stats().Upstreams
+	assert.Len(t, stats, 2)
+	// The outlier moves the average by a quarter of the difference only
+	assert.InDelta(t, 200, stats["1.1.1.1:53"].RTT, 1e-9)
+	assert.Equal(t, 500, stats["1.1.1.1:53"].RTTP95)
+	assert.InDelta(t, 40, stats["8.8.8.8:53"].RTT, 1e-9)
+	assert.Equal(t, 40, stats["8.8.8.8:53"].RTTP95)
+
+	dnsProxy.RttSmoothingFactor = 1.5
+	assert.NotNil(t, dnsProxy.validateConfig())
+}
+
+func TestRttHistory(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.TimeSource = clock.Now
+	dnsProxy.RttHistoryWindow = 30 * time.Second
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	dnsProxy.updateRtt("1.1.1.1:53", 10)
+	clock.Add(5 * time.Second)
+	dnsProxy.updateRtt("1.1.1.1:53", 20)
+	clock.Add(7 * time.Second)
+	dnsProxy.updateRtt("1.1.1.1:53", 40)
+
+	assert.Equal(t, []RTTPoint{
+		{Time: start, RTT: 15, Count: 2},
+		{Time: start.Add(10 * time.Second), RTT: 40, Count: 1},
+	}, dnsProxy.Stats().Upstreams["1.1.1.1:53"].History)
+
+	// The intervals that have ended before the window are removed.
+	clock.Set(start.Add(45 * time.Second))
+	dnsProxy.updateRtt("1.1.1.1:53", 50)
+
+	assert.Equal(t, []RTTPoint{
+		{Time: start.Add(10 * time.Second), RTT: 40, Count: 1},
+		{Time: start.Add(40 * time.Second), RTT: 50, Count: 1},
+	}, dnsProxy.Stats().Upstreams["1.1.1.1:53"].History)
+
+	clock.Add(time.Minute)
+	assert.Empty(t, dnsProxy.Stats().Upstreams["1.1.1.1:53"].History)
+}
+
+func TestResetUpstreamStats(t *testing.T) {
+	ups := []upstream.Upstream{
+		&fastUpstream{addr: "fast"},
+		&fastUpstream{addr: "slow"},
+	}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = ups
+	dnsProxy.UpstreamWeights = []int{1, 1}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	weights := func() []float64 {
+		dnsProxy.rttLock.Lock()
+		defer dnsProxy.rttLock.Unlock()
+
+		return dnsProxy.effectiveWeights(ups)
+	}
+
+	dnsProxy.updateRtt("fast", 10)
+	dnsProxy.updateRtt("slow", 500)
+	w := weights()
+	assert.Greater(t, w[0], w[1])
+	assert.Len(t, dnsProxy.Stats().Upstreams, 2)
+
+	dnsProxy.ResetUpstreamStats()
+	assert.Equal(t, []float64{1, 1}, weights())
+	assert.Empty(t, dnsProxy.Stats().Upstreams)
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// initStubZones creates the upstreams for the authoritative name servers of
+// the StubZones.
+func (p *Proxy) initStubZones() (err error) {
+	p.stubZones = nil
+	if len(p.StubZones) == 0 {
+		return nil
+	}
+
+	p.stubZones = make(map[string][]upstream.Upstream, len(p.StubZones))
+	for zone, addrs := range p.StubZones {
+		if len(addrs) == 0 {
+			return fmt.Errorf("stub zone %q: no name servers", zone)
+		}
+
+		var ups []upstream.Upstream
+		for _, addr := range addrs {
+			u, uErr := upstream.AddressToUpstream(addr, upstream.Options{
+				Timeout:     defaultTimeout,
+				DialTimeout: p.UpstreamDialTimeout,
+			})
+			if uErr != nil {
+				return errorx.Decorate(uErr, "stub zone %q", zone)
+			}
+
+			ups = append(ups, u)
+		}
+
+		p.stubZones[strings.ToLower(strings.TrimSuffix(zone, "."))] = ups
+	}
+
+	log.Info("Forwarding %d stub zones to their name servers", len(p.stubZones))
+
+	return nil
+}
+
+// stubZoneUpstreams returns the name servers of the longest stub zone host
+// belongs to or nil if there is none.
+func (p *Proxy) stubZoneUpstreams(host string) (ups []upstream.Upstream) {
+	if len(p.stubZones) == 0 {
+		return nil
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for {
+		if ups = p.stubZones[host]; ups != nil {
+			return ups
+		}
+
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return nil
+		}
+		host = host[i+1:]
+	}
+}
+
+// stubRequest returns the copy of req to send to the authoritative name
+// servers of a stub zone, which don't provide recursion.
+func stubRequest(req *dns.Msg) (stub *dns.Msg) {
+	stub = req.Copy()
+	stub.RecursionDesired = false
+
+	return stub
+}
+
+// fixStubResponse makes the response of the stub zone name server look like
+// the one of the recursive resolver, since the proxy isn't authoritative for
+// the zone itself.
+func fixStubResponse(resp *dns.Msg) {
+	resp.Authoritative = false
+	resp.RecursionAvailable = true
+}
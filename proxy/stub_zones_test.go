@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// startAuthServer starts the authoritative name server answering all the A
+// requests with 10.0.0.1.  recursive is set to the number of the requests
+// with the RD bit set.
+func startAuthServer(t *testing.T, recursive *uint32) (addr string) {
+	conn, err := net.ListenPacket("udp", listenIP+":0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+
+	srv := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			if r.RecursionDesired {
+				atomic.AddUint32(recursive, 1)
+			}
+
+			resp := &dns.Msg{}
+			resp.SetReply(r)
+			resp.Authoritative = true
+			resp.Answer = append(resp.Answer, newRR(r.Question[0].Name+" 60 IN A 10.0.0.1"))
+			_ = w.WriteMsg(resp)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	return conn.LocalAddr().String()
+}
+
+func TestStubZones(t *testing.T) {
+	var recursive uint32
+	authAddr := startAuthServer(t, &recursive)
+
+	u := &rcodeUpstream{}
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	dnsProxy.StubZones = map[string][]string{
+		"Internal.Example.": {authAddr},
+	}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	// The requests for the stub zone go to its name server.
+	for _, host := range []string{"internal.example", "host.internal.example"} {
+		req := createHostTestMessage(host)
+		d := &DNSContext{Req: req, Addr: &net.TCPAddr{}}
+		err = dnsProxy.Resolve(d)
+		assert.Nil(t, err)
+
+		assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+		assert.False(t, d.Res.Authoritative)
+		assert.True(t, d.Res.RecursionAvailable)
+		assert.True(t, d.Res.RecursionDesired)
+		assert.Equal(t, req.Question, d.Res.Question)
+		if assert.Len(t, d.Res.Answer, 1) {
+			assert.Equal(t, "10.0.0.1", d.Res.Answer[0].(*dns.A).A.String())
+		}
+	}
+	assert.Zero(t, atomic.LoadUint32(&recursive))
+	assert.Zero(t, atomic.LoadUint32(&u.calls))
+
+	// The rest go to the upstreams.
+	d := &DNSContext{Req: createHostTestMessage("external.example"), Addr: &net.TCPAddr{}}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&u.calls))
+
+	// The stub zones without name servers are invalid.
+	dnsProxy = createTestProxy(t, nil)
+	dnsProxy.StubZones = map[string][]string{"internal.example": nil}
+	assert.NotNil(t, dnsProxy.Init())
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// subscriptionBufferSize is the number of the events a subscriber may fall
+// behind before the new ones are dropped for it.
+const subscriptionBufferSize = 256
+
+// QueryEvent is a request answered by the proxy, see Subscribe.
+type QueryEvent struct {
+	// Time is the time the request was received.
+	Time time.Time
+	// Elapsed is the time it took to handle the request.
+	Elapsed time.Duration
+	// RequestID is the ID of the request, see DNSContext.RequestID.
+	RequestID uint64
+	// Client is the client's address, it may be nil.
+	Client net.Addr
+	// Proto is the protocol of the request.
+	Proto string
+	// Question is the question of the request.
+	Question dns.Question
+	// Rcode is the response code of the response.
+	Rcode int
+	// Upstream is the address of the upstream which has resolved the
+	// request, it's empty if the request wasn't sent to the upstreams.
+	Upstream string
+}
+
+// Subscribe returns the channel receiving the events about the requests
+// answered by the proxy and the function which stops the events and closes
+// the channel.  The events are dropped if the subscriber doesn't keep up with
+// them so that the slow subscribers never stall the proxy.
+func (p *Proxy) Subscribe() (events <-chan QueryEvent, unsubscribe func()) {
+	ch := make(chan QueryEvent, subscriptionBufferSize)
+
+	p.subscribersLock.Lock()
+	if p.subscribers == nil {
+		p.subscribers = map[chan QueryEvent]struct{}{}
+	}
+	p.subscribers[ch] = struct{}{}
+	p.subscribersLock.Unlock()
+
+	once := &sync.Once{}
+	unsubscribe = func() {
+		once.Do(func() {
+			p.subscribersLock.Lock()
+			defer p.subscribersLock.Unlock()
+
+			delete(p.subscribers, ch)
+			close(ch)
+		})
+	}
+
+	return ch, unsubscribe
+}
+
+// publishQuery sends the event about d to the subscribers.  It never blocks.
+func (p *Proxy) publishQuery(d *DNSContext) {
+	p.subscribersLock.RLock()
+	defer p.subscribersLock.RUnlock()
+
+	if len(p.subscribers) == 0 {
+		return
+	}
+
+	e := QueryEvent{
+		Time:      d.StartTime,
+		Elapsed:   time.Since(d.StartTime),
+		RequestID: d.RequestID,
+		Client:    d.Addr,
+		Proto:     d.Proto,
+		Rcode:     d.Res.Rcode,
+	}
+	if len(d.Req.Question) != 0 {
+		e.Question = d.Req.Question[0]
+	}
+	if d.Upstream != nil {
+		e.Upstream = d.Upstream.Address()
+	}
+
+	for ch := range p.subscribers {
+		select {
+		case ch <- e:
+		default:
+			log.Tracef("[%d] Subscriber is full, dropping the event", d.RequestID)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribe(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{createTestUpstream()}
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	events, unsubscribe := dnsProxy.Subscribe()
+	// The other subscriber never reads its events.
+	_, unsubscribeSlow := dnsProxy.Subscribe()
+	defer unsubscribeSlow()
+
+	client := dns.Client{Net: "udp", Timeout: defaultTimeout}
+	addr := dnsProxy.Addr(ProtoUDP).String()
+	hosts := []string{"first.example", "second.example", "third.example"}
+	for _, host := range hosts {
+		_, _, err = client.Exchange(createHostTestMessage(host), addr)
+		assert.Nil(t, err)
+	}
+
+	for _, host := range hosts {
+		select {
+		case e := <-events:
+			assert.Equal(t, host+".", e.Question.Name)
+			assert.Equal(t, ProtoUDP, e.Proto)
+			assert.Equal(t, dns.RcodeSuccess, e.Rcode)
+			assert.NotNil(t, e.Client)
+		case <-time.After(time.Second):
+			t.Fatalf("no event for %s", host)
+		}
+	}
+
+	// The channel is closed once unsubscribed, and unsubscribing again is
+	// fine.
+	unsubscribe()
+	unsubscribe()
+	_, ok := <-events
+	assert.False(t, ok)
+
+	// The full channel of the slow subscriber doesn't stall the proxy.
+	for i := 0; i < subscriptionBufferSize; i++ {
+		d := &DNSContext{Req: createTestMessage(), Res: &dns.Msg{}, StartTime: time.Now()}
+		dnsProxy.publishQuery(d)
+	}
+
+	reply, _, err := client.Exchange(createTestMessage(), addr)
+	if assert.Nil(t, err) {
+		assertResponse(t, reply)
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// txtLength returns the total length of the strings of rr.
+func txtLength(rr *dns.TXT) (n int) {
+	for _, s := range rr.Txt {
+		n += len(s)
+	}
+
+	return n
+}
+
+// limitTXT makes the TXT records of the UDP response fit MaxTXTLength.  The
+// response is either marked as truncated so that the client retries over TCP
+// or the strings of the long records are cut, see MaxTXTLengthTC.
+func (p *Proxy) limitTXT(d *DNSContext) {
+	if p.MaxTXTLength <= 0 || d.Proto != ProtoUDP || d.Res == nil {
+		return
+	}
+
+	for i, rr := range d.Res.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok || txtLength(txt) <= p.MaxTXTLength {
+			continue
+		}
+
+		if p.MaxTXTLengthTC {
+			log.Tracef("[%d] TXT record of %s is too long, truncating response", d.RequestID, txt.Hdr.Name)
+			d.Res.Truncated = true
+			d.Res.Answer, d.Res.Ns, d.Res.Extra = nil, nil, filterOPT(d.Res.Extra)
+
+			return
+		}
+
+		// The records may be shared with the cache, so modify a copy.
+		txt = dns.Copy(txt).(*dns.TXT)
+		left := p.MaxTXTLength
+		for j, s := range txt.Txt {
+			if len(s) > left {
+				txt.Txt = append(txt.Txt[:j], s[:left])
+
+				break
+			}
+			left -= len(s)
+		}
+		d.Res.Answer[i] = txt
+	}
+}
+
+// filterOPT returns the OPT records of rrs.
+func filterOPT(rrs []dns.RR) (opts []dns.RR) {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opts = append(opts, rr)
+		}
+	}
+
+	return opts
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// txtUpstream answers all requests with a 4KB TXT record.
+type txtUpstream struct{}
+
+func (u *txtUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	txt := &dns.TXT{
+		Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+	}
+	for i := 0; i < 16; i++ {
+		txt.Txt = append(txt.Txt, strings.Repeat("a", 255))
+	}
+
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	resp.Answer = append(resp.Answer, txt)
+
+	return resp, nil
+}
+
+func (u *txtUpstream) Address() string {
+	return "txt"
+}
+
+func TestMaxTXTLength(t *testing.T) {
+	testCases := []struct {
+		name      string
+		tc        bool
+		truncated bool
+		answers   int
+	}{{
+		name:      "cut",
+		tc:        false,
+		truncated: false,
+		answers:   1,
+	}, {
+		name:      "tc",
+		tc:        true,
+		truncated: true,
+		answers:   0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dnsProxy := createTestProxy(t, nil)
+			dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&txtUpstream{}}
+			dnsProxy.MaxTXTLength = 300
+			dnsProxy.MaxTXTLengthTC = tc.tc
+
+			err := dnsProxy.Start()
+			if err != nil {
+				t.Fatalf("cannot start the DNS proxy: %s", err)
+			}
+			defer func() {
+				assert.Nil(t, dnsProxy.Stop())
+			}()
+
+			req := &dns.Msg{}
+			req.SetQuestion("txt.example.", dns.TypeTXT)
+			req.SetEdns0(dns.MaxMsgSize, false)
+
+			client := &dns.Client{Net: "udp", Timeout: defaultTimeout, UDPSize: dns.MaxMsgSize}
+			reply, _, err := client.Exchange(req, dnsProxy.Addr(ProtoUDP).String())
+			if err != nil {
+				t.Fatalf("cannot exchange: %s", err)
+			}
+
+			assert.Equal(t, tc.truncated, reply.Truncated)
+			if assert.Len(t, reply.Answer, tc.answers) && tc.answers > 0 {
+				assert.Equal(t, 300, txtLength(reply.Answer[0].(*dns.TXT)))
+			}
+
+			// The limit doesn't apply to TCP.
+			client.Net = "tcp"
+			reply, _, err = client.Exchange(req, dnsProxy.Addr(ProtoTCP).String())
+			if err != nil {
+				t.Fatalf("cannot exchange: %s", err)
+			}
+			if assert.Len(t, reply.Answer, 1) {
+				assert.Equal(t, 16*255, txtLength(reply.Answer[0].(*dns.TXT)))
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// TypeHandler handles the requests of a particular type.  If handled is true,
+// d.Res is sent to the client.  Otherwise the request is processed as usual.
+// A non-nil err makes the proxy respond with SERVFAIL.
+type TypeHandler func(d *DNSContext) (handled bool, err error)
+
+// RegisterTypeHandler registers h to handle the requests of type qtype before
+// they're filtered and sent to the upstreams.  It replaces the handler
+// registered for qtype before, nil h unregisters it.
+func (p *Proxy) RegisterTypeHandler(qtype uint16, h TypeHandler) {
+	p.typeHandlersLock.Lock()
+	defer p.typeHandlersLock.Unlock()
+
+	if h == nil {
+		delete(p.typeHandlers, qtype)
+
+		return
+	}
+
+	if p.typeHandlers == nil {
+		p.typeHandlers = map[uint16]TypeHandler{}
+	}
+	p.typeHandlers[qtype] = h
+}
+
+// handleType calls the handler registered for the type of d's request, if
+// any, and sets d.Res if the handler has handled the request.
+func (p *Proxy) handleType(d *DNSContext) {
+	if len(d.Req.Question) != 1 {
+		return
+	}
+	qtype := d.Req.Question[0].Qtype
+
+	p.typeHandlersLock.RLock()
+	h := p.typeHandlers[qtype]
+	p.typeHandlersLock.RUnlock()
+
+	if h == nil {
+		return
+	}
+
+	handled, err := h(d)
+	if err != nil {
+		log.Error("[%d] Error in the handler of type %s: %s", d.RequestID, dns.Type(qtype), err)
+		d.Res = p.genServerFailure(d.Req)
+
+		return
+	}
+
+	if !handled {
+		d.Res = nil
+
+		return
+	}
+
+	if d.Res == nil {
+		log.Debug("[%d] The handler of type %s has set no response", d.RequestID, dns.Type(qtype))
+		d.Res = p.genServerFailure(d.Req)
+	}
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterTypeHandler(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{createTestUpstream()}
+
+	dnsProxy.RegisterTypeHandler(dns.TypeTXT, func(d *DNSContext) (bool, error) {
+		if d.Req.Question[0].Name != "token.example.org." {
+			return false, nil
+		}
+
+		d.Res = &dns.Msg{}
+		d.Res.SetReply(d.Req)
+		d.Res.Answer = append(d.Res.Answer, newRR(`token.example.org. 10 IN TXT "secret"`))
+
+		return true, nil
+	})
+	dnsProxy.RegisterTypeHandler(dns.TypeSRV, func(_ *DNSContext) (bool, error) {
+		return false, errors.New("no srv")
+	})
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	client := &dns.Client{Net: "udp", Timeout: defaultTimeout}
+	exchange := func(name string, qtype uint16) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion(name, qtype)
+		reply, _, eErr := client.Exchange(req, dnsProxy.Addr(ProtoUDP).String())
+		if eErr != nil {
+			t.Fatalf("cannot exchange: %s", eErr)
+		}
+
+		return reply
+	}
+
+	// The handler answers the TXT requests it handles.
+	reply := exchange("token.example.org.", dns.TypeTXT)
+	if assert.Len(t, reply.Answer, 1) {
+		assert.Equal(t, []string{"secret"}, reply.Answer[0].(*dns.TXT).Txt)
+	}
+
+	// The rest of the TXT requests and other types are forwarded.
+	reply = exchange("google-public-dns-a.google.com.", dns.TypeTXT)
+	assertResponse(t, reply)
+
+	reply = exchange("google-public-dns-a.google.com.", dns.TypeA)
+	assertResponse(t, reply)
+
+	// The handler's error makes the proxy respond with SERVFAIL.
+	reply = exchange("_sip._udp.example.org.", dns.TypeSRV)
+	assert.Equal(t, dns.RcodeServerFailure, reply.Rcode)
+
+	// The unregistered handler isn't called.
+	dnsProxy.RegisterTypeHandler(dns.TypeSRV, nil)
+	reply = exchange("_sip._udp.example.org.", dns.TypeSRV)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+}
@@ -54,6 +54,7 @@ func ParseUpstreamsConfig(upstreamConfig []string, options upstream.Options) (Up
 					upstream.Options{
 						Bootstrap:          options.Bootstrap,
 						Timeout:            options.Timeout,
+						DialTimeout:        options.DialTimeout,
 						InsecureSkipVerify: options.InsecureSkipVerify,
 					})
 				if err != nil {
@@ -127,13 +128,21 @@ func parseUpstreamLine(l string) (string, []string, error) {
 // If we are looking for domain www.host.com, this method will return value of www.host.com key
 // If more specific domain value is nil, it means that domain was excluded and should be exchanged with default upstreams
 func (uc *UpstreamConfig) getUpstreamsForDomain(host string) []upstream.Upstream {
+	ups, _ := uc.upstreamsForDomain(host)
+
+	return ups
+}
+
+// upstreamsForDomain is like getUpstreamsForDomain but it also returns true if
+// the upstreams are reserved for host rather than the default ones.
+func (uc *UpstreamConfig) upstreamsForDomain(host string) (ups []upstream.Upstream, reserved bool) {
 	if len(uc.DomainReservedUpstreams) == 0 {
-		return uc.Upstreams
+		return uc.Upstreams, false
 	}
 
 	dotsCount := strings.Count(host, ".")
 	if dotsCount < 2 {
-		return uc.DomainReservedUpstreams[UnqualifiedNames]
+		return uc.DomainReservedUpstreams[UnqualifiedNames], true
 	}
 
 	for i := 1; i <= dotsCount; i++ {
@@ -142,11 +151,11 @@ func (uc *UpstreamConfig) getUpstreamsForDomain(host string) []upstream.Upstream
 		if u, ok := uc.DomainReservedUpstreams[strings.ToLower(name)]; ok {
 			if u == nil {
 				// domain was excluded from reserved upstreams querying
-				return uc.Upstreams
+				return uc.Upstreams, false
 			}
-			return u
+			return u, true
 		}
 	}
 
-	return uc.Upstreams
+	return uc.Upstreams, false
 }
@@ -53,10 +53,24 @@ func ReadPrefixed(conn net.Conn) ([]byte, error) {
 }
 
 // WritePrefixed -- write a DNS message to a TCP connection
-// it first writes a 2-byte prefix followed by the message itself
+// it first writes a 2-byte prefix followed by the message itself.  Short
+// writes are legal on a stream, so it keeps writing the rest until the whole
+// message is written or a real error occurs, e.g. the write deadline is hit.
 func WritePrefixed(b []byte, conn net.Conn) error {
-	l := make([]byte, 2)
-	binary.BigEndian.PutUint16(l, uint16(len(b)))
-	_, err := (&net.Buffers{l, b}).WriteTo(conn)
-	return err
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+
+	for len(buf) > 0 {
+		n, err := conn.Write(buf)
+		buf = buf[n:]
+		if err != nil && !(n > 0 && errors.Is(err, io.ErrShortWrite)) {
+			return err
+		}
+		if n == 0 && err == nil {
+			return io.ErrNoProgress
+		}
+	}
+
+	return nil
 }
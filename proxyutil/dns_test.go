@@ -0,0 +1,64 @@
+package proxyutil
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// throttledConn is a net.Conn that writes at most max bytes at once.
+type throttledConn struct {
+	net.Conn
+
+	buf    bytes.Buffer
+	max    int
+	writes int
+	// err is returned with the short writes if not nil.
+	err error
+}
+
+func (c *throttledConn) Write(b []byte) (n int, err error) {
+	c.writes++
+	if len(b) <= c.max {
+		return c.buf.Write(b)
+	}
+
+	n, _ = c.buf.Write(b[:c.max])
+
+	return n, c.err
+}
+
+func TestWritePrefixed(t *testing.T) {
+	msg := bytes.Repeat([]byte{0xAB}, 1000)
+
+	for _, shortErr := range []error{nil, io.ErrShortWrite} {
+		conn := &throttledConn{max: 100, err: shortErr}
+		err := WritePrefixed(msg, conn)
+		assert.Nil(t, err)
+		assert.Equal(t, 11, conn.writes)
+
+		// The message is read back in full
+		got, err := ReadPrefixed(&readConn{Reader: &conn.buf})
+		assert.Nil(t, err)
+		assert.Equal(t, msg, got)
+	}
+
+	// The real errors are returned right away
+	conn := &throttledConn{max: 100, err: io.ErrClosedPipe}
+	err := WritePrefixed(msg, conn)
+	assert.Equal(t, io.ErrClosedPipe, err)
+	assert.Equal(t, 1, conn.writes)
+}
+
+// readConn is a net.Conn that reads from the reader.
+type readConn struct {
+	net.Conn
+	io.Reader
+}
+
+func (c *readConn) Read(b []byte) (n int, err error) {
+	return c.Reader.Read(b)
+}
@@ -208,8 +208,12 @@ func (n *bootstrapper) createTLSConfig(host string) *tls.Config {
 
 // createDialContext returns dialContext function that tries to establish connection with all given addresses one by one
 func (n *bootstrapper) createDialContext(addresses []string) (dialContext dialHandler) {
+	timeout := n.options.Timeout
+	if n.options.DialTimeout > 0 {
+		timeout = n.options.DialTimeout
+	}
 	dialer := &net.Dialer{
-		Timeout: n.options.Timeout,
+		Timeout: timeout,
 	}
 
 	dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
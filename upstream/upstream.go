@@ -33,6 +33,12 @@ type Options struct {
 	// timeout=0 means infinite timeout.
 	Timeout time.Duration
 
+	// DialTimeout is the timeout of establishing the TCP connections and of
+	// the TLS handshakes with the upstream, so that the unreachable upstreams
+	// fail quickly while the connected ones still have Timeout to respond.
+	// Zero means no separate limit.
+	DialTimeout time.Duration
+
 	// List of IP addresses of upstream DNS server
 	// Bootstrap DNS servers won't be used at all
 	ServerIPAddrs []net.IP
@@ -46,6 +52,15 @@ type Options struct {
 	// VerifyDNSCryptCertificate is callback to which the DNSCrypt server certificate will be passed.
 	// is called in dnsCrypt.exchangeDNSCrypt; if error != nil then Upstream.Exchange() will return it
 	VerifyDNSCryptCertificate func(cert *dnscrypt.Cert) error
+
+	// DoHUserAgent is the User-Agent header value sent in the DoH requests.
+	// If empty, the default value of net/http is used.
+	DoHUserAgent string
+
+	// Multiplex makes the DNS-over-TLS upstreams send the concurrent queries
+	// over a single connection instead of a pool of connections.  The
+	// responses are matched to the queries by their IDs, see RFC 7766.
+	Multiplex bool
 }
 
 // Parse "host:port" string and validate port number
@@ -89,7 +104,7 @@ func AddressToUpstream(address string, options Options) (Upstream, error) {
 		port = "53"
 	}
 
-	return &plainDNS{address: net.JoinHostPort(host, port), timeout: options.Timeout}, nil
+	return &plainDNS{address: net.JoinHostPort(host, port), timeout: options.Timeout, dialTimeout: options.DialTimeout}, nil
 }
 
 // urlToBoot creates an instance of the bootstrapper with the specified options
@@ -110,10 +125,15 @@ func urlToUpstream(upstreamURL *url.URL, opts Options) (Upstream, error) {
 		return stampToUpstream(upstreamURL, opts)
 
 	case "dns":
-		return &plainDNS{address: getHostWithPort(upstreamURL, "53"), timeout: opts.Timeout}, nil
+		return &plainDNS{address: getHostWithPort(upstreamURL, "53"), timeout: opts.Timeout, dialTimeout: opts.DialTimeout}, nil
 
 	case "tcp":
-		return &plainDNS{address: getHostWithPort(upstreamURL, "53"), timeout: opts.Timeout, preferTCP: true}, nil
+		return &plainDNS{
+			address:     getHostWithPort(upstreamURL, "53"),
+			timeout:     opts.Timeout,
+			dialTimeout: opts.DialTimeout,
+			preferTCP:   true,
+		}, nil
 
 	case "quic":
 		if upstreamURL.Port() == "" {
@@ -183,7 +203,7 @@ func stampToUpstream(upsURL *url.URL, opts Options) (Upstream, error) {
 
 	switch stamp.Proto {
 	case dnsstamps.StampProtoTypePlain:
-		return &plainDNS{address: stamp.ServerAddrStr, timeout: opts.Timeout}, nil
+		return &plainDNS{address: stamp.ServerAddrStr, timeout: opts.Timeout, dialTimeout: opts.DialTimeout}, nil
 	case dnsstamps.StampProtoTypeDNSCrypt:
 		b, err := newBootstrapper(upsURL, opts)
 		if err != nil {
@@ -63,6 +63,9 @@ func (p *dnsOverHTTPS) exchangeHTTPSClient(m *dns.Msg, client *http.Client) (*dn
 		return nil, errorx.Decorate(err, "couldn't create a HTTP request to %s", p.boot.URL)
 	}
 	req.Header.Set("Accept", "application/dns-message")
+	if ua := p.boot.options.DoHUserAgent; ua != "" {
+		req.Header.Set("User-Agent", ua)
+	}
 
 	resp, err := client.Do(req)
 	if resp != nil && resp.Body != nil {
@@ -144,6 +147,8 @@ func (p *dnsOverHTTPS) createTransport() (*http.Transport, error) {
 		DialContext:        dialContext,
 		MaxConnsPerHost:    DoHMaxConnsPerHost,
 		MaxIdleConns:       1,
+		// The TCP connection is limited by the dialer.
+		TLSHandshakeTimeout: p.boot.options.DialTimeout,
 	}
 	// It appears that this is important to explicitly configure transport to use HTTP2
 	// Relevant issue: https://github.com/AdguardTeam/dnsproxy/issues/11
@@ -1,8 +1,10 @@
 package upstream
 
 import (
+	"encoding/binary"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
@@ -15,13 +17,21 @@ import (
 type dnsOverTLS struct {
 	boot *bootstrapper
 	pool *TLSPool
+	// mux is the multiplexed connection used if Options.Multiplex is set.
+	mux *muxConn
+	// muxDialLock serializes dialing the multiplexed connection.
+	muxDialLock sync.Mutex
 
-	sync.RWMutex // protects pool
+	sync.RWMutex // protects pool and mux
 }
 
 func (p *dnsOverTLS) Address() string { return p.boot.URL.String() }
 
 func (p *dnsOverTLS) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if p.boot.options.Multiplex {
+		return p.exchangeMux(m)
+	}
+
 	var pool *TLSPool
 	p.RLock()
 	pool = p.pool
@@ -71,9 +81,92 @@ func (p *dnsOverTLS) Exchange(m *dns.Msg) (*dns.Msg, error) {
 	return reply, err
 }
 
+// exchangeMux sends m over the multiplexed connection.
+func (p *dnsOverTLS) exchangeMux(m *dns.Msg) (*dns.Msg, error) {
+	c, err := p.getMuxConn()
+	if err != nil {
+		return nil, err
+	}
+
+	logBegin(p.Address(), m)
+	reply, err := c.exchange(m)
+	logFinish(p.Address(), err)
+	if err != nil && c.brokenErr() != nil {
+		// The server might have closed the idle connection, so retry over a
+		// new one.
+		c, err = p.getMuxConn()
+		if err != nil {
+			return nil, err
+		}
+
+		logBegin(p.Address(), m)
+		reply, err = c.exchange(m)
+		logFinish(p.Address(), err)
+	}
+
+	return reply, err
+}
+
+// getMuxConn returns the multiplexed connection, replacing it with a new one
+// if it's broken.
+func (p *dnsOverTLS) getMuxConn() (*muxConn, error) {
+	if mux := p.currentMuxConn(); mux != nil {
+		return mux, nil
+	}
+
+	// Dial without holding the upstream's lock so that the concurrent
+	// queries don't wait for it, but only once at a time.
+	p.muxDialLock.Lock()
+	defer p.muxDialLock.Unlock()
+
+	// Another query may have already reconnected.
+	if mux := p.currentMuxConn(); mux != nil {
+		return mux, nil
+	}
+
+	tlsConfig, dialContext, err := p.boot.get()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := tlsDial(dialContext, "tcp", tlsConfig, p.boot.options.DialTimeout)
+	if err != nil {
+		return nil, errorx.Decorate(err, "Failed to connect to %s", tlsConfig.ServerName)
+	}
+
+	mux := newMuxConn(conn, p.boot.options.Timeout)
+
+	p.Lock()
+	p.mux = mux
+	p.Unlock()
+
+	return mux, nil
+}
+
+// currentMuxConn returns the multiplexed connection or nil if there is none
+// or it's broken.
+func (p *dnsOverTLS) currentMuxConn() *muxConn {
+	p.RLock()
+	defer p.RUnlock()
+
+	if p.mux != nil && p.mux.brokenErr() == nil {
+		return p.mux
+	}
+
+	return nil
+}
+
 func (p *dnsOverTLS) exchangeConn(poolConn net.Conn, m *dns.Msg) (*dns.Msg, error) {
+	// Negotiate the keepalive on the first query over the pooled connection
+	req := m
+	pc, isPooled := poolConn.(*pooledConn)
+	if isPooled && !pc.keepaliveSent {
+		req = withKeepalive(m)
+		pc.keepaliveSent = true
+	}
+
 	c := dns.Conn{Conn: poolConn}
-	err := c.WriteMsg(m)
+	err := c.WriteMsg(req)
 	if err != nil {
 		poolConn.Close()
 		return nil, errorx.Decorate(err, "Failed to send a request to %s", p.Address())
@@ -87,5 +180,64 @@ func (p *dnsOverTLS) exchangeConn(poolConn net.Conn, m *dns.Msg) (*dns.Msg, erro
 	if err == nil && reply.Id != m.Id {
 		err = dns.ErrId
 	}
+	if err == nil && req != m {
+		pc.idleTimeout = removeKeepalive(reply, m.IsEdns0() != nil)
+		if pc.idleTimeout > 0 {
+			log.Tracef("%s announced keepalive timeout %s", p.Address(), pc.idleTimeout)
+		}
+	}
 	return reply, err
 }
+
+// withKeepalive returns a copy of m with the EDNS0 TCP Keepalive option which
+// has no timeout as required for the clients, see RFC 7828.  The option is
+// added as EDNS0_LOCAL since dns.EDNS0_TCP_KEEPALIVE is packed incorrectly.
+func withKeepalive(m *dns.Msg) *dns.Msg {
+	req := m.Copy()
+	opt := req.IsEdns0()
+	if opt == nil {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt = req.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE})
+
+	return req
+}
+
+// removeKeepalive removes the EDNS0 TCP Keepalive option from the reply and
+// returns the idle timeout announced by the server or zero if there is none.
+// If hadEDNS is false, the OPT record added by withKeepalive is removed
+// entirely.
+func removeKeepalive(reply *dns.Msg, hadEDNS bool) (timeout time.Duration) {
+	opt := reply.IsEdns0()
+	if opt == nil {
+		return 0
+	}
+
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0TCPKEEPALIVE {
+			options = append(options, o)
+
+			continue
+		}
+
+		// The timeout is in units of 100 milliseconds.
+		if l, ok := o.(*dns.EDNS0_LOCAL); ok && len(l.Data) == 2 {
+			timeout = time.Duration(binary.BigEndian.Uint16(l.Data)) * 100 * time.Millisecond
+		}
+	}
+	opt.Option = options
+
+	if !hadEDNS {
+		extra := reply.Extra[:0]
+		for _, rr := range reply.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		reply.Extra = extra
+	}
+
+	return timeout
+}
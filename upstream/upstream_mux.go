@@ -0,0 +1,175 @@
+package upstream
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// muxConn is a stream connection over which the concurrent queries are
+// multiplexed, see RFC 7766.  Each outgoing query gets a fresh ID unique
+// among the queries awaiting the responses, and the responses, which may come
+// in any order, are dispatched to the callers by their IDs.
+type muxConn struct {
+	conn    net.Conn
+	timeout time.Duration
+
+	writeLock sync.Mutex // serializes the writes to conn
+
+	lock sync.Mutex // protects pending and err
+	// pending are the channels of the callers awaiting the responses by the
+	// IDs of the outgoing queries.
+	pending map[uint16]chan *dns.Msg
+	// err is the reason the connection is broken or nil if it's still usable.
+	err error
+}
+
+// newMuxConn returns a new muxConn over conn and starts reading the responses.
+// timeout is the time to wait for a response, zero means infinite timeout.
+func newMuxConn(conn net.Conn, timeout time.Duration) *muxConn {
+	// The connection stays open while the server keeps it, so make sure
+	// there is no read deadline.
+	_ = conn.SetReadDeadline(time.Time{})
+
+	c := &muxConn{
+		conn:    conn,
+		timeout: timeout,
+		pending: map[uint16]chan *dns.Msg{},
+	}
+	go c.readLoop()
+
+	return c
+}
+
+// exchange sends m over the connection and returns the response with the ID
+// of m restored.
+func (c *muxConn) exchange(m *dns.Msg) (reply *dns.Msg, err error) {
+	// Copy the message header only since just the ID is changed.
+	req := *m
+	ch := make(chan *dns.Msg, 1)
+
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+
+		return nil, c.err
+	}
+	if len(c.pending) >= math.MaxUint16 {
+		c.lock.Unlock()
+
+		return nil, fmt.Errorf("too many outstanding queries")
+	}
+	for {
+		req.Id = dns.Id()
+		if _, ok := c.pending[req.Id]; !ok {
+			break
+		}
+	}
+	c.pending[req.Id] = ch
+	c.lock.Unlock()
+
+	defer c.release(req.Id, ch)
+
+	c.writeLock.Lock()
+	if c.timeout > 0 {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	err = (&dns.Conn{Conn: c.conn}).WriteMsg(&req)
+	c.writeLock.Unlock()
+	if err != nil {
+		c.fail(err)
+
+		return nil, errorx.Decorate(err, "Failed to send a request")
+	}
+
+	var timeout <-chan time.Time
+	if c.timeout > 0 {
+		timer := time.NewTimer(c.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case reply, ok := <-ch:
+		if !ok {
+			return nil, errorx.Decorate(c.brokenErr(), "Failed to read a response")
+		}
+		reply.Id = m.Id
+
+		return reply, nil
+	case <-timeout:
+		return nil, fmt.Errorf("timeout waiting for the response to query %d", req.Id)
+	}
+}
+
+// release removes the caller's channel unless the ID has been already reused
+// by another query.
+func (c *muxConn) release(id uint16, ch chan *dns.Msg) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.pending[id] == ch {
+		delete(c.pending, id)
+	}
+}
+
+// readLoop reads the responses and dispatches them to the callers until the
+// connection is broken.
+func (c *muxConn) readLoop() {
+	dc := &dns.Conn{Conn: c.conn}
+	for {
+		reply, err := dc.ReadMsg()
+		if err != nil {
+			c.fail(err)
+
+			return
+		}
+
+		c.lock.Lock()
+		ch, ok := c.pending[reply.Id]
+		delete(c.pending, reply.Id)
+		c.lock.Unlock()
+
+		if !ok {
+			log.Tracef("Dropping the response with unexpected id %d from %s", reply.Id, c.conn.RemoteAddr())
+
+			continue
+		}
+
+		// ch is buffered and receives a single response.
+		ch <- reply
+	}
+}
+
+// fail marks the connection as broken, closes it, and wakes up the callers
+// awaiting the responses.
+func (c *muxConn) fail(err error) {
+	c.lock.Lock()
+	if c.err == nil {
+		log.Tracef("Multiplexed connection to %s is broken due to %s", c.conn.RemoteAddr(), err)
+
+		c.err = err
+		for id, ch := range c.pending {
+			close(ch)
+			delete(c.pending, id)
+		}
+	}
+	c.lock.Unlock()
+
+	_ = c.conn.Close()
+}
+
+// brokenErr returns the reason the connection is broken or nil if it's still
+// usable.
+func (c *muxConn) brokenErr() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.err
+}
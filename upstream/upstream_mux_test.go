@@ -0,0 +1,138 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// startInterleavingDoTServer starts a DoT server which answers the queries
+// concurrently after random delays, so that the responses interleave.  The
+// answer to the query for "q<n>.example.org." is 10.0.<n / 256>.<n % 256>.
+// conns is increased on each accepted connection, dupIDs on each query with
+// the ID of another unanswered query.
+func startInterleavingDoTServer(t *testing.T, conns, dupIDs *int32) net.Addr {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", newTestTLSConfig(t))
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, aErr := l.Accept()
+			if aErr != nil {
+				return
+			}
+			atomic.AddInt32(conns, 1)
+
+			go serveInterleavingConn(conn, dupIDs)
+		}
+	}()
+
+	return l.Addr()
+}
+
+// serveInterleavingConn answers the queries over conn until it's closed.
+func serveInterleavingConn(conn net.Conn, dupIDs *int32) {
+	c := &dns.Conn{Conn: conn}
+	defer c.Close()
+
+	var lock sync.Mutex
+	outstanding := map[uint16]bool{}
+	for {
+		req, err := c.ReadMsg()
+		if err != nil {
+			return
+		}
+
+		lock.Lock()
+		if outstanding[req.Id] {
+			atomic.AddInt32(dupIDs, 1)
+		}
+		outstanding[req.Id] = true
+		lock.Unlock()
+
+		go func() {
+			time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+
+			var n int
+			_, _ = fmt.Sscanf(req.Question[0].Name, "q%d.", &n)
+
+			resp := &dns.Msg{}
+			resp.SetReply(req)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+				A:   net.IPv4(10, 0, byte(n/256), byte(n%256)),
+			})
+
+			lock.Lock()
+			delete(outstanding, req.Id)
+			_ = c.WriteMsg(resp)
+			lock.Unlock()
+		}()
+	}
+}
+
+func TestDoTMultiplex(t *testing.T) {
+	conns, dupIDs := int32(0), int32(0)
+	addr := startInterleavingDoTServer(t, &conns, &dupIDs)
+
+	u, err := AddressToUpstream("tls://"+addr.String(), Options{
+		InsecureSkipVerify: true,
+		Timeout:            timeout,
+		Multiplex:          true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+
+	const n = 200
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+
+			req := &dns.Msg{}
+			req.SetQuestion(fmt.Sprintf("q%d.example.org.", i), dns.TypeA)
+			// The same ID for all the callers must not confuse the
+			// dispatching.
+			req.Id = 1
+
+			reply, eErr := u.Exchange(req)
+			if !assert.Nil(t, eErr) {
+				return
+			}
+
+			assert.Equal(t, uint16(1), reply.Id)
+			if assert.Len(t, reply.Answer, 1) {
+				assert.Equal(t, req.Question[0].Name, reply.Answer[0].Header().Name)
+				assert.Equal(t, net.IPv4(10, 0, byte(i/256), byte(i%256)).To4(), reply.Answer[0].(*dns.A).A.To4())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&dupIDs))
+
+	// The broken connection is replaced with a new one.
+	p := u.(*dnsOverTLS)
+	_ = p.mux.conn.Close()
+
+	reply, err := u.Exchange(createTestMessage())
+	if err != nil {
+		t.Fatalf("cannot exchange after reconnecting: %s", err)
+	}
+	assert.Len(t, reply.Answer, 1)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&conns))
+}
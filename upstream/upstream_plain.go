@@ -1,6 +1,7 @@
 package upstream
 
 import (
+	"net"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
@@ -11,9 +12,10 @@ import (
 // plain DNS
 //
 type plainDNS struct {
-	address   string
-	timeout   time.Duration
-	preferTCP bool
+	address     string
+	timeout     time.Duration
+	dialTimeout time.Duration // timeout of establishing the TCP connection, see Options.DialTimeout
+	preferTCP   bool
 }
 
 // Address returns the original address that we've put in initially, not resolved one
@@ -26,9 +28,8 @@ func (p *plainDNS) Address() string {
 
 func (p *plainDNS) Exchange(m *dns.Msg) (*dns.Msg, error) {
 	if p.preferTCP {
-		tcpClient := dns.Client{Net: "tcp", Timeout: p.timeout}
 		logBegin(p.Address(), m)
-		reply, _, tcpErr := tcpClient.Exchange(m, p.address)
+		reply, tcpErr := p.exchangeTCP(m)
 		logFinish(p.Address(), tcpErr)
 		return reply, tcpErr
 	}
@@ -41,11 +42,32 @@ func (p *plainDNS) Exchange(m *dns.Msg) (*dns.Msg, error) {
 
 	if reply != nil && reply.Truncated {
 		log.Tracef("Truncated message was received, retrying over TCP, question: %s", m.Question[0].String())
-		tcpClient := dns.Client{Net: "tcp", Timeout: p.timeout}
 		logBegin(p.Address(), m)
-		reply, _, err = tcpClient.Exchange(m, p.address)
+		reply, err = p.exchangeTCP(m)
 		logFinish(p.Address(), err)
 	}
 
 	return reply, err
 }
+
+// exchangeTCP exchanges m with the upstream over TCP.  The connection is
+// established within dialTimeout if it's set, the exchange itself is limited
+// by timeout.
+func (p *plainDNS) exchangeTCP(m *dns.Msg) (reply *dns.Msg, err error) {
+	client := dns.Client{Net: "tcp", Timeout: p.timeout}
+	if p.dialTimeout == 0 {
+		reply, _, err = client.Exchange(m, p.address)
+
+		return reply, err
+	}
+
+	conn, err := net.DialTimeout("tcp", p.address, p.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	reply, _, err = client.ExchangeWithConn(m, &dns.Conn{Conn: conn})
+
+	return reply, err
+}
@@ -1,9 +1,12 @@
 package upstream
 
 import (
+	"net"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestDNSTruncated(t *testing.T) {
@@ -30,3 +33,38 @@ func TestDNSTruncated(t *testing.T) {
 		t.Fatalf("response must NOT be truncated")
 	}
 }
+
+func TestTCPDialTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+
+	// The server responds later than the dial timeout.
+	srv := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(300 * time.Millisecond)
+
+		resp := &dns.Msg{}
+		resp.SetReply(r)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+			A:   net.IPv4(8, 8, 8, 8),
+		})
+		_ = w.WriteMsg(resp)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer func() { _ = srv.Shutdown() }()
+
+	u, err := AddressToUpstream("tcp://"+l.Addr().String(), Options{
+		Timeout:     timeout,
+		DialTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+
+	reply, err := u.Exchange(createTestMessage())
+	if assert.Nil(t, err) {
+		assertResponse(t, reply)
+	}
+}
@@ -37,16 +37,47 @@ type TLSPool struct {
 	connsMutex sync.Mutex // protects conns
 }
 
+// pooledConn is a connection of the TLSPool with its EDNS0 TCP Keepalive state,
+// see RFC 7828.
+type pooledConn struct {
+	net.Conn
+
+	// keepaliveSent is true if the keepalive option has already been sent
+	// over the connection.
+	keepaliveSent bool
+	// idleTimeout is the idle timeout announced by the server.  Zero means
+	// that it's unknown.
+	idleTimeout time.Duration
+	// idleSince is the time when the connection has been put into the pool.
+	idleSince time.Time
+}
+
+// isExpired returns true if the server has probably closed the idle
+// connection by now.
+func (c *pooledConn) isExpired(now time.Time) bool {
+	return c.idleTimeout > 0 && now.Sub(c.idleSince) >= c.idleTimeout
+}
+
 // Get gets or creates a new TLS connection
 func (n *TLSPool) Get() (net.Conn, error) {
-	// get the connection from the slice inside the lock
+	// get the connection from the slice inside the lock, skipping the ones
+	// the server has closed due to the keepalive timeout
 	var c net.Conn
 	n.connsMutex.Lock()
-	num := len(n.conns)
-	if num > 0 {
-		last := num - 1
+	for len(n.conns) > 0 {
+		last := len(n.conns) - 1
 		c = n.conns[last]
 		n.conns = n.conns[:last]
+
+		if pc, ok := c.(*pooledConn); ok && pc.isExpired(time.Now()) {
+			log.Tracef("Closing connection to %s idle for longer than %s", c.RemoteAddr(), pc.idleTimeout)
+			_ = c.Close()
+			c = nil
+
+			continue
+		}
+
+		break
 	}
 	n.connsMutex.Unlock()
 
@@ -72,11 +103,19 @@ func (n *TLSPool) Create() (net.Conn, error) {
 	}
 
 	// we'll need a new connection, dial now
-	conn, err := tlsDial(dialContext, "tcp", tlsConfig)
+	conn, err := tlsDial(dialContext, "tcp", tlsConfig, n.boot.options.DialTimeout)
 	if err != nil {
 		return nil, errorx.Decorate(err, "Failed to connect to %s", tlsConfig.ServerName)
 	}
-	return conn, nil
+
+	// The connected upstream has the usual time to respond.
+	err = conn.SetDeadline(time.Now().Add(dialTimeout))
+	if err != nil {
+		_ = conn.Close()
+		return nil, errorx.Decorate(err, "Failed to set deadline for %s", tlsConfig.ServerName)
+	}
+
+	return &pooledConn{Conn: conn}, nil
 }
 
 // Put returns connection to the pool
@@ -84,13 +123,17 @@ func (n *TLSPool) Put(c net.Conn) {
 	if c == nil {
 		return
 	}
+	if pc, ok := c.(*pooledConn); ok {
+		pc.idleSince = time.Now()
+	}
 	n.connsMutex.Lock()
 	n.conns = append(n.conns, c)
 	n.connsMutex.Unlock()
 }
 
-// tlsDial is basically the same as tls.DialWithDialer, but we will call our own dialContext function to get connection
-func tlsDial(dialContext dialHandler, network string, config *tls.Config) (*tls.Conn, error) {
+// tlsDial is basically the same as tls.DialWithDialer, but we will call our own dialContext function to get connection.
+// The TLS handshake is limited by handshakeTimeout if it's not zero.
+func tlsDial(dialContext dialHandler, network string, config *tls.Config, handshakeTimeout time.Duration) (*tls.Conn, error) {
 	// we're using bootstrapped address instead of what's passed to the function
 	rawConn, err := dialContext(context.TODO(), network, "")
 	if err != nil {
@@ -100,7 +143,11 @@ func tlsDial(dialContext dialHandler, network string, config *tls.Config) (*tls.
 	// we want the timeout to cover the whole process: TCP connection and TLS handshake
 	// dialTimeout will be used as connection deadLine
 	conn := tls.Client(rawConn, config)
-	err = conn.SetDeadline(time.Now().Add(dialTimeout))
+	deadline := time.Now().Add(dialTimeout)
+	if handshakeTimeout > 0 {
+		deadline = time.Now().Add(handshakeTimeout)
+	}
+	err = conn.SetDeadline(deadline)
 	if err != nil {
 		log.Printf("DeadLine is not supported cause: %s", err)
 		conn.Close()
@@ -112,5 +159,13 @@ func tlsDial(dialContext dialHandler, network string, config *tls.Config) (*tls.
 		conn.Close()
 		return nil, err
 	}
+
+	// The callers set the deadlines of the exchanges themselves.
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
 	return conn, nil
 }
@@ -1,8 +1,21 @@
 package upstream
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestTLSPoolReconnect(t *testing.T) {
@@ -97,3 +110,226 @@ func TestTLSPoolDeadLine(t *testing.T) {
 		t.Fatalf("this connection should be already closed, got response %s", response)
 	}
 }
+
+// newTestTLSConfig returns the server TLS configuration with a self-signed
+// certificate for 127.0.0.1.
+func newTestTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate the key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"AdGuard Tests"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cannot create the certificate: %s", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+// startKeepaliveDoTServer starts a DoT server answering with 8.8.8.8 and
+// announcing the keepalive timeout in units of 100 milliseconds.  conns is
+// increased on each accepted connection.
+func startKeepaliveDoTServer(t *testing.T, keepalive uint16, conns *int32) net.Addr {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", newTestTLSConfig(t))
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, aErr := l.Accept()
+			if aErr != nil {
+				return
+			}
+			atomic.AddInt32(conns, 1)
+
+			go serveKeepaliveConn(conn, keepalive)
+		}
+	}()
+
+	return l.Addr()
+}
+
+// serveKeepaliveConn answers the queries over conn until it's closed.
+func serveKeepaliveConn(conn net.Conn, keepalive uint16) {
+	c := &dns.Conn{Conn: conn}
+	defer c.Close()
+
+	for {
+		req, err := c.ReadMsg()
+		if err != nil {
+			return
+		}
+
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+			A:   net.IPv4(8, 8, 8, 8),
+		})
+
+		if opt := req.IsEdns0(); opt != nil {
+			respOpt := resp.SetEdns0(opt.UDPSize(), false).IsEdns0()
+			for _, o := range opt.Option {
+				if o.Option() == dns.EDNS0TCPKEEPALIVE {
+					data := make([]byte, 2)
+					binary.BigEndian.PutUint16(data, keepalive)
+					respOpt.Option = append(respOpt.Option, &dns.EDNS0_LOCAL{
+						Code: dns.EDNS0TCPKEEPALIVE,
+						Data: data,
+					})
+				}
+			}
+		}
+
+		if err = c.WriteMsg(resp); err != nil {
+			return
+		}
+	}
+}
+
+func TestTLSPoolKeepalive(t *testing.T) {
+	conns := int32(0)
+	addr := startKeepaliveDoTServer(t, 2, &conns)
+
+	u, err := AddressToUpstream("tls://"+addr.String(), Options{InsecureSkipVerify: true, Timeout: timeout})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+
+	// The keepalive option must not leak to the caller
+	reply, err := u.Exchange(createTestMessage())
+	if err != nil {
+		t.Fatalf("first DNS message failed: %s", err)
+	}
+	assertResponse(t, reply)
+	assert.Nil(t, reply.IsEdns0())
+
+	p := u.(*dnsOverTLS)
+	if assert.Len(t, p.pool.conns, 1) {
+		assert.Equal(t, 200*time.Millisecond, p.pool.conns[0].(*pooledConn).idleTimeout)
+	}
+
+	// The connection is reused while it isn't idle for too long
+	reply, err = u.Exchange(createTestMessage())
+	if err != nil {
+		t.Fatalf("second DNS message failed: %s", err)
+	}
+	assertResponse(t, reply)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns))
+
+	// The idle connection is evicted after the server's timeout
+	time.Sleep(300 * time.Millisecond)
+	reply, err = u.Exchange(createTestMessage())
+	if err != nil {
+		t.Fatalf("third DNS message failed: %s", err)
+	}
+	assertResponse(t, reply)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&conns))
+}
+
+// startDelayedDoTServer starts a DoT server which starts the TLS handshake
+// after handshakeDelay since the connection has been accepted and answers the
+// queries after responseDelay.
+func startDelayedDoTServer(t *testing.T, handshakeDelay, responseDelay time.Duration) net.Addr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	conf := newTestTLSConfig(t)
+	go func() {
+		for {
+			conn, aErr := l.Accept()
+			if aErr != nil {
+				return
+			}
+
+			go func() {
+				time.Sleep(handshakeDelay)
+
+				c := &dns.Conn{Conn: tls.Server(conn, conf)}
+				defer c.Close()
+
+				for {
+					req, rErr := c.ReadMsg()
+					if rErr != nil {
+						return
+					}
+
+					time.Sleep(responseDelay)
+					resp := &dns.Msg{}
+					resp.SetReply(req)
+					resp.Answer = append(resp.Answer, &dns.A{
+						Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+						A:   net.IPv4(8, 8, 8, 8),
+					})
+					_ = c.WriteMsg(resp)
+				}
+			}()
+		}
+	}()
+
+	return l.Addr()
+}
+
+func TestDialTimeout(t *testing.T) {
+	opts := Options{
+		InsecureSkipVerify: true,
+		Timeout:            timeout,
+		DialTimeout:        200 * time.Millisecond,
+	}
+
+	// The upstream that takes too long to establish the connection fails
+	// quickly.
+	addr := startDelayedDoTServer(t, time.Second, 0)
+	u, err := AddressToUpstream("tls://"+addr.String(), opts)
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+
+	start := time.Now()
+	_, err = u.Exchange(createTestMessage())
+	assert.NotNil(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	// The connected upstream has the whole timeout to respond.
+	addr = startDelayedDoTServer(t, 0, 500*time.Millisecond)
+	u, err = AddressToUpstream("tls://"+addr.String(), opts)
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+
+	reply, err := u.Exchange(createTestMessage())
+	if assert.Nil(t, err) {
+		assertResponse(t, reply)
+	}
+
+	// So does the multiplexed one, which has no deadline left from dialing.
+	opts.Multiplex = true
+	u, err = AddressToUpstream("tls://"+addr.String(), opts)
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		reply, err = u.Exchange(createTestMessage())
+		if assert.Nil(t, err) {
+			assertResponse(t, reply)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package upstream
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -423,3 +426,46 @@ func assertResponse(t *testing.T, reply *dns.Msg) {
 		t.Fatalf("DNS upstream returned wrong answer type instead of A: %v", reply.Answer[0])
 	}
 }
+
+func TestDoHUserAgent(t *testing.T) {
+	uaCh := make(chan string, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uaCh <- r.UserAgent()
+
+		buf, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		req := &dns.Msg{}
+		err = req.Unpack(buf)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		resp, _ := (&dns.Msg{}).SetReply(req).Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(resp)
+	}))
+	defer srv.Close()
+
+	u, err := AddressToUpstream(srv.URL+"/dns-query", Options{
+		InsecureSkipVerify: true,
+		DoHUserAgent:       "test-agent/1.0",
+		Timeout:            timeout,
+	})
+	if err != nil {
+		t.Fatalf("cannot create the upstream: %s", err)
+	}
+
+	req := &dns.Msg{}
+	req.Id = dns.Id()
+	req.SetQuestion("example.org.", dns.TypeA)
+	_, err = u.Exchange(req)
+	assert.Nil(t, err)
+	assert.Equal(t, "test-agent/1.0", <-uaCh)
+}